@@ -53,6 +53,10 @@ func stopCmd(ctx context.Context, args []string) {
 	log, service, sock, path, _ := parseCmd(ctx, "stop", args)
 
 	log.Infof("Stopping service: %q", service)
+	// so that the supervisor does not restart it
+	if err := markStopped(service, true); err != nil {
+		log.WithError(err).Warn("marking service stopped")
+	}
 	id, pid, msg, err := stop(ctx, service, sock, path)
 	if err != nil {
 		log.WithError(err).Fatal(msg)
@@ -65,6 +69,9 @@ func startCmd(ctx context.Context, args []string) {
 	log, service, sock, path, dumpSpec := parseCmd(ctx, "start", args)
 
 	log.Infof("Starting service: %q", service)
+	if err := markStopped(service, false); err != nil {
+		log.WithError(err).Warn("marking service started")
+	}
 	id, pid, msg, err := start(ctx, service, sock, path, dumpSpec)
 	if err != nil {
 		log.WithError(err).Fatal(msg)
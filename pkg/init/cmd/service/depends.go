@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/pkg/cio"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// serviceReadyTimeout is how long a service has to become ready, unless its readiness sets a timeout
+	serviceReadyTimeout = 5 * time.Minute
+	// readinessInterval is how often the readiness of a service is checked until it is ready
+	readinessInterval = 500 * time.Millisecond
+	// readinessExecTimeout is how long a single readiness command may run for
+	readinessExecTimeout = 10 * time.Second
+)
+
+// containerExecs numbers the commands run in containers, as exec IDs must be unique in a task
+var containerExecs atomic.Uint64
+
+// serviceState records whether a service is ready, for the services that depend on it
+type serviceState struct {
+	done  chan struct{}
+	ready bool
+}
+
+func newServiceState() *serviceState {
+	return &serviceState{done: make(chan struct{})}
+}
+
+// finish records that the service is ready, or failed to start or become ready, and wakes up
+// the services waiting for it
+func (s *serviceState) finish(ready bool) {
+	s.ready = ready
+	close(s.done)
+}
+
+// serviceOrder returns services in an order in which each comes after the services it depends on, and
+// otherwise in the order given. Services that cannot be ordered, as they depend on each other in a cycle
+// or on services that do, are returned separately. linuxkit build rejects such configurations, but a
+// dependency can also come from the label of an image.
+func serviceOrder(services []string, runtimes map[string]Runtime) ([]string, []string) {
+	known := map[string]bool{}
+	for _, service := range services {
+		known[service] = true
+	}
+	var order []string
+	placed := map[string]bool{}
+	remaining := services
+	for len(remaining) != 0 {
+		var next []string
+		for _, service := range remaining {
+			ordered := true
+			for _, dep := range runtimes[service].DependsOn {
+				// an unknown dependency is reported when the service waits for it
+				if known[dep] && !placed[dep] {
+					ordered = false
+					break
+				}
+			}
+			if ordered {
+				order = append(order, service)
+				placed[service] = true
+			} else {
+				next = append(next, service)
+			}
+		}
+		if len(next) == len(remaining) {
+			return order, next
+		}
+		remaining = next
+	}
+	return order, nil
+}
+
+// waitForServices waits for the services that the service name depends on to be ready
+func waitForServices(name string, deps []string, states map[string]*serviceState) error {
+	for _, dep := range deps {
+		state, ok := states[dep]
+		if !ok {
+			return fmt.Errorf("depends on %s, which is not a service", dep)
+		}
+		select {
+		case <-state.done:
+		default:
+			log.Infof("%s waiting for service %s", name, dep)
+			<-state.done
+		}
+		if !state.ready {
+			return fmt.Errorf("service %s that it depends on is not ready", dep)
+		}
+	}
+	return nil
+}
+
+// startServices starts the services in path, each once the services it depends on are ready, and those
+// that consume shared volumes once their producers have marked them ready, and returns when all have
+// started and are ready, or have failed to
+func startServices(ctx context.Context, cli *client.Client, sock, path string) {
+	files, err := os.ReadDir(path)
+	// just skip if there is an error, eg no such path
+	if err != nil {
+		return
+	}
+	var services []string
+	runtimes := map[string]Runtime{}
+	for _, file := range files {
+		service := file.Name()
+		runtime, err := readRuntimeConfig(filepath.Join(path, service))
+		if err != nil {
+			log.WithError(err).Errorf("failed to start service %s", service)
+			continue
+		}
+		services = append(services, service)
+		runtimes[service] = runtime
+	}
+	states := map[string]*serviceState{}
+	for _, service := range services {
+		states[service] = newServiceState()
+	}
+	order, blocked := serviceOrder(services, runtimes)
+	if len(blocked) != 0 {
+		log.Errorf("not starting services %s, which depend on each other in a cycle, or on services that do", strings.Join(blocked, ", "))
+		for _, service := range blocked {
+			states[service].finish(false)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, service := range order {
+		runtime := runtimes[service]
+		state := states[service]
+		consumed := consumedVolumes(service)
+		if len(runtime.DependsOn) == 0 && len(consumed) == 0 {
+			started := startService(ctx, service, sock, path)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				state.finish(started && serviceReady(ctx, cli, service, runtime))
+			}()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := waitForServices(service, runtime.DependsOn, states); err != nil {
+				log.WithError(err).Errorf("failed to start service %s", service)
+				state.finish(false)
+				return
+			}
+			if err := waitForVolumes(service, consumed); err != nil {
+				log.WithError(err).Errorf("failed to start service %s", service)
+				state.finish(false)
+				return
+			}
+			started := startService(ctx, service, sock, path)
+			state.finish(started && serviceReady(ctx, cli, service, runtime))
+		}()
+	}
+	wg.Wait()
+}
+
+// startService starts a service, and returns whether it started
+func startService(ctx context.Context, service, sock, path string) bool {
+	id, pid, msg, err := start(ctx, service, sock, path, "")
+	if err != nil {
+		log.WithError(err).Error(msg)
+		return false
+	}
+	log.Debugf("Started %s pid %d", id, pid)
+	return true
+}
+
+// serviceReady waits for a started service to be ready, and returns whether it is
+func serviceReady(ctx context.Context, cli *client.Client, service string, runtime Runtime) bool {
+	if err := waitForReadiness(ctx, cli, service, runtime); err != nil {
+		log.WithError(err).Errorf("service %s is not ready", service)
+		return false
+	}
+	return true
+}
+
+// waitForReadiness waits for a started service to be ready, as set by its runtime config. A service
+// without a readiness check is ready as soon as it has started.
+func waitForReadiness(ctx context.Context, cli *client.Client, service string, runtime Runtime) error {
+	r := runtime.Readiness
+	if r == nil {
+		return nil
+	}
+	timeout := serviceReadyTimeout
+	if r.Timeout != "" {
+		d, err := time.ParseDuration(r.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid readiness timeout %s: %v", r.Timeout, err)
+		}
+		timeout = d
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := checkReadiness(ctx, cli, service, runtime)
+		if err == nil {
+			log.Infof("%s is ready", service)
+			return nil
+		}
+		if status, stopped := taskStopped(ctx, cli, service, runtime.Namespace); stopped {
+			return fmt.Errorf("exited with status %d before it was ready", status.ExitStatus)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not ready after %s: %v", timeout, err)
+		}
+		time.Sleep(readinessInterval)
+	}
+}
+
+// checkReadiness checks once whether a service is ready
+func checkReadiness(ctx context.Context, cli *client.Client, service string, runtime Runtime) error {
+	r := runtime.Readiness
+	switch {
+	case r.Socket != "":
+		conn, err := net.DialTimeout("unix", r.Socket, time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case r.File != "":
+		_, err := os.Stat(r.File)
+		return err
+	case len(r.Exec) != 0:
+		return execInContainer(ctx, cli, service, runtime.Namespace, "readiness", runtime.Readiness.Exec, readinessExecTimeout)
+	}
+	return nil
+}
+
+// execInContainer runs a command in the container of a service, as its process would be, for up to timeout,
+// and returns an error unless it succeeds. The exec ID of the command starts with kind.
+func execInContainer(ctx context.Context, cli *client.Client, service, namespace, kind string, args []string, timeout time.Duration) error {
+	if namespace != "" {
+		ctx = namespaces.WithNamespace(ctx, namespace)
+	}
+	ctr, err := cli.LoadContainer(ctx, service)
+	if err != nil {
+		return err
+	}
+	spec, err := ctr.Spec(ctx)
+	if err != nil {
+		return err
+	}
+	task, err := ctr.Task(ctx, nil)
+	if err != nil {
+		return err
+	}
+	process := *spec.Process
+	process.Args = args
+	process.Terminal = false
+	id := fmt.Sprintf("%s-%d", kind, containerExecs.Add(1))
+	p, err := task.Exec(ctx, id, &process, cio.NullIO)
+	if err != nil {
+		return err
+	}
+	defer func() { _, _ = p.Delete(ctx, client.WithProcessKill) }()
+
+	execCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	statusC, err := p.Wait(execCtx)
+	if err != nil {
+		return err
+	}
+	if err := p.Start(execCtx); err != nil {
+		return err
+	}
+	select {
+	case status := <-statusC:
+		code, _, err := status.Result()
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return fmt.Errorf("%s exited with status %d", strings.Join(args, " "), code)
+		}
+		return nil
+	case <-execCtx.Done():
+		return fmt.Errorf("%s did not finish within %s", strings.Join(args, " "), timeout)
+	}
+}
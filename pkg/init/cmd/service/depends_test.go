@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServiceOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []string
+		deps     map[string][]string
+		order    []string
+		blocked  []string
+	}{
+		{
+			name:     "no dependencies",
+			services: []string{"b", "a", "c"},
+			order:    []string{"b", "a", "c"},
+		},
+		{
+			name:     "dependencies",
+			services: []string{"agent", "dhcpcd", "sshd"},
+			deps:     map[string][]string{"agent": {"sshd", "dhcpcd"}, "sshd": {"dhcpcd"}},
+			order:    []string{"dhcpcd", "sshd", "agent"},
+		},
+		{
+			name:     "unknown dependency",
+			services: []string{"a", "b"},
+			deps:     map[string][]string{"a": {"missing"}},
+			order:    []string{"a", "b"},
+		},
+		{
+			name:     "cycle",
+			services: []string{"a", "b", "c", "d"},
+			deps:     map[string][]string{"a": {"b"}, "b": {"a"}, "c": {"a"}},
+			order:    []string{"d"},
+			blocked:  []string{"a", "b", "c"},
+		},
+		{
+			name:     "self",
+			services: []string{"a", "b"},
+			deps:     map[string][]string{"a": {"a"}},
+			order:    []string{"b"},
+			blocked:  []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		runtimes := map[string]Runtime{}
+		for service, deps := range tt.deps {
+			runtimes[service] = Runtime{DependsOn: deps}
+		}
+		order, blocked := serviceOrder(tt.services, runtimes)
+		if !reflect.DeepEqual(order, tt.order) || !reflect.DeepEqual(blocked, tt.blocked) {
+			t.Errorf("%s: expected order %v and blocked %v, got %v and %v", tt.name, tt.order, tt.blocked, order, blocked)
+		}
+	}
+}
+
+func TestWaitForServices(t *testing.T) {
+	states := map[string]*serviceState{
+		"ready":    newServiceState(),
+		"notready": newServiceState(),
+		"later":    newServiceState(),
+	}
+	states["ready"].finish(true)
+	states["notready"].finish(false)
+
+	if err := waitForServices("a", []string{"ready"}, states); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := waitForServices("a", []string{"ready", "notready"}, states); err == nil {
+		t.Error("expected error for a dependency that is not ready")
+	}
+	if err := waitForServices("a", []string{"missing"}, states); err == nil {
+		t.Error("expected error for a dependency that is not a service")
+	}
+
+	// a service waits until its dependencies are ready
+	done := make(chan error)
+	go func() {
+		done <- waitForServices("a", []string{"ready", "later"}, states)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("returned before the dependency was ready: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	states["later"].finish(true)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("did not return once the dependency was ready")
+	}
+}
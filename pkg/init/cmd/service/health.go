@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// healthStateFile is where the supervisor records the health of a service
+	healthStateFile = "health.json"
+	// defaultHealthInterval, defaultHealthTimeout and defaultHealthRetries are used unless a health check sets them
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 10 * time.Second
+	defaultHealthRetries  = 3
+	// healthLogLength is the number of results of a health check that are kept
+	healthLogLength = 5
+)
+
+// Health status of a service
+const (
+	healthStarting  = "starting"
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+)
+
+// healthState is the health of a service that the supervisor records, in healthStateFile
+type healthState struct {
+	Status        string         `json:"status"`
+	FailingStreak int            `json:"failingStreak"`
+	Log           []healthResult `json:"log"`
+}
+
+// healthResult is the result of a single health check
+type healthResult struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Error string    `json:"error,omitempty"`
+}
+
+// checkHealth runs the health check of service every interval while it is running, records its health,
+// and kills it if it becomes unhealthy and the health check says to restart it
+func (s *supervisor) checkHealth(ctx context.Context, service string, runtimeConfig Runtime) {
+	hc := runtimeConfig.Healthcheck
+	interval := parseDurationDefault(hc.Interval, defaultHealthInterval)
+	timeout := parseDurationDefault(hc.Timeout, defaultHealthTimeout)
+	if runtimeConfig.Namespace != "" {
+		ctx = namespaces.WithNamespace(ctx, runtimeConfig.Namespace)
+	}
+
+	var (
+		state   healthState
+		pid     uint32
+		started time.Time
+	)
+	for {
+		time.Sleep(interval)
+		task, ok := s.runningTask(ctx, service)
+		if !ok {
+			continue
+		}
+		if task.Pid() != pid {
+			// started, or restarted, since the last check
+			pid = task.Pid()
+			started = time.Now()
+			state = healthState{Status: healthStarting}
+		}
+		result := healthResult{Start: time.Now()}
+		err := runHealthcheck(ctx, s.cli, service, runtimeConfig, pid, timeout)
+		result.End = time.Now()
+		if err != nil {
+			result.Error = err.Error()
+		}
+		changed, kill := recordHealth(&state, *hc, started, result)
+		switch {
+		case changed && state.Status == healthHealthy:
+			log.Infof("Service %s is healthy", service)
+		case changed && state.Status == healthUnhealthy:
+			log.WithError(err).Errorf("Service %s is unhealthy", service)
+		}
+		if kill {
+			s.killUnhealthy(ctx, service, task)
+		}
+		if err := writeStateFile(service, healthStateFile, state); err != nil {
+			log.WithError(err).Errorf("recording health of service %s", service)
+		}
+	}
+}
+
+// recordHealth records the result of a health check in st, for a service that was started at started.
+// Failures during the start period of a service that has not yet been healthy do not count, and it
+// becomes unhealthy after retries consecutive failures. It returns whether the status changed, and
+// whether to kill the service to restart it, as it has just become unhealthy.
+func recordHealth(st *healthState, hc Healthcheck, started time.Time, result healthResult) (changed, kill bool) {
+	startPeriod := parseDurationDefault(hc.StartPeriod, 0)
+	retries := hc.Retries
+	if retries == 0 {
+		retries = defaultHealthRetries
+	}
+
+	st.Log = append(st.Log, result)
+	if len(st.Log) > healthLogLength {
+		st.Log = st.Log[len(st.Log)-healthLogLength:]
+	}
+	switch {
+	case result.Error == "":
+		changed = st.Status != healthHealthy
+		st.Status = healthHealthy
+		st.FailingStreak = 0
+	case st.Status == healthStarting && result.Start.Sub(started) < startPeriod:
+		// failures while the service starts do not count
+	default:
+		st.FailingStreak++
+		if st.FailingStreak >= retries && st.Status != healthUnhealthy {
+			st.Status = healthUnhealthy
+			changed = true
+			kill = hc.Restart
+		}
+	}
+	return changed, kill
+}
+
+// killUnhealthy kills an unhealthy service, to be restarted when it has exited
+func (s *supervisor) killUnhealthy(ctx context.Context, service string, task client.Task) {
+	if isStopped(service) {
+		return
+	}
+	s.mu.Lock()
+	s.unhealthy[service] = true
+	s.mu.Unlock()
+	log.Infof("Killing unhealthy service %s to restart it", service)
+	if err := task.Kill(ctx, syscall.SIGKILL); err != nil {
+		log.WithError(err).Errorf("killing unhealthy service %s", service)
+	}
+}
+
+// runningTask returns the task of service if it is running
+func (s *supervisor) runningTask(ctx context.Context, service string) (client.Task, bool) {
+	ctr, err := s.cli.LoadContainer(ctx, service)
+	if err != nil {
+		return nil, false
+	}
+	task, err := ctr.Task(ctx, nil)
+	if err != nil {
+		return nil, false
+	}
+	status, err := task.Status(ctx)
+	if err != nil || status.Status != client.Running {
+		return nil, false
+	}
+	return task, true
+}
+
+// runHealthcheck runs the health check of a service once. TCP and HTTP checks connect to localhost in the
+// network namespace of the service, whose process is pid.
+func runHealthcheck(ctx context.Context, cli *client.Client, service string, runtimeConfig Runtime, pid uint32, timeout time.Duration) error {
+	hc := runtimeConfig.Healthcheck
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var conn net.Conn
+		err := inNetNS(pid, func() error {
+			var err error
+			conn, err = (&net.Dialer{Timeout: timeout}).DialContext(ctx, network, addr)
+			return err
+		})
+		return conn, err
+	}
+	switch {
+	case len(hc.Exec) != 0:
+		return execInContainer(ctx, cli, service, runtimeConfig.Namespace, "health", hc.Exec, timeout)
+	case hc.TCP != 0:
+		conn, err := dial(ctx, "tcp", net.JoinHostPort("localhost", strconv.Itoa(hc.TCP)))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case hc.HTTP != "":
+		c := &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{DialContext: dial, DisableKeepAlives: true},
+		}
+		resp, err := c.Get(hc.HTTP)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			return fmt.Errorf("GET %s returned %s", hc.HTTP, resp.Status)
+		}
+	}
+	return nil
+}
+
+// inNetNS runs f in the network namespace of the process pid
+func inNetNS(pid uint32, f func() error) error {
+	runtime.LockOSThread()
+	orig, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer func() { _ = orig.Close() }()
+	ns, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer func() { _ = ns.Close() }()
+	if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("entering network namespace: %v", err)
+	}
+	err = f()
+	if err := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); err != nil {
+		// leave the thread locked, so that it exits with the goroutine rather than being reused
+		log.WithError(err).Error("leaving network namespace")
+		return err
+	}
+	runtime.UnlockOSThread()
+	return err
+}
+
+// parseDurationDefault parses s, which has been validated by linuxkit build, or returns def if it is empty
+func parseDurationDefault(s string, def time.Duration) time.Duration {
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return def
+	}
+	return d
+}
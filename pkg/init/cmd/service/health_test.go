@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordHealth(t *testing.T) {
+	started := time.Now()
+	check := func(after time.Duration, failed bool) healthResult {
+		r := healthResult{Start: started.Add(after), End: started.Add(after + time.Second)}
+		if failed {
+			r.Error = "connection refused"
+		}
+		return r
+	}
+	hc := Healthcheck{StartPeriod: "1m", Retries: 2, Restart: true}
+
+	// failures during the start period do not count
+	st := healthState{Status: healthStarting}
+	if changed, kill := recordHealth(&st, hc, started, check(30*time.Second, true)); changed || kill {
+		t.Errorf("expected no change during the start period, got %v, %v", changed, kill)
+	}
+	if st.Status != healthStarting || st.FailingStreak != 0 {
+		t.Errorf("expected to still be starting, got %+v", st)
+	}
+
+	// after it, the service becomes unhealthy after retries failures, and is killed once
+	for i, expected := range []struct{ changed, kill bool }{{false, false}, {true, true}, {false, false}} {
+		changed, kill := recordHealth(&st, hc, started, check(time.Minute+time.Duration(i)*time.Second, true))
+		if changed != expected.changed || kill != expected.kill {
+			t.Errorf("failure %d: expected %v, %v, got %v, %v", i+1, expected.changed, expected.kill, changed, kill)
+		}
+	}
+	if st.Status != healthUnhealthy || st.FailingStreak != 3 {
+		t.Errorf("expected to be unhealthy after 3 failures, got %+v", st)
+	}
+
+	// a success makes it healthy again
+	if changed, kill := recordHealth(&st, hc, started, check(2*time.Minute, false)); !changed || kill {
+		t.Errorf("expected to become healthy, got %v, %v", changed, kill)
+	}
+	if st.Status != healthHealthy || st.FailingStreak != 0 {
+		t.Errorf("expected to be healthy, got %+v", st)
+	}
+	// only the latest results are kept
+	if len(st.Log) != healthLogLength || !st.Log[healthLogLength-1].Start.Equal(started.Add(2*time.Minute)) || st.Log[0].Error == "" {
+		t.Errorf("expected the last %d results, got %+v", healthLogLength, st.Log)
+	}
+
+	// once healthy, the start period no longer applies
+	if changed, _ := recordHealth(&st, hc, started, check(10*time.Second, true)); changed || st.FailingStreak != 1 {
+		t.Errorf("expected a failure to count once healthy, got %v, %+v", changed, st)
+	}
+}
+
+func TestRecordHealthDefaults(t *testing.T) {
+	started := time.Now()
+	failed := healthResult{Start: started, End: started, Error: "exit status 1"}
+
+	// without restart, an unhealthy service is not killed, after the default number of retries
+	st := healthState{Status: healthStarting}
+	for i := 1; i <= defaultHealthRetries; i++ {
+		changed, kill := recordHealth(&st, Healthcheck{}, started, failed)
+		if kill || changed != (i == defaultHealthRetries) {
+			t.Errorf("failure %d: unexpected %v, %v", i, changed, kill)
+		}
+	}
+	if st.Status != healthUnhealthy {
+		t.Errorf("expected to be unhealthy after %d failures, got %+v", defaultHealthRetries, st)
+	}
+}
@@ -1,15 +1,15 @@
 package main
 
 import (
-	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
-	"strings"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -22,14 +22,20 @@ var (
 
 const (
 	logDumpCommand byte = iota
+	logFollowCommand
+	logDumpFollowCommand
 )
 
+// logFollowInterval is how often log files are checked for more output when following them
+const logFollowInterval = 500 * time.Millisecond
+
 // Log provides access to a log by path or io.WriteCloser
 type Log interface {
-	Path(string) string                  // Path of the log file (may be a FIFO)
-	Open(string) (io.WriteCloser, error) // Opens a log stream
-	Dump(string)                         // Copies logs to the console
-	Symlink(string)                      // Symlinks to the log directory (if there is one)
+	Path(string) string                    // Path of the log file (may be a FIFO)
+	Open(string) (io.WriteCloser, error)   // Opens a log stream
+	Dump(string)                           // Copies logs to the console
+	Read(io.Writer, bool, ...string) error // Copies the logs of names to a writer, and optionally follows them
+	Symlink(string)                        // Symlinks to the log directory (if there is one)
 }
 
 // GetLog returns the log destination we should use.
@@ -83,6 +89,51 @@ func (f *fileLog) Dump(n string) {
 	}
 }
 
+// Read copies the log files of names to w, one after the other, and if follow is set
+// keeps copying what is written to them.
+func (f *fileLog) Read(w io.Writer, follow bool, names ...string) error {
+	offsets := make([]int64, len(names))
+	for {
+		for i, n := range names {
+			off, err := copyFrom(w, f.localPath(n), offsets[i])
+			if err != nil {
+				return err
+			}
+			offsets[i] = off
+		}
+		if !follow {
+			return nil
+		}
+		time.Sleep(logFollowInterval)
+	}
+}
+
+// copyFrom copies the file path from offset to w, and returns the offset it copied up to. A file that
+// does not exist yet is empty, and one that is shorter than offset has been truncated, so is copied
+// from the start.
+func copyFrom(w io.Writer, path string, offset int64) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return offset, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return offset, err
+	}
+	if fi.Size() < offset {
+		offset = 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	n, err := io.Copy(w, file)
+	return offset + n, err
+}
+
 // Symlink links to the log directory. This is useful if we are logging directly to tmpfs and now need to symlink from a permanent disk.
 func (f *fileLog) Symlink(path string) {
 	parent := filepath.Dir(path)
@@ -143,41 +194,58 @@ func (r *remoteLog) Open(n string) (io.WriteCloser, error) {
 
 // Dump copies logs to the console.
 func (r *remoteLog) Dump(n string) {
+	if err := r.Read(os.Stdout, false, n); err != nil {
+		log.Printf("Failed to read logs from logger: %s", err)
+	}
+}
+
+// logEntry is a log message read from the logging daemon
+type logEntry struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Msg    string    `json:"msg"`
+}
+
+// Read copies the messages from the logging daemon whose source is one of names to w, and
+// if follow is set keeps copying new messages.
+func (r *remoteLog) Read(w io.Writer, follow bool, names ...string) error {
 	addr := net.UnixAddr{
 		Name: logReadSocket,
 		Net:  "unix",
 	}
 	conn, err := net.DialUnix("unix", nil, &addr)
 	if err != nil {
-		log.Printf("Failed to connect to logger: %s", err)
-		return
+		return fmt.Errorf("failed to connect to logger: %v", err)
 	}
 	defer conn.Close()
-	nWritten, err := conn.Write([]byte{logDumpCommand})
+	command := logDumpCommand
+	if follow {
+		command = logDumpFollowCommand
+	}
+	nWritten, err := conn.Write([]byte{command})
 	if err != nil || nWritten < 1 {
-		log.Printf("Failed to request logs from logger: %s", err)
-		return
+		return fmt.Errorf("failed to request logs from logger: %v", err)
+	}
+	return copyLogEntries(w, conn, names...)
+}
+
+// copyLogEntries copies the messages read from the logging daemon on r whose source is one of names to w
+func copyLogEntries(w io.Writer, r io.Reader, names ...string) error {
+	sources := map[string]bool{}
+	for _, n := range names {
+		sources[n] = true
 	}
-	reader := bufio.NewReader(conn)
+	decoder := json.NewDecoder(r)
 	for {
-		line, err := reader.ReadString('\n')
-		if err == io.EOF {
-			return
-		}
-		if err != nil {
-			log.Printf("Failed to read log message: %s", err)
-			return
-		}
-		// a line is of the form
-		// <timestamp>,<log>;<body>
-		prefixBody := strings.SplitN(line, ";", 2)
-		csv := strings.Split(prefixBody[0], ",")
-		if len(csv) < 2 {
-			log.Printf("Failed to parse log message: %s", line)
-			continue
+		var entry logEntry
+		if err := decoder.Decode(&entry); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read log message: %v", err)
 		}
-		if csv[1] == n {
-			fmt.Print(line)
+		if sources[entry.Source] {
+			fmt.Fprintf(w, "%s;%s;%s\n", entry.Time.Format(time.RFC3339Nano), entry.Source, entry.Msg)
 		}
 	}
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCopyFrom(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "service.log")
+	var buf bytes.Buffer
+
+	// a log that does not exist yet is empty
+	off, err := copyFrom(&buf, path, 0)
+	if err != nil || off != 0 || buf.Len() != 0 {
+		t.Fatalf("expected nothing for a missing file, got %d %q %v", off, buf.String(), err)
+	}
+
+	if err := os.WriteFile(path, []byte("one\ntwo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	off, err = copyFrom(&buf, path, off)
+	if err != nil || off != 8 || buf.String() != "one\ntwo\n" {
+		t.Fatalf("unexpected copy %d %q %v", off, buf.String(), err)
+	}
+
+	// only what was written since is copied
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("three\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	buf.Reset()
+	off, err = copyFrom(&buf, path, off)
+	if err != nil || off != 14 || buf.String() != "three\n" {
+		t.Fatalf("unexpected copy after append %d %q %v", off, buf.String(), err)
+	}
+
+	// a truncated log is copied from the start
+	if err := os.WriteFile(path, []byte("four\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	off, err = copyFrom(&buf, path, off)
+	if err != nil || off != 5 || buf.String() != "four\n" {
+		t.Fatalf("unexpected copy after truncation %d %q %v", off, buf.String(), err)
+	}
+}
+
+func TestFileLogRead(t *testing.T) {
+	l := &fileLog{dir: t.TempDir()}
+	if err := os.WriteFile(l.localPath("service.out"), []byte("out\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(l.localPath("service"), []byte("err\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := l.Read(&buf, false, "service.out", "missing", "service"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "out\nerr\n" {
+		t.Errorf("unexpected logs %q", buf.String())
+	}
+}
+
+func TestCopyLogEntries(t *testing.T) {
+	entries := `{"time":"2024-01-02T03:04:05Z","source":"sshd","msg":"listening"}
+{"time":"2024-01-02T03:04:06Z","source":"sshd.out","msg":"hello"}
+{"time":"2024-01-02T03:04:07Z","source":"getty","msg":"login"}
+{"time":"2024-01-02T03:04:08Z","source":"sshd","msg":"accepted"}
+`
+	var buf bytes.Buffer
+	if err := copyLogEntries(&buf, strings.NewReader(entries), "sshd"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "2024-01-02T03:04:05Z;sshd;listening\n2024-01-02T03:04:08Z;sshd;accepted\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+
+	if err := copyLogEntries(&buf, strings.NewReader(`{"time":`), "sshd"); err == nil {
+		t.Error("expected error for a malformed message")
+	}
+}
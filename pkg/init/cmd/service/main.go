@@ -47,6 +47,10 @@ func main() {
 		fmt.Printf("  stop        Stop a service\n")
 		fmt.Printf("  start       Start a service\n")
 		fmt.Printf("  restart     Restart a service\n")
+		fmt.Printf("  list        List the services and their state\n")
+		fmt.Printf("  status      Show the state, resource usage and health of a service\n")
+		fmt.Printf("  logs        Show the log of a service\n")
+		fmt.Printf("  supervise   Restart services that exit, according to their restart policy\n")
 		fmt.Printf("  help        Print this message\n")
 		fmt.Printf("\n")
 		fmt.Printf("Run '%s COMMAND --help' for more information on the command\n", filepath.Base(os.Args[0]))
@@ -111,6 +115,14 @@ func main() {
 		restartCmd(ctx, args[1:])
 	case "system-init":
 		systemInitCmd(ctx, args[1:])
+	case "list":
+		listCmd(ctx, args[1:])
+	case "status":
+		statusCmd(ctx, args[1:])
+	case "logs":
+		logsCmd(ctx, args[1:])
+	case "supervise":
+		superviseCmd(ctx, args[1:])
 	default:
 		fmt.Printf("%q is not valid command.\n\n", args[0])
 		flag.Usage()
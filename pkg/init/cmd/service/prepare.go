@@ -17,12 +17,46 @@ import (
 
 // Runtime is the type of config processed at runtime, not used to build the OCI spec
 type Runtime struct {
-	Cgroups    []string      `yaml:"cgroups" json:"cgroups,omitempty"`
-	Mounts     []specs.Mount `yaml:"mounts" json:"mounts,omitempty"`
-	Mkdir      []string      `yaml:"mkdir" json:"mkdir,omitempty"`
-	Interfaces []Interface   `yaml:"interfaces" json:"interfaces,omitempty"`
-	BindNS     Namespaces    `yaml:"bindNS" json:"bindNS,omitempty"`
-	Namespace  string        `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	Cgroups     []string       `yaml:"cgroups" json:"cgroups,omitempty"`
+	Mounts      []specs.Mount  `yaml:"mounts" json:"mounts,omitempty"`
+	Mkdir       []string       `yaml:"mkdir" json:"mkdir,omitempty"`
+	Interfaces  []Interface    `yaml:"interfaces" json:"interfaces,omitempty"`
+	BindNS      Namespaces     `yaml:"bindNS" json:"bindNS,omitempty"`
+	Namespace   string         `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	DependsOn   []string       `yaml:"dependsOn" json:"dependsOn,omitempty"`
+	Readiness   *Readiness     `yaml:"readiness" json:"readiness,omitempty"`
+	Restart     *RestartPolicy `yaml:"restart" json:"restart,omitempty"`
+	Healthcheck *Healthcheck   `yaml:"healthcheck" json:"healthcheck,omitempty"`
+	Timeout     string         `yaml:"timeout" json:"timeout,omitempty"`
+	OnFailure   string         `yaml:"onFailure" json:"onFailure,omitempty"`
+	Retries     int            `yaml:"retries" json:"retries,omitempty"`
+}
+
+// Readiness is how to find out that a service is ready, for the services that depend on it
+type Readiness struct {
+	Socket  string   `yaml:"socket" json:"socket,omitempty"`
+	File    string   `yaml:"file" json:"file,omitempty"`
+	Exec    []string `yaml:"exec" json:"exec,omitempty"`
+	Timeout string   `yaml:"timeout" json:"timeout,omitempty"`
+}
+
+// RestartPolicy is when to restart a service that has exited
+type RestartPolicy struct {
+	Policy     string `yaml:"policy" json:"policy"`
+	MaxRetries int    `yaml:"maxRetries" json:"maxRetries,omitempty"`
+	Backoff    string `yaml:"backoff" json:"backoff,omitempty"`
+}
+
+// Healthcheck is how to check that a service is healthy
+type Healthcheck struct {
+	Exec        []string `yaml:"exec" json:"exec,omitempty"`
+	TCP         int      `yaml:"tcp" json:"tcp,omitempty"`
+	HTTP        string   `yaml:"http" json:"http,omitempty"`
+	Interval    string   `yaml:"interval" json:"interval,omitempty"`
+	Timeout     string   `yaml:"timeout" json:"timeout,omitempty"`
+	StartPeriod string   `yaml:"startPeriod" json:"startPeriod,omitempty"`
+	Retries     int      `yaml:"retries" json:"retries,omitempty"`
+	Restart     bool     `yaml:"restart" json:"restart,omitempty"`
 }
 
 // Namespaces is the type for configuring paths to bind namespaces
@@ -45,19 +79,28 @@ type Interface struct {
 }
 
 func getRuntimeConfig(path string) Runtime {
+	runtime, err := readRuntimeConfig(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return runtime
+}
+
+// readRuntimeConfig reads the runtime config of the container in path
+func readRuntimeConfig(path string) (Runtime, error) {
 	var runtime Runtime
 	conf, err := os.ReadFile(filepath.Join(path, "runtime.json"))
 	if err != nil {
 		// if it does not exist it is fine to return an empty runtime, to not do anything
 		if os.IsNotExist(err) {
-			return runtime
+			return runtime, nil
 		}
-		log.Fatalf("Cannot read runtime config: %v", err)
+		return runtime, fmt.Errorf("cannot read runtime config: %v", err)
 	}
 	if err := json.Unmarshal(conf, &runtime); err != nil {
-		log.Fatalf("Cannot parse runtime config: %v", err)
+		return runtime, fmt.Errorf("cannot parse runtime config: %v", err)
 	}
-	return runtime
+	return runtime, nil
 }
 
 // parseMountOptions takes fstab style mount options and parses them for
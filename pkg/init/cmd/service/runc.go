@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
@@ -8,17 +10,61 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
 
+// runcBinary is the runc that onboot and onshutdown containers are run with
+var runcBinary = "/usr/bin/runc"
+
 const (
-	runcBinary = "/usr/bin/runc"
 	logDirBase = "/run/log/"
 	varLogDir  = "/var/log"
+	// bootReportPath is where the outcome of the onboot and onshutdown containers is recorded
+	bootReportPath = "/run/boot"
+	// onbootRetryDelay is the delay before running a failed onboot or onshutdown container again
+	onbootRetryDelay = time.Second
+)
+
+// What is done when an onboot or onshutdown container fails, after its retries, other than continuing
+// with the next one
+const (
+	onFailureHalt     = "halt"
+	onFailureReboot   = "reboot"
+	onFailurePoweroff = "poweroff"
+)
+
+// Results of onboot and onshutdown containers in the boot report
+const (
+	stepSucceeded = "succeeded"
+	stepFailed    = "failed"
+	stepTimedOut  = "timed out"
+	stepSkipped   = "skipped"
 )
 
+// bootReport is the outcome of each onboot or onshutdown container, written to bootReportPath as they run
+type bootReport struct {
+	Type  string     `json:"type"`
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"`
+	// Action is what was done when a container failed, when it was not to continue
+	Action string     `json:"action,omitempty"`
+	Steps  []bootStep `json:"steps"`
+}
+
+// bootStep is the outcome of an onboot or onshutdown container
+type bootStep struct {
+	Name       string     `json:"name"`
+	Result     string     `json:"result"`
+	Attempts   int        `json:"attempts,omitempty"`
+	ExitStatus *int       `json:"exitStatus,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Start      *time.Time `json:"start,omitempty"`
+	End        *time.Time `json:"end,omitempty"`
+}
+
 func dumpFile(w io.Writer, filePath string) error {
 	f, err := os.OpenFile(filePath, os.O_RDONLY, 0644)
 	if err != nil {
@@ -74,148 +120,279 @@ func runcInit(rootPath, serviceType string) int {
 	log.Printf("Using %s", msg)
 
 	// did we choose to run in debug mode? If so, runc will be in debug, and all messages will go to stdout/stderr in addition to the log
-	var runcDebugMode, runcConsoleMode bool
+	r := &runcRunner{serviceType: serviceType, tmpdir: tmpdir, logger: logger}
 	dt, err := os.ReadFile("/proc/cmdline")
 	if err != nil {
 		log.Fatalf("error reading /proc/cmdline: %v", err)
 	}
 
-	debugLogger := log.New()
-	debugLogger.Level = log.InfoLevel
+	r.debugLogger = log.New()
+	r.debugLogger.Level = log.InfoLevel
 
 	for _, s := range strings.Fields(string(dt)) {
 		if s == "linuxkit.runc_debug=1" {
-			runcDebugMode = true
-			debugLogger.Level = log.DebugLevel
+			r.debugMode = true
+			r.debugLogger.Level = log.DebugLevel
 		}
 		if s == "linuxkit.runc_console=1" {
-			runcConsoleMode = true
+			r.consoleMode = true
 		}
 	}
 
-	for _, file := range files {
+	report := bootReport{Type: serviceType, Start: time.Now()}
+	reportPath := filepath.Join(bootReportPath, serviceType+".json")
+	writeReport := func() {
+		if err := writeJSONFile(reportPath, report); err != nil {
+			log.Printf("Cannot write %s: %v", reportPath, err)
+		}
+	}
+	writeReport()
+
+	for i, file := range files {
 		name := file.Name()
 		path := filepath.Join(rootPath, name)
 		log.Printf("%s %s: from %s", serviceType, name, path)
 
 		runtimeConfig := getRuntimeConfig(path)
-
-		if err := prepareFilesystem(path, runtimeConfig); err != nil {
-			log.Printf("Error preparing %s: %v", name, err)
+		start := time.Now()
+		step := bootStep{Name: name, Start: &start}
+		err := r.runStep(&step, path, runtimeConfig)
+		end := time.Now()
+		step.End = &end
+		if err != nil {
+			log.Printf("Error running %s: %v", name, err)
+			step.Error = err.Error()
 			status = 1
-			continue
 		}
-		debugLogger.Debugf("%s %s: creating", serviceType, name)
-		pidfile := filepath.Join(tmpdir, name)
-		cmdArgs := []string{"create", "--bundle", path, "--pid-file", pidfile, name}
-		if runcDebugMode {
-			cmdArgs = append([]string{"--debug"}, cmdArgs...)
+		report.Steps = append(report.Steps, step)
+		stop := false
+		switch runtimeConfig.OnFailure {
+		case onFailureHalt, onFailureReboot, onFailurePoweroff:
+			stop = err != nil
 		}
-		cmd := exec.Command(runcBinary, cmdArgs...)
-
-		stdoutLog := serviceType + "." + name + ".out"
-		stdout, err := logger.Open(stdoutLog)
-		if err != nil {
-			log.Printf("Error opening stdout log connection: %v", err)
-			status = 1
+		if !stop {
+			writeReport()
 			continue
 		}
-		defer stdout.Close()
 
-		stderrLog := serviceType + "." + name
-		stderr, err := logger.Open(stderrLog)
-		if err != nil {
-			log.Printf("Error opening stderr log connection: %v", err)
-			status = 1
-			continue
+		// do not run the remaining containers
+		for _, skipped := range files[i+1:] {
+			report.Steps = append(report.Steps, bootStep{Name: skipped.Name(), Result: stepSkipped})
 		}
-		defer stderr.Close()
-
-		cmd.Stdout = stdout
-		cmd.Stderr = stderr
-
-		// if in console mode, send output to stdout/stderr instead of the log
-		// do not try io.MultiWriter(os.Stdout, stdout) as console messages will hang.
-		// it is not clear why, but since this is all for debugging anyways, it doesn't matter
-		// much.
-		if runcConsoleMode {
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
+		report.Action = runtimeConfig.OnFailure
+		now := time.Now()
+		report.End = &now
+		writeReport()
+		if serviceType == "shutdown" {
+			// the system is already going down
+			log.Printf("Not running the remaining %s containers after %s failed", serviceType, name)
+			break
 		}
-
+		log.Printf("Running %s after %s failed", runtimeConfig.OnFailure, name)
+		// ask init to halt, reboot or power off, which runs the onshutdown containers first
+		cmd := exec.Command(filepath.Join("/sbin", runtimeConfig.OnFailure))
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
 		if err := cmd.Run(); err != nil {
-			log.Printf("Error creating %s: %v", name, err)
-			status = 1
-			// skip cleanup on error for debug
-			continue
+			log.Printf("Cannot %s: %v", runtimeConfig.OnFailure, err)
+			break
 		}
-		pf, err := os.ReadFile(pidfile)
-		if err != nil {
-			log.Printf("Cannot read pidfile: %v", err)
-			status = 1
-			continue
-		}
-		pid, err := strconv.Atoi(string(pf))
-		if err != nil {
-			log.Printf("Cannot parse pid from pidfile: %v", err)
-			status = 1
-			continue
+		// do not let the boot continue while init shuts down
+		for {
+			time.Sleep(time.Hour)
 		}
+	}
+	if report.End == nil {
+		now := time.Now()
+		report.End = &now
+		writeReport()
+	}
 
-		debugLogger.Debugf("%s %s: preparing", serviceType, name)
-		if err := prepareProcess(pid, runtimeConfig); err != nil {
-			log.Printf("Cannot prepare process: %v", err)
-			status = 1
-			continue
-		}
+	_ = os.RemoveAll(tmpdir)
 
-		waitFor := make(chan *os.ProcessState)
-		go func() {
-			// never errors in Unix
-			p, _ := os.FindProcess(pid)
-			state, err := p.Wait()
-			if err != nil {
-				log.Printf("Process wait error: %v", err)
-			}
-			waitFor <- state
-		}()
+	// make sure the link exists from /var/log/onboot -> /run/log/onboot
+	logger.Symlink(varLogLink)
 
-		debugLogger.Debugf("%s %s: starting", serviceType, name)
-		cmdArgs = []string{"start", name}
-		if runcDebugMode {
-			cmdArgs = append([]string{"--debug"}, cmdArgs...)
+	return status
+}
+
+// runcRunner runs onboot or onshutdown containers with runc
+type runcRunner struct {
+	serviceType string
+	tmpdir      string
+	logger      Log
+	// in debug mode runc logs debug messages, and in console mode the output of containers goes to the console
+	debugMode   bool
+	consoleMode bool
+	debugLogger *log.Logger
+}
+
+// runStep runs the container name from its bundle at path until it succeeds, or it has failed after its retries,
+// and records the outcome in step
+func (r *runcRunner) runStep(step *bootStep, path string, runtimeConfig Runtime) error {
+	name := step.Name
+	step.Result = stepFailed
+	// onboot containers are named with their position, eg 000-dhcpcd
+	_, container, _ := strings.Cut(name, "-")
+	if r.serviceType == "onboot" {
+		if err := waitForVolumes(container, consumedVolumes(container)); err != nil {
+			return err
 		}
-		cmd = exec.Command(runcBinary, cmdArgs...)
-		cmd.Stdout = stdout
-		cmd.Stderr = stderr
+	}
 
-		if err := cmd.Run(); err != nil {
-			log.Printf("Error starting %s: %v", name, err)
-			status = 1
-			continue
+	if err := prepareFilesystem(path, runtimeConfig); err != nil {
+		return fmt.Errorf("preparing: %v", err)
+	}
+	var timeout time.Duration
+	if runtimeConfig.Timeout != "" {
+		d, err := time.ParseDuration(runtimeConfig.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout %s: %v", runtimeConfig.Timeout, err)
 		}
+		timeout = d
+	}
+
+	stdoutLog := r.serviceType + "." + name + ".out"
+	stdout, err := r.logger.Open(stdoutLog)
+	if err != nil {
+		return fmt.Errorf("opening stdout log connection: %v", err)
+	}
+	defer stdout.Close()
 
-		debugLogger.Debugf("%s %s: waiting for completion", serviceType, name)
-		_ = <-waitFor
+	stderrLog := r.serviceType + "." + name
+	stderr, err := r.logger.Open(stderrLog)
+	if err != nil {
+		return fmt.Errorf("opening stderr log connection: %v", err)
+	}
+	defer stderr.Close()
+
+	// ideally we want to use io.MultiWriter here, sending one stream to stdout/stderr, another to the log
+	// however, this hangs if we do, due to a runc bug, see https://github.com/opencontainers/runc/issues/1721#issuecomment-366315563
+	// once that is fixed, this can be cleaned up
+	defer r.logger.Dump(stderrLog)
+	defer r.logger.Dump(stdoutLog)
+
+	// if in console mode, send output to stdout/stderr instead of the log
+	// do not try io.MultiWriter(os.Stdout, stdout) as console messages will hang.
+	// it is not clear why, but since this is all for debugging anyways, it doesn't matter
+	// much.
+	var out, errOut io.Writer = stdout, stderr
+	if r.consoleMode {
+		out, errOut = os.Stdout, os.Stderr
+	}
+
+	for {
+		step.Attempts++
+		step.ExitStatus = nil
+		state, err := r.run(name, path, runtimeConfig, timeout, out, errOut)
+		switch {
+		case errors.Is(err, errTimedOut):
+			step.Result = stepTimedOut
+			err = fmt.Errorf("did not finish within %s", timeout)
+		case err == nil && state != nil:
+			code := state.ExitCode()
+			step.ExitStatus = &code
+			if state.Success() {
+				step.Result = stepSucceeded
+				if r.serviceType == "onboot" {
+					markVolumesReady(container)
+				}
+				r.debugLogger.Debugf("%s %s: cleaning up", r.serviceType, name)
+				cleanup(path)
+				return nil
+			}
+			err = errors.New(state.String())
+		case err == nil:
+			err = fmt.Errorf("cannot wait for process")
+		}
+		if step.Attempts > runtimeConfig.Retries {
+			// skip cleanup on error for debug
+			return err
+		}
+		log.Printf("%s %s: %v, retrying", r.serviceType, name, err)
+		// the container has to be deleted for it to be created again
+		_ = r.runc(io.Discard, io.Discard, "delete", "--force", name)
+		time.Sleep(onbootRetryDelay)
+		step.Result = stepFailed
+	}
+}
 
-		debugLogger.Debugf("%s %s: cleaning up", serviceType, name)
-		cleanup(path)
-		_ = os.Remove(pidfile)
+// errTimedOut is returned when a container does not finish within its timeout, and has been killed
+var errTimedOut = errors.New("timed out")
+
+// run creates and starts the container name from its bundle at path, and waits for it to exit, or kills it
+// if it is still running after timeout, if it is set
+func (r *runcRunner) run(name, path string, runtimeConfig Runtime, timeout time.Duration, stdout, stderr io.Writer) (*os.ProcessState, error) {
+	r.debugLogger.Debugf("%s %s: creating", r.serviceType, name)
+	pidfile := filepath.Join(r.tmpdir, name)
+	defer func() { _ = os.Remove(pidfile) }()
+	if err := r.runc(stdout, stderr, "create", "--bundle", path, "--pid-file", pidfile, name); err != nil {
+		return nil, fmt.Errorf("creating: %v", err)
+	}
+	pf, err := os.ReadFile(pidfile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read pidfile: %v", err)
+	}
+	pid, err := strconv.Atoi(string(pf))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse pid from pidfile: %v", err)
+	}
 
-		// ideally we want to use io.MultiWriter here, sending one stream to stdout/stderr, another to the log
-		// however, this hangs if we do, due to a runc bug, see https://github.com/opencontainers/runc/issues/1721#issuecomment-366315563
-		// once that is fixed, this can be cleaned up
-		logger.Dump(stdoutLog)
-		logger.Dump(stderrLog)
-		debugLogger.Debugf("%s %s: complete", serviceType, name)
+	r.debugLogger.Debugf("%s %s: preparing", r.serviceType, name)
+	if err := prepareProcess(pid, runtimeConfig); err != nil {
+		return nil, fmt.Errorf("cannot prepare process: %v", err)
 	}
 
-	_ = os.RemoveAll(tmpdir)
+	waitFor := make(chan *os.ProcessState, 1)
+	go func() {
+		// never errors in Unix
+		p, _ := os.FindProcess(pid)
+		state, err := p.Wait()
+		if err != nil {
+			log.Printf("Process wait error: %v", err)
+		}
+		waitFor <- state
+	}()
 
-	// make sure the link exists from /var/log/onboot -> /run/log/onboot
-	logger.Symlink(varLogLink)
+	r.debugLogger.Debugf("%s %s: starting", r.serviceType, name)
+	if err := r.runc(stdout, stderr, "start", name); err != nil {
+		return nil, fmt.Errorf("starting: %v", err)
+	}
 
-	return status
+	r.debugLogger.Debugf("%s %s: waiting for completion", r.serviceType, name)
+	if timeout == 0 {
+		return <-waitFor, nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case state := <-waitFor:
+		return state, nil
+	case <-timer.C:
+		log.Printf("%s %s: did not finish within %s, killing it", r.serviceType, name, timeout)
+		// kill all the processes of the container, even if it shares the pid namespace of the host
+		if err := r.runc(io.Discard, io.Discard, "kill", "--all", name, "KILL"); err != nil {
+			log.Printf("%s %s: cannot kill container: %v", r.serviceType, name, err)
+			_ = unix.Kill(pid, unix.SIGKILL)
+		}
+		<-waitFor
+		// delete the container, so that it is not left behind if it is not run again
+		if err := r.runc(io.Discard, io.Discard, "delete", "--force", name); err != nil {
+			log.Printf("%s %s: cannot delete container: %v", r.serviceType, name, err)
+		}
+		return nil, errTimedOut
+	}
+}
+
+// runc runs a runc command, with --debug in debug mode
+func (r *runcRunner) runc(stdout, stderr io.Writer, args ...string) error {
+	if r.debugMode {
+		args = append([]string{"--debug"}, args...)
+	}
+	cmd := exec.Command(runcBinary, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
 }
 
 // setSubreaper copied directly from https://github.com/opencontainers/runc/blob/b23315bdd99c388f5d0dd3616188729c5a97484a/libcontainer/system/linux.go#L88
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fakeRunc runs containers as a background process that exits with the status on the line of the exits
+// file for each attempt, or keeps running if it is "hang", and records its arguments in the calls file
+const fakeRunc = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$*" >> "$dir/calls"
+case "$1" in
+create)
+	attempt=$(grep -c '^create' "$dir/calls")
+	status=$(sed -n "${attempt}p" "$dir/exits")
+	if [ "$status" = hang ]; then
+		sleep 60 >/dev/null 2>&1 &
+	else
+		sh -c "sleep 0.1; exit $status" >/dev/null 2>&1 &
+	fi
+	printf %s $! > "$5"
+	printf %s $! > "$dir/$6.pid"
+	;;
+kill)
+	kill -9 $(cat "$dir/$3.pid")
+	;;
+esac
+`
+
+// testRunner returns a runner that uses a fake runc, whose containers exit as set out in exits
+func testRunner(t *testing.T, exits ...string) (*runcRunner, string) {
+	t.Helper()
+	if err := setSubreaper(1); err != nil {
+		t.Skipf("cannot set as subreaper: %v", err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "runc"), []byte(fakeRunc), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "exits"), []byte(strings.Join(exits, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := runcBinary
+	runcBinary = filepath.Join(dir, "runc")
+	t.Cleanup(func() { runcBinary = old })
+
+	r := &runcRunner{serviceType: "shutdown", tmpdir: t.TempDir(), logger: &fileLog{dir: t.TempDir()}, debugLogger: log.New()}
+	return r, dir
+}
+
+// runcCalls returns the commands the fake runc in dir was run with
+func runcCalls(t *testing.T, dir string) []string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(dir, "calls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+func TestRunStep(t *testing.T) {
+	tests := []struct {
+		name     string
+		exits    []string
+		runtime  Runtime
+		result   string
+		attempts int
+		status   int
+		err      bool
+	}{
+		{name: "success", exits: []string{"0"}, result: stepSucceeded, attempts: 1},
+		{name: "failure", exits: []string{"3", "0"}, result: stepFailed, attempts: 1, status: 3, err: true},
+		{name: "retry", exits: []string{"3", "0"}, runtime: Runtime{Retries: 2}, result: stepSucceeded, attempts: 2},
+		{name: "retries", exits: []string{"3", "4", "5"}, runtime: Runtime{Retries: 2}, result: stepFailed, attempts: 3, status: 5, err: true},
+	}
+	for _, tt := range tests {
+		r, dir := testRunner(t, tt.exits...)
+		step := bootStep{Name: "000-" + tt.name}
+		err := r.runStep(&step, t.TempDir(), tt.runtime)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if step.Result != tt.result || step.Attempts != tt.attempts {
+			t.Errorf("%s: expected %s after %d attempts, got %s after %d", tt.name, tt.result, tt.attempts, step.Result, step.Attempts)
+		}
+		if step.ExitStatus == nil || *step.ExitStatus != tt.status {
+			t.Errorf("%s: expected exit status %d, got %v", tt.name, tt.status, step.ExitStatus)
+		}
+		// the container is deleted before each retry
+		deletes := 0
+		for _, call := range runcCalls(t, dir) {
+			if call == "delete --force "+step.Name {
+				deletes++
+			}
+		}
+		if deletes != tt.attempts-1 {
+			t.Errorf("%s: expected the container to be deleted %d times, got %d", tt.name, tt.attempts-1, deletes)
+		}
+	}
+}
+
+func TestRunStepTimeout(t *testing.T) {
+	r, dir := testRunner(t, "hang", "hang")
+	step := bootStep{Name: "000-timeout"}
+	err := r.runStep(&step, t.TempDir(), Runtime{Timeout: "200ms", Retries: 1})
+	if err == nil || !strings.Contains(err.Error(), "did not finish within 200ms") {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if step.Result != stepTimedOut || step.Attempts != 2 || step.ExitStatus != nil {
+		t.Errorf("expected to time out after 2 attempts, got %+v", step)
+	}
+	// all the processes of the container are killed, and it is not left behind after the last attempt
+	calls := runcCalls(t, dir)
+	kills := 0
+	for _, call := range calls {
+		if call == "kill --all 000-timeout KILL" {
+			kills++
+		}
+	}
+	if kills != 2 {
+		t.Errorf("expected the container to be killed twice, got %v", calls)
+	}
+	if last := calls[len(calls)-1]; last != "delete --force 000-timeout" {
+		t.Errorf("expected the container to be deleted after the last attempt, got %v", calls)
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+	log "github.com/sirupsen/logrus"
+)
+
+// clockTicks is the unit of process start times in /proc, USER_HZ, which is 100 on all supported architectures
+const clockTicks = 100
+
+// serviceInfo is the state of a service shown by list and status
+type serviceInfo struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	PID   uint32 `json:"pid,omitempty"`
+	// Started is when the process of a running service started
+	Started    *time.Time `json:"started,omitempty"`
+	ExitStatus *uint32    `json:"exitStatus,omitempty"`
+	// Stopped is set for a service stopped with 'service stop'
+	Stopped   bool           `json:"stopped,omitempty"`
+	Restart   *restartState  `json:"restart,omitempty"`
+	Health    *healthState   `json:"health,omitempty"`
+	Resources *resourceUsage `json:"resources,omitempty"`
+}
+
+// resourceUsage is the resource usage of the cgroup of a service
+type resourceUsage struct {
+	MemoryBytes uint64 `json:"memoryBytes"`
+	CPUNanos    uint64 `json:"cpuNanoseconds"`
+	Pids        uint64 `json:"pids"`
+}
+
+// parseInfoCmd parses the options of the command, and exits with msg and its usage unless it has nargs arguments
+func parseInfoCmd(command, usage string, args []string, nargs int, msg string) (string, string, bool, []string) {
+	invoked := filepath.Base(os.Args[0])
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s %s\n\n", invoked, usage)
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+
+	sock := flags.String("sock", defaultSocket, "Path to containerd socket")
+	path := flags.String("path", defaultServicesPath, "Path to service configs")
+	jsonOutput := flags.Bool("json", false, "Output JSON")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if len(flags.Args()) != nargs {
+		fmt.Println(msg)
+		flags.Usage()
+		os.Exit(1)
+	}
+	return *sock, *path, *jsonOutput, flags.Args()
+}
+
+func listCmd(ctx context.Context, args []string) {
+	sock, path, jsonOutput, _ := parseInfoCmd("list", "list", args, 0, "Unexpected argument")
+
+	files, err := os.ReadDir(path)
+	if err != nil {
+		log.WithError(err).Fatal("listing services")
+	}
+	cli, err := client.New(sock)
+	if err != nil {
+		log.WithError(err).Fatal("creating containerd client")
+	}
+	infos := []serviceInfo{}
+	for _, file := range files {
+		info, err := getServiceInfo(ctx, cli, path, file.Name(), false)
+		if err != nil {
+			log.WithError(err).Errorf("fetching state of service %s", file.Name())
+			continue
+		}
+		infos = append(infos, info)
+	}
+
+	if jsonOutput {
+		printJSON(infos)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tSTATE\tPID\tUPTIME\tRESTARTS\tHEALTH\n")
+	for _, info := range infos {
+		pid, uptime, restarts, health := "-", "-", "0", "-"
+		if info.PID != 0 {
+			pid = strconv.Itoa(int(info.PID))
+		}
+		if info.Started != nil {
+			uptime = time.Since(*info.Started).Round(time.Second).String()
+		}
+		if info.Restart != nil {
+			restarts = strconv.Itoa(info.Restart.Restarts)
+		}
+		if info.Health != nil {
+			health = info.Health.Status
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", info.Name, info.State, pid, uptime, restarts, health)
+	}
+	_ = w.Flush()
+}
+
+func statusCmd(ctx context.Context, args []string) {
+	sock, path, jsonOutput, args := parseInfoCmd("status", "status [service]", args, 1, "Please specify the service")
+	service := args[0]
+
+	if _, err := os.Stat(filepath.Join(path, service)); err != nil {
+		log.Fatalf("No such service: %s", service)
+	}
+	cli, err := client.New(sock)
+	if err != nil {
+		log.WithError(err).Fatal("creating containerd client")
+	}
+	info, err := getServiceInfo(ctx, cli, path, service, true)
+	if err != nil {
+		log.WithError(err).Fatal("fetching service state")
+	}
+
+	if jsonOutput {
+		printJSON(info)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Service:\t%s\n", info.Name)
+	fmt.Fprintf(w, "State:\t%s\n", info.State)
+	if info.PID != 0 {
+		fmt.Fprintf(w, "PID:\t%d\n", info.PID)
+	}
+	if info.Started != nil {
+		fmt.Fprintf(w, "Started:\t%s, up %s\n", info.Started.Format(time.RFC3339), time.Since(*info.Started).Round(time.Second))
+	}
+	if info.ExitStatus != nil {
+		fmt.Fprintf(w, "Exit status:\t%d\n", *info.ExitStatus)
+	}
+	if info.Stopped {
+		fmt.Fprintf(w, "Stopped:\tby service stop\n")
+	}
+	if r := info.Resources; r != nil {
+		fmt.Fprintf(w, "Memory:\t%d bytes\n", r.MemoryBytes)
+		fmt.Fprintf(w, "CPU:\t%s\n", time.Duration(r.CPUNanos).Round(time.Millisecond))
+		fmt.Fprintf(w, "Processes:\t%d\n", r.Pids)
+	}
+	if r := info.Restart; r != nil {
+		fmt.Fprintf(w, "Restart policy:\t%s\n", r.Policy)
+		fmt.Fprintf(w, "Restarts:\t%d\n", r.Restarts)
+		fmt.Fprintf(w, "Last exit:\tstatus %d at %s\n", r.LastExitStatus, r.LastExitTime.Format(time.RFC3339))
+		if r.GaveUp {
+			fmt.Fprintf(w, "\tnot restarted after %d consecutive restarts\n", r.Consecutive)
+		}
+	}
+	if h := info.Health; h != nil {
+		fmt.Fprintf(w, "Health:\t%s\n", h.Status)
+		if h.FailingStreak != 0 {
+			fmt.Fprintf(w, "Failing streak:\t%d\n", h.FailingStreak)
+		}
+		for _, r := range h.Log {
+			result := "ok"
+			if r.Error != "" {
+				result = r.Error
+			}
+			fmt.Fprintf(w, "\t%s  %s\n", r.Start.Format(time.RFC3339), result)
+		}
+	}
+	_ = w.Flush()
+}
+
+func logsCmd(ctx context.Context, args []string) {
+	invoked := filepath.Base(os.Args[0])
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s logs [service]\n\n", invoked)
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	follow := flags.Bool("f", false, "Follow the log")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		fmt.Println("Please specify the service")
+		flags.Usage()
+		os.Exit(1)
+	}
+	service := args[0]
+
+	// stderr and stdout of a service are logged separately, see start
+	if err := GetLog(varLogDir).Read(os.Stdout, *follow, service, service+".out"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// getServiceInfo returns the state of service from containerd and from the supervisor, and with
+// resources, the resource usage of its cgroup if it is running
+func getServiceInfo(ctx context.Context, cli *client.Client, path, service string, resources bool) (serviceInfo, error) {
+	info := serviceInfo{Name: service, Stopped: isStopped(service)}
+	runtimeConfig, err := readRuntimeConfig(filepath.Join(path, service))
+	if err != nil {
+		return info, err
+	}
+	if runtimeConfig.Namespace != "" {
+		ctx = namespaces.WithNamespace(ctx, runtimeConfig.Namespace)
+	}
+
+	var (
+		restart restartState
+		health  healthState
+	)
+	if err := readStateFile(service, restartStateFile, &restart); err != nil {
+		return info, fmt.Errorf("reading restart state: %v", err)
+	}
+	if !restart.LastExitTime.IsZero() {
+		info.Restart = &restart
+	}
+	if err := readStateFile(service, healthStateFile, &health); err != nil {
+		return info, fmt.Errorf("reading health state: %v", err)
+	}
+	if runtimeConfig.Healthcheck != nil {
+		if health.Status == "" {
+			health.Status = "not checked yet"
+		}
+		info.Health = &health
+	}
+
+	ctr, err := cli.LoadContainer(ctx, service)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			info.State = "not started"
+			return info, nil
+		}
+		return info, err
+	}
+	task, err := ctr.Task(ctx, nil)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			info.State = "created"
+			return info, nil
+		}
+		return info, err
+	}
+	status, err := task.Status(ctx)
+	if err != nil {
+		return info, err
+	}
+	info.State = string(status.Status)
+	if status.Status == client.Stopped {
+		info.ExitStatus = &status.ExitStatus
+		return info, nil
+	}
+	info.PID = task.Pid()
+	if started, err := processStartTime(info.PID); err == nil {
+		info.Started = &started
+	}
+	if resources {
+		if usage, err := cgroupUsage(info.PID); err == nil {
+			info.Resources = usage
+		} else {
+			log.WithError(err).Debug("reading cgroup resource usage")
+		}
+	}
+	return info, nil
+}
+
+// processStartTime returns when the process pid started, from its start time in clock ticks since boot
+func processStartTime(pid uint32) (time.Time, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}, err
+	}
+	// the command, the second field, is in parentheses and may contain spaces
+	stat := string(b)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	// the start time is the 22nd field, and fields starts with the 3rd
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("cannot parse /proc/%d/stat", pid)
+	}
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	boot, err := bootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return boot.Add(time.Duration(ticks) * time.Second / clockTicks), nil
+}
+
+// bootTime returns when the system booted, from /proc/stat
+func bootTime() (time.Time, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if btime, ok := strings.CutPrefix(scanner.Text(), "btime "); ok {
+			secs, err := strconv.ParseInt(btime, 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(secs, 0), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no boot time in /proc/stat")
+}
+
+// cgroupUsage returns the resource usage of the cgroup of the process pid
+func cgroupUsage(pid uint32) (*resourceUsage, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return nil, err
+	}
+	v2, err := isCgroupV2()
+	if err != nil {
+		return nil, err
+	}
+	usage := &resourceUsage{}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		// hierarchy-ID:controllers:path, with a single hierarchy 0 with no controllers listed in cgroup v2
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		cgroup := parts[2]
+		if v2 {
+			if parts[0] != "0" {
+				continue
+			}
+			dir := filepath.Join("/sys/fs/cgroup", cgroup)
+			usage.MemoryBytes, _ = readCgroupUint(filepath.Join(dir, "memory.current"))
+			usage.Pids, _ = readCgroupUint(filepath.Join(dir, "pids.current"))
+			if usec, err := readCgroupStat(filepath.Join(dir, "cpu.stat"), "usage_usec"); err == nil {
+				usage.CPUNanos = usec * 1000
+			}
+			return usage, nil
+		}
+		// a cgroup v1 controller is mounted in a directory named for it
+		for _, controller := range strings.Split(parts[1], ",") {
+			dir := filepath.Join("/sys/fs/cgroup", controller, cgroup)
+			switch controller {
+			case "memory":
+				usage.MemoryBytes, _ = readCgroupUint(filepath.Join(dir, "memory.usage_in_bytes"))
+			case "cpuacct":
+				usage.CPUNanos, _ = readCgroupUint(filepath.Join(dir, "cpuacct.usage"))
+			case "pids":
+				usage.Pids, _ = readCgroupUint(filepath.Join(dir, "pids.current"))
+			}
+		}
+	}
+	return usage, nil
+}
+
+func readCgroupUint(path string) (uint64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// readCgroupStat reads the value of key in a flat keyed cgroup file such as cpu.stat
+func readCgroupStat(path, key string) (uint64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if value, ok := strings.CutPrefix(line, key+" "); ok {
+			return strconv.ParseUint(value, 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("no %s in %s", key, path)
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Fatal(err)
+	}
+}
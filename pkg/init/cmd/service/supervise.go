@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// serviceStatePath is where the state of each service is recorded for inspection, in a directory per service
+	serviceStatePath = "/run/service"
+	// restartStateFile is where the supervisor records the exits and restarts of a service
+	restartStateFile = "restart.json"
+	// stoppedFile marks a service stopped with 'service stop', which the supervisor does not restart
+	stoppedFile = "stopped"
+	// defaultRestartBackoff is the delay before restarting a service, unless its restart policy sets one
+	defaultRestartBackoff = time.Second
+	// maxRestartBackoff is the longest delay before restarting a service, however often it has been restarted
+	maxRestartBackoff = 5 * time.Minute
+	// restartResetAfter is how long a service runs for after a restart for its next exit not to count as consecutive
+	restartResetAfter = 10 * time.Second
+)
+
+// Restart policies, see RestartPolicy
+const (
+	restartNo        = "no"
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+)
+
+// restartState is the state of a service that the supervisor records, in restartStateFile
+type restartState struct {
+	Policy string `json:"policy"`
+	// Restarts is the number of times the service has been restarted, and Consecutive the number of those
+	// since it last ran for restartResetAfter, which the backoff and maximum retries apply to
+	Restarts       int        `json:"restarts"`
+	Consecutive    int        `json:"consecutiveRestarts"`
+	LastExitStatus uint32     `json:"lastExitStatus"`
+	LastExitTime   time.Time  `json:"lastExitTime"`
+	LastRestart    *time.Time `json:"lastRestart,omitempty"`
+	// GaveUp is set when the service is not restarted as it failed more than the maximum retries
+	GaveUp bool `json:"gaveUp,omitempty"`
+}
+
+func serviceStateDir(service string) string {
+	return filepath.Join(serviceStatePath, service)
+}
+
+// readStateFile reads the state file name of service into v, which is left as it is if there is none
+func readStateFile(service, name string, v interface{}) error {
+	b, err := os.ReadFile(filepath.Join(serviceStateDir(service), name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func writeStateFile(service, name string, v interface{}) error {
+	return writeJSONFile(filepath.Join(serviceStateDir(service), name), v)
+}
+
+// writeJSONFile writes v to path as JSON, replacing the file so that it is never read partly written
+func writeJSONFile(path string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// markStopped marks service as stopped, or not, by 'service stop' and 'service start'
+func markStopped(service string, stopped bool) error {
+	marker := filepath.Join(serviceStateDir(service), stoppedFile)
+	if !stopped {
+		if err := os.Remove(marker); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(serviceStateDir(service), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(marker, nil, 0644)
+}
+
+func isStopped(service string) bool {
+	_, err := os.Stat(filepath.Join(serviceStateDir(service), stoppedFile))
+	return err == nil
+}
+
+// startSupervisor starts the supervisor in the background, where it outlives system-init, to start the
+// services and then restart them
+func startSupervisor(ctx context.Context, sock, path string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{"supervise", "-start", "-sock", sock, "-path", path}
+	if ns, ok := namespaces.Namespace(ctx); ok {
+		args = append([]string{"-containerd-namespace", ns}, args...)
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	return cmd.Start()
+}
+
+func superviseCmd(ctx context.Context, args []string) {
+	invoked := filepath.Base(os.Args[0])
+	flags := flag.NewFlagSet("supervise", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s supervise\n\n", invoked)
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+
+	sock := flags.String("sock", defaultSocket, "Path to containerd socket")
+	path := flags.String("path", defaultServicesPath, "Path to service configs")
+	startServicesFlag := flags.Bool("start", false, "Start the services, in the order of their dependencies")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if len(flags.Args()) != 0 {
+		fmt.Println("Unexpected argument")
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	cli, err := client.New(*sock)
+	if err != nil {
+		log.WithError(err).Fatal("creating containerd client")
+	}
+	files, err := os.ReadDir(*path)
+	if err != nil {
+		log.WithError(err).Fatal("listing services")
+	}
+	s := &supervisor{cli: cli, sock: *sock, path: *path, unhealthy: map[string]bool{}}
+	var wg sync.WaitGroup
+	if *startServicesFlag {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			startServices(ctx, cli, *sock, *path)
+		}()
+	}
+	for _, file := range files {
+		service := file.Name()
+		runtime, err := readRuntimeConfig(filepath.Join(*path, service))
+		if err != nil {
+			log.WithError(err).Errorf("not supervising service %s", service)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.watch(ctx, service, runtime)
+		}()
+	}
+	wg.Wait()
+}
+
+// supervisor records the exits and health of services, and restarts them according to their restart
+// policy, or if they are unhealthy and their health check says so
+type supervisor struct {
+	cli  *client.Client
+	sock string
+	path string
+
+	mu sync.Mutex
+	// unhealthy are the services killed as they are unhealthy, which are restarted whatever their policy
+	unhealthy map[string]bool
+}
+
+// watch handles each exit of service
+func (s *supervisor) watch(ctx context.Context, service string, runtime Runtime) {
+	if runtime.Namespace != "" {
+		ctx = namespaces.WithNamespace(ctx, runtime.Namespace)
+	}
+	ns, _ := namespaces.Namespace(ctx)
+	// only exits of the task itself, not of processes run in it such as readiness checks
+	exits, errs := s.cli.Subscribe(ctx, fmt.Sprintf(`topic=="/tasks/exit",namespace==%q,event.container_id==%q,event.id==%q`, ns, service, service))
+	if runtime.Healthcheck != nil {
+		go s.checkHealth(ctx, service, runtime)
+	}
+	// the service may have exited before the subscription
+	s.exited(ctx, service, runtime)
+	for {
+		select {
+		case <-exits:
+			s.exited(ctx, service, runtime)
+		case err := <-errs:
+			log.WithError(err).Errorf("no longer supervising service %s", service)
+			return
+		}
+	}
+}
+
+// exited records the exit of service, if its task has exited, and restarts it if its policy says so
+func (s *supervisor) exited(ctx context.Context, service string, runtime Runtime) {
+	status, ok := taskStopped(ctx, s.cli, service, runtime.Namespace)
+	if !ok {
+		return
+	}
+	var st restartState
+	if err := readStateFile(service, restartStateFile, &st); err != nil {
+		log.WithError(err).Errorf("reading state of service %s", service)
+	}
+	if st.LastExitTime.Equal(status.ExitTime) {
+		// already handled
+		return
+	}
+	policy := RestartPolicy{Policy: restartNo}
+	if runtime.Restart != nil {
+		policy = *runtime.Restart
+	}
+	if !recordExit(&st, policy, status.ExitStatus, status.ExitTime, s.killedUnhealthy(service), isStopped(service)) {
+		s.record(service, st)
+		return
+	}
+
+	for {
+		delay, ok := nextRestart(&st, policy)
+		s.record(service, st)
+		if !ok {
+			log.Errorf("Service %s failed after %d restarts, not restarting it again", service, st.Consecutive)
+			return
+		}
+		log.Infof("Restarting service %s in %s, after it exited with status %d", service, delay, status.ExitStatus)
+		time.Sleep(delay)
+
+		restarted, err := s.restart(ctx, service)
+		if err != nil {
+			log.WithError(err).Errorf("failed to restart service %s", service)
+			continue
+		}
+		if restarted {
+			now := time.Now()
+			st.Restarts++
+			st.LastRestart = &now
+			s.record(service, st)
+		}
+		return
+	}
+}
+
+// recordExit records in st an exit of a service with policy, and returns whether to restart it, which is if
+// it was killed as it was unhealthy or its policy says so, unless it was stopped with 'service stop'
+func recordExit(st *restartState, policy RestartPolicy, exitStatus uint32, exitTime time.Time, killedUnhealthy, stopped bool) bool {
+	st.Policy = policy.Policy
+	st.LastExitStatus = exitStatus
+	st.LastExitTime = exitTime
+	if st.LastRestart == nil || exitTime.Sub(*st.LastRestart) >= restartResetAfter {
+		st.Consecutive = 0
+		st.GaveUp = false
+	}
+
+	restart := false
+	switch {
+	case killedUnhealthy:
+		restart = true
+	case policy.Policy == restartAlways:
+		restart = true
+	case policy.Policy == restartOnFailure:
+		restart = exitStatus != 0
+	}
+	return restart && !stopped
+}
+
+// nextRestart counts the next restart of a service with policy in st, and returns the delay before it, which
+// doubles with each consecutive restart up to maxRestartBackoff. It returns false, and records that it gave up,
+// if the service has already been restarted the maximum retries of its policy.
+func nextRestart(st *restartState, policy RestartPolicy) (time.Duration, bool) {
+	if policy.Policy == restartOnFailure && policy.MaxRetries > 0 && st.Consecutive >= policy.MaxRetries {
+		st.GaveUp = true
+		return 0, false
+	}
+	delay := parseDurationDefault(policy.Backoff, defaultRestartBackoff)
+	for i := 0; i < st.Consecutive && delay < maxRestartBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRestartBackoff {
+		delay = maxRestartBackoff
+	}
+	st.Consecutive++
+	return delay, true
+}
+
+// killedUnhealthy returns whether service was killed as it was unhealthy, since it was last checked
+func (s *supervisor) killedUnhealthy(service string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	killed := s.unhealthy[service]
+	delete(s.unhealthy, service)
+	return killed
+}
+
+// taskStopped returns the status of the task of service if it has exited
+func taskStopped(ctx context.Context, cli *client.Client, service, namespace string) (client.Status, bool) {
+	if namespace != "" {
+		ctx = namespaces.WithNamespace(ctx, namespace)
+	}
+	ctr, err := cli.LoadContainer(ctx, service)
+	if err != nil {
+		// not started yet, or stopped
+		return client.Status{}, false
+	}
+	task, err := ctr.Task(ctx, nil)
+	if err != nil {
+		return client.Status{}, false
+	}
+	status, err := task.Status(ctx)
+	if err != nil || status.Status != client.Stopped {
+		return client.Status{}, false
+	}
+	return status, true
+}
+
+// restart starts service again, unless it was stopped or started by someone else in the meantime
+func (s *supervisor) restart(ctx context.Context, service string) (bool, error) {
+	if isStopped(service) {
+		return false, nil
+	}
+	// the container is not there if an earlier restart failed to start it
+	ctr, err := s.cli.LoadContainer(ctx, service)
+	switch {
+	case err == nil:
+		task, err := ctr.Task(ctx, nil)
+		if err == nil {
+			status, err := task.Status(ctx)
+			if err != nil {
+				return false, fmt.Errorf("fetching task status: %v", err)
+			}
+			if status.Status != client.Stopped {
+				return false, nil
+			}
+			if _, err := task.Delete(ctx); err != nil {
+				return false, fmt.Errorf("deleting task: %v", err)
+			}
+		} else if !errdefs.IsNotFound(err) {
+			return false, fmt.Errorf("fetching task: %v", err)
+		}
+		if err := ctr.Delete(ctx); err != nil {
+			return false, fmt.Errorf("deleting container: %v", err)
+		}
+	case !errdefs.IsNotFound(err):
+		return false, fmt.Errorf("loading container: %v", err)
+	}
+	if _, _, msg, err := start(ctx, service, s.sock, s.path, ""); err != nil {
+		return false, fmt.Errorf("%s: %v", msg, err)
+	}
+	return true, nil
+}
+
+func (s *supervisor) record(service string, st restartState) {
+	if err := writeStateFile(service, restartStateFile, st); err != nil {
+		log.WithError(err).Errorf("recording state of service %s", service)
+	}
+}
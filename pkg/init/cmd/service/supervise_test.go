@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordExit(t *testing.T) {
+	exitTime := time.Now()
+	tests := []struct {
+		name    string
+		policy  string
+		status  uint32
+		killed  bool
+		stopped bool
+		restart bool
+	}{
+		{name: "no", policy: restartNo, status: 1},
+		{name: "always", policy: restartAlways, restart: true},
+		{name: "on-failure success", policy: restartOnFailure},
+		{name: "on-failure failure", policy: restartOnFailure, status: 1, restart: true},
+		{name: "unhealthy", policy: restartNo, killed: true, restart: true},
+		{name: "unhealthy on-failure success", policy: restartOnFailure, killed: true, restart: true},
+		{name: "stopped", policy: restartAlways, stopped: true},
+		{name: "stopped unhealthy", policy: restartOnFailure, status: 1, killed: true, stopped: true},
+	}
+	for _, tt := range tests {
+		var st restartState
+		restart := recordExit(&st, RestartPolicy{Policy: tt.policy}, tt.status, exitTime, tt.killed, tt.stopped)
+		if restart != tt.restart {
+			t.Errorf("%s: expected restart %v, got %v", tt.name, tt.restart, restart)
+		}
+		if st.Policy != tt.policy || st.LastExitStatus != tt.status || !st.LastExitTime.Equal(exitTime) {
+			t.Errorf("%s: exit not recorded: %+v", tt.name, st)
+		}
+	}
+}
+
+func TestRecordExitReset(t *testing.T) {
+	exitTime := time.Now()
+	policy := RestartPolicy{Policy: restartOnFailure, MaxRetries: 3}
+
+	// an exit soon after a restart is consecutive
+	lastRestart := exitTime.Add(-restartResetAfter + time.Second)
+	st := restartState{Consecutive: 3, GaveUp: true, LastRestart: &lastRestart}
+	recordExit(&st, policy, 1, exitTime, false, false)
+	if st.Consecutive != 3 || !st.GaveUp {
+		t.Errorf("expected consecutive restarts to be kept, got %+v", st)
+	}
+
+	// but not once the service has run for restartResetAfter
+	lastRestart = exitTime.Add(-restartResetAfter)
+	st = restartState{Consecutive: 3, GaveUp: true, LastRestart: &lastRestart}
+	recordExit(&st, policy, 1, exitTime, false, false)
+	if st.Consecutive != 0 || st.GaveUp {
+		t.Errorf("expected consecutive restarts to be reset, got %+v", st)
+	}
+	if _, ok := nextRestart(&st, policy); !ok {
+		t.Error("expected a restart after the reset")
+	}
+
+	// nor if it was never restarted
+	st = restartState{Consecutive: 2}
+	recordExit(&st, policy, 1, exitTime, false, false)
+	if st.Consecutive != 0 {
+		t.Errorf("expected consecutive restarts to be reset, got %+v", st)
+	}
+}
+
+func TestNextRestart(t *testing.T) {
+	var st restartState
+	policy := RestartPolicy{Policy: restartAlways, Backoff: "10s"}
+	for i, expected := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second, 160 * time.Second, maxRestartBackoff, maxRestartBackoff} {
+		delay, ok := nextRestart(&st, policy)
+		if !ok || delay != expected {
+			t.Errorf("restart %d: expected delay %s, got %s, %v", i, expected, delay, ok)
+		}
+		if st.Consecutive != i+1 {
+			t.Errorf("restart %d: expected %d consecutive restarts, got %d", i, i+1, st.Consecutive)
+		}
+	}
+
+	st = restartState{Consecutive: 100}
+	if delay, _ := nextRestart(&st, policy); delay != maxRestartBackoff {
+		t.Errorf("expected delay to be capped at %s, got %s", maxRestartBackoff, delay)
+	}
+	st = restartState{}
+	if delay, _ := nextRestart(&st, RestartPolicy{Policy: restartAlways, Backoff: "1h"}); delay != maxRestartBackoff {
+		t.Errorf("expected backoff to be capped at %s, got %s", maxRestartBackoff, delay)
+	}
+	st = restartState{}
+	if delay, _ := nextRestart(&st, RestartPolicy{Policy: restartAlways}); delay != defaultRestartBackoff {
+		t.Errorf("expected default backoff %s, got %s", defaultRestartBackoff, delay)
+	}
+}
+
+func TestNextRestartMaxRetries(t *testing.T) {
+	policy := RestartPolicy{Policy: restartOnFailure, MaxRetries: 2}
+	var st restartState
+	for i := 0; i < 2; i++ {
+		if _, ok := nextRestart(&st, policy); !ok {
+			t.Fatalf("restart %d: expected a restart", i)
+		}
+	}
+	if _, ok := nextRestart(&st, policy); ok {
+		t.Error("expected no restart after the maximum retries")
+	}
+	if !st.GaveUp || st.Consecutive != 2 {
+		t.Errorf("expected to give up after 2 restarts, got %+v", st)
+	}
+
+	// a service killed as it is unhealthy soon after its last restart is not restarted again either
+	lastRestart := time.Now()
+	st.LastRestart = &lastRestart
+	if !recordExit(&st, policy, 0, lastRestart.Add(time.Second), true, false) {
+		t.Error("expected an unhealthy service to be restarted")
+	}
+	if _, ok := nextRestart(&st, policy); ok {
+		t.Error("expected no restart of an unhealthy service after the maximum retries")
+	}
+
+	// without a maximum, a service is restarted however often it failed
+	st = restartState{Consecutive: 100}
+	if _, ok := nextRestart(&st, RestartPolicy{Policy: restartOnFailure}); !ok || st.GaveUp {
+		t.Errorf("expected a restart without maximum retries, got %+v", st)
+	}
+}
@@ -171,18 +171,11 @@ func systemInitCmd(ctx context.Context, args []string) {
 		}
 	}
 
-	// Start up containers
-	files, err := os.ReadDir(*path)
-	// just skip if there is an error, eg no such path
-	if err != nil {
-		return
-	}
-	for _, file := range files {
-		if id, pid, msg, err := start(ctx, file.Name(), *sock, *path, ""); err != nil {
-			log.WithError(err).Error(msg)
-		} else {
-			log.Debugf("Started %s pid %d", id, pid)
-		}
+	// start the services in the background, in the order of their dependencies, where the supervisor
+	// restarts those that exit according to their restart policy, so that the boot is not held up
+	if err := startSupervisor(ctx, *sock, *path); err != nil {
+		log.WithError(err).Error("cannot start service supervisor, starting services without it")
+		startServices(ctx, client, *sock, *path)
 	}
 }
 
@@ -2,16 +2,53 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
 
+const (
+	// volumeConfigFile is written by linuxkit build to the directory of a volume with anything to configure
+	volumeConfigFile = "volume.json"
+	// volumeReadyFile is created at the root of a shared volume when its producer has populated it
+	volumeReadyFile = ".ready"
+	// deviceTimeout is how long to wait for the device of a volume to appear, as the driver may still be loading
+	deviceTimeout = 10 * time.Second
+	// volumeReadyTimeout is how long a consumer of a shared volume waits for it to be ready
+	volumeReadyTimeout = 5 * time.Minute
+)
+
+// Note these definitions are from src/moby/config.go and should be kept in sync
+
+// volumeBacking is where the read-write upper layer of a volume is stored
+type volumeBacking struct {
+	Device string `json:"device"`
+	FSType string `json:"fstype"`
+	Path   string `json:"path"`
+	Size   string `json:"size"`
+}
+
+// volumeConfig is the configuration of a volume for init
+type volumeConfig struct {
+	volumeBacking
+	UID       int      `json:"uid"`
+	GID       int      `json:"gid"`
+	Producer  string   `json:"producer"`
+	Consumers []string `json:"consumers"`
+}
+
 func volumeInitCmd(ctx context.Context) int {
 	invoked := filepath.Base(os.Args[0])
 	flags := flag.NewFlagSet("volume", flag.ExitOnError)
@@ -29,6 +66,15 @@ func volumeInitCmd(ctx context.Context) int {
 	if err != nil {
 		return 1
 	}
+	configs, err := readVolumeConfigs(*path)
+	if err != nil {
+		log.WithError(err).Error("Error reading volume configs")
+		return 1
+	}
+	// volumes backed by a host path are set up last, so the path can be in a volume on a device
+	sort.SliceStable(vols, func(i, j int) bool {
+		return configs[vols[i].Name()].Path == "" && configs[vols[j].Name()].Path != ""
+	})
 	// go through each volume, ensure that the volPath/merged exists as a directory,
 	// and is one of:
 	// - read-only: i.e. no tmp exists, merged bindmounted to lower
@@ -60,22 +106,36 @@ func volumeInitCmd(ctx context.Context) int {
 		}
 		lowerDir := filepath.Join(*path, vol.Name(), "lower")
 		mergedDir := filepath.Join(*path, vol.Name(), "merged")
-		// need a tmpfs to create the workdir and upper
+		// need a filesystem to create the workdir and upper
 		tmpDir := filepath.Join(*path, vol.Name(), "tmp")
-		if err := unix.Mount("tmpfs", tmpDir, "tmpfs", unix.MS_RELATIME, ""); err != nil {
+		config := configs[vol.Name()]
+		if err := mountVolumeBacking(tmpDir, config.volumeBacking); err != nil {
 			log.WithError(err).Errorf("Error creating tmpDir for volume %s", vol.Name())
 			return 1
 		}
 		workDir := filepath.Join(tmpDir, "work")
 		upperDir := filepath.Join(tmpDir, "upper")
-		if err := os.Mkdir(upperDir, 0755); err != nil {
+		// these already exist if the upper layer persists from an earlier boot
+		if err := os.MkdirAll(upperDir, 0755); err != nil {
 			log.WithError(err).Errorf("Error creating upper dir for volume %s", vol.Name())
 			return 1
 		}
-		if err := os.Mkdir(workDir, 0755); err != nil {
+		if err := os.MkdirAll(workDir, 0755); err != nil {
 			log.WithError(err).Errorf("Error creating work dir for volume %s", vol.Name())
 			return 1
 		}
+		// the root of the merged volume has the owner of the upper dir
+		if err := os.Lchown(upperDir, config.UID, config.GID); err != nil {
+			log.WithError(err).Errorf("Error setting owner of volume %s", vol.Name())
+			return 1
+		}
+		// a shared volume is not ready until its producer has run in this boot
+		if config.Producer != "" {
+			if err := os.Remove(filepath.Join(upperDir, volumeReadyFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.WithError(err).Errorf("Error resetting volume %s", vol.Name())
+				return 1
+			}
+		}
 		// and let's mount the actual dir
 		mountOps := []string{fmt.Sprintf("lowerdir=%s", lowerDir), fmt.Sprintf("upperdir=%s", upperDir), fmt.Sprintf("workdir=%s", workDir)}
 
@@ -93,3 +153,164 @@ func volumeInitCmd(ctx context.Context) int {
 	}
 	return 0
 }
+
+// readVolumeConfigs returns the configuration of each volume in path by name. Volumes without
+// a config file have the default configuration.
+func readVolumeConfigs(path string) (map[string]volumeConfig, error) {
+	vols, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	configs := map[string]volumeConfig{}
+	for _, vol := range vols {
+		var config volumeConfig
+		b, err := os.ReadFile(filepath.Join(path, vol.Name(), volumeConfigFile))
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(b, &config); err != nil {
+				return nil, fmt.Errorf("volume %s: %v", vol.Name(), err)
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			return nil, fmt.Errorf("volume %s: %v", vol.Name(), err)
+		}
+		configs[vol.Name()] = config
+	}
+	return configs, nil
+}
+
+// markVolumesReady marks the shared volumes produced by the container name as ready for their consumers
+func markVolumesReady(name string) {
+	configs, err := readVolumeConfigs(defaultVolumesPath)
+	if err != nil {
+		return
+	}
+	for vol, config := range configs {
+		if config.Producer != name {
+			continue
+		}
+		ready := filepath.Join(defaultVolumesPath, vol, "merged", volumeReadyFile)
+		if err := os.WriteFile(ready, nil, 0644); err != nil {
+			log.WithError(err).Errorf("Error marking volume %s ready", vol)
+		}
+	}
+}
+
+// consumedVolumes returns the configuration of the shared volumes that the container name waits for
+func consumedVolumes(name string) map[string]volumeConfig {
+	configs, err := readVolumeConfigs(defaultVolumesPath)
+	if err != nil {
+		// no volumes
+		return nil
+	}
+	consumed := map[string]volumeConfig{}
+	for vol, config := range configs {
+		for _, c := range config.Consumers {
+			if c == name {
+				consumed[vol] = config
+			}
+		}
+	}
+	return consumed
+}
+
+// waitForVolumes waits for the shared volumes that the container name consumes to be marked ready
+// by their producers, for up to volumeReadyTimeout
+func waitForVolumes(name string, consumed map[string]volumeConfig) error {
+	deadline := time.Now().Add(volumeReadyTimeout)
+	for vol, config := range consumed {
+		ready := filepath.Join(defaultVolumesPath, vol, "merged", volumeReadyFile)
+		logged := false
+		for {
+			if _, err := os.Stat(ready); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("volume %s not ready from %s", vol, config.Producer)
+			}
+			if !logged {
+				log.Infof("%s waiting for volume %s from %s", name, vol, config.Producer)
+				logged = true
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// mountVolumeBacking mounts the filesystem for the upper layer of a volume on dir
+func mountVolumeBacking(dir string, backing volumeBacking) error {
+	switch {
+	case backing.Device != "":
+		device, fstype, err := findVolumeDevice(backing.Device)
+		if err != nil {
+			return err
+		}
+		if backing.FSType != "" {
+			fstype = backing.FSType
+		}
+		if fstype == "" {
+			return fmt.Errorf("cannot determine the filesystem type of %s", device)
+		}
+		log.Infof("Mounting %s (%s) for volume upper layer", device, fstype)
+		return unix.Mount(device, dir, fstype, unix.MS_RELATIME, "")
+	case backing.Path != "":
+		if err := os.MkdirAll(backing.Path, 0755); err != nil {
+			return err
+		}
+		log.Infof("Binding %s for volume upper layer", backing.Path)
+		return unix.Mount(backing.Path, dir, "", unix.MS_BIND, "")
+	default:
+		var data string
+		if backing.Size != "" {
+			data = "size=" + backing.Size
+		}
+		return unix.Mount("tmpfs", dir, "tmpfs", unix.MS_RELATIME, data)
+	}
+}
+
+// findVolumeDevice finds the block device for a LABEL=, UUID= or /dev path, and its filesystem type,
+// if known, waiting for up to deviceTimeout for it to appear
+func findVolumeDevice(spec string) (string, string, error) {
+	key, value, _ := strings.Cut(spec, "=")
+	deadline := time.Now().Add(deviceTimeout)
+	for {
+		if strings.HasPrefix(spec, "/dev/") {
+			if _, err := os.Stat(spec); err == nil {
+				return spec, blkid(spec)["TYPE"], nil
+			}
+		} else {
+			devs, err := os.ReadDir("/sys/class/block")
+			if err != nil {
+				return "", "", err
+			}
+			for _, dev := range devs {
+				device := filepath.Join("/dev", dev.Name())
+				props := blkid(device)
+				if props[key] == value {
+					return device, props["TYPE"], nil
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			return "", "", fmt.Errorf("device %s not found", spec)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+var blkidRE = regexp.MustCompile(`([A-Z_]+)=("(?:\\.|[^"])*")`)
+
+// blkid returns the properties of a block device, such as LABEL, UUID and TYPE, or none if it has no filesystem
+func blkid(device string) map[string]string {
+	props := map[string]string{}
+	out, err := exec.Command("blkid", device).Output()
+	if err != nil {
+		return props
+	}
+	for _, match := range blkidRE.FindAllStringSubmatch(strings.TrimPrefix(string(out), device+":"), -1) {
+		if value, err := strconv.Unquote(match[2]); err == nil {
+			props[match[1]] = value
+		}
+	}
+	return props
+}
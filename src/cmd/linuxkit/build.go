@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
 	mobybuild "github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby/build"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/signature"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/spec"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -19,8 +21,12 @@ import (
 )
 
 const (
-	defaultNameForStdin = "moby"
-	defaultSbomFilename = "sbom.spdx.json"
+	defaultNameForStdin          = "moby"
+	defaultSbomFilename          = "sbom.spdx.json"
+	defaultCycloneDXSbomFilename = "sbom.cdx.json"
+	envVarSecretKey              = "LINUXKIT_SECRET_KEY"
+	envVarSecretKeyFile          = "LINUXKIT_SECRET_KEY_FILE"
+	envVarSignaturePolicy        = "LINUXKIT_SIGNATURE_POLICY"
 )
 
 type formatList []string
@@ -40,6 +46,155 @@ func (f *formatList) Type() string {
 	return "[]string"
 }
 
+// configSource is the raw contents of a config file that was loaded
+type configSource struct {
+	name string
+	data []byte
+}
+
+// parseArches parses a comma separated list of architectures, as given to --arch
+func parseArches(arch string) ([]string, error) {
+	arches := strings.Split(arch, ",")
+	seen := map[string]bool{}
+	for _, a := range arches {
+		if a == "" || seen[a] {
+			return nil, fmt.Errorf("invalid list of architectures %q", arch)
+		}
+		seen[a] = true
+	}
+	return arches, nil
+}
+
+// loadConfig reads and parses the config file at arg, which can be a local file, a URL, or "-" for stdin.
+// Any files listed in its include key are loaded first, relative to arg, and the config is then appended
+// to them, so that it can override or patch what they contain. parents tracks the files currently being
+// loaded, to catch include loops. If sources is not nil, the contents of every file loaded are appended
+// to it, in the order in which they are applied.
+func loadConfig(arg string, vars map[string]string, parents map[string]bool, sources *[]configSource) (moby.Moby, error) {
+	var (
+		config             []byte
+		templatesSupported bool
+	)
+	if parents[arg] {
+		return moby.Moby{}, fmt.Errorf("include loop detected at %s", arg)
+	}
+	if conf := arg; conf == "-" {
+		var err error
+		config, err = io.ReadAll(os.Stdin)
+		if err != nil {
+			return moby.Moby{}, fmt.Errorf("cannot read stdin: %v", err)
+		}
+	} else if isURL(arg) {
+		buffer := new(bytes.Buffer)
+		response, err := http.Get(arg)
+		if err != nil {
+			return moby.Moby{}, fmt.Errorf("cannot fetch remote yaml file: %v", err)
+		}
+		defer func() { _ = response.Body.Close() }()
+		_, err = io.Copy(buffer, response.Body)
+		if err != nil {
+			return moby.Moby{}, fmt.Errorf("error reading http body: %v", err)
+		}
+		config = buffer.Bytes()
+	} else {
+		var err error
+		config, err = os.ReadFile(conf)
+		if err != nil {
+			return moby.Moby{}, fmt.Errorf("cannot open config file: %v", err)
+		}
+		// templates are only supported for local files
+		templatesSupported = true
+	}
+	var pkgFinder spec.PackageResolver
+	if templatesSupported {
+		pkgFinder = createPackageResolver(filepath.Dir(arg))
+	}
+	c, err := moby.NewConfig(config, pkgFinder, vars)
+	if err != nil {
+		return moby.Moby{}, fmt.Errorf("invalid config %s: %v", arg, err)
+	}
+	if len(c.Include) == 0 {
+		if sources != nil {
+			*sources = append(*sources, configSource{arg, config})
+		}
+		return c, nil
+	}
+
+	parents[arg] = true
+	defer delete(parents, arg)
+	var m moby.Moby
+	for _, inc := range c.Include {
+		path, err := includePath(arg, inc)
+		if err != nil {
+			return moby.Moby{}, err
+		}
+		ic, err := loadConfig(path, vars, parents, sources)
+		if err != nil {
+			return moby.Moby{}, fmt.Errorf("cannot include %s from %s: %v", inc, arg, err)
+		}
+		if m, err = moby.AppendConfig(m, ic); err != nil {
+			return moby.Moby{}, fmt.Errorf("cannot append included file %s: %v", inc, err)
+		}
+	}
+	c.Include = nil
+	if sources != nil {
+		*sources = append(*sources, configSource{arg, config})
+	}
+	return moby.AppendConfig(m, c)
+}
+
+// includePath resolves an include relative to the config file that includes it
+func includePath(parent, inc string) (string, error) {
+	switch {
+	case isURL(inc), filepath.IsAbs(inc):
+		return inc, nil
+	case isURL(parent):
+		base, err := url.Parse(parent)
+		if err != nil {
+			return "", fmt.Errorf("invalid url %s: %v", parent, err)
+		}
+		ref, err := url.Parse(inc)
+		if err != nil {
+			return "", fmt.Errorf("invalid include %s: %v", inc, err)
+		}
+		return base.ResolveReference(ref).String(), nil
+	case parent == "-":
+		return inc, nil
+	default:
+		return filepath.Join(filepath.Dir(parent), inc), nil
+	}
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// secretIdentities returns the keys to decrypt secrets with, from the key file, if any, and the
+// LINUXKIT_SECRET_KEY env var, which holds the keys themselves
+func secretIdentities(keyFile string) ([]*mobybuild.SecretIdentity, error) {
+	var ids []*mobybuild.SecretIdentity
+	if keyFile != "" {
+		f, err := os.Open(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open secret key file: %v", err)
+		}
+		defer func() { _ = f.Close() }()
+		fileIDs, err := mobybuild.ParseSecretIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", keyFile, err)
+		}
+		ids = append(ids, fileIDs...)
+	}
+	if key := os.Getenv(envVarSecretKey); key != "" {
+		envIDs, err := mobybuild.ParseSecretIdentities(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", envVarSecretKey, err)
+		}
+		ids = append(ids, envIDs...)
+	}
+	return ids, nil
+}
+
 func buildCmd() *cobra.Command {
 
 	var (
@@ -56,9 +211,21 @@ func buildCmd() *cobra.Command {
 		outputTypes        = mobybuild.OutputTypes()
 		noSbom             bool
 		sbomOutputFilename string
+		sbomFormat         string
+		sbomHostOutput     string
 		inputTar           string
 		sbomCurrentTime    bool
 		dryRun             bool
+		vars               []string
+		varFiles           []string
+		manifestFile       string
+		lockedFile         string
+		builder            string
+		buildCache         string
+		jobs               int
+		secretKeyFile      flagOverEnvVarOverDefaultString
+		ociIndex           string
+		policyFile         flagOverEnvVarOverDefaultString
 	)
 	cmd := &cobra.Command{
 		Use:   "build",
@@ -109,7 +276,7 @@ The generated image can be in one of multiple formats which can be run on variou
 					dir = ""
 				}
 			} else {
-				err := mobybuild.ValidateFormats(buildFormats, cacheDir.String())
+				err := mobybuild.ValidateFormats(buildFormats, cacheDir.String(), builder)
 				if err != nil {
 					return fmt.Errorf("error parsing formats: %v", err)
 				}
@@ -118,8 +285,28 @@ The generated image can be in one of multiple formats which can be run on variou
 			if inputTar != "" && pull {
 				return fmt.Errorf("cannot use --input-tar and --pull together")
 			}
+			if docker && (manifestFile != "" || lockedFile != "") {
+				return fmt.Errorf("cannot use --docker with --manifest or --locked, as images in docker have no digest")
+			}
+			if docker && policyFile.String() != "" {
+				return fmt.Errorf("cannot use --docker with a signature policy, as images in docker have no digest")
+			}
 
-			var outfile *os.File
+			arches, err := parseArches(arch)
+			if err != nil {
+				return err
+			}
+			if len(arches) > 1 {
+				if outputFile == "-" {
+					return fmt.Errorf("cannot write the outputs for several architectures to stdout")
+				}
+				if inputTar != "" {
+					return fmt.Errorf("cannot use --input-tar when building for several architectures")
+				}
+			}
+			if ociIndex != "" && outputFile == "-" {
+				return fmt.Errorf("cannot use --oci-index when writing the output to stdout")
+			}
 			if outputFile != "" {
 				if len(buildFormats) > 1 {
 					return fmt.Errorf("the -output option can only be specified when generating a single output format")
@@ -133,16 +320,6 @@ The generated image can be in one of multiple formats which can be run on variou
 				if !mobybuild.Streamable(buildFormats[0]) {
 					return fmt.Errorf("the -output option cannot be specified for build type %s as it cannot be streamed", buildFormats[0])
 				}
-				if outputFile == "-" {
-					outfile = os.Stdout
-				} else {
-					var err error
-					outfile, err = os.Create(outputFile)
-					if err != nil {
-						log.Fatalf("cannot open output file: %v", err)
-					}
-					defer func() { _ = outfile.Close() }()
-				}
 			}
 
 			size, err := getDiskSizeMB(sizeString)
@@ -150,46 +327,16 @@ The generated image can be in one of multiple formats which can be run on variou
 				log.Fatalf("unable to parse disk size: %v", err)
 			}
 
-			var (
-				m                  moby.Moby
-				templatesSupported bool
-			)
+			templateValues, err := templateVars(varFiles, vars)
+			if err != nil {
+				return err
+			}
+
+			var m moby.Moby
 			for _, arg := range args {
-				var config []byte
-				if conf := arg; conf == "-" {
-					var err error
-					config, err = io.ReadAll(os.Stdin)
-					if err != nil {
-						return fmt.Errorf("cannot read stdin: %v", err)
-					}
-				} else if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
-					buffer := new(bytes.Buffer)
-					response, err := http.Get(arg)
-					if err != nil {
-						return fmt.Errorf("cannot fetch remote yaml file: %v", err)
-					}
-					defer func() { _ = response.Body.Close() }()
-					_, err = io.Copy(buffer, response.Body)
-					if err != nil {
-						return fmt.Errorf("error reading http body: %v", err)
-					}
-					config = buffer.Bytes()
-				} else {
-					var err error
-					config, err = os.ReadFile(conf)
-					if err != nil {
-						return fmt.Errorf("cannot open config file: %v", err)
-					}
-					// templates are only supported for local files
-					templatesSupported = true
-				}
-				var pkgFinder spec.PackageResolver
-				if templatesSupported {
-					pkgFinder = createPackageResolver(filepath.Dir(arg))
-				}
-				c, err := moby.NewConfig(config, pkgFinder)
+				c, err := loadConfig(arg, templateValues, map[string]bool{}, nil)
 				if err != nil {
-					return fmt.Errorf("invalid config: %v", err)
+					return err
 				}
 				m, err = moby.AppendConfig(m, c)
 				if err != nil {
@@ -206,51 +353,159 @@ The generated image can be in one of multiple formats which can be run on variou
 				return nil
 			}
 
-			var (
-				tf *os.File
-				w  io.Writer
-			)
-			if outfile != nil {
-				w = outfile
-			} else {
-				if tf, err = os.CreateTemp("", ""); err != nil {
-					log.Fatalf("error creating tempfile: %v", err)
-				}
-				defer func() { _ = os.Remove(tf.Name()) }()
-				w = tf
-			}
-			if inputTar != "" && inputTar == outputFile {
-				return fmt.Errorf("input-tar and output file cannot be the same")
+			secrets, err := secretIdentities(secretKeyFile.String())
+			if err != nil {
+				return err
 			}
 
-			// this is a weird interface, but currently only streamable types can have additional files
-			// need to split up the base tarball outputs from the secondary stages
-			var tp string
-			if mobybuild.Streamable(buildFormats[0]) {
-				tp = buildFormats[0]
-			}
-			var sbomGenerator *mobybuild.SbomGenerator
-			if !noSbom {
-				sbomGenerator, err = mobybuild.NewSbomGenerator(sbomOutputFilename, sbomCurrentTime)
+			if policyFile.String() != "" {
+				policy, err := signature.LoadPolicy(policyFile.String())
 				if err != nil {
-					return fmt.Errorf("error creating sbom generator: %v", err)
+					return err
 				}
+				log.Infof("Verify image signatures")
+				if err := mobybuild.VerifyImages(m, mobybuild.BuildOpts{Pull: pull, CacheDir: cacheDir.String()}, arches, policy); err != nil {
+					return err
+				}
+				// the images that were verified are in the cache, and pulling again could resolve to others
+				pull = false
 			}
-			err = mobybuild.Build(m, w, mobybuild.BuildOpts{Pull: pull, BuilderType: tp, DecompressKernel: decompressKernel, CacheDir: cacheDir.String(), DockerCache: docker, Arch: arch, SbomGenerator: sbomGenerator, InputTar: inputTar})
-			if err != nil {
-				return fmt.Errorf("%v", err)
+
+			if len(arches) > 1 {
+				log.Infof("Resolve images for %s", strings.Join(arches, ", "))
+				if err := mobybuild.ResolveIndexes(m, mobybuild.BuildOpts{Pull: pull, CacheDir: cacheDir.String()}, arches); err != nil {
+					return err
+				}
+				// everything is now in the cache, and pulling again could resolve to a different index
+				pull = false
 			}
 
-			if outfile == nil {
+			// the temporary image tars are kept until the OCI index has been written
+			var tmpFiles []string
+			defer func() {
+				for _, f := range tmpFiles {
+					_ = os.Remove(f)
+				}
+			}()
+
+			// buildArch builds the outputs for one architecture, and returns the path of the image tar
+			buildArch := func(arch string) (string, error) {
+				// with several architectures, every output has the architecture in its name
+				archName := func(s string) string {
+					if len(arches) == 1 || s == "" || s == "-" {
+						return s
+					}
+					return mobybuild.ArchName(s, arch)
+				}
+				if len(arches) > 1 {
+					log.Infof("Build for %s", arch)
+				}
+
+				pull := pull
+				if manifestFile != "" || lockedFile != "" {
+					log.Infof("Resolve image digests")
+					manifest, err := mobybuild.ResolveManifest(m, mobybuild.BuildOpts{Pull: pull, CacheDir: cacheDir.String(), Arch: arch})
+					if err != nil {
+						return "", err
+					}
+					if lockedFile != "" {
+						locked, err := mobybuild.ReadManifest(archName(lockedFile))
+						if err != nil {
+							return "", err
+						}
+						if err := manifest.Verify(locked); err != nil {
+							return "", err
+						}
+					}
+					if manifestFile != "" {
+						if err := manifest.Write(archName(manifestFile)); err != nil {
+							return "", fmt.Errorf("error writing manifest: %v", err)
+						}
+					}
+					// everything is now in the cache, and pulling again could resolve to different digests
+					pull = false
+				}
+
+				var (
+					tf *os.File
+					w  io.Writer
+				)
+				switch {
+				case outputFile == "-":
+					w = os.Stdout
+				case outputFile != "":
+					outfile, err := os.Create(archName(outputFile))
+					if err != nil {
+						log.Fatalf("cannot open output file: %v", err)
+					}
+					defer func() { _ = outfile.Close() }()
+					w = outfile
+				default:
+					if tf, err = os.CreateTemp("", ""); err != nil {
+						log.Fatalf("error creating tempfile: %v", err)
+					}
+					tmpFiles = append(tmpFiles, tf.Name())
+					w = tf
+				}
+				if inputTar != "" && inputTar == outputFile {
+					return "", fmt.Errorf("input-tar and output file cannot be the same")
+				}
+
+				// this is a weird interface, but currently only streamable types can have additional files
+				// need to split up the base tarball outputs from the secondary stages
+				var tp string
+				if mobybuild.Streamable(buildFormats[0]) {
+					tp = buildFormats[0]
+				}
+				var sbomGenerator *mobybuild.SbomGenerator
+				if !noSbom {
+					sbomOutput := sbomOutputFilename
+					if sbomFormat == mobybuild.SbomFormatCycloneDX && !cmd.Flags().Changed("sbom-output") {
+						sbomOutput = defaultCycloneDXSbomFilename
+					}
+					sbomGenerator, err = mobybuild.NewSbomGenerator(sbomOutput, sbomFormat, archName(sbomHostOutput), sbomCurrentTime)
+					if err != nil {
+						return "", fmt.Errorf("error creating sbom generator: %v", err)
+					}
+				}
+				err = mobybuild.Build(m, w, mobybuild.BuildOpts{Pull: pull, BuilderType: tp, DecompressKernel: decompressKernel, CacheDir: cacheDir.String(), DockerCache: docker, Arch: arch, SbomGenerator: sbomGenerator, InputTar: inputTar, Jobs: jobs, SecretIdentities: secrets, BuildCacheDir: buildCache})
+				if err != nil {
+					return "", fmt.Errorf("%v", err)
+				}
+
+				if tf == nil {
+					return archName(outputFile), nil
+				}
 				image := tf.Name()
 				if err := tf.Close(); err != nil {
-					return fmt.Errorf("error closing tempfile: %v", err)
+					return "", fmt.Errorf("error closing tempfile: %v", err)
 				}
 
 				log.Infof("Create outputs:")
-				err = mobybuild.Formats(filepath.Join(dir, name), image, buildFormats, size, arch, cacheDir.String())
+				base := name
+				if len(arches) > 1 {
+					base = name + "-" + arch
+				}
+				err = mobybuild.Formats(filepath.Join(dir, base), image, buildFormats, size, arch, cacheDir.String(), buildCache, builder)
+				if err != nil {
+					return "", fmt.Errorf("error writing outputs: %v", err)
+				}
+				return image, nil
+			}
+
+			var images []mobybuild.ArchImage
+			for _, arch := range arches {
+				image, err := buildArch(arch)
 				if err != nil {
-					return fmt.Errorf("error writing outputs: %v", err)
+					return err
+				}
+				images = append(images, mobybuild.ArchImage{Arch: arch, Path: image})
+			}
+
+			if ociIndex != "" {
+				log.Infof("Write OCI index %s", ociIndex)
+				if err := mobybuild.WriteOCIIndex(ociIndex, images); err != nil {
+					return err
 				}
 			}
 			return nil
@@ -264,7 +519,8 @@ The generated image can be in one of multiple formats which can be run on variou
 	cmd.Flags().BoolVar(&pull, "pull", false, "Always pull images")
 	cmd.Flags().BoolVar(&docker, "docker", false, "Check for images in docker before linuxkit cache")
 	cmd.Flags().BoolVar(&decompressKernel, "decompress-kernel", false, "Decompress the Linux kernel (default false)")
-	cmd.Flags().StringVar(&arch, "arch", runtime.GOARCH, "target architecture for which to build")
+	cmd.Flags().StringVar(&arch, "arch", runtime.GOARCH, "target architecture for which to build, or a comma separated list of architectures, each of whose outputs has the architecture added to its name")
+	cmd.Flags().StringVar(&ociIndex, "oci-index", "", "File to write an OCI image layout tar to, with an index of an image for each architecture built, whose only layer is its tar output")
 	cmd.Flags().VarP(&buildFormats, "format", "f", "Formats to create [ "+strings.Join(outputTypes, " ")+" ]")
 	cmd.Flags().StringVar(&inputTar, "input-tar", "", "path to tar from previous linuxkit build to use as input; if provided, will take files from images from this tar, using OCI images only to replace or update files. Always copies to a temporary working directory to avoid overwriting. Only works if input-tar file has the linuxkit.yaml used to build it in the exact same location. Incompatible with --pull")
 	cacheDir = flagOverEnvVarOverDefaultString{def: defaultLinuxkitCache(), envVar: envVarCacheDir}
@@ -272,7 +528,20 @@ The generated image can be in one of multiple formats which can be run on variou
 	cmd.Flags().BoolVar(&noSbom, "no-sbom", false, "suppress consolidation of sboms on input container images to a single sbom and saving in the output filesystem")
 	cmd.Flags().BoolVar(&sbomCurrentTime, "sbom-current-time", false, "whether to use the current time as the build time in the sbom; this will make the build non-reproducible (default false)")
 	cmd.Flags().StringVar(&sbomOutputFilename, "sbom-output", defaultSbomFilename, "filename to save the output to in the root filesystem")
+	cmd.Flags().StringVar(&sbomFormat, "sbom-format", mobybuild.SbomFormatSPDX, "format of the sbom, spdx or cyclonedx; the default filename for cyclonedx is "+defaultCycloneDXSbomFilename)
+	cmd.Flags().StringVar(&sbomHostOutput, "sbom-host-output", "", "file to also save the sbom to on the host, next to the build output")
 	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Do not actually build, just print the final yml file that would be used, including all merges and templates")
+	cmd.Flags().StringArrayVar(&vars, "var", nil, "Variable to substitute into the yml files, in the form name=value, referenced as {{ .name }}; can be provided multiple times and overrides --var-file")
+	cmd.Flags().StringArrayVar(&varFiles, "var-file", nil, "yaml file containing a map of variables to substitute into the yml files; can be provided multiple times, later files override earlier ones")
+	cmd.Flags().StringVar(&manifestFile, "manifest", "", "File to write a manifest of the digests of every image and file source used in the build to")
+	cmd.Flags().StringVar(&lockedFile, "locked", "", "Manifest written by a previous build with --manifest; fail unless every image and file source resolves to the same digest")
+	cmd.Flags().IntVar(&jobs, "jobs", 1, "Number of images to pull and extract concurrently; the output is the same whatever the number")
+	cmd.Flags().StringVar(&buildCache, "build-cache", "", "Directory for an incremental build cache; sections of the image and output formats whose inputs have not changed since a previous build are reused from it")
+	secretKeyFile = flagOverEnvVarOverDefaultString{envVar: envVarSecretKeyFile}
+	cmd.Flags().Var(&secretKeyFile, "secret-key-file", fmt.Sprintf("File with the age keys to decrypt the secrets in the files section with, overrides env var %s; keys can also be provided in env var %s", envVarSecretKeyFile, envVarSecretKey))
+	policyFile = flagOverEnvVarOverDefaultString{envVar: envVarSignaturePolicy}
+	cmd.Flags().Var(&policyFile, "policy", fmt.Sprintf("Signature policy file; fail unless every image is signed as it requires, overrides env var %s", envVarSignaturePolicy))
+	cmd.Flags().StringVar(&builder, "builder", mobybuild.BuilderDocker, "How to write output formats: docker runs the mkimage containers, native writes them without docker, where supported")
 
 	return cmd
 }
@@ -2,11 +2,13 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"path"
 	"strings"
 
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/pkglib"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/spec"
+	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -45,3 +47,33 @@ func createPackageResolver(baseDir string) spec.PackageResolver {
 		return pkgValue, nil
 	}
 }
+
+// templateVars builds the variables used to render yaml templates. Variables are read from each of
+// the varFiles in order, which are yaml maps of name to value, and then from vars, each of which is
+// name=value. Later values override earlier ones, so values on the command-line win. It never returns
+// nil, even without any varFiles or vars, so configs are always rendered, and defaults and undefined
+// variables are handled the same whether or not any variable is given.
+func templateVars(varFiles, vars []string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, f := range varFiles {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read var file %s: %v", f, err)
+		}
+		var fileValues map[string]string
+		if err := yaml.Unmarshal(b, &fileValues); err != nil {
+			return nil, fmt.Errorf("invalid var file %s: %v", f, err)
+		}
+		for k, v := range fileValues {
+			values[k] = v
+		}
+	}
+	for _, v := range vars {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid var %q, must be of the form name=value", v)
+		}
+		values[parts[0]] = parts[1]
+	}
+	return values, nil
+}
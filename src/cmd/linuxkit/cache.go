@@ -26,6 +26,8 @@ func cacheCmd() *cobra.Command {
 	cmd.AddCommand(cacheLsCmd())
 	cmd.AddCommand(cacheExportCmd())
 	cmd.AddCommand(cacheImportCmd())
+	cmd.AddCommand(cacheExportBundleCmd())
+	cmd.AddCommand(cacheImportBundleCmd())
 	cmd.AddCommand(cachePullCmd())
 	cmd.AddCommand(cachePushCmd())
 	return cmd
@@ -0,0 +1,184 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// A LinuxKit image, that is the outputs of linuxkit build, can be stored as an OCI artifact,
+// with a layer for each file, so it can be distributed through a registry
+const (
+	// ArtifactTypeImage is the artifact type of a LinuxKit image
+	ArtifactTypeImage = "application/vnd.linuxkit.image.v1"
+	// MediaTypeKernel is the media type of the kernel of a LinuxKit image
+	MediaTypeKernel = "application/vnd.linuxkit.kernel.v1"
+	// MediaTypeInitrd is the media type of the initrd of a LinuxKit image
+	MediaTypeInitrd = "application/vnd.linuxkit.initrd.v1"
+	// MediaTypeCmdline is the media type of the kernel command line of a LinuxKit image
+	MediaTypeCmdline = "application/vnd.linuxkit.cmdline.v1"
+	// MediaTypeDisk is the media type of a disk image or other output format of a LinuxKit image
+	MediaTypeDisk = "application/vnd.linuxkit.disk.v1"
+
+	// AnnotationArch is the architecture a LinuxKit image was built for
+	AnnotationArch = "org.linuxkit.arch"
+	// AnnotationFormats is the comma separated list of the formats in a LinuxKit image
+	AnnotationFormats = "org.linuxkit.formats"
+	// AnnotationFormat is the format that a file of a LinuxKit image is the output of
+	AnnotationFormat = "org.linuxkit.format"
+	// AnnotationSourceDigest is the digest of the yaml a LinuxKit image was built from
+	AnnotationSourceDigest = "org.linuxkit.source.digest"
+)
+
+// ArtifactFile is a file in an artifact, where Name is the name it has in the artifact, and
+// Path is where it is on disk
+type ArtifactFile struct {
+	Name        string
+	Path        string
+	MediaType   string
+	Annotations map[string]string
+}
+
+// ArtifactWrite writes files to the cache as an OCI artifact of artifactType for platform, with the
+// annotations on its manifest, and returns the descriptor of the manifest, which can then be added to
+// an index with IndexWrite
+func (p *Provider) ArtifactWrite(artifactType string, files []ArtifactFile, platform v1.Platform, annotations map[string]string) (v1.Descriptor, error) {
+	manifest := imagespec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    imagespec.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       imagespec.DescriptorEmptyJSON,
+		Layers:       []imagespec.Descriptor{},
+		Annotations:  annotations,
+	}
+	if err := p.writeBlob(imagespec.DescriptorEmptyJSON.Data); err != nil {
+		return v1.Descriptor{}, err
+	}
+	for _, file := range files {
+		f, err := os.Open(file.Path)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+		h := sha256.New()
+		size, err := io.Copy(h, f)
+		_ = f.Close()
+		if err != nil {
+			return v1.Descriptor{}, fmt.Errorf("cannot read %s: %v", file.Path, err)
+		}
+		hash := v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", h.Sum(nil))}
+		f, err = os.Open(file.Path)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+		if err := p.cache.WriteBlob(hash, f); err != nil {
+			return v1.Descriptor{}, fmt.Errorf("unable to write %s to cache: %v", file.Path, err)
+		}
+		layerAnnotations := map[string]string{imagespec.AnnotationTitle: file.Name}
+		for k, v := range file.Annotations {
+			layerAnnotations[k] = v
+		}
+		manifest.Layers = append(manifest.Layers, imagespec.Descriptor{
+			MediaType:   file.MediaType,
+			Digest:      digest.Digest(hash.String()),
+			Size:        size,
+			Annotations: layerAnnotations,
+		})
+	}
+
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	if err := p.writeBlob(b); err != nil {
+		return v1.Descriptor{}, err
+	}
+	hash, _, err := v1.SHA256(bytes.NewReader(b))
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return v1.Descriptor{
+		MediaType:    types.OCIManifestSchema1,
+		ArtifactType: artifactType,
+		Size:         int64(len(b)),
+		Digest:       hash,
+		Platform:     &platform,
+	}, nil
+}
+
+func (p *Provider) writeBlob(b []byte) error {
+	hash, _, err := v1.SHA256(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	return p.cache.WriteBlob(hash, io.NopCloser(bytes.NewReader(b)))
+}
+
+// ArtifactExtract writes the files of the artifact ref for platform, which must already be in
+// the cache, to dir, each named by its name in the artifact, and returns them
+func (p *Provider) ArtifactExtract(ref *reference.Spec, platform imagespec.Platform, dir string) ([]ArtifactFile, error) {
+	img, err := p.findImage(util.ReferenceExpand(ref.String()), platform)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := img.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	var manifest imagespec.Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest for %s: %v", ref, err)
+	}
+	if manifest.ArtifactType != ArtifactTypeImage {
+		return nil, fmt.Errorf("%s is not a LinuxKit image, but has artifact type %q", ref, manifest.ArtifactType)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var files []ArtifactFile
+	for _, layer := range manifest.Layers {
+		name := layer.Annotations[imagespec.AnnotationTitle]
+		if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+			return nil, fmt.Errorf("invalid file name %q in %s", name, ref)
+		}
+		hash, err := v1.NewHash(layer.Digest.String())
+		if err != nil {
+			return nil, err
+		}
+		l, err := img.LayerByDigest(hash)
+		if err != nil {
+			return nil, err
+		}
+		blob, err := l.Compressed()
+		if err != nil {
+			return nil, err
+		}
+		file := ArtifactFile{Name: name, Path: filepath.Join(dir, name), MediaType: layer.MediaType, Annotations: layer.Annotations}
+		f, err := os.Create(file.Path)
+		if err != nil {
+			_ = blob.Close()
+			return nil, err
+		}
+		_, err = io.Copy(f, blob)
+		_ = blob.Close()
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot extract %s from %s: %v", name, ref, err)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
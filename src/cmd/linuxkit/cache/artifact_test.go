@@ -0,0 +1,44 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactWriteExtract(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewProvider(filepath.Join(dir, "cache"))
+	require.NoError(t, err)
+
+	var descs []v1.Descriptor
+	for _, arch := range []string{"amd64", "arm64"} {
+		var files []ArtifactFile
+		for name, mediaType := range map[string]string{"linuxkit-kernel": MediaTypeKernel, "linuxkit-cmdline": MediaTypeCmdline} {
+			path := filepath.Join(dir, arch+name)
+			require.NoError(t, os.WriteFile(path, []byte(name+" for "+arch), 0644))
+			files = append(files, ArtifactFile{Name: name, Path: path, MediaType: mediaType})
+		}
+		desc, err := p.ArtifactWrite(ArtifactTypeImage, files, v1.Platform{OS: "linux", Architecture: arch}, map[string]string{AnnotationArch: arch})
+		require.NoError(t, err)
+		descs = append(descs, desc)
+	}
+	ref, err := reference.Parse("docker.io/linuxkit/test:artifact")
+	require.NoError(t, err)
+	require.NoError(t, p.IndexWrite(&ref, descs...))
+
+	out := filepath.Join(dir, "out")
+	files, err := p.ArtifactExtract(&ref, imagespec.Platform{OS: "linux", Architecture: "arm64"}, out)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	for _, f := range files {
+		b, err := os.ReadFile(filepath.Join(out, f.Name))
+		require.NoError(t, err)
+		require.Equal(t, f.Name+" for arm64", string(b))
+	}
+}
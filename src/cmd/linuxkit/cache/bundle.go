@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/pkg/reference"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+)
+
+// AnnotationBundleDocker marks an image in the index.json of a bundle that the docker builder runs with
+// docker, so that it is loaded into docker as well as the cache when the bundle is imported.
+const AnnotationBundleDocker = "org.linuxkit.bundle.docker"
+
+// BundleWriter writes images from the cache to a single tar whose contents match the OCI v1 layout
+// spec, with an entry in index.json named for each image, so that ImageLoad reads all of them back
+// into another cache.
+type BundleWriter struct {
+	p         *Provider
+	tw        *tar.Writer
+	blobs     *layoutBlobs
+	manifests []v1.Descriptor
+}
+
+// NewBundleWriter returns a BundleWriter that writes to w. Close must be called to finish the bundle.
+func (p *Provider) NewBundleWriter(w io.Writer) (*BundleWriter, error) {
+	tw := tar.NewWriter(w)
+	if err := writeLayoutHeader(tw); err != nil {
+		return nil, err
+	}
+	return &BundleWriter{p: p, tw: tw, blobs: newLayoutBlobs(tw)}, nil
+}
+
+// Add adds the image or index ref, which must already be in the cache, to the bundle. Of an index, only
+// the images for platforms, or all of them if there are none, and their attestations, are added. The
+// index itself is unchanged, so that it keeps its digest, and in another cache is the same partial
+// index as the cache has after pulling for those platforms.
+func (b *BundleWriter) Add(ref *reference.Spec, platforms []imagespec.Platform) error {
+	return b.add(ref, platforms, map[string]string{})
+}
+
+// AddDocker adds the image or index ref to the bundle like Add, marked with AnnotationBundleDocker so that
+// it is also loaded into docker on import.
+func (b *BundleWriter) AddDocker(ref *reference.Spec, platforms []imagespec.Platform) error {
+	return b.add(ref, platforms, map[string]string{AnnotationBundleDocker: "true"})
+}
+
+func (b *BundleWriter) add(ref *reference.Spec, platforms []imagespec.Platform, annotations map[string]string) error {
+	name := util.ReferenceExpand(ref.String())
+	canonicalRef, err := reference.Parse(name)
+	if err != nil {
+		return fmt.Errorf("invalid image name %s: %v", name, err)
+	}
+	desc, err := b.p.FindDescriptor(&canonicalRef)
+	if err != nil {
+		return err
+	}
+	if desc == nil {
+		return fmt.Errorf("image %s is not in the cache", name)
+	}
+	root, err := b.p.FindRoot(name)
+	if err != nil {
+		return err
+	}
+	img, err1 := root.Image()
+	ii, err2 := root.ImageIndex()
+	switch {
+	case err1 == nil:
+		err = b.blobs.image(img)
+	case err2 == nil:
+		err = b.addIndex(name, ii, platforms)
+	default:
+		err = fmt.Errorf("%s is neither an image nor an index", name)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to add %s to bundle: %v", name, err)
+	}
+	annotations[images.AnnotationImageName] = name
+	b.manifests = append(b.manifests, v1.Descriptor{
+		MediaType:   desc.MediaType,
+		Size:        desc.Size,
+		Digest:      desc.Digest,
+		Annotations: annotations,
+	})
+	return nil
+}
+
+func (b *BundleWriter) addIndex(name string, ii v1.ImageIndex, platforms []imagespec.Platform) error {
+	im, err := ii.IndexManifest()
+	if err != nil {
+		return err
+	}
+	added := map[string]bool{}
+	for _, m := range im.Manifests {
+		if m.Platform == nil || (m.Platform.Architecture == unknown && m.Platform.OS == unknown) {
+			continue
+		}
+		if !bundlePlatform(*m.Platform, platforms) {
+			continue
+		}
+		if err := validateManifestContents(ii, m.Digest); err != nil {
+			return fmt.Errorf("image for %s is not in the cache: %v", m.Platform, err)
+		}
+		img, err := ii.Image(m.Digest)
+		if err != nil {
+			return err
+		}
+		if err := b.blobs.image(img); err != nil {
+			return err
+		}
+		added[m.Digest.String()] = true
+	}
+	// the attestations, such as sboms, of the images that were added
+	for _, m := range im.Manifests {
+		if m.Annotations[util.AnnotationDockerReferenceType] != util.AnnotationAttestationManifest || !added[m.Annotations[util.AnnotationDockerReferenceDigest]] {
+			continue
+		}
+		if err := validateManifestContents(ii, m.Digest); err != nil {
+			log.Debugf("skipping attestation %s of %s that is not in the cache: %v", m.Digest, name, err)
+			continue
+		}
+		img, err := ii.Image(m.Digest)
+		if err != nil {
+			return err
+		}
+		if err := b.blobs.image(img); err != nil {
+			return err
+		}
+	}
+	raw, err := ii.RawManifest()
+	if err != nil {
+		return err
+	}
+	digest, err := ii.Digest()
+	if err != nil {
+		return err
+	}
+	return b.blobs.raw(digest, raw)
+}
+
+// bundlePlatform returns true if p is one of platforms, or there are none
+func bundlePlatform(p v1.Platform, platforms []imagespec.Platform) bool {
+	if len(platforms) == 0 {
+		return true
+	}
+	for _, plat := range platforms {
+		if plat.Architecture == p.Architecture && plat.OS == p.OS && (plat.Variant == "" || plat.Variant == p.Variant) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close writes index.json, with an entry for each image added, and finishes the tar
+func (b *BundleWriter) Close() error {
+	if err := writeLayoutIndex(b.tw, b.manifests...); err != nil {
+		return err
+	}
+	return b.tw.Close()
+}
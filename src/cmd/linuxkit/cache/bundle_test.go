@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBundleWriteLoad(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewProvider(filepath.Join(dir, "cache"))
+	require.NoError(t, err)
+
+	var index v1.ImageIndex = empty.Index
+	digests := map[string]v1.Hash{}
+	for _, arch := range []string{"amd64", "arm64"} {
+		img, err := random.Image(1024, 2)
+		require.NoError(t, err)
+		digests[arch], err = img.Digest()
+		require.NoError(t, err)
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: arch}}})
+	}
+	require.NoError(t, p.cache.WriteIndex(index))
+	desc, err := partial.Descriptor(index)
+	require.NoError(t, err)
+	require.NoError(t, p.DescriptorWrite("docker.io/linuxkit/test:bundle", *desc))
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	require.NoError(t, p.cache.WriteImage(img))
+	imgDesc, err := partial.Descriptor(img)
+	require.NoError(t, err)
+	require.NoError(t, p.DescriptorWrite("docker.io/linuxkit/single:bundle", *imgDesc))
+
+	var buf bytes.Buffer
+	bw, err := p.NewBundleWriter(&buf)
+	require.NoError(t, err)
+	ref, err := reference.Parse("linuxkit/test:bundle")
+	require.NoError(t, err)
+	require.NoError(t, bw.Add(&ref, []imagespec.Platform{{OS: "linux", Architecture: "arm64"}}))
+	single, err := reference.Parse("docker.io/linuxkit/single:bundle")
+	require.NoError(t, err)
+	require.NoError(t, bw.AddDocker(&single, nil))
+	missing, err := reference.Parse("docker.io/linuxkit/missing:bundle")
+	require.NoError(t, err)
+	require.Error(t, bw.Add(&missing, nil))
+	require.NoError(t, bw.Close())
+
+	other, err := NewProvider(filepath.Join(dir, "other"))
+	require.NoError(t, err)
+	descs, err := other.ImageLoad(&buf)
+	require.NoError(t, err)
+	require.Len(t, descs, 2)
+	// only the image added for docker is marked to be loaded into docker
+	require.Empty(t, descs[0].Annotations[AnnotationBundleDocker])
+	require.Equal(t, "true", descs[1].Annotations[AnnotationBundleDocker])
+
+	// the index keeps its digest, with only the image for arm64
+	canonical, err := reference.Parse("docker.io/linuxkit/test:bundle")
+	require.NoError(t, err)
+	found, err := other.FindDescriptor(&canonical)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	require.Equal(t, desc.Digest, found.Digest)
+	root, err := other.FindRoot(canonical.String())
+	require.NoError(t, err)
+	ii, err := root.ImageIndex()
+	require.NoError(t, err)
+	require.NoError(t, validateManifestContents(ii, digests["arm64"]))
+	require.Error(t, validateManifestContents(ii, digests["amd64"]))
+
+	found, err = other.FindDescriptor(&single)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	require.Equal(t, imgDesc.Digest, found.Digest)
+}
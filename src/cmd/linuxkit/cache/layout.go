@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"io"
 
+	"github.com/containerd/containerd/v2/core/images"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
 )
 
 func writeLayoutHeader(tw *tar.Writer) error {
@@ -116,7 +118,7 @@ func writeLayoutBlob(tw *tar.Writer, digest string, size int64, blob io.Reader)
 	return nil
 }
 
-func writeLayoutIndex(tw *tar.Writer, desc v1.Descriptor) error {
+func writeLayoutIndex(tw *tar.Writer, descs ...v1.Descriptor) error {
 	ii := empty.Index
 
 	index, err := ii.IndexManifest()
@@ -124,7 +126,7 @@ func writeLayoutIndex(tw *tar.Writer, desc v1.Descriptor) error {
 		return err
 	}
 
-	index.Manifests = append(index.Manifests, desc)
+	index.Manifests = append(index.Manifests, descs...)
 
 	rawIndex, err := json.MarshalIndent(index, "", "   ")
 	if err != nil {
@@ -143,3 +145,134 @@ func writeLayoutIndex(tw *tar.Writer, desc v1.Descriptor) error {
 	}
 	return nil
 }
+
+// layoutBlobs writes blobs to a tar of an OCI v1 layout, each only once, as images can share blobs,
+// such as identical layers
+type layoutBlobs struct {
+	tw      *tar.Writer
+	written map[v1.Hash]bool
+}
+
+func newLayoutBlobs(tw *tar.Writer) *layoutBlobs {
+	return &layoutBlobs{tw: tw, written: map[v1.Hash]bool{}}
+}
+
+func (l *layoutBlobs) blob(digest v1.Hash, size int64, open func() (io.ReadCloser, error)) error {
+	if l.written[digest] {
+		return nil
+	}
+	l.written[digest] = true
+	blob, err := open()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = blob.Close() }()
+	return writeLayoutBlob(l.tw, digest.Hex, size, blob)
+}
+
+func (l *layoutBlobs) raw(digest v1.Hash, b []byte) error {
+	return l.blob(digest, int64(len(b)), func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	})
+}
+
+// image writes the config, layers and manifest of an image
+func (l *layoutBlobs) image(image v1.Image) error {
+	manifest, err := image.Manifest()
+	if err != nil {
+		return err
+	}
+	config, err := image.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	if err := l.raw(manifest.Config.Digest, config); err != nil {
+		return err
+	}
+	for _, layer := range manifest.Layers {
+		blob, err := image.LayerByDigest(layer.Digest)
+		if err != nil {
+			return err
+		}
+		if err := l.blob(layer.Digest, layer.Size, blob.Compressed); err != nil {
+			return err
+		}
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		return err
+	}
+	raw, err := image.RawManifest()
+	if err != nil {
+		return err
+	}
+	return l.raw(digest, raw)
+}
+
+// WriteIndexLayout writes an index, and every image in it, to w as a tarball whose contents match
+// the OCI v1 layout spec, with the index as the only entry in index.json. Blobs shared by several
+// images, such as identical layers, are only written once.
+func WriteIndexLayout(w io.Writer, index v1.ImageIndex) error {
+	tw := tar.NewWriter(w)
+	if err := writeLayoutHeader(tw); err != nil {
+		return err
+	}
+	manifests, err := index.IndexManifest()
+	if err != nil {
+		return err
+	}
+	blobs := newLayoutBlobs(tw)
+	for _, desc := range manifests.Manifests {
+		image, err := index.Image(desc.Digest)
+		if err != nil {
+			return err
+		}
+		if err := blobs.image(image); err != nil {
+			return err
+		}
+	}
+	indexSize, err := index.Size()
+	if err != nil {
+		return err
+	}
+	indexDigest, err := index.Digest()
+	if err != nil {
+		return err
+	}
+	indexBytes, err := index.RawManifest()
+	if err != nil {
+		return err
+	}
+	if err := blobs.raw(indexDigest, indexBytes); err != nil {
+		return err
+	}
+	mediaType, err := index.MediaType()
+	if err != nil {
+		return err
+	}
+	if err := writeLayoutIndex(tw, v1.Descriptor{MediaType: mediaType, Size: indexSize, Digest: indexDigest}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// WriteImageLayout writes a single image to w as a tarball whose contents match the OCI v1 layout spec,
+// with the image named name in index.json, so that ImageLoad stores it under that name.
+func WriteImageLayout(w io.Writer, name string, image v1.Image) error {
+	tw := tar.NewWriter(w)
+	if err := writeLayoutHeader(tw); err != nil {
+		return err
+	}
+	if err := writeLayoutImage(tw, image); err != nil {
+		return err
+	}
+	desc, err := partial.Descriptor(image)
+	if err != nil {
+		return err
+	}
+	desc.Annotations = map[string]string{images.AnnotationImageName: name}
+	if err := writeLayoutIndex(tw, *desc); err != nil {
+		return err
+	}
+	return tw.Close()
+}
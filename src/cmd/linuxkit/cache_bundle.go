@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/pkg/reference"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	cachepkg "github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/docker"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	mobybuild "github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby/build"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func cacheExportBundleCmd() *cobra.Command {
+	var (
+		outputFile   string
+		arch         string
+		buildFormats formatList
+		builder      string
+		pull         bool
+		vars         []string
+		varFiles     []string
+	)
+	cmd := &cobra.Command{
+		Use:   "export-bundle",
+		Short: "export every image a yaml configuration needs from the linuxkit cache to a single file",
+		Long: `Export every image that building a yaml configuration needs to a single OCI v1 layout tar,
+		which 'linuxkit cache import-bundle' loads into the cache of another host, so that it can build
+		the configuration without access to a registry.
+
+		These are the images in the configuration, and those used to write the requested formats,
+		for each of the requested architectures. Images that are not in the cache are pulled.
+		`,
+		Example: `  linuxkit cache export-bundle -o bundle.tar --arch amd64,arm64 --format raw-efi linuxkit.yml`,
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if outputFile == "" {
+				return fmt.Errorf("the -o option is required")
+			}
+			arches, err := parseArches(arch)
+			if err != nil {
+				return err
+			}
+			templateValues, err := templateVars(varFiles, vars)
+			if err != nil {
+				return err
+			}
+			var m moby.Moby
+			for _, arg := range args {
+				c, err := loadConfig(arg, templateValues, map[string]bool{}, nil)
+				if err != nil {
+					return err
+				}
+				m, err = moby.AppendConfig(m, c)
+				if err != nil {
+					return fmt.Errorf("cannot append config files: %v", err)
+				}
+			}
+
+			var (
+				w io.Writer = os.Stdout
+				f *os.File
+			)
+			if outputFile != "-" {
+				if f, err = os.Create(outputFile); err != nil {
+					return fmt.Errorf("unable to open %s: %v", outputFile, err)
+				}
+				defer func() { _ = f.Close() }()
+				w = f
+			}
+			log.Infof("Export images for %s", strings.Join(arches, ", "))
+			if err := mobybuild.WriteBundle(w, m, buildFormats, builder, arches, mobybuild.BuildOpts{Pull: pull, CacheDir: cacheDir}); err != nil {
+				if f != nil {
+					// do not leave an incomplete bundle behind
+					_ = os.Remove(outputFile)
+				}
+				return fmt.Errorf("error writing bundle: %v", err)
+			}
+			if f != nil {
+				return f.Close()
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&outputFile, "output", "o", "", "File to write the bundle to, or '-' for stdout")
+	cmd.Flags().StringVar(&arch, "arch", runtime.GOARCH, "target architecture for which to export images, or a comma separated list of architectures")
+	cmd.Flags().VarP(&buildFormats, "format", "f", "Formats the build will create, to also export the images used to write them [ "+strings.Join(mobybuild.OutputTypes(), " ")+" ]")
+	cmd.Flags().StringVar(&builder, "builder", mobybuild.BuilderDocker, "How the build will write output formats, which determines the images used to write them: docker or native")
+	cmd.Flags().BoolVar(&pull, "pull", false, "Always pull images, even if they are in the cache")
+	cmd.Flags().StringArrayVar(&vars, "var", nil, "Variable to substitute into the yml files, in the form name=value, referenced as {{ .name }}; can be provided multiple times and overrides --var-file")
+	cmd.Flags().StringArrayVar(&varFiles, "var-file", nil, "yaml file containing a map of variables to substitute into the yml files; can be provided multiple times, later files override earlier ones")
+
+	return cmd
+}
+
+func cacheImportBundleCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import-bundle",
+		Short: "import a bundle written by export-bundle to the linuxkit cache",
+		Long: `Import every image in a bundle written by 'linuxkit cache export-bundle' to the linuxkit cache.
+		The images that the docker builder runs with docker, to write output formats, are also loaded into
+		docker, for the architecture of this host.
+		Can provide the file on the command-line or via stdin with filename '-'.
+		`,
+		Example: `  linuxkit cache import-bundle bundle.tar`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			infile := args[0]
+
+			p, err := cachepkg.NewProvider(cacheDir)
+			if err != nil {
+				return fmt.Errorf("unable to read a local cache: %v", err)
+			}
+
+			var reader io.Reader
+			if infile == "-" {
+				reader = os.Stdin
+			} else {
+				f, err := os.Open(infile)
+				if err != nil {
+					return fmt.Errorf("unable to open %s: %v", infile, err)
+				}
+				defer func() { _ = f.Close() }()
+				reader = f
+			}
+
+			descs, err := p.ImageLoad(reader)
+			if err != nil {
+				return fmt.Errorf("unable to load bundle: %v", err)
+			}
+			for _, desc := range descs {
+				name := desc.Annotations[images.AnnotationImageName]
+				log.Infof("Imported %s", name)
+				if desc.Annotations[cachepkg.AnnotationBundleDocker] == "" {
+					continue
+				}
+				if err := dockerLoadFromCache(p, name, desc); err != nil {
+					return fmt.Errorf("unable to load %s into docker: %v", name, err)
+				}
+				log.Infof("Loaded %s into docker", name)
+			}
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+// dockerLoadFromCache loads the image name, which is in the cache with desc, into docker for the
+// architecture of this host, which is what the docker builder runs
+func dockerLoadFromCache(p *cachepkg.Provider, name string, desc v1.Descriptor) error {
+	ref, err := reference.Parse(name)
+	if err != nil {
+		return fmt.Errorf("invalid image name %s: %v", name, err)
+	}
+	src := p.NewSource(&ref, &imagespec.Platform{OS: "linux", Architecture: runtime.GOARCH}, &desc)
+	r, err := src.V1TarReader(name)
+	if err != nil {
+		return fmt.Errorf("no image for linux/%s, export the bundle with --arch %s: %v", runtime.GOARCH, runtime.GOARCH, err)
+	}
+	defer func() { _ = r.Close() }()
+	return docker.Load(r)
+}
@@ -1,22 +1,42 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	"github.com/google/go-containerregistry/pkg/authn"
+	namepkg "github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	cachepkg "github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/registry"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/signature"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 func cachePullCmd() *cobra.Command {
+	var policyFile flagOverEnvVarOverDefaultString
 	cmd := &cobra.Command{
 		Use:   "pull",
 		Short: "pull images to the linuxkit cache from registry",
 		Long: `Pull named images from their registry to the linuxkit cache. Can provide short name, like linuxkit/kernel:6.6.13
 		or nginx, or canonical name, like docker.io/library/nginx:latest. Will be saved into cache as canonical.
-		Will replace in cache if found. Blobs with the same content are not replaced.`,
+		Will replace in cache if found. Blobs with the same content are not replaced.
+		With a signature policy, images that are not signed as it requires are not pulled.`,
 		Args: cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			var policy *signature.Policy
+			if policyFile.String() != "" {
+				var err error
+				if policy, err = signature.LoadPolicy(policyFile.String()); err != nil {
+					return err
+				}
+			}
 			names := args
+			var failed []string
 			for _, name := range names {
 				fullname := util.ReferenceExpand(name, util.ReferenceWithTag())
 
@@ -25,13 +45,68 @@ func cachePullCmd() *cobra.Command {
 					log.Fatalf("unable to read a local cache: %v", err)
 				}
 
+				var verified v1.Hash
+				if policy != nil {
+					ref, err := namepkg.ParseReference(fullname)
+					if err != nil {
+						return err
+					}
+					desc, err := registry.GetRemote().Head(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+					if err != nil {
+						return fmt.Errorf("error getting manifest for %s: %v", name, err)
+					}
+					if err := policy.Verify(fullname, desc.Digest); err != nil {
+						failed = append(failed, fmt.Sprintf("  %s: %v", fullname, err))
+						continue
+					}
+					verified = desc.Digest
+				}
+
 				if err := p.Pull(fullname, true); err != nil {
 					log.Fatalf("unable to push image named %s: %v", name, err)
 				}
+
+				if policy != nil {
+					// the tag may have moved since it was checked, so verify what was pulled, as a build does
+					if err := verifyPulled(p, policy, fullname, verified); err != nil {
+						failed = append(failed, fmt.Sprintf("  %s: %v", fullname, err))
+					}
+				}
+			}
+			if len(failed) > 0 {
+				return fmt.Errorf("%d images do not satisfy the signature policy:\n%s", len(failed), strings.Join(failed, "\n"))
 			}
 			return nil
 		},
 	}
+	policyFile = flagOverEnvVarOverDefaultString{envVar: envVarSignaturePolicy}
+	cmd.Flags().Var(&policyFile, "policy", fmt.Sprintf("Signature policy file; images not signed as it requires are not pulled, overrides env var %s", envVarSignaturePolicy))
 
 	return cmd
 }
+
+// verifyPulled verifies the signature of the image pulled to the cache as fullname, unless it is the
+// verified digest, and removes it from the cache if it does not satisfy the policy
+func verifyPulled(p *cachepkg.Provider, policy *signature.Policy, fullname string, verified v1.Hash) error {
+	ref, err := reference.Parse(fullname)
+	if err != nil {
+		return err
+	}
+	desc, err := p.FindDescriptor(&ref)
+	if err != nil {
+		return err
+	}
+	if desc == nil {
+		return fmt.Errorf("not found in the cache after pulling")
+	}
+	if desc.Digest == verified {
+		return nil
+	}
+	if err := policy.Verify(fullname, desc.Digest); err != nil {
+		if rerr := p.Remove(fullname); rerr != nil {
+			log.Warnf("unable to remove %s from the cache: %v", fullname, rerr)
+		}
+		return err
+	}
+	return nil
+}
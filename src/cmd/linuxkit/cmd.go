@@ -113,6 +113,8 @@ func newCmd() *cobra.Command {
 
 	cmd.AddCommand(buildCmd()) // apko login
 	cmd.AddCommand(cacheCmd())
+	cmd.AddCommand(diffCmd())
+	cmd.AddCommand(lintCmd())
 	cmd.AddCommand(metadataCmd())
 	cmd.AddCommand(pkgCmd())
 	cmd.AddCommand(pushCmd())
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	mobybuild "github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby/build"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func diffCmd() *cobra.Command {
+	var (
+		arch     string
+		cacheDir flagOverEnvVarOverDefaultString
+		pull     bool
+		format   string
+		noFiles  bool
+		vars     []string
+		varFiles []string
+	)
+	cmd := &cobra.Command{
+		Use:   "diff",
+		Short: "Show what changed between two images",
+		Long: `Show what changed between two images.
+
+Each image can be a yaml configuration file, which is built first, a tar output of linuxkit build, or
+the initrd of a kernel+initrd output, in which case the -kernel and -cmdline files alongside it are
+also compared.
+
+Reports the images each section of the configuration was built from, the kernel and its command line,
+files that were added, removed or modified, and changes to the OCI runtime config of each container.
+Image digests are only compared when both sides are yaml files, as build outputs record only references.
+`,
+		Example: `  linuxkit diff old.yml new.yml
+  linuxkit diff old.tar new.tar
+  linuxkit diff old-initrd.img new-initrd.img`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format != "text" && format != "json" {
+				return fmt.Errorf("unknown format %s, must be one of text or json", format)
+			}
+			templates, err := templateVars(varFiles, vars)
+			if err != nil {
+				return err
+			}
+			opts := mobybuild.BuildOpts{Pull: pull, CacheDir: cacheDir.String(), Arch: arch}
+			var contents []*mobybuild.ImageContents
+			for _, arg := range args {
+				c, err := readImageContents(arg, templates, opts)
+				if err != nil {
+					return fmt.Errorf("cannot read %s: %v", arg, err)
+				}
+				contents = append(contents, c)
+			}
+			d := mobybuild.DiffContents(contents[0], contents[1])
+			if noFiles {
+				d.Files = nil
+			}
+
+			if format == "json" {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				enc.SetEscapeHTML(false)
+				return enc.Encode(d)
+			}
+			printDiff(d)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&arch, "arch", runtime.GOARCH, "target architecture to build yaml files for")
+	cacheDir = flagOverEnvVarOverDefaultString{def: defaultLinuxkitCache(), envVar: envVarCacheDir}
+	cmd.Flags().Var(&cacheDir, "cache", fmt.Sprintf("Directory for caching and finding cached image, overrides env var %s", envVarCacheDir))
+	cmd.Flags().BoolVar(&pull, "pull", false, "Always pull images when building yaml files")
+	cmd.Flags().StringVar(&format, "format", "text", "Output format, one of text or json")
+	cmd.Flags().BoolVar(&noFiles, "no-files", false, "Do not report changed files")
+	cmd.Flags().StringArrayVar(&vars, "var", nil, "Variable to substitute into yml files, in the form name=value; can be provided multiple times and overrides --var-file")
+	cmd.Flags().StringArrayVar(&varFiles, "var-file", nil, "yaml file containing a map of variables to substitute into yml files; can be provided multiple times")
+
+	return cmd
+}
+
+// readImageContents reads a yaml file, build tar or kernel+initrd output
+func readImageContents(arg string, vars map[string]string, opts mobybuild.BuildOpts) (*mobybuild.ImageContents, error) {
+	switch {
+	case strings.HasSuffix(arg, "-initrd.img"):
+		return mobybuild.ReadKernelInitrdContents(strings.TrimSuffix(arg, "-initrd.img"))
+	case strings.HasSuffix(arg, ".yml"), strings.HasSuffix(arg, ".yaml"), isURL(arg):
+		c, err := loadConfig(arg, vars, map[string]bool{}, nil)
+		if err != nil {
+			return nil, err
+		}
+		// combine with an empty config, as build does, to check for duplicates
+		m, err := moby.AppendConfig(moby.Moby{}, c)
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := mobybuild.ResolveManifest(m, opts)
+		if err != nil {
+			return nil, err
+		}
+		// everything needed is now in the cache
+		opts.Pull = false
+		tf, err := os.CreateTemp("", "linuxkit-diff")
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = os.Remove(tf.Name()) }()
+		defer func() { _ = tf.Close() }()
+		log.Infof("Build %s", arg)
+		if err := mobybuild.Build(m, tf, opts); err != nil {
+			return nil, err
+		}
+		if _, err := tf.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		contents, err := mobybuild.ReadTarContents(tf)
+		if err != nil {
+			return nil, err
+		}
+		contents.SetManifest(manifest)
+		return contents, nil
+	default:
+		f, err := os.Open(arg)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = f.Close() }()
+		return mobybuild.ReadTarContents(f)
+	}
+}
+
+func printDiff(d *mobybuild.ImageDiff) {
+	if d.Empty() {
+		fmt.Println("no differences")
+		return
+	}
+	change := func(name, old, new string) {
+		switch {
+		case old == "":
+			fmt.Printf("  + %s: %s\n", name, new)
+		case new == "":
+			fmt.Printf("  - %s: %s\n", name, old)
+		default:
+			fmt.Printf("  ~ %s: %s -> %s\n", name, old, new)
+		}
+	}
+	if len(d.Images) > 0 {
+		fmt.Println("images:")
+		for _, c := range d.Images {
+			change(c.Name, c.Old, c.New)
+		}
+	}
+	if d.Kernel != nil {
+		fmt.Println("kernel:")
+		change(d.Kernel.Name, d.Kernel.Old, d.Kernel.New)
+	}
+	if len(d.Cmdline) > 0 {
+		fmt.Println("cmdline:")
+		for _, c := range d.Cmdline {
+			change(c.Name, c.Old, c.New)
+		}
+	}
+	if len(d.Specs) > 0 {
+		fmt.Println("container specs:")
+		for _, c := range d.Specs {
+			change(c.Path+": "+c.Field, c.Old, c.New)
+		}
+	}
+	if len(d.Files) > 0 {
+		fmt.Println("files:")
+		for _, f := range d.Files {
+			switch {
+			case f.Added:
+				fmt.Printf("  + %s\n", f.Path)
+			case f.Removed:
+				fmt.Printf("  - %s\n", f.Path)
+			default:
+				fmt.Printf("  ~ %s (%s)\n", f.Path, strings.Join(f.Changes, ", "))
+			}
+		}
+	}
+}
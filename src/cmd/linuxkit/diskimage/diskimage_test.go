@@ -0,0 +1,279 @@
+package diskimage
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// readFAT returns the contents of a file in a FAT filesystem, following long names
+func readFAT(t *testing.T, fs []byte, path string) []byte {
+	t.Helper()
+	clusterSize := int(fs[13]) * SectorSize
+	fatStart := int(binary.LittleEndian.Uint16(fs[14:])) * SectorSize
+	rootEntries := int(binary.LittleEndian.Uint16(fs[17:]))
+	fatSectors := int(binary.LittleEndian.Uint16(fs[22:]))
+	if fatSectors == 0 {
+		fatSectors = int(binary.LittleEndian.Uint32(fs[36:]))
+	}
+	rootStart := fatStart + int(fs[16])*fatSectors*SectorSize
+	dataStart := rootStart + rootEntries*fatDirEntrySize
+	clusters := (len(fs) - dataStart) / clusterSize
+	next := func(cluster uint32) uint32 {
+		switch {
+		case rootEntries == 0:
+			return binary.LittleEndian.Uint32(fs[fatStart+int(cluster)*4:])
+		case clusters > fat12MaxClusters:
+			return uint32(binary.LittleEndian.Uint16(fs[fatStart+int(cluster)*2:])) | 0x0fff0000
+		}
+		v := uint32(binary.LittleEndian.Uint16(fs[fatStart+int(cluster)*3/2:]))
+		if cluster%2 == 1 {
+			v >>= 4
+		}
+		return v&0xfff | 0x0ffff000
+	}
+	chain := func(cluster uint32) []byte {
+		var b []byte
+		for cluster < 0x0ffffff8 {
+			off := dataStart + int(cluster-2)*clusterSize
+			b = append(b, fs[off:off+clusterSize]...)
+			cluster = next(cluster)
+		}
+		return b
+	}
+	dir := fs[rootStart:dataStart]
+	if rootEntries == 0 {
+		dir = chain(binary.LittleEndian.Uint32(fs[44:]))
+	}
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		var long []uint16
+		found := false
+		for off := 0; off < len(dir) && dir[off] != 0; off += 32 {
+			e := dir[off : off+32]
+			if e[11] == attrLongName {
+				var chars []uint16
+				for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+					for j := r[0]; j < r[1]; j += 2 {
+						chars = append(chars, binary.LittleEndian.Uint16(e[j:]))
+					}
+				}
+				long = append(chars, long...)
+				continue
+			}
+			name := strings.TrimRight(string(e[0:8]), " ")
+			if e[12]&caseLowerBase != 0 {
+				name = strings.ToLower(name)
+			}
+			if ext := strings.TrimRight(string(e[8:11]), " "); ext != "" {
+				if e[12]&caseLowerExt != 0 {
+					ext = strings.ToLower(ext)
+				}
+				name += "." + ext
+			}
+			if long != nil {
+				for j, c := range long {
+					if c == 0 {
+						long = long[:j]
+						break
+					}
+				}
+				name = string(utf16.Decode(long))
+				long = nil
+			}
+			if name != part {
+				continue
+			}
+			found = true
+			cluster := uint32(binary.LittleEndian.Uint16(e[20:]))<<16 | uint32(binary.LittleEndian.Uint16(e[26:]))
+			if i == len(parts)-1 {
+				return chain(cluster)[:binary.LittleEndian.Uint32(e[28:])]
+			}
+			dir = chain(cluster)
+			break
+		}
+		if !found {
+			t.Fatalf("%s not found", path)
+		}
+	}
+	return nil
+}
+
+func TestWriteEFIDisk(t *testing.T) {
+	files := []File{
+		{"EFI/BOOT/BOOTX64.EFI", bytes.Repeat([]byte("boot"), 10000)},
+		{"EFI/Linux/linuxkit.efi", bytes.Repeat([]byte("kernel"), 1000000)},
+		{"EFI/Linux/a-rather-long-name.efi", []byte("x")},
+		{"loader/loader.conf", []byte("timeout 0\n")},
+	}
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "disk.img")
+	if err := WriteEFIDisk(filename, files, modTime); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// check the primary and backup GPT headers
+	last := len(disk)/SectorSize - 1
+	for _, lba := range []int{1, last} {
+		h := disk[lba*SectorSize : lba*SectorSize+gptHeaderSize]
+		if string(h[0:8]) != "EFI PART" {
+			t.Fatalf("no GPT header at sector %d", lba)
+		}
+		crc := binary.LittleEndian.Uint32(h[16:])
+		c := append([]byte{}, h...)
+		binary.LittleEndian.PutUint32(c[16:], 0)
+		if crc32.ChecksumIEEE(c) != crc {
+			t.Errorf("bad GPT header checksum at sector %d", lba)
+		}
+		entries := int(binary.LittleEndian.Uint64(h[72:])) * SectorSize
+		if crc32.ChecksumIEEE(disk[entries:entries+gptEntries*gptEntrySize]) != binary.LittleEndian.Uint32(h[88:]) {
+			t.Errorf("bad GPT entries checksum for header at sector %d", lba)
+		}
+	}
+	entry := disk[2*SectorSize:]
+	if !bytes.Equal(entry[0:16], guidBytes(EFISystemPartition)) {
+		t.Errorf("partition is not an EFI system partition")
+	}
+	start, end := binary.LittleEndian.Uint64(entry[32:]), binary.LittleEndian.Uint64(entry[40:])
+	if start != espStart || (end+1)%2048 != 0 {
+		t.Errorf("partition sectors %d-%d not aligned to 1MiB", start, end)
+	}
+	if len(disk) != int(end+1-start)*SectorSize+espPadding {
+		t.Errorf("unexpected disk size %d for partition of %d sectors", len(disk), end+1-start)
+	}
+
+	fs := disk[start*SectorSize : (end+1)*SectorSize]
+	if string(fs[82:90]) != "FAT32   " || binary.LittleEndian.Uint32(fs[32:]) != uint32(end+1-start) {
+		t.Fatalf("invalid FAT32 boot sector")
+	}
+	for _, f := range files {
+		if got := readFAT(t, fs, f.Path); !bytes.Equal(got, f.Contents) {
+			t.Errorf("wrong contents for %s", f.Path)
+		}
+	}
+
+	// the output must be reproducible
+	again := filepath.Join(dir, "again.img")
+	if err := WriteEFIDisk(again, files, modTime); err != nil {
+		t.Fatal(err)
+	}
+	disk2, err := os.ReadFile(again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(disk, disk2) {
+		t.Error("disk images differ for the same input")
+	}
+}
+
+func TestShortName(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		short string
+		flags byte
+		ok    bool
+	}{
+		{"BOOTX64.EFI", "BOOTX64 EFI", 0, true},
+		{"linuxkit.efi", "LINUXKITEFI", caseLowerBase | caseLowerExt, true},
+		{"loader", "LOADER     ", caseLowerBase, true},
+		{"Linux", "", 0, false},
+		{"loader.conf", "", 0, false},
+		{"BOOTRISCV64.EFI", "", 0, false},
+	} {
+		short, flags, ok := shortName(tc.name)
+		if ok != tc.ok || (ok && (string(short[:]) != tc.short || flags != tc.flags)) {
+			t.Errorf("%s: got %q %#x %v", tc.name, short, flags, ok)
+		}
+	}
+	if short := shortAlias("BOOTRISCV64.EFI", 1); string(short[:]) != "BOOTRI~1EFI" {
+		t.Errorf("unexpected short alias %q", short)
+	}
+}
+
+// testPE returns a minimal PE32+ image with a single .text section
+func testPE() []byte {
+	b := make([]byte, 0x600)
+	copy(b, "MZ")
+	binary.LittleEndian.PutUint32(b[0x3c:], 0x40)
+	copy(b[0x40:], "PE\x00\x00")
+	coff := 0x44
+	binary.LittleEndian.PutUint16(b[coff:], 0x8664)
+	binary.LittleEndian.PutUint16(b[coff+2:], 1)
+	binary.LittleEndian.PutUint16(b[coff+16:], 240)
+	binary.LittleEndian.PutUint16(b[coff+18:], 0x2022)
+	opt := coff + 20
+	binary.LittleEndian.PutUint16(b[opt:], 0x20b)
+	binary.LittleEndian.PutUint32(b[opt+32:], 0x1000)
+	binary.LittleEndian.PutUint32(b[opt+36:], 0x200)
+	binary.LittleEndian.PutUint32(b[opt+56:], 0x2000)
+	binary.LittleEndian.PutUint32(b[opt+60:], 0x400)
+	binary.LittleEndian.PutUint16(b[opt+68:], 10)
+	binary.LittleEndian.PutUint32(b[opt+108:], 16)
+	s := opt + 240
+	copy(b[s:], ".text")
+	binary.LittleEndian.PutUint32(b[s+8:], 0x10)
+	binary.LittleEndian.PutUint32(b[s+12:], 0x1000)
+	binary.LittleEndian.PutUint32(b[s+16:], 0x200)
+	binary.LittleEndian.PutUint32(b[s+20:], 0x400)
+	binary.LittleEndian.PutUint32(b[s+36:], 0x60000020)
+	return b
+}
+
+func TestUKI(t *testing.T) {
+	kernel := bytes.Repeat([]byte{0xaa}, 5000)
+	initrd := bytes.Repeat([]byte{0xbb}, 3000)
+	uki, err := UKI(testPE(), kernel, initrd, "console=ttyS0 text", `NAME="LinuxKit"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := pe.NewFile(bytes.NewReader(uki))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]byte{
+		".osrel":   []byte(`NAME="LinuxKit"`),
+		".cmdline": []byte("console=ttyS0 text"),
+		".initrd":  initrd,
+		".linux":   kernel,
+	}
+	if len(f.Sections) != 5 || f.Sections[4].Name != ".linux" {
+		t.Fatalf("unexpected sections %v", f.Sections)
+	}
+	var virtualEnd uint32
+	for _, s := range f.Sections {
+		if s.VirtualAddress < virtualEnd || s.VirtualAddress%0x1000 != 0 {
+			t.Errorf("section %s at %#x overlaps or is not aligned", s.Name, s.VirtualAddress)
+		}
+		virtualEnd = s.VirtualAddress + s.VirtualSize
+		data, ok := expected[s.Name]
+		if !ok {
+			continue
+		}
+		got, err := s.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got[:s.VirtualSize], data) {
+			t.Errorf("wrong contents for section %s", s.Name)
+		}
+	}
+	if size := f.OptionalHeader.(*pe.OptionalHeader64).SizeOfImage; size < virtualEnd || size%0x1000 != 0 {
+		t.Errorf("unexpected image size %#x", size)
+	}
+
+	if _, err := AddSections(uki, []Section{{".linux", kernel}}); err == nil {
+		t.Error("expected error adding a duplicate section")
+	}
+}
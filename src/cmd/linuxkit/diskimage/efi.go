@@ -0,0 +1,59 @@
+package diskimage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// espStart is the first sector of the EFI system partition, aligned to 1MiB
+	espStart = 2048
+	// espPadding is the space on the disk outside the EFI system partition
+	espPadding = 4 * 1024 * 1024
+	// espAttributes marks the partition as legacy BIOS bootable, as mkimage-raw-efi does
+	espAttributes = 1 << 2
+)
+
+// WriteEFIDisk writes a GPT partitioned disk image with a single FAT32 EFI system partition containing
+// files, laid out as mkimage-raw-efi does. The disk and partition GUIDs and the volume ID are derived
+// from the contents, so the same files always produce the same image.
+func WriteEFIDisk(filename string, files []File, modTime time.Time) error {
+	h := sha256.New()
+	for _, f := range files {
+		_, _ = h.Write([]byte(f.Path))
+		_, _ = h.Write(f.Contents)
+	}
+	seed := h.Sum(nil)
+	diskGUID := uuid.NewSHA1(uuid.NameSpaceOID, append([]byte("linuxkit-disk:"), seed...))
+	partGUID := uuid.NewSHA1(uuid.NameSpaceOID, append([]byte("linuxkit-esp:"), seed...))
+
+	espSize := FAT32Size(files)
+	size := espSize + espPadding
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	if err := WriteGPT(f, size, diskGUID, []Partition{{
+		Type:       EFISystemPartition,
+		GUID:       partGUID,
+		Start:      espStart,
+		End:        espStart + uint64(espSize/SectorSize) - 1,
+		Attributes: espAttributes,
+		Name:       "EFI System",
+	}}); err != nil {
+		return err
+	}
+	if err := WriteFAT32(f, espStart*SectorSize, espSize, files, binary.LittleEndian.Uint32(seed), modTime); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,630 @@
+package diskimage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// FAT layouts. FAT32 matches that used by mkimage-raw-efi, and FAT12 and FAT16 the small EFI boot images
+// used by mkimage-iso-efi, which mkfs.fat creates with its defaults.
+const (
+	fatCount               = 2
+	fat32ReservedSectors   = 32
+	fat32SectorsPerCluster = 8
+	fatInfoSector          = 1
+	fatBackupSector        = 6
+	fat16ReservedSectors   = 1
+	fat16SectorsPerCluster = 4
+	fat16RootEntries       = 512
+	fat12MaxClusters       = 4084
+	fat16MaxClusters       = 65524
+	fatRootCluster         = 2
+	fatDirEntrySize        = 32
+
+	attrDirectory = 0x10
+	attrArchive   = 0x20
+	attrLongName  = 0x0f
+
+	caseLowerBase = 0x08
+	caseLowerExt  = 0x10
+)
+
+// File is a file to write to a FAT filesystem. Path is slash separated, and directories are created as
+// needed, in the order they are first seen.
+type File struct {
+	Path     string
+	Contents []byte
+}
+
+type fatNode struct {
+	name      string
+	shortName [11]byte
+	caseFlags byte
+	long      bool
+	dir       bool
+	contents  []byte
+	children  []*fatNode
+	parent    *fatNode
+	cluster   uint32
+	clusters  uint32
+}
+
+// FAT32Size returns the size in bytes of a FAT32 filesystem to hold files, calculated in the same way as
+// mkimage-raw-efi, as a whole number of MiB
+func FAT32Size(files []File) int64 {
+	var data int64
+	for _, f := range files {
+		data += int64(len(f.Contents))
+	}
+	fatSectors := (data/SectorSize/fat32SectorsPerCluster + 2) * 4 / SectorSize
+	overhead := (fat32ReservedSectors + fatCount*fatSectors) * SectorSize
+	kb := ((data+overhead+1023)/1024 + 1023) / 1024 * 1024
+	size := kb * 1024
+	// the calculation does not allow for directories or partly used clusters, so add space if needed
+	root, err := fatTree(files)
+	if err != nil {
+		return size
+	}
+	for {
+		l := fat32Layout(size)
+		root.size(l)
+		if l.clusters >= root.totalClusters() {
+			return size
+		}
+		size += 1024 * 1024
+	}
+}
+
+type fatLayout struct {
+	bits              int
+	sectors           uint32
+	reserved          uint32
+	sectorsPerCluster uint32
+	fatSectors        uint32
+	// rootSectors is the size of the fixed root directory of FAT12 and FAT16
+	rootSectors uint32
+	clusters    uint32
+}
+
+// fat32Layout returns the FAT32 layout for a filesystem of size bytes
+func fat32Layout(size int64) fatLayout {
+	sectors := uint32(size / SectorSize)
+	data := sectors - fat32ReservedSectors
+	// as mkfs.fat, estimate the clusters, then size the tables for them aligned to a cluster
+	clusters := (uint64(data)*SectorSize + fatCount*8) / (fat32SectorsPerCluster*SectorSize + fatCount*4)
+	fatSectors := uint32((clusters+2)*4+SectorSize-1) / SectorSize
+	fatSectors = (fatSectors + fat32SectorsPerCluster - 1) / fat32SectorsPerCluster * fat32SectorsPerCluster
+	return fatLayout{
+		bits:              32,
+		sectors:           sectors,
+		reserved:          fat32ReservedSectors,
+		sectorsPerCluster: fat32SectorsPerCluster,
+		fatSectors:        fatSectors,
+		clusters:          (data - fatCount*fatSectors) / fat32SectorsPerCluster,
+	}
+}
+
+// fat16Layout returns the FAT12 layout for a filesystem of size bytes, or FAT16 if it has too many
+// clusters for FAT12
+func fat16Layout(size int64) fatLayout {
+	l := fatLayout{
+		sectors:           uint32(size / SectorSize),
+		reserved:          fat16ReservedSectors,
+		sectorsPerCluster: fat16SectorsPerCluster,
+		rootSectors:       fat16RootEntries * fatDirEntrySize / SectorSize,
+	}
+	for _, bits := range []int{12, 16} {
+		l.bits = bits
+		for l.fatSectors = 1; ; l.fatSectors++ {
+			l.clusters = (l.sectors - l.reserved - l.rootSectors - fatCount*l.fatSectors) / l.sectorsPerCluster
+			if (uint64(l.clusters)+2)*uint64(bits) <= uint64(l.fatSectors)*SectorSize*8 {
+				break
+			}
+		}
+		if l.clusters <= fat12MaxClusters {
+			break
+		}
+	}
+	return l
+}
+
+func (l fatLayout) clusterSize() int64 {
+	return int64(l.sectorsPerCluster) * SectorSize
+}
+
+// rootOffset returns the offset of the fixed root directory of FAT12 and FAT16
+func (l fatLayout) rootOffset() int64 {
+	return int64(l.reserved+fatCount*l.fatSectors) * SectorSize
+}
+
+// dataOffset returns the offset of a cluster from the start of the filesystem
+func (l fatLayout) dataOffset(cluster uint32) int64 {
+	return l.rootOffset() + int64(l.rootSectors)*SectorSize + int64(cluster-fatRootCluster)*l.clusterSize()
+}
+
+// endOfChain returns the FAT entry marking the last cluster of a file
+func (l fatLayout) endOfChain() uint32 {
+	return 1<<min(l.bits, 28) - 1
+}
+
+// table returns the encoded file allocation table
+func (l fatLayout) table(entries []uint32) []byte {
+	b := make([]byte, (len(entries)*l.bits+7)/8)
+	for i, v := range entries {
+		switch l.bits {
+		case 12:
+			off := i * 3 / 2
+			if i%2 == 0 {
+				b[off] = byte(v)
+				b[off+1] = b[off+1]&0xf0 | byte(v>>8)&0x0f
+			} else {
+				b[off] = b[off]&0x0f | byte(v<<4)
+				b[off+1] = byte(v >> 4)
+			}
+		case 16:
+			binary.LittleEndian.PutUint16(b[i*2:], uint16(v))
+		default:
+			binary.LittleEndian.PutUint32(b[i*4:], v)
+		}
+	}
+	return b
+}
+
+// WriteFAT32 writes a FAT32 filesystem of size bytes containing files at offset. The space is assumed to
+// be zeroed already, as it is for a newly created file. All timestamps are set to modTime, so the output
+// only depends on the files and volumeID.
+func WriteFAT32(w io.WriterAt, offset, size int64, files []File, volumeID uint32, modTime time.Time) error {
+	return writeFAT(w, offset, size, fat32Layout(size), files, volumeID, modTime)
+}
+
+// WriteFAT writes a FAT12 filesystem, or FAT16 if it is too large for FAT12, in the same way as WriteFAT32
+func WriteFAT(w io.WriterAt, offset, size int64, files []File, volumeID uint32, modTime time.Time) error {
+	l := fat16Layout(size)
+	if l.clusters > fat16MaxClusters {
+		return fmt.Errorf("filesystem size %d is too large for FAT16", size)
+	}
+	return writeFAT(w, offset, size, l, files, volumeID, modTime)
+}
+
+// FATImage returns a FAT12 or FAT16 filesystem of size bytes containing files, as written by WriteFAT
+func FATImage(size int64, files []File, volumeID uint32, modTime time.Time) ([]byte, error) {
+	b := make(bufferAt, size)
+	if err := WriteFAT(b, 0, size, files, volumeID, modTime); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// bufferAt is an io.WriterAt for a fixed size buffer
+type bufferAt []byte
+
+func (b bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(b)) {
+		return 0, errors.New("write outside buffer")
+	}
+	return copy(b[off:], p), nil
+}
+
+func writeFAT(w io.WriterAt, offset, size int64, l fatLayout, files []File, volumeID uint32, modTime time.Time) error {
+	if size%SectorSize != 0 {
+		return fmt.Errorf("filesystem size %d is not a multiple of the sector size", size)
+	}
+	root, err := fatTree(files)
+	if err != nil {
+		return err
+	}
+	root.size(l)
+	if l.bits != 32 && len(root.entries(modTime)) > fat16RootEntries*fatDirEntrySize {
+		return fmt.Errorf("too many entries in root directory")
+	}
+	used := root.totalClusters()
+	if used > l.clusters {
+		return fmt.Errorf("files need %d clusters, but filesystem of %d bytes only has %d", used, size, l.clusters)
+	}
+
+	// allocate clusters, directories first then files, in the order they were created
+	next := uint32(fatRootCluster)
+	fat := make([]uint32, used+fatRootCluster)
+	fat[0] = l.endOfChain()&^0xff | 0xf8
+	fat[1] = l.endOfChain()
+	allocate := func(n *fatNode) {
+		if n.clusters == 0 {
+			return
+		}
+		n.cluster = next
+		for i := uint32(0); i < n.clusters; i++ {
+			fat[next] = next + 1
+			if i == n.clusters-1 {
+				fat[next] = l.endOfChain()
+			}
+			next++
+		}
+	}
+	dirs, regular := root.walk()
+	for _, n := range dirs {
+		allocate(n)
+	}
+	for _, n := range regular {
+		allocate(n)
+	}
+
+	type write struct {
+		offset int64
+		data   []byte
+	}
+	boot := fatBootSector(l, volumeID)
+	writes := []write{{0, boot}}
+	if l.bits == 32 {
+		info := make([]byte, SectorSize)
+		binary.LittleEndian.PutUint32(info[0:], 0x41615252)
+		binary.LittleEndian.PutUint32(info[484:], 0x61417272)
+		binary.LittleEndian.PutUint32(info[488:], l.clusters-used)
+		binary.LittleEndian.PutUint32(info[492:], next)
+		binary.LittleEndian.PutUint32(info[508:], 0xaa550000)
+		writes = append(writes,
+			write{fatInfoSector * SectorSize, info},
+			write{fatBackupSector * SectorSize, boot},
+			write{(fatBackupSector + fatInfoSector) * SectorSize, info},
+		)
+	}
+	table := l.table(fat)
+	for i := int64(0); i < fatCount; i++ {
+		writes = append(writes, write{(int64(l.reserved) + i*int64(l.fatSectors)) * SectorSize, table})
+	}
+	for _, n := range dirs {
+		if n.clusters == 0 {
+			writes = append(writes, write{l.rootOffset(), n.entries(modTime)})
+			continue
+		}
+		writes = append(writes, write{l.dataOffset(n.cluster), n.entries(modTime)})
+	}
+	for _, n := range regular {
+		if len(n.contents) == 0 {
+			continue
+		}
+		writes = append(writes, write{l.dataOffset(n.cluster), n.contents})
+	}
+	for _, wr := range writes {
+		if _, err := w.WriteAt(wr.data, offset+wr.offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fatBootSector(l fatLayout, volumeID uint32) []byte {
+	b := make([]byte, SectorSize)
+	copy(b[3:11], "mkfs.fat")
+	binary.LittleEndian.PutUint16(b[11:], SectorSize)
+	b[13] = byte(l.sectorsPerCluster)
+	binary.LittleEndian.PutUint16(b[14:], uint16(l.reserved))
+	b[16] = fatCount
+	binary.LittleEndian.PutUint16(b[17:], uint16(l.rootSectors*SectorSize/fatDirEntrySize))
+	b[21] = 0xf8
+	binary.LittleEndian.PutUint16(b[24:], 32)
+	binary.LittleEndian.PutUint16(b[26:], 64)
+	if l.sectors < 0x10000 && l.bits != 32 {
+		binary.LittleEndian.PutUint16(b[19:], uint16(l.sectors))
+	} else {
+		binary.LittleEndian.PutUint32(b[32:], l.sectors)
+	}
+	// the extended boot record is after the FAT32 fields
+	ext := 36
+	if l.bits == 32 {
+		ext = 64
+		binary.LittleEndian.PutUint32(b[36:], l.fatSectors)
+		binary.LittleEndian.PutUint32(b[44:], fatRootCluster)
+		binary.LittleEndian.PutUint16(b[48:], fatInfoSector)
+		binary.LittleEndian.PutUint16(b[50:], fatBackupSector)
+	} else {
+		binary.LittleEndian.PutUint16(b[22:], uint16(l.fatSectors))
+	}
+	copy(b[0:], []byte{0xeb, byte(ext + 26 - 2), 0x90})
+	b[ext] = 0x80
+	b[ext+2] = 0x29
+	binary.LittleEndian.PutUint32(b[ext+3:], volumeID)
+	copy(b[ext+7:ext+18], "NO NAME    ")
+	copy(b[ext+18:ext+26], fmt.Sprintf("FAT%-5d", l.bits))
+	b[510], b[511] = 0x55, 0xaa
+	return b
+}
+
+// fatTree builds the directory tree for files
+func fatTree(files []File) (*fatNode, error) {
+	root := &fatNode{dir: true}
+	for _, f := range files {
+		parts := strings.Split(strings.Trim(f.Path, "/"), "/")
+		dir := root
+		for i, name := range parts {
+			if name == "" || name == "." || name == ".." {
+				return nil, fmt.Errorf("invalid path %s", f.Path)
+			}
+			last := i == len(parts)-1
+			var child *fatNode
+			for _, c := range dir.children {
+				if strings.EqualFold(c.name, name) {
+					child = c
+				}
+			}
+			switch {
+			case child == nil:
+				child = &fatNode{name: name, dir: !last, parent: dir}
+				if last {
+					child.contents = f.Contents
+				}
+				if err := dir.add(child); err != nil {
+					return nil, fmt.Errorf("invalid path %s: %v", f.Path, err)
+				}
+			case last || !child.dir:
+				return nil, fmt.Errorf("duplicate path %s", f.Path)
+			}
+			dir = child
+		}
+	}
+	return root, nil
+}
+
+// add adds a child to a directory, choosing its short name
+func (n *fatNode) add(c *fatNode) error {
+	if len(utf16.Encode([]rune(c.name))) > 255 {
+		return errors.New("name too long")
+	}
+	short, flags, ok := shortName(c.name)
+	if !ok {
+		c.long = true
+		for i := 1; ; i++ {
+			short = shortAlias(c.name, i)
+			if !n.hasShortName(short) {
+				break
+			}
+		}
+	} else if n.hasShortName(short) {
+		return fmt.Errorf("%s clashes with an existing name", c.name)
+	}
+	c.shortName, c.caseFlags = short, flags
+	n.children = append(n.children, c)
+	return nil
+}
+
+func (n *fatNode) hasShortName(short [11]byte) bool {
+	for _, c := range n.children {
+		if c.shortName == short {
+			return true
+		}
+	}
+	return false
+}
+
+// size sets the number of clusters needed by each node. The root directory of FAT12 and FAT16 is
+// not in a cluster.
+func (n *fatNode) size(l fatLayout) {
+	clusterSize := l.clusterSize()
+	if !n.dir {
+		n.clusters = uint32((int64(len(n.contents)) + clusterSize - 1) / clusterSize)
+		return
+	}
+	entries := 0
+	if n.parent != nil {
+		entries = 2
+	}
+	for _, c := range n.children {
+		c.size(l)
+		entries += 1 + c.longEntries()
+	}
+	n.clusters = uint32((int64(entries*fatDirEntrySize) + clusterSize - 1) / clusterSize)
+	if n.clusters == 0 {
+		n.clusters = 1
+	}
+	if n.parent == nil && l.bits != 32 {
+		n.clusters = 0
+	}
+}
+
+func (n *fatNode) totalClusters() uint32 {
+	total := n.clusters
+	for _, c := range n.children {
+		total += c.totalClusters()
+	}
+	return total
+}
+
+// walk returns the directories and then the files, in the order they were created
+func (n *fatNode) walk() (dirs, files []*fatNode) {
+	var add func(d *fatNode)
+	add = func(d *fatNode) {
+		dirs = append(dirs, d)
+		for _, c := range d.children {
+			if c.dir {
+				add(c)
+			} else {
+				files = append(files, c)
+			}
+		}
+	}
+	add(n)
+	return dirs, files
+}
+
+func (n *fatNode) longEntries() int {
+	if !n.long {
+		return 0
+	}
+	return (len(utf16.Encode([]rune(n.name))) + 12) / 13
+}
+
+// entries returns the directory entries of a directory
+func (n *fatNode) entries(modTime time.Time) []byte {
+	t, d := fatTime(modTime)
+	entry := func(name [11]byte, attr, flags byte, cluster, size uint32) []byte {
+		e := make([]byte, fatDirEntrySize)
+		copy(e[0:11], name[:])
+		e[11] = attr
+		e[12] = flags
+		binary.LittleEndian.PutUint16(e[14:], t)
+		binary.LittleEndian.PutUint16(e[16:], d)
+		binary.LittleEndian.PutUint16(e[18:], d)
+		binary.LittleEndian.PutUint16(e[20:], uint16(cluster>>16))
+		binary.LittleEndian.PutUint16(e[22:], t)
+		binary.LittleEndian.PutUint16(e[24:], d)
+		binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+		binary.LittleEndian.PutUint32(e[28:], size)
+		return e
+	}
+	var b []byte
+	if n.parent != nil {
+		parent := n.parent.cluster
+		if n.parent.parent == nil {
+			// the root directory is referred to as cluster 0
+			parent = 0
+		}
+		b = append(b, entry(dotName("."), attrDirectory, 0, n.cluster, 0)...)
+		b = append(b, entry(dotName(".."), attrDirectory, 0, parent, 0)...)
+	}
+	for _, c := range n.children {
+		if c.long {
+			b = append(b, longNameEntries(c.name, c.shortName)...)
+		}
+		attr, size := byte(attrArchive), uint32(len(c.contents))
+		if c.dir {
+			attr, size = attrDirectory, 0
+		}
+		b = append(b, entry(c.shortName, attr, c.caseFlags, c.cluster, size)...)
+	}
+	return b
+}
+
+func dotName(name string) [11]byte {
+	var b [11]byte
+	copy(b[:], name+strings.Repeat(" ", 11-len(name)))
+	return b
+}
+
+// longNameEntries returns the VFAT long file name entries for name, last first as they are stored
+func longNameEntries(name string, short [11]byte) []byte {
+	var sum byte
+	for _, c := range short {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	u := utf16.Encode([]rune(name))
+	count := (len(u) + 12) / 13
+	if len(u)%13 != 0 {
+		u = append(u, 0)
+	}
+	for len(u)%13 != 0 {
+		u = append(u, 0xffff)
+	}
+	var b []byte
+	for i := count; i > 0; i-- {
+		e := make([]byte, fatDirEntrySize)
+		e[0] = byte(i)
+		if i == count {
+			e[0] |= 0x40
+		}
+		e[11] = attrLongName
+		e[13] = sum
+		chars := u[(i-1)*13 : i*13]
+		for j, c := range chars {
+			var off int
+			switch {
+			case j < 5:
+				off = 1 + 2*j
+			case j < 11:
+				off = 14 + 2*(j-5)
+			default:
+				off = 28 + 2*(j-11)
+			}
+			binary.LittleEndian.PutUint16(e[off:], c)
+		}
+		b = append(b, e...)
+	}
+	return b
+}
+
+func validShortChar(c rune) bool {
+	switch {
+	case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		return true
+	case strings.ContainsRune("!#$%&'()-@^_`{}~", c):
+		return true
+	}
+	return false
+}
+
+// shortName returns the 8.3 name for name, and the case flags to recover it, if it can be stored
+// without a long name
+func shortName(name string) ([11]byte, byte, bool) {
+	var short [11]byte
+	base, ext, _ := strings.Cut(name, ".")
+	if len(base) == 0 || len(base) > 8 || len(ext) > 3 || strings.Contains(ext, ".") {
+		return short, 0, false
+	}
+	var flags byte
+	for _, part := range []struct {
+		s    string
+		flag byte
+	}{{base, caseLowerBase}, {ext, caseLowerExt}} {
+		var lower, upper bool
+		for _, c := range part.s {
+			if !validShortChar(c) {
+				return short, 0, false
+			}
+			lower = lower || (c >= 'a' && c <= 'z')
+			upper = upper || (c >= 'A' && c <= 'Z')
+		}
+		if lower && upper {
+			return short, 0, false
+		}
+		if lower {
+			flags |= part.flag
+		}
+	}
+	copy(short[:], fmt.Sprintf("%-8s%-3s", strings.ToUpper(base), strings.ToUpper(ext)))
+	return short, flags, true
+}
+
+// shortAlias returns the numbered short name used alongside a long name
+func shortAlias(name string, n int) [11]byte {
+	clean := func(s string) string {
+		var b strings.Builder
+		for _, c := range strings.ToUpper(s) {
+			switch {
+			case c == ' ' || c == '.':
+			case validShortChar(c):
+				b.WriteRune(c)
+			default:
+				b.WriteRune('_')
+			}
+		}
+		return b.String()
+	}
+	base, ext := strings.TrimLeft(name, "."), ""
+	if i := strings.LastIndex(base, "."); i >= 0 {
+		base, ext = base[:i], base[i+1:]
+	}
+	base, ext = clean(base), clean(ext)
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	tail := fmt.Sprintf("~%d", n)
+	if len(base) > 8-len(tail) {
+		base = base[:8-len(tail)]
+	}
+	var short [11]byte
+	copy(short[:], fmt.Sprintf("%-8s%-3s", base+tail, ext))
+	return short
+}
+
+// fatTime returns the FAT encoding of a time, which must be from 1980 onwards
+func fatTime(t time.Time) (uint16, uint16) {
+	t = t.UTC()
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2),
+		uint16((t.Year()-1980)<<9 | int(t.Month())<<5 | t.Day())
+}
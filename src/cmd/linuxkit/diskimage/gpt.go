@@ -0,0 +1,133 @@
+package diskimage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// SectorSize is the logical sector size of the disk images written
+	SectorSize = 512
+
+	gptEntries     = 128
+	gptEntrySize   = 128
+	gptHeaderSize  = 92
+	gptEntrySects  = gptEntries * gptEntrySize / SectorSize
+	gptFirstUsable = 2 + gptEntrySects
+)
+
+var (
+	// EFISystemPartition is the GPT partition type of an EFI system partition
+	EFISystemPartition = uuid.MustParse("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+)
+
+// Partition is a partition in a GPT partition table. Start and End are the first and last sectors.
+type Partition struct {
+	Type       uuid.UUID
+	GUID       uuid.UUID
+	Start      uint64
+	End        uint64
+	Attributes uint64
+	Name       string
+}
+
+// WriteGPT writes a protective MBR, and the primary and backup GPT partition tables for a disk of
+// size bytes, which must be a whole number of sectors
+func WriteGPT(w io.WriterAt, size int64, disk uuid.UUID, partitions []Partition) error {
+	if size%SectorSize != 0 {
+		return fmt.Errorf("disk size %d is not a multiple of the sector size", size)
+	}
+	if len(partitions) > gptEntries {
+		return fmt.Errorf("too many partitions: %d", len(partitions))
+	}
+	last := uint64(size/SectorSize) - 1
+	if last < 2*gptFirstUsable {
+		return errors.New("disk too small for partition table")
+	}
+	lastUsable := last - gptEntrySects - 1
+
+	entries := make([]byte, gptEntries*gptEntrySize)
+	for i, p := range partitions {
+		if p.Start < gptFirstUsable || p.End > lastUsable || p.End < p.Start {
+			return fmt.Errorf("partition %d sectors %d-%d outside usable space %d-%d", i+1, p.Start, p.End, gptFirstUsable, lastUsable)
+		}
+		e := entries[i*gptEntrySize : (i+1)*gptEntrySize]
+		copy(e[0:16], guidBytes(p.Type))
+		copy(e[16:32], guidBytes(p.GUID))
+		binary.LittleEndian.PutUint64(e[32:], p.Start)
+		binary.LittleEndian.PutUint64(e[40:], p.End)
+		binary.LittleEndian.PutUint64(e[48:], p.Attributes)
+		name := utf16.Encode([]rune(p.Name))
+		if len(name) > 36 {
+			return fmt.Errorf("partition name %q too long", p.Name)
+		}
+		for j, c := range name {
+			binary.LittleEndian.PutUint16(e[56+2*j:], c)
+		}
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries)
+
+	header := func(self, alternate, entriesLBA uint64) []byte {
+		h := make([]byte, SectorSize)
+		copy(h[0:8], "EFI PART")
+		binary.LittleEndian.PutUint32(h[8:], 0x00010000)
+		binary.LittleEndian.PutUint32(h[12:], gptHeaderSize)
+		binary.LittleEndian.PutUint64(h[24:], self)
+		binary.LittleEndian.PutUint64(h[32:], alternate)
+		binary.LittleEndian.PutUint64(h[40:], gptFirstUsable)
+		binary.LittleEndian.PutUint64(h[48:], lastUsable)
+		copy(h[56:72], guidBytes(disk))
+		binary.LittleEndian.PutUint64(h[72:], entriesLBA)
+		binary.LittleEndian.PutUint32(h[80:], gptEntries)
+		binary.LittleEndian.PutUint32(h[84:], gptEntrySize)
+		binary.LittleEndian.PutUint32(h[88:], entriesCRC)
+		binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h[:gptHeaderSize]))
+		return h
+	}
+
+	// protective MBR, with a single partition of type 0xEE covering the disk
+	mbr := make([]byte, SectorSize)
+	p := mbr[446:462]
+	p[1], p[2], p[3] = 0x00, 0x02, 0x00
+	p[4] = 0xee
+	p[5], p[6], p[7] = 0xff, 0xff, 0xff
+	binary.LittleEndian.PutUint32(p[8:], 1)
+	if last > 0xffffffff {
+		binary.LittleEndian.PutUint32(p[12:], 0xffffffff)
+	} else {
+		binary.LittleEndian.PutUint32(p[12:], uint32(last))
+	}
+	mbr[510], mbr[511] = 0x55, 0xaa
+
+	for _, s := range []struct {
+		lba  uint64
+		data []byte
+	}{
+		{0, mbr},
+		{1, header(1, last, 2)},
+		{2, entries},
+		{last - gptEntrySects, entries},
+		{last, header(last, 1, last-gptEntrySects)},
+	} {
+		if _, err := w.WriteAt(s.data, int64(s.lba)*SectorSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// guidBytes returns the on disk form of a GUID, which has the first three fields little endian
+func guidBytes(u uuid.UUID) []byte {
+	b := make([]byte, 16)
+	copy(b, u[:])
+	b[0], b[1], b[2], b[3] = u[3], u[2], u[1], u[0]
+	b[4], b[5] = u[5], u[4]
+	b[6], b[7] = u[7], u[6]
+	return b
+}
@@ -0,0 +1,902 @@
+package diskimage
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// ISOSectorSize is the logical block size of ISO9660 images
+	ISOSectorSize = 2048
+
+	isoSystemAreaSectors = 16
+	isoMaxRecord         = 255
+	isoMaxIdentifier     = 30
+
+	// POSIX file types, as recorded by Rock Ridge
+	sIFMT   = 0170000
+	sIFDIR  = 0040000
+	sIFREG  = 0100000
+	sIFLNK  = 0120000
+	sIFCHR  = 0020000
+	sIFBLK  = 0060000
+	sIFIFO  = 0010000
+	ceEntry = 28
+
+	// El Torito platforms
+	eltoritoX86 = 0x00
+	eltoritoEFI = 0xef
+
+	// isolinuxHybridMagic marks an isolinux.bin that can boot from a hybrid disk image
+	isolinuxHybridMagic = 0x7078c0fb
+	// hybridHeads and hybridSectors are the disk geometry used by isohybrid, which pads the image to
+	// a whole number of cylinders
+	hybridHeads   = 64
+	hybridSectors = 32
+)
+
+// ISO is an ISO9660 filesystem with Rock Ridge extensions, so it has POSIX names, permissions, symbolic
+// links and devices, and can be made bootable with El Torito. It is the equivalent of the filesystems that
+// mkisofs -R creates in the mkimage-iso-* images.
+type ISO struct {
+	volumeID string
+	modTime  time.Time
+	root     *isoNode
+	bios     *isoBIOSBoot
+	efi      []byte
+}
+
+type isoBIOSBoot struct {
+	image *isoNode
+	mbr   []byte
+}
+
+type isoNode struct {
+	name     string
+	mode     uint32
+	uid      uint32
+	gid      uint32
+	modTime  time.Time
+	devMajor uint32
+	devMinor uint32
+	target   string
+	contents []byte
+	children map[string]*isoNode
+	parent   *isoNode
+	// link is the file that a hard link shares its contents with
+	link  *isoNode
+	nlink uint32
+	// catalog is set for the El Torito boot catalog, whose contents are generated
+	catalog bool
+
+	// set when writing the image
+	id      string
+	extent  uint32
+	size    uint32
+	number  int
+	records []*isoRecord
+	sorted  []*isoNode
+}
+
+type isoRecord struct {
+	node   *isoNode
+	id     []byte
+	su     []byte
+	ce     []byte
+	ceAt   int
+	offset int
+}
+
+// NewISO returns an empty ISO9660 filesystem with the volume ID and times of its root directory set
+func NewISO(volumeID string, modTime time.Time) *ISO {
+	return &ISO{
+		volumeID: volumeID,
+		modTime:  modTime,
+		root:     &isoNode{mode: sIFDIR | 0755, modTime: modTime, children: map[string]*isoNode{}},
+	}
+}
+
+// Add adds a file, directory, link or device from a tar header and its contents. Parent directories are
+// created if needed, and a later entry for the same path replaces an earlier one, as when extracting a tar.
+func (iso *ISO) Add(hdr *tar.Header, contents []byte) error {
+	name := path.Clean("/" + hdr.Name)
+	n := &isoNode{
+		mode:     uint32(hdr.Mode & 07777),
+		uid:      uint32(hdr.Uid),
+		gid:      uint32(hdr.Gid),
+		modTime:  hdr.ModTime,
+		devMajor: uint32(hdr.Devmajor),
+		devMinor: uint32(hdr.Devminor),
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		n.mode |= sIFDIR
+		n.children = map[string]*isoNode{}
+	case tar.TypeReg:
+		n.mode |= sIFREG
+		n.contents = contents
+	case tar.TypeSymlink:
+		n.mode |= sIFLNK
+		n.target = hdr.Linkname
+	case tar.TypeLink:
+		target, err := iso.lookup(path.Clean("/" + hdr.Linkname))
+		if err != nil {
+			return fmt.Errorf("hard link %s: %v", hdr.Name, err)
+		}
+		if target.mode&sIFMT != sIFREG {
+			return fmt.Errorf("hard link %s to %s is not to a regular file", hdr.Name, hdr.Linkname)
+		}
+		for target.link != nil {
+			target = target.link
+		}
+		n.mode = target.mode
+		n.link = target
+	case tar.TypeChar:
+		n.mode |= sIFCHR
+	case tar.TypeBlock:
+		n.mode |= sIFBLK
+	case tar.TypeFifo:
+		n.mode |= sIFIFO
+	default:
+		return nil
+	}
+	if name == "/" {
+		if n.mode&sIFMT != sIFDIR {
+			return errors.New("root must be a directory")
+		}
+		n.children = iso.root.children
+		for _, c := range n.children {
+			c.parent = n
+		}
+		iso.root = n
+		return nil
+	}
+	if n.mode&sIFMT == sIFREG && int64(len(contents)) > 0xffffffff {
+		return fmt.Errorf("%s is too large for ISO9660", hdr.Name)
+	}
+	dir, err := iso.mkdirAll(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	n.name = path.Base(name)
+	n.parent = dir
+	if old, ok := dir.children[n.name]; ok && old.children != nil && n.children != nil {
+		// keep the contents of a directory that is added again
+		n.children = old.children
+		for _, c := range n.children {
+			c.parent = n
+		}
+	}
+	dir.children[n.name] = n
+	return nil
+}
+
+// AddFile adds a regular file with mode 0644 owned by root
+func (iso *ISO) AddFile(name string, contents []byte) error {
+	return iso.Add(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(contents)),
+		ModTime:  iso.modTime,
+	}, contents)
+}
+
+func (iso *ISO) lookup(name string) (*isoNode, error) {
+	n := iso.root
+	for _, part := range strings.Split(strings.Trim(name, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		if n.children == nil {
+			return nil, fmt.Errorf("%s is not a directory", n.name)
+		}
+		c, ok := n.children[part]
+		if !ok {
+			return nil, fmt.Errorf("%s does not exist", name)
+		}
+		n = c
+	}
+	return n, nil
+}
+
+func (iso *ISO) mkdirAll(name string) (*isoNode, error) {
+	n := iso.root
+	for _, part := range strings.Split(strings.Trim(name, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		c, ok := n.children[part]
+		if !ok {
+			c = &isoNode{name: part, mode: sIFDIR | 0755, modTime: iso.modTime, children: map[string]*isoNode{}, parent: n}
+			n.children[part] = c
+		}
+		if c.children == nil {
+			return nil, fmt.Errorf("%s is not a directory", part)
+		}
+		n = c
+	}
+	return n, nil
+}
+
+// SetBIOSBoot makes the image bootable from BIOS with El Torito, using image, which must be an isolinux.bin
+// already added, with no emulation and a boot info table. The boot catalog is added as catalog. If mbr is
+// not empty, it is the isohdpfx.bin boot code to make a hybrid image, which can also boot as a disk, as
+// isohybrid does.
+func (iso *ISO) SetBIOSBoot(image, catalog string, mbr []byte) error {
+	n, err := iso.lookup(image)
+	if err != nil {
+		return fmt.Errorf("boot image: %v", err)
+	}
+	for n.link != nil {
+		n = n.link
+	}
+	if n.mode&sIFMT != sIFREG || len(n.contents) < 0x44 {
+		return fmt.Errorf("boot image %s is not a valid boot file", image)
+	}
+	if len(mbr) > 0 && binary.LittleEndian.Uint32(n.contents[0x40:]) != isolinuxHybridMagic {
+		return fmt.Errorf("boot image %s does not support hybrid booting", image)
+	}
+	if err := iso.AddFile(catalog, nil); err != nil {
+		return err
+	}
+	c, err := iso.lookup(catalog)
+	if err != nil {
+		return err
+	}
+	c.catalog = true
+	iso.bios = &isoBIOSBoot{image: n, mbr: mbr}
+	return nil
+}
+
+// SetEFIBoot makes the image bootable from EFI with El Torito, using a FAT filesystem image, which is
+// not visible in the ISO9660 filesystem
+func (iso *ISO) SetEFIBoot(image []byte) {
+	iso.efi = image
+}
+
+// layout assigns identifiers and system use areas, returning the directories in path table order
+func (iso *ISO) layout() ([]*isoNode, error) {
+	var dirs []*isoNode
+	queue := []*isoNode{iso.root}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		dirs = append(dirs, d)
+		d.number = len(dirs)
+		if d.number > 0xffff {
+			return nil, errors.New("too many directories for ISO9660")
+		}
+		d.sorted = sortedChildren(d)
+		for _, c := range d.sorted {
+			if c.children != nil {
+				queue = append(queue, c)
+			}
+		}
+	}
+	// count the links to each file and subdirectories of each directory
+	for _, d := range dirs {
+		d.nlink = 2
+		if d.parent != nil {
+			d.parent.nlink++
+		}
+		for _, c := range d.children {
+			switch {
+			case c.children != nil:
+			case c.link != nil:
+				c.link.nlink++
+			default:
+				c.nlink++
+			}
+		}
+	}
+	for _, d := range dirs {
+		parent := d.parent
+		if parent == nil {
+			parent = d
+		}
+		dot := []byte{0}
+		entries := [][]byte{}
+		if d == iso.root {
+			entries = append(entries, susp("SP", []byte{0xbe, 0xef, 0}))
+		}
+		entries = append(entries, d.rockRidge(iso.modTime)...)
+		if d == iso.root {
+			entries = append(entries, erEntry())
+		}
+		records := []*isoRecord{{node: d, id: dot}, {node: parent, id: []byte{1}}}
+		if err := records[0].pack(entries); err != nil {
+			return nil, err
+		}
+		if err := records[1].pack(parent.rockRidge(iso.modTime)); err != nil {
+			return nil, err
+		}
+		for _, c := range d.sorted {
+			id := c.id
+			if c.children == nil {
+				id += ";1"
+			}
+			r := &isoRecord{node: c, id: []byte(id)}
+			if err := r.pack(c.rockRidgeNamed(iso.modTime)); err != nil {
+				return nil, fmt.Errorf("%s: %v", c.path(), err)
+			}
+			records = append(records, r)
+		}
+		pos := 0
+		for _, r := range records {
+			l := r.length()
+			if pos%ISOSectorSize+l > ISOSectorSize {
+				pos = (pos + ISOSectorSize - 1) / ISOSectorSize * ISOSectorSize
+			}
+			r.offset = pos
+			pos += l
+		}
+		d.records = records
+		d.size = uint32((pos + ISOSectorSize - 1) / ISOSectorSize * ISOSectorSize)
+	}
+	return dirs, nil
+}
+
+func (n *isoNode) path() string {
+	if n.parent == nil {
+		return "/"
+	}
+	return path.Join(n.parent.path(), n.name)
+}
+
+// sortedChildren assigns unique ISO9660 identifiers to the children of a directory, and returns them
+// in the order of their identifiers
+func sortedChildren(d *isoNode) []*isoNode {
+	var names []string
+	for name := range d.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	used := map[string]bool{}
+	var children []*isoNode
+	for _, name := range names {
+		c := d.children[name]
+		base, ext := isoIdentifier(c.name, c.children != nil)
+		id := joinIdentifier(base, ext, c.children != nil)
+		for i := 1; used[id]; i++ {
+			suffix := fmt.Sprintf("%d", i)
+			b := base
+			if len(b)+len(suffix) > isoMaxIdentifier-len(ext)-1 {
+				b = b[:max(0, isoMaxIdentifier-len(ext)-1-len(suffix))]
+			}
+			id = joinIdentifier(b+suffix, ext, c.children != nil)
+		}
+		used[id] = true
+		c.id = id
+		children = append(children, c)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		bi, ei, _ := strings.Cut(children[i].id, ".")
+		bj, ej, _ := strings.Cut(children[j].id, ".")
+		if bi != bj {
+			return bi < bj
+		}
+		return ei < ej
+	})
+	return children
+}
+
+// isoIdentifier returns the base name and extension of the ISO9660 identifier for a name, using only
+// d-characters
+func isoIdentifier(name string, dir bool) (string, string) {
+	clean := func(s string) string {
+		var b strings.Builder
+		for _, c := range strings.ToUpper(s) {
+			if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' {
+				b.WriteRune(c)
+			} else {
+				b.WriteRune('_')
+			}
+		}
+		return b.String()
+	}
+	if dir {
+		base := clean(name)
+		if len(base) > isoMaxIdentifier {
+			base = base[:isoMaxIdentifier]
+		}
+		return base, ""
+	}
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	base, ext = clean(base), clean(ext)
+	if len(ext) > 8 {
+		ext = ext[:8]
+	}
+	if len(base) > isoMaxIdentifier-len(ext)-1 {
+		base = base[:isoMaxIdentifier-len(ext)-1]
+	}
+	return base, ext
+}
+
+func joinIdentifier(base, ext string, dir bool) string {
+	if dir {
+		return base
+	}
+	return base + "." + ext
+}
+
+// rockRidge returns the Rock Ridge entries for the attributes of a node
+func (n *isoNode) rockRidge(defaultTime time.Time) [][]byte {
+	nlink, mode := n.nlink, n.mode
+	if n.link != nil {
+		nlink = n.link.nlink
+	}
+	px := append(both32(mode), both32(nlink)...)
+	px = append(px, both32(n.uid)...)
+	px = append(px, both32(n.gid)...)
+	t := n.modTime
+	if t.IsZero() {
+		t = defaultTime
+	}
+	// modify, access and attribute change times
+	tf := []byte{0x0e}
+	for i := 0; i < 3; i++ {
+		tf = append(tf, isoRecordTime(t)...)
+	}
+	return [][]byte{susp("PX", px), susp("TF", tf)}
+}
+
+// rockRidgeNamed returns the Rock Ridge entries for a node, including its name and link target
+func (n *isoNode) rockRidgeNamed(defaultTime time.Time) [][]byte {
+	entries := n.rockRidge(defaultTime)
+	name := []byte(n.name)
+	for len(name) > 0 {
+		l := min(len(name), isoMaxRecord-5)
+		flags := byte(0)
+		if l < len(name) {
+			flags = 1
+		}
+		entries = append(entries, susp("NM", append([]byte{flags}, name[:l]...)))
+		name = name[l:]
+	}
+	switch n.mode & sIFMT {
+	case sIFLNK:
+		entries = append(entries, slEntries(n.target)...)
+	case sIFCHR, sIFBLK:
+		entries = append(entries, susp("PN", append(both32(n.devMajor), both32(n.devMinor)...)))
+	}
+	return entries
+}
+
+// slEntries returns the SL entries for a symbolic link target
+func slEntries(target string) [][]byte {
+	var components [][]byte
+	if strings.HasPrefix(target, "/") {
+		components = append(components, []byte{0x08, 0})
+	}
+	for _, part := range strings.Split(target, "/") {
+		switch part {
+		case "":
+		case ".":
+			components = append(components, []byte{0x02, 0})
+		case "..":
+			components = append(components, []byte{0x04, 0})
+		default:
+			for len(part) > 0 {
+				l := min(len(part), isoMaxRecord-10)
+				flags := byte(0)
+				if l < len(part) {
+					flags = 1
+				}
+				components = append(components, append([]byte{flags, byte(l)}, part[:l]...))
+				part = part[l:]
+			}
+		}
+	}
+	var entries [][]byte
+	var current []byte
+	for i, c := range components {
+		if len(current)+len(c) > isoMaxRecord-5 {
+			entries = append(entries, current)
+			current = nil
+		}
+		current = append(current, c...)
+		if i == len(components)-1 {
+			entries = append(entries, current)
+		}
+	}
+	var sl [][]byte
+	for i, e := range entries {
+		flags := byte(0)
+		if i < len(entries)-1 {
+			flags = 1
+		}
+		sl = append(sl, susp("SL", append([]byte{flags}, e...)))
+	}
+	return sl
+}
+
+// erEntry returns the extension reference for Rock Ridge
+func erEntry() []byte {
+	id := "RRIP_1991A"
+	des := "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+	src := "PLEASE CONTACT DISC PUBLISHER FOR SPECIFICATION SOURCE.  SEE PUBLISHER IDENTIFIER IN PRIMARY VOLUME DESCRIPTOR FOR CONTACT INFORMATION."
+	b := []byte{byte(len(id)), byte(len(des)), byte(len(src)), 1}
+	b = append(b, id...)
+	b = append(b, des...)
+	b = append(b, src...)
+	return susp("ER", b)
+}
+
+func susp(sig string, data []byte) []byte {
+	return append([]byte{sig[0], sig[1], byte(4 + len(data)), 1}, data...)
+}
+
+// pack puts the system use entries in the record, moving those that do not fit to a continuation area
+func (r *isoRecord) pack(entries [][]byte) error {
+	r.ceAt = -1
+	// records must have an even length
+	budget := isoMaxRecord - 1 - r.length()
+	total := 0
+	for _, e := range entries {
+		total += len(e)
+	}
+	if total <= budget {
+		for _, e := range entries {
+			r.su = append(r.su, e...)
+		}
+		return nil
+	}
+	i := 0
+	for ; i < len(entries) && len(r.su)+len(entries[i]) <= budget-ceEntry; i++ {
+		r.su = append(r.su, entries[i]...)
+	}
+	r.ceAt = len(r.su)
+	r.su = append(r.su, susp("CE", make([]byte, ceEntry-4))...)
+	for ; i < len(entries); i++ {
+		r.ce = append(r.ce, entries[i]...)
+	}
+	if len(r.ce) > ISOSectorSize {
+		return errors.New("too much Rock Ridge information")
+	}
+	return nil
+}
+
+// length returns the length of the directory record
+func (r *isoRecord) length() int {
+	l := 33 + len(r.id) + len(r.su)
+	if len(r.id)%2 == 0 {
+		l++
+	}
+	return l + l%2
+}
+
+func (r *isoRecord) bytes(extent, size uint32, t time.Time, flags byte) []byte {
+	b := make([]byte, r.length())
+	b[0] = byte(len(b))
+	copy(b[2:], both32(extent))
+	copy(b[10:], both32(size))
+	copy(b[18:], isoRecordTime(t))
+	b[25] = flags
+	copy(b[28:], both16(1))
+	b[32] = byte(len(r.id))
+	copy(b[33:], r.id)
+	su := 33 + len(r.id)
+	if len(r.id)%2 == 0 {
+		su++
+	}
+	copy(b[su:], r.su)
+	return b
+}
+
+// Write writes the image to filename
+func (iso *ISO) Write(filename string) error {
+	dirs, err := iso.layout()
+	if err != nil {
+		return err
+	}
+
+	// allocate sectors: volume descriptors, path tables, boot catalog, directories, continuation
+	// areas, the EFI boot image, then file contents
+	next := uint32(isoSystemAreaSectors)
+	alloc := func(size int) uint32 {
+		lba := next
+		next += uint32((size + ISOSectorSize - 1) / ISOSectorSize)
+		return lba
+	}
+	pvdLBA := alloc(ISOSectorSize)
+	boot := iso.bios != nil || iso.efi != nil
+	var brLBA uint32
+	if boot {
+		brLBA = alloc(ISOSectorSize)
+	}
+	termLBA := alloc(ISOSectorSize)
+	pathTableSize := 0
+	for _, d := range dirs {
+		l := max(len(d.id), 1)
+		pathTableSize += 8 + l + l%2
+	}
+	lTableLBA := alloc(pathTableSize)
+	mTableLBA := alloc(pathTableSize)
+	var catalogLBA uint32
+	if boot {
+		catalogLBA = alloc(ISOSectorSize)
+	}
+	for _, d := range dirs {
+		d.extent = alloc(int(d.size))
+	}
+	var ce []byte
+	ceLBA := next
+	for _, d := range dirs {
+		for _, r := range d.records {
+			if r.ceAt < 0 {
+				continue
+			}
+			if len(ce)%ISOSectorSize+len(r.ce) > ISOSectorSize {
+				ce = append(ce, make([]byte, ISOSectorSize-len(ce)%ISOSectorSize)...)
+			}
+			lba := ceLBA + uint32(len(ce)/ISOSectorSize)
+			copy(r.su[r.ceAt+4:], both32(lba))
+			copy(r.su[r.ceAt+12:], both32(uint32(len(ce)%ISOSectorSize)))
+			copy(r.su[r.ceAt+20:], both32(uint32(len(r.ce))))
+			ce = append(ce, r.ce...)
+		}
+	}
+	alloc(len(ce))
+	var efiLBA uint32
+	if iso.efi != nil {
+		efiLBA = alloc(len(iso.efi))
+	}
+	var files []*isoNode
+	for _, d := range dirs {
+		for _, c := range d.sorted {
+			switch {
+			case c.catalog:
+				c.extent, c.size = catalogLBA, ISOSectorSize
+			case c.link != nil || c.mode&sIFMT != sIFREG:
+			case len(c.contents) > 0:
+				c.size = uint32(len(c.contents))
+				c.extent = alloc(len(c.contents))
+				files = append(files, c)
+			}
+		}
+	}
+	for _, d := range dirs {
+		for _, c := range d.sorted {
+			if c.link != nil {
+				c.extent, c.size = c.link.extent, c.link.size
+			}
+		}
+	}
+	total := int64(next) * ISOSectorSize
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	size := total
+	if iso.bios != nil && len(iso.bios.mbr) > 0 {
+		cylinder := int64(hybridHeads * hybridSectors * SectorSize)
+		size = (total + cylinder - 1) / cylinder * cylinder
+	}
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	writeAt := func(lba uint32, b []byte) error {
+		_, err := f.WriteAt(b, int64(lba)*ISOSectorSize)
+		return err
+	}
+
+	if err := writeAt(pvdLBA, iso.primaryVolumeDescriptor(next, pathTableSize, lTableLBA, mTableLBA)); err != nil {
+		return err
+	}
+	if boot {
+		br := make([]byte, ISOSectorSize)
+		copy(br[1:], "CD001\x01EL TORITO SPECIFICATION")
+		binary.LittleEndian.PutUint32(br[71:], catalogLBA)
+		if err := writeAt(brLBA, br); err != nil {
+			return err
+		}
+		if err := writeAt(catalogLBA, iso.bootCatalog(efiLBA)); err != nil {
+			return err
+		}
+	}
+	term := make([]byte, ISOSectorSize)
+	copy(term, "\xffCD001\x01")
+	if err := writeAt(termLBA, term); err != nil {
+		return err
+	}
+	var lTable, mTable []byte
+	for _, d := range dirs {
+		id := []byte(d.id)
+		if d.parent == nil {
+			id = []byte{0}
+		}
+		parent := 1
+		if d.parent != nil {
+			parent = d.parent.number
+		}
+		e := make([]byte, 8+len(id)+len(id)%2)
+		e[0] = byte(len(id))
+		copy(e[8:], id)
+		binary.LittleEndian.PutUint32(e[2:], d.extent)
+		binary.LittleEndian.PutUint16(e[6:], uint16(parent))
+		lTable = append(lTable, e...)
+		e = append([]byte{}, e...)
+		binary.BigEndian.PutUint32(e[2:], d.extent)
+		binary.BigEndian.PutUint16(e[6:], uint16(parent))
+		mTable = append(mTable, e...)
+	}
+	if err := writeAt(lTableLBA, lTable); err != nil {
+		return err
+	}
+	if err := writeAt(mTableLBA, mTable); err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		b := make([]byte, d.size)
+		for _, r := range d.records {
+			copy(b[r.offset:], r.bytes(r.node.extent, r.node.size, r.node.modTime, r.node.flags()))
+		}
+		if err := writeAt(d.extent, b); err != nil {
+			return err
+		}
+	}
+	if len(ce) > 0 {
+		if err := writeAt(ceLBA, ce); err != nil {
+			return err
+		}
+	}
+	if iso.efi != nil {
+		if err := writeAt(efiLBA, iso.efi); err != nil {
+			return err
+		}
+	}
+	for _, n := range files {
+		contents := n.contents
+		if iso.bios != nil && n == iso.bios.image {
+			contents = bootInfoTable(contents, pvdLBA, n.extent)
+		}
+		if err := writeAt(n.extent, contents); err != nil {
+			return err
+		}
+	}
+	if iso.bios != nil && len(iso.bios.mbr) > 0 {
+		if _, err := f.WriteAt(iso.hybridMBR(size), 0); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func (n *isoNode) flags() byte {
+	if n.children != nil {
+		return 0x02
+	}
+	return 0
+}
+
+func (iso *ISO) primaryVolumeDescriptor(sectors uint32, pathTableSize int, lTableLBA, mTableLBA uint32) []byte {
+	b := make([]byte, ISOSectorSize)
+	b[0] = 1
+	copy(b[1:], "CD001\x01")
+	copy(b[8:40], fmt.Sprintf("%-32s", ""))
+	copy(b[40:72], fmt.Sprintf("%-32.32s", iso.volumeID))
+	copy(b[80:], both32(sectors))
+	copy(b[120:], both16(1))
+	copy(b[124:], both16(1))
+	copy(b[128:], both16(ISOSectorSize))
+	copy(b[132:], both32(uint32(pathTableSize)))
+	binary.LittleEndian.PutUint32(b[140:], lTableLBA)
+	binary.BigEndian.PutUint32(b[148:], mTableLBA)
+	root := &isoRecord{id: []byte{0}}
+	copy(b[156:190], root.bytes(iso.root.extent, iso.root.size, iso.root.modTime, 0x02))
+	copy(b[190:813], strings.Repeat(" ", 813-190))
+	t := iso.modTime.UTC().Format("20060102150405") + "00"
+	copy(b[813:], t)
+	copy(b[830:], t)
+	copy(b[847:], "0000000000000000")
+	copy(b[864:], "0000000000000000")
+	b[881] = 1
+	return b
+}
+
+// bootCatalog returns the El Torito boot catalog, with the BIOS boot image as the default entry, and the
+// EFI boot image in a section if there is one, or as the default entry otherwise
+func (iso *ISO) bootCatalog(efiLBA uint32) []byte {
+	b := make([]byte, ISOSectorSize)
+	entry := func(e []byte, count, lba uint32) {
+		e[0] = 0x88
+		binary.LittleEndian.PutUint16(e[6:], uint16(min(count, 0xffff)))
+		binary.LittleEndian.PutUint32(e[8:], lba)
+	}
+	efiCount := uint32((len(iso.efi) + SectorSize - 1) / SectorSize)
+	b[0] = 1
+	if iso.bios != nil {
+		b[1] = eltoritoX86
+		entry(b[32:64], 4, iso.bios.image.extent)
+		if iso.efi != nil {
+			b[64] = 0x91
+			b[65] = eltoritoEFI
+			binary.LittleEndian.PutUint16(b[66:], 1)
+			entry(b[96:128], efiCount, efiLBA)
+		}
+	} else {
+		b[1] = eltoritoEFI
+		entry(b[32:64], efiCount, efiLBA)
+	}
+	b[30], b[31] = 0x55, 0xaa
+	var sum uint16
+	for i := 0; i < 32; i += 2 {
+		sum += binary.LittleEndian.Uint16(b[i:])
+	}
+	binary.LittleEndian.PutUint16(b[28:], -sum)
+	return b
+}
+
+// bootInfoTable returns a copy of an isolinux boot file with the boot info table filled in, as
+// mkisofs -boot-info-table does
+func bootInfoTable(contents []byte, pvdLBA, lba uint32) []byte {
+	b := make([]byte, (len(contents)+3)/4*4)
+	copy(b, contents)
+	var sum uint32
+	for i := 64; i < len(b); i += 4 {
+		sum += binary.LittleEndian.Uint32(b[i:])
+	}
+	binary.LittleEndian.PutUint32(b[8:], pvdLBA)
+	binary.LittleEndian.PutUint32(b[12:], lba)
+	binary.LittleEndian.PutUint32(b[16:], uint32(len(contents)))
+	binary.LittleEndian.PutUint32(b[20:], sum)
+	return b[:len(contents)]
+}
+
+// hybridMBR returns the master boot record written by isohybrid, with a single partition covering the
+// whole image, of size bytes
+func (iso *ISO) hybridMBR(size int64) []byte {
+	b := make([]byte, SectorSize)
+	copy(b[:432], iso.bios.mbr)
+	binary.LittleEndian.PutUint64(b[432:], uint64(iso.bios.image.extent)*ISOSectorSize/SectorSize)
+	// a disk signature, which only needs to be stable for the same contents
+	binary.LittleEndian.PutUint32(b[440:], iso.bios.image.extent^uint32(size/SectorSize))
+	cylinders := size / (hybridHeads * hybridSectors * SectorSize)
+	p := b[446:462]
+	p[0] = 0x80
+	p[1], p[2], p[3] = 0, 1, 0
+	p[4] = 0x17
+	p[5] = hybridHeads - 1
+	p[6] = byte(hybridSectors + ((cylinders-1)&0x300)>>2)
+	p[7] = byte((cylinders - 1) & 0xff)
+	binary.LittleEndian.PutUint32(p[12:], uint32(size/SectorSize))
+	b[510], b[511] = 0x55, 0xaa
+	return b
+}
+
+// isoRecordTime returns the 7 byte time format used in directory records and Rock Ridge
+func isoRecordTime(t time.Time) []byte {
+	t = t.UTC()
+	if t.Year() < 1900 {
+		t = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return []byte{byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0}
+}
+
+// both32 returns v in both byte orders, little endian first
+func both32(v uint32) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+	return b
+}
+
+func both16(v uint16) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+	return b
+}
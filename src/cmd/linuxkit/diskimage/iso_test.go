@@ -0,0 +1,226 @@
+package diskimage
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type isoEntry struct {
+	name   string
+	mode   uint32
+	target string
+	extent uint32
+	size   uint32
+	major  uint32
+	minor  uint32
+}
+
+// readISODir returns the entries of a directory, using their Rock Ridge attributes
+func readISODir(t *testing.T, img []byte, extent, size uint32) []isoEntry {
+	t.Helper()
+	var entries []isoEntry
+	dir := img[extent*ISOSectorSize : extent*ISOSectorSize+size]
+	for off := 0; off < len(dir); {
+		l := int(dir[off])
+		if l == 0 {
+			off = (off/ISOSectorSize + 1) * ISOSectorSize
+			continue
+		}
+		r := dir[off : off+l]
+		off += l
+		idLen := int(r[32])
+		if idLen == 1 && (r[33] == 0 || r[33] == 1) {
+			continue
+		}
+		e := isoEntry{
+			extent: binary.LittleEndian.Uint32(r[2:]),
+			size:   binary.LittleEndian.Uint32(r[10:]),
+		}
+		su := r[33+idLen+1-idLen%2:]
+		for len(su) >= 4 {
+			sl := int(su[2])
+			if sl < 4 || sl > len(su) {
+				break
+			}
+			data := su[4:sl]
+			switch string(su[0:2]) {
+			case "NM":
+				e.name += string(data[1:])
+			case "PX":
+				e.mode = binary.LittleEndian.Uint32(data)
+			case "PN":
+				e.major, e.minor = binary.LittleEndian.Uint32(data), binary.LittleEndian.Uint32(data[8:])
+			case "SL":
+				for c := data[1:]; len(c) >= 2; c = c[2+int(c[1]):] {
+					switch {
+					case c[0]&0x08 != 0:
+						e.target += "/"
+					case c[0]&0x04 != 0:
+						e.target += "../"
+					case c[0]&0x02 != 0:
+						e.target += "./"
+					default:
+						e.target += string(c[2:2+int(c[1])]) + "/"
+					}
+				}
+			case "CE":
+				lba, offset, length := binary.LittleEndian.Uint32(data), binary.LittleEndian.Uint32(data[8:]), binary.LittleEndian.Uint32(data[16:])
+				start := lba*ISOSectorSize + offset
+				su = img[start : start+length]
+				continue
+			}
+			su = su[sl:]
+		}
+		if e.target != "/" {
+			e.target = strings.TrimSuffix(e.target, "/")
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func readISOPath(t *testing.T, img []byte, path string) isoEntry {
+	t.Helper()
+	root := img[16*ISOSectorSize+156:]
+	e := isoEntry{extent: binary.LittleEndian.Uint32(root[2:]), size: binary.LittleEndian.Uint32(root[10:]), mode: sIFDIR}
+	for _, part := range strings.Split(path, "/") {
+		found := false
+		for _, c := range readISODir(t, img, e.extent, e.size) {
+			if c.name == part {
+				e, found = c, true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("%s not found", path)
+		}
+	}
+	return e
+}
+
+func TestISO(t *testing.T) {
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	isolinux := make([]byte, 4000)
+	binary.LittleEndian.PutUint32(isolinux[0x40:], isolinuxHybridMagic)
+	isolinux[3999] = 0x42
+	longName := strings.Repeat("long-name-", 20)
+
+	efiImage, err := FATImage(1024*1024, []File{{"EFI/BOOT/BOOTX64.EFI", []byte("grub")}}, 1, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(efiImage[54:62]) != "FAT12   " || string(readFAT(t, efiImage, "EFI/BOOT/BOOTX64.EFI")) != "grub" {
+		t.Fatal("invalid FAT12 EFI boot image")
+	}
+
+	build := func(filename string) []byte {
+		iso := NewISO("LinuxKit", modTime)
+		for _, e := range []struct {
+			hdr      tar.Header
+			contents string
+		}{
+			{tar.Header{Name: "boot/kernel", Typeflag: tar.TypeReg, Mode: 0644}, "kernel"},
+			{tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0700}, ""},
+			{tar.Header{Name: "etc/" + longName, Typeflag: tar.TypeReg, Mode: 0600}, "long"},
+			{tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755}, "busybox"},
+			{tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "/bin/busybox"}, ""},
+			{tar.Header{Name: "bin/ls", Typeflag: tar.TypeLink, Linkname: "bin/busybox"}, ""},
+			{tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}, ""},
+			{tar.Header{Name: "isolinux/isolinux.bin", Typeflag: tar.TypeReg, Mode: 0644}, string(isolinux)},
+		} {
+			if err := iso.Add(&e.hdr, []byte(e.contents)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := iso.SetBIOSBoot("isolinux/isolinux.bin", "isolinux/boot.cat", bytes.Repeat([]byte{0xfa}, 432)); err != nil {
+			t.Fatal(err)
+		}
+		iso.SetEFIBoot(efiImage)
+		if err := iso.Write(filename); err != nil {
+			t.Fatal(err)
+		}
+		img, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	dir := t.TempDir()
+	img := build(filepath.Join(dir, "test.iso"))
+	if !bytes.Equal(img, build(filepath.Join(dir, "again.iso"))) {
+		t.Error("images differ for the same input")
+	}
+
+	if string(img[16*ISOSectorSize+1:16*ISOSectorSize+6]) != "CD001" || strings.TrimSpace(string(img[16*ISOSectorSize+40:16*ISOSectorSize+72])) != "LinuxKit" {
+		t.Fatal("invalid primary volume descriptor")
+	}
+	for _, tc := range []struct {
+		path     string
+		mode     uint32
+		contents string
+		target   string
+	}{
+		{"boot/kernel", sIFREG | 0644, "kernel", ""},
+		{"etc", sIFDIR | 0700, "", ""},
+		{"etc/" + longName, sIFREG | 0600, "long", ""},
+		{"bin/sh", sIFLNK, "", "/bin/busybox"},
+		{"bin/ls", sIFREG, "busybox", ""},
+	} {
+		e := readISOPath(t, img, tc.path)
+		if e.mode&^0777 != tc.mode&^0777 || (tc.mode&0777 != 0 && e.mode != tc.mode) {
+			t.Errorf("%s: mode %o, expected %o", tc.path, e.mode, tc.mode)
+		}
+		if tc.mode&sIFMT == sIFREG && string(img[e.extent*ISOSectorSize:e.extent*ISOSectorSize+e.size]) != tc.contents {
+			t.Errorf("%s: wrong contents", tc.path)
+		}
+		if e.target != tc.target {
+			t.Errorf("%s: link target %q, expected %q", tc.path, e.target, tc.target)
+		}
+	}
+	if e := readISOPath(t, img, "dev/null"); e.mode != sIFCHR|0666 || e.major != 1 || e.minor != 3 {
+		t.Errorf("wrong device %+v", e)
+	}
+
+	// El Torito boot record and catalog
+	br := img[17*ISOSectorSize:]
+	if !strings.HasPrefix(string(br[7:]), "EL TORITO SPECIFICATION") {
+		t.Fatal("no El Torito boot record")
+	}
+	catalog := img[binary.LittleEndian.Uint32(br[71:])*ISOSectorSize:]
+	var sum uint16
+	for i := 0; i < 32; i += 2 {
+		sum += binary.LittleEndian.Uint16(catalog[i:])
+	}
+	if catalog[0] != 1 || sum != 0 || catalog[30] != 0x55 {
+		t.Error("invalid boot catalog validation entry")
+	}
+	bootLBA := binary.LittleEndian.Uint32(catalog[40:])
+	if e := readISOPath(t, img, "isolinux/isolinux.bin"); catalog[32] != 0x88 || bootLBA != e.extent {
+		t.Error("default boot entry is not isolinux.bin")
+	}
+	if catalog[65] != eltoritoEFI {
+		t.Error("no EFI boot entry")
+	}
+	efiLBA := binary.LittleEndian.Uint32(catalog[104:])
+	if !bytes.Equal(img[efiLBA*ISOSectorSize:efiLBA*ISOSectorSize+uint32(len(efiImage))], efiImage) {
+		t.Error("wrong EFI boot image")
+	}
+	boot := img[bootLBA*ISOSectorSize:]
+	if binary.LittleEndian.Uint32(boot[8:]) != 16 || binary.LittleEndian.Uint32(boot[12:]) != bootLBA || binary.LittleEndian.Uint32(boot[16:]) != 4000 || boot[3999] != 0x42 {
+		t.Error("invalid boot info table")
+	}
+
+	// isohybrid master boot record
+	if len(img)%(1024*1024) != 0 || img[510] != 0x55 || img[0] != 0xfa {
+		t.Error("invalid hybrid image")
+	}
+	if binary.LittleEndian.Uint64(img[432:]) != uint64(bootLBA)*4 || binary.LittleEndian.Uint32(img[446+12:]) != uint32(len(img)/SectorSize) {
+		t.Error("invalid hybrid partition table")
+	}
+}
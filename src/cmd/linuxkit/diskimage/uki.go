@@ -0,0 +1,137 @@
+package diskimage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	peSectionHeaderSize = 40
+	// IMAGE_SCN_CNT_INITIALIZED_DATA | IMAGE_SCN_MEM_READ
+	peSectionReadOnlyData = 0x40000040
+)
+
+// Section is a section to add to a PE image
+type Section struct {
+	Name string
+	Data []byte
+}
+
+// UKI returns a unified kernel image, which is the systemd EFI stub with the kernel, initrd, command line
+// and os-release added as sections, in the same way as ukify
+func UKI(stub, kernel, initrd []byte, cmdline, osRelease string) ([]byte, error) {
+	return AddSections(stub, []Section{
+		{".osrel", []byte(osRelease)},
+		{".cmdline", []byte(cmdline)},
+		{".initrd", initrd},
+		// the kernel must be the last section
+		{".linux", kernel},
+	})
+}
+
+// AddSections returns a copy of the PE image with the sections appended, after the existing sections in
+// memory and at the end of the file
+func AddSections(image []byte, sections []Section) ([]byte, error) {
+	if len(image) < 0x40 || image[0] != 'M' || image[1] != 'Z' {
+		return nil, errors.New("not a PE image: no DOS header")
+	}
+	peOffset := int(binary.LittleEndian.Uint32(image[0x3c:]))
+	if peOffset+24 > len(image) || string(image[peOffset:peOffset+4]) != "PE\x00\x00" {
+		return nil, errors.New("not a PE image: no PE signature")
+	}
+	coff := peOffset + 4
+	numSections := int(binary.LittleEndian.Uint16(image[coff+2:]))
+	optSize := int(binary.LittleEndian.Uint16(image[coff+16:]))
+	opt := coff + 20
+	if opt+optSize > len(image) || optSize < 64 {
+		return nil, errors.New("invalid PE optional header")
+	}
+	if magic := binary.LittleEndian.Uint16(image[opt:]); magic != 0x10b && magic != 0x20b {
+		return nil, fmt.Errorf("unknown PE optional header magic %#x", magic)
+	}
+	sectionAlign := binary.LittleEndian.Uint32(image[opt+32:])
+	fileAlign := binary.LittleEndian.Uint32(image[opt+36:])
+	headersSize := int(binary.LittleEndian.Uint32(image[opt+60:]))
+	if sectionAlign == 0 || fileAlign == 0 {
+		return nil, errors.New("invalid PE alignment")
+	}
+	table := opt + optSize
+	end := table + (numSections+len(sections))*peSectionHeaderSize
+	if end > headersSize || headersSize > len(image) {
+		return nil, fmt.Errorf("not enough space in PE headers for %d more sections", len(sections))
+	}
+
+	// find the end of the existing sections in memory and in the file
+	var virtualEnd, fileEnd uint32
+	for i := 0; i < numSections; i++ {
+		s := image[table+i*peSectionHeaderSize:]
+		if string(trimName(s[0:8])) == "" {
+			continue
+		}
+		for _, n := range sections {
+			if string(trimName(s[0:8])) == n.Name {
+				return nil, fmt.Errorf("PE image already has a %s section", n.Name)
+			}
+		}
+		virtualEnd = max(virtualEnd, binary.LittleEndian.Uint32(s[12:])+binary.LittleEndian.Uint32(s[8:]))
+		fileEnd = max(fileEnd, binary.LittleEndian.Uint32(s[20:])+binary.LittleEndian.Uint32(s[16:]))
+	}
+	fileEnd = max(fileEnd, uint32(len(image)))
+
+	out := make([]byte, alignUp(fileEnd, fileAlign))
+	copy(out, image)
+	virtual := alignUp(virtualEnd, sectionAlign)
+	for i, s := range sections {
+		if len(s.Name) > 8 {
+			return nil, fmt.Errorf("section name %s too long", s.Name)
+		}
+		h := out[table+(numSections+i)*peSectionHeaderSize:]
+		copy(h[0:8], s.Name)
+		rawSize := alignUp(uint32(len(s.Data)), fileAlign)
+		binary.LittleEndian.PutUint32(h[8:], uint32(len(s.Data)))
+		binary.LittleEndian.PutUint32(h[12:], virtual)
+		binary.LittleEndian.PutUint32(h[16:], rawSize)
+		binary.LittleEndian.PutUint32(h[20:], uint32(len(out)))
+		binary.LittleEndian.PutUint32(h[36:], peSectionReadOnlyData)
+		data := make([]byte, rawSize)
+		copy(data, s.Data)
+		out = append(out, data...)
+		virtual = alignUp(virtual+uint32(len(s.Data)), sectionAlign)
+	}
+	binary.LittleEndian.PutUint16(out[coff+2:], uint16(numSections+len(sections)))
+	binary.LittleEndian.PutUint32(out[opt+56:], virtual)
+	binary.LittleEndian.PutUint32(out[opt+64:], peChecksum(out, opt+64))
+	return out, nil
+}
+
+func trimName(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
+
+func alignUp(v, align uint32) uint32 {
+	return (v + align - 1) / align * align
+}
+
+// peChecksum calculates the PE image checksum, skipping the checksum field itself
+func peChecksum(b []byte, checksumOffset int) uint32 {
+	var sum uint64
+	for i := 0; i < len(b); i += 2 {
+		if i == checksumOffset || i == checksumOffset+2 {
+			continue
+		}
+		v := uint64(b[i])
+		if i+1 < len(b) {
+			v |= uint64(b[i+1]) << 8
+		}
+		sum += v
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	sum = (sum & 0xffff) + (sum >> 16)
+	return uint32(sum) + uint32(len(b))
+}
@@ -13,6 +13,7 @@ import (
 	containertypes "github.com/docker/docker/api/types/container"
 	dockerimagetypes "github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -128,6 +129,26 @@ func Save(image string) (io.ReadCloser, error) {
 	return cli.ImageSave(context.Background(), []string{image})
 }
 
+// Load load the images in the docker or OCI format tar r, as `docker load` does.
+func Load(r io.Reader) error {
+	log.Debugf("docker load")
+	cli, err := Client()
+	if err != nil {
+		return errors.New("could not initialize Docker API client")
+	}
+	resp, err := cli.ImageLoad(context.Background(), r, client.ImageLoadWithQuiet(true))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	// errors while loading are only reported in the response
+	if err := jsonmessage.DisplayJSONMessagesStream(resp.Body, io.Discard, 0, false, nil); err != nil {
+		return err
+	}
+	log.Debugf("docker load...Done")
+	return nil
+}
+
 // Rm remove the given container from docker.
 func Rm(container string) error {
 	log.Debugf("docker rm: %s", container)
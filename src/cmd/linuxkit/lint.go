@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	mobybuild "github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby/build"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+func lintCmd() *cobra.Command {
+	var (
+		arch     string
+		cacheDir flagOverEnvVarOverDefaultString
+		pull     bool
+		format   string
+		vars     []string
+		varFiles []string
+	)
+	cmd := &cobra.Command{
+		Use:   "lint",
+		Short: "Check a yaml configuration file for mistakes",
+		Long: `Check a yaml configuration file for mistakes.
+
+In addition to validating the file, as build does, checks for semantic problems, such as binds and mounts
+of volumes that do not exist, bind sources that nothing provides, files that overwrite image content,
+dangerous capabilities, and images that are not pinned. Image configurations are read from the cache;
+images that are not in the cache are skipped, unless --pull is set.
+
+Multiple files, and includes and overlays, are combined as they are by build.
+`,
+		Example: `  linuxkit lint [options] <file>[.yml]`,
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format != "text" && format != "json" {
+				return fmt.Errorf("unknown format %s, must be one of text or json", format)
+			}
+			templateValues, err := templateVars(varFiles, vars)
+			if err != nil {
+				return err
+			}
+			var (
+				m       moby.Moby
+				sources []configSource
+			)
+			for _, arg := range args {
+				c, err := loadConfig(arg, templateValues, map[string]bool{}, &sources)
+				if err != nil {
+					return err
+				}
+				m, err = moby.AppendConfig(m, c)
+				if err != nil {
+					return fmt.Errorf("cannot append config files: %v", err)
+				}
+			}
+
+			issues, err := mobybuild.Lint(m, mobybuild.BuildOpts{Pull: pull, CacheDir: cacheDir.String(), Arch: arch})
+			if err != nil {
+				return err
+			}
+			positions := newYamlPositions(sources)
+			var errors int
+			for i := range issues {
+				issues[i].File, issues[i].Line = positions.find(issues[i])
+				if issues[i].Severity == mobybuild.LintError {
+					errors++
+				}
+			}
+
+			switch format {
+			case "json":
+				if issues == nil {
+					issues = []mobybuild.LintIssue{}
+				}
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(issues); err != nil {
+					return err
+				}
+			default:
+				for _, issue := range issues {
+					pos := issue.File
+					if issue.Line > 0 {
+						pos = fmt.Sprintf("%s:%d", issue.File, issue.Line)
+					}
+					if pos != "" {
+						pos += ": "
+					}
+					fmt.Printf("%s%s: %s: [%s] %s\n", pos, issue.Severity, issue.Location(), issue.Category, issue.Message)
+				}
+			}
+			if errors > 0 {
+				return fmt.Errorf("found %d errors", errors)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&arch, "arch", runtime.GOARCH, "target architecture to check images for")
+	cacheDir = flagOverEnvVarOverDefaultString{def: defaultLinuxkitCache(), envVar: envVarCacheDir}
+	cmd.Flags().Var(&cacheDir, "cache", fmt.Sprintf("Directory for caching and finding cached image, overrides env var %s", envVarCacheDir))
+	cmd.Flags().BoolVar(&pull, "pull", false, "Pull images that are not in the cache, rather than skipping their checks")
+	cmd.Flags().StringVar(&format, "format", "text", "Output format, one of text or json")
+	cmd.Flags().StringArrayVar(&vars, "var", nil, "Variable to substitute into the yml files, in the form name=value; can be provided multiple times and overrides --var-file")
+	cmd.Flags().StringArrayVar(&varFiles, "var-file", nil, "yaml file containing a map of variables to substitute into the yml files; can be provided multiple times")
+
+	return cmd
+}
+
+// yamlPositions finds the position in the source files of the entries in a config
+type yamlPositions struct {
+	sources []configSource
+	roots   []*yaml.Node
+}
+
+func newYamlPositions(sources []configSource) *yamlPositions {
+	p := &yamlPositions{}
+	for _, source := range sources {
+		var node yaml.Node
+		// if the file cannot be parsed as is, e.g. because of unquoted templates, we
+		// just do not know positions for it
+		if err := yaml.Unmarshal(source.data, &node); err != nil || len(node.Content) == 0 {
+			continue
+		}
+		p.sources = append(p.sources, source)
+		p.roots = append(p.roots, node.Content[0])
+	}
+	return p
+}
+
+// find the file and line for an issue. As later files override earlier ones, the last file
+// that has a matching entry with the field is used, or else the last with a matching entry.
+func (p *yamlPositions) find(issue mobybuild.LintIssue) (string, int) {
+	var (
+		entryFile string
+		entryLine int
+	)
+	for i := len(p.roots) - 1; i >= 0; i-- {
+		section := mappingValue(p.roots[i], issue.Section)
+		if section == nil {
+			continue
+		}
+		entry := section
+		if section.Kind == yaml.SequenceNode {
+			entry = nil
+			for _, item := range section.Content {
+				if entryMatches(issue, item) {
+					entry = item
+				}
+			}
+		}
+		if entry == nil {
+			continue
+		}
+		name := p.sources[i].name
+		if issue.Field == "" {
+			return name, entry.Line
+		}
+		if field := fieldValue(entry, issue.Field); field != nil {
+			return name, field.Line
+		}
+		if entryFile == "" {
+			entryFile, entryLine = name, entry.Line
+		}
+	}
+	return entryFile, entryLine
+}
+
+// entryMatches checks if a yaml entry in a section is the one an issue refers to
+func entryMatches(issue mobybuild.LintIssue, item *yaml.Node) bool {
+	switch issue.Section {
+	case "init":
+		return item.Kind == yaml.ScalarNode && util.ReferenceExpand(item.Value) == issue.Name
+	case "files":
+		if v := mappingValue(item, "path"); v != nil {
+			return strings.TrimPrefix(v.Value, "/") == strings.TrimPrefix(issue.Name, "/")
+		}
+	default:
+		if v := mappingValue(item, "name"); v != nil {
+			return v.Value == issue.Name
+		}
+	}
+	return false
+}
+
+// fieldValue finds a field in a mapping, where the field can be a literal key, such as binds.add,
+// or a dotted path, such as runtime.mounts
+func fieldValue(node *yaml.Node, field string) *yaml.Node {
+	if v := mappingKey(node, field); v != nil {
+		return v
+	}
+	parts := strings.SplitN(field, ".", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	if v := mappingValue(node, parts[0]); v != nil {
+		return fieldValue(v, parts[1])
+	}
+	return nil
+}
+
+// mappingKey returns the key node for a key in a yaml mapping, or nil
+func mappingKey(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i]
+		}
+	}
+	return nil
+}
+
+// mappingValue returns the value node for a key in a yaml mapping, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
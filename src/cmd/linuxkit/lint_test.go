@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	mobybuild "github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby/build"
+)
+
+func TestYamlPositions(t *testing.T) {
+	base := `kernel:
+  image: linuxkit/kernel:6.6
+init:
+  - linuxkit/init:v1.0
+onboot:
+  - name: format
+    image: linuxkit/format:v1.0
+services:
+  - name: sshd
+    image: linuxkit/sshd:v1.0
+    binds.add:
+      - data:/data
+    runtime:
+      mounts:
+        - type: bind
+          source: other
+          destination: /other
+files:
+  - path: /etc/motd
+    contents: hello
+`
+	overlay := `services:
+  - name: sshd
+    image: linuxkit/sshd:latest
+`
+	p := newYamlPositions([]configSource{
+		{name: "base.yml", data: []byte(base)},
+		{name: "unparsable.yml", data: []byte("image: {{ .Image }}")},
+		{name: "overlay.yml", data: []byte(overlay)},
+	})
+	for _, tt := range []struct {
+		issue mobybuild.LintIssue
+		file  string
+		line  int
+	}{
+		{mobybuild.LintIssue{Section: "kernel", Field: "image"}, "base.yml", 2},
+		{mobybuild.LintIssue{Section: "init", Name: "docker.io/linuxkit/init:v1.0"}, "base.yml", 4},
+		{mobybuild.LintIssue{Section: "onboot", Name: "format"}, "base.yml", 6},
+		{mobybuild.LintIssue{Section: "services", Name: "sshd", Field: "binds.add"}, "base.yml", 11},
+		{mobybuild.LintIssue{Section: "services", Name: "sshd", Field: "runtime.mounts"}, "base.yml", 14},
+		{mobybuild.LintIssue{Section: "files", Name: "etc/motd"}, "base.yml", 19},
+		// later files override earlier ones
+		{mobybuild.LintIssue{Section: "services", Name: "sshd", Field: "image"}, "overlay.yml", 3},
+		{mobybuild.LintIssue{Section: "services", Name: "sshd", Field: "capabilities"}, "overlay.yml", 2},
+		{mobybuild.LintIssue{Section: "services", Name: "getty"}, "", 0},
+	} {
+		file, line := p.find(tt.issue)
+		if file != tt.file || line != tt.line {
+			t.Errorf("expected %s at %s:%d, got %s:%d", tt.issue.Location(), tt.file, tt.line, file, line)
+		}
+	}
+}
@@ -73,7 +73,7 @@ var additions = map[string]addFun{
 	},
 }
 
-// OutputTypes returns a list of the valid output types
+// OutputTypes returns a list of the valid output types, including any format plugins
 func OutputTypes() []string {
 	var ts []string
 	for k := range streamable {
@@ -82,14 +82,20 @@ func OutputTypes() []string {
 	for k := range outFuns {
 		ts = append(ts, k)
 	}
+	ts = append(ts, pluginNames()...)
 	sort.Strings(ts)
 
 	return ts
 }
 
 // outputImage given an image and a section, such as onboot, onshutdown or services, lay it out with correct location
-// config, etc. in the filesystem, so runc can use it.
-func outputImage(image *moby.Image, section string, index int, prefix string, m moby.Moby, idMap map[string]uint32, dupMap map[string]string, iw *tar.Writer, opts BuildOpts) error {
+// config, etc. in the filesystem, so runc can use it. The first container using an image extracts it to its root,
+// and sets that on root; later ones wait for it and share it.
+func outputImage(image *moby.Image, section string, index int, prefix string, m moby.Moby, idMap map[string]uint32, root *sharedRoot, first bool, iw tarWriter, bc *buildCache, opts BuildOpts) error {
+	if first {
+		// make sure containers waiting for the root are not blocked if this fails
+		defer root.set("")
+	}
 	log.Infof("  Create OCI config for %s", image.Image)
 	imageName := util.ReferenceExpand(image.Image)
 	ref, err := reference.Parse(imageName)
@@ -119,14 +125,58 @@ func outputImage(image *moby.Image, section string, index int, prefix string, m
 		return fmt.Errorf("failed to create config for %s: %v", image.Image, err)
 	}
 	path := path.Join("containers", section, prefix+image.Name)
+	location := fmt.Sprintf("%s[%d]", section, index)
 	readonly := oci.Root.Readonly
-	err = ImageBundle(path, fmt.Sprintf("%s[%d]", section, index), image.Ref(), config, runtime, iw, readonly, dupMap, opts)
+	if err := addSbomImage(location, &ref, nil, opts); err != nil {
+		return err
+	}
+	dupMap := map[string]string{}
+	var dup string
+	if first {
+		root.set(bundleRoot(path, readonly))
+	} else {
+		// a container that shares the root filesystem of an earlier one depends on where that is
+		dup = root.get()
+		if dup == "" {
+			return fmt.Errorf("failed to extract root filesystem for %s: not extracted by an earlier container", image.Image)
+		}
+		dupMap[image.Ref().String()] = dup
+	}
+	key, err := bc.imageKey(image.Ref(), opts, nil, location, path, config, runtime, readonly, dup)
+	if err != nil {
+		return err
+	}
+	reused, err := bc.section(key, location, iw, func(tw tarWriter) error {
+		return ImageBundle(path, location, image.Ref(), config, runtime, tw, readonly, dupMap, opts)
+	})
 	if err != nil {
 		return fmt.Errorf("failed to extract root filesystem for %s: %v", image.Image, err)
 	}
+	if first && reused {
+		return bc.sboms(image.Ref(), location, bundleRoot(path, readonly)+"/", opts)
+	}
 	return nil
 }
 
+// containerIDs allocates each container a uid, gid that can be referenced by name
+func containerIDs(m moby.Moby) map[string]uint32 {
+	idMap := map[string]uint32{}
+	id := uint32(100)
+	for _, image := range m.Onboot {
+		idMap[image.Name] = id
+		id++
+	}
+	for _, image := range m.Onshutdown {
+		idMap[image.Name] = id
+		id++
+	}
+	for _, image := range m.Services {
+		idMap[image.Name] = id
+		id++
+	}
+	return idMap
+}
+
 // Build performs the actual build process. The output is the filesystem
 // in a tar stream written to w.
 func Build(m moby.Moby, w io.Writer, opts BuildOpts) error {
@@ -134,6 +184,11 @@ func Build(m moby.Moby, w io.Writer, opts BuildOpts) error {
 		MobyDir = defaultMobyConfigDir()
 	}
 
+	// init could not start services whose dependencies are missing or form a cycle
+	if _, err := moby.ServiceOrder(m); err != nil {
+		return err
+	}
+
 	// create tmp dir in case needed
 	if err := os.MkdirAll(filepath.Join(MobyDir, "tmp"), 0755); err != nil {
 		return err
@@ -179,7 +234,7 @@ func Build(m moby.Moby, w io.Writer, opts BuildOpts) error {
 				if _, err := buf.ReadFrom(inputTarReader); err != nil {
 					return fmt.Errorf("failed to read metadata file from input tar: %w", err)
 				}
-				config, err := moby.NewConfig(buf.Bytes(), nil)
+				config, err := moby.NewConfig(buf.Bytes(), nil, nil)
 				if err != nil {
 					return fmt.Errorf("invalid config in existing tar file: %v", err)
 				}
@@ -189,6 +244,11 @@ func Build(m moby.Moby, w io.Writer, opts BuildOpts) error {
 		}
 	}
 
+	bc, err := newBuildCache(opts.BuildCacheDir)
+	if err != nil {
+		return err
+	}
+
 	// do we have an inTar
 	iw := tar.NewWriter(w)
 
@@ -196,23 +256,42 @@ func Build(m moby.Moby, w io.Writer, opts BuildOpts) error {
 	addition := additions[opts.BuilderType]
 
 	// allocate each container a uid, gid that can be referenced by name
-	idMap := map[string]uint32{}
-	id := uint32(100)
-	for _, image := range m.Onboot {
-		idMap[image.Name] = id
-		id++
-	}
-	for _, image := range m.Onshutdown {
-		idMap[image.Name] = id
-		id++
+	idMap := containerIDs(m)
+
+	// pull and extract the images concurrently, up to opts.Jobs at a time
+	total := len(m.Init) + len(m.Volumes) + len(m.Onboot) + len(m.Onshutdown) + len(m.Services)
+	if m.Kernel.Ref() != nil {
+		total++
 	}
-	for _, image := range m.Services {
-		idMap[image.Name] = id
-		id++
+	queue := newSectionQueue(opts.Jobs, total, opts)
+	defer func() { _ = queue.wait() }()
+
+	// fromInputTar copies a section from the input tar; each job opens it, so that they can run concurrently
+	fromInputTar := func(image, section string) func(tw tarWriter, opts BuildOpts) error {
+		return func(tw tarWriter, opts BuildOpts) error {
+			in, err := os.Open(opts.InputTar)
+			if err != nil {
+				return fmt.Errorf("failed to open input tar: %w", err)
+			}
+			defer func() { _ = in.Close() }()
+			if opts.SbomGenerator != nil {
+				// the digest is not known for an image copied from the input tar
+				opts.SbomGenerator.AddImage(section, image, "")
+			}
+			return extractPackageFilesFromTar(in, tw, image, section)
+		}
 	}
 
 	// deduplicate containers with the same image
-	dupMap := map[string]string{}
+	sharedRoots := map[string]*sharedRoot{}
+	containerRoot := func(image *moby.Image) (*sharedRoot, bool) {
+		if root, ok := sharedRoots[image.Ref().String()]; ok {
+			return root, false
+		}
+		root := newSharedRoot()
+		sharedRoots[image.Ref().String()] = root
+		return root, true
+	}
 
 	kernelRef := m.Kernel.Ref()
 	var oldKernelRef *reference.Spec
@@ -222,20 +301,38 @@ func Build(m moby.Moby, w io.Writer, opts BuildOpts) error {
 	if kernelRef != nil {
 		// first check if the existing one had it
 		if oldKernelRef != nil && oldKernelRef.String() == kernelRef.String() {
-			if err := extractPackageFilesFromTar(in, iw, kernelRef.String(), "kernel"); err != nil {
+			if err := queue.add("kernel", kernelRef.String(), iw, fromInputTar(kernelRef.String(), "kernel")); err != nil {
 				return err
 			}
 		} else {
-			// get kernel and initrd tarball and ucode cpio archive from container
-			log.Infof("Extract kernel image: %s", m.Kernel.Ref())
-			kf := newKernelFilter(kernelRef, iw, m.Kernel.Cmdline, m.Kernel.Binary, m.Kernel.Tar, m.Kernel.UCode, opts.DecompressKernel)
-			err := ImageTar("kernel", kernelRef, "", kf, "", opts)
-			if err != nil {
-				return fmt.Errorf("failed to extract kernel image and tarball: %v", err)
-			}
-			err = kf.Close()
-			if err != nil {
-				return fmt.Errorf("close error: %v", err)
+			if err := queue.add("kernel", kernelRef.String(), iw, func(tw tarWriter, opts BuildOpts) error {
+				if err := addSbomImage("kernel", kernelRef, nil, opts); err != nil {
+					return err
+				}
+				key, err := bc.imageKey(kernelRef, opts, nil, "kernel", m.Kernel, opts.DecompressKernel)
+				if err != nil {
+					return err
+				}
+				reused, err := bc.section(key, "kernel", tw, func(tw tarWriter) error {
+					// get kernel and initrd tarball and ucode cpio archive from container
+					log.Infof("Extract kernel image: %s", m.Kernel.Ref())
+					kf := newKernelFilter(kernelRef, tw, m.Kernel.Cmdline, m.Kernel.Binary, m.Kernel.Tar, m.Kernel.UCode, opts.DecompressKernel)
+					err := ImageTar("kernel", kernelRef, "", kf, "", opts)
+					if err != nil {
+						return fmt.Errorf("failed to extract kernel image and tarball: %v", err)
+					}
+					err = kf.Close()
+					if err != nil {
+						return fmt.Errorf("close error: %v", err)
+					}
+					return nil
+				})
+				if err != nil || !reused {
+					return err
+				}
+				return bc.sboms(kernelRef, "kernel", "", opts)
+			}); err != nil {
+				return err
 			}
 		}
 	}
@@ -251,18 +348,41 @@ func Build(m moby.Moby, w io.Writer, opts BuildOpts) error {
 		oldInitRefs = oldConfig.InitRefs()
 	}
 	for i, ii := range initRefs {
+		location := fmt.Sprintf("init[%d]", i)
 		if len(oldInitRefs) > i && oldInitRefs[i].String() == ii.String() {
-			if err := extractPackageFilesFromTar(in, apkTar, ii.String(), fmt.Sprintf("init[%d]", i)); err != nil {
+			if err := queue.add(location, ii.String(), apkTar, fromInputTar(ii.String(), location)); err != nil {
 				return err
 			}
 		} else {
-			log.Infof("Process init image: %s", ii)
-			err := ImageTar(fmt.Sprintf("init[%d]", i), ii, "", apkTar, resolvconfSymlink, opts)
-			if err != nil {
-				return fmt.Errorf("failed to build init tarball from %s: %v", ii, err)
+			if err := queue.add(location, ii.String(), apkTar, func(tw tarWriter, opts BuildOpts) error {
+				if err := addSbomImage(location, ii, nil, opts); err != nil {
+					return err
+				}
+				key, err := bc.imageKey(ii, opts, nil, location, resolvconfSymlink)
+				if err != nil {
+					return err
+				}
+				reused, err := bc.section(key, location, tw, func(tw tarWriter) error {
+					log.Infof("Process init image: %s", ii)
+					err := ImageTar(location, ii, "", tw, resolvconfSymlink, opts)
+					if err != nil {
+						return fmt.Errorf("failed to build init tarball from %s: %v", ii, err)
+					}
+					return nil
+				})
+				if err != nil || !reused {
+					return err
+				}
+				return bc.sboms(ii, location, "", opts)
+			}); err != nil {
+				return err
 			}
 		}
 	}
+	// the apk database is the union of those in all the init images
+	if err := queue.wait(); err != nil {
+		return err
+	}
 	if err := apkTar.WriteAPKDB(); err != nil {
 		return err
 	}
@@ -275,7 +395,7 @@ func Build(m moby.Moby, w io.Writer, opts BuildOpts) error {
 		log.Infof("Process volume image: %s", vol.Name)
 		// there is an Image, so we need to extract it, either from inputTar or from the image
 		if oldConfig != nil && len(oldConfig.Volumes) > i && oldConfig.Volumes[i].Image == vol.Image {
-			if err := extractPackageFilesFromTar(in, iw, vol.Image, fmt.Sprintf("volumes[%d]", i)); err != nil {
+			if err := queue.add(fmt.Sprintf("volumes[%d]", i), vol.Image, iw, fromInputTar(vol.Image, fmt.Sprintf("volumes[%d]", i))); err != nil {
 				return err
 			}
 			continue
@@ -284,15 +404,10 @@ func Build(m moby.Moby, w io.Writer, opts BuildOpts) error {
 		lower, tmpDir, merged := vol.LowerDir(), vol.TmpDir(), vol.MergedDir()
 		lowerPath := strings.TrimPrefix(lower, "/") + "/"
 
-		// get volume tarball from container
-		switch {
-		case vol.ImageRef() == nil || vol.Format == "" || vol.Format == "filesystem":
-			if err := ImageTar(location, vol.ImageRef(), lowerPath, apkTar, resolvconfSymlink, opts); err != nil {
-				return fmt.Errorf("failed to build volume filesystem tarball from %s: %v", vol.Name, err)
-			}
-		case vol.Format == "oci":
-			// convert platforms into imagespec platforms
-			platforms := make([]imagespec.Platform, len(vol.Platforms))
+		// convert platforms into imagespec platforms
+		var platforms []imagespec.Platform
+		if vol.Format == "oci" {
+			platforms = make([]imagespec.Platform, len(vol.Platforms))
 			for i, p := range vol.Platforms {
 				platform, err := v1.ParsePlatform(p)
 				if err != nil {
@@ -304,41 +419,99 @@ func Build(m moby.Moby, w io.Writer, opts BuildOpts) error {
 					Variant:      platform.Variant,
 				}
 			}
-			if err := ImageOCITar(location, vol.ImageRef(), lowerPath, apkTar, opts, platforms); err != nil {
-				return fmt.Errorf("failed to build volume OCI v1 layout tarball from %s: %v", vol.Name, err)
-			}
 		}
 
-		// make upper and merged dirs which will be used for mounting
-		// no need to make lower dir, as it is made automatically by ImageTar()
-		tmpPath := strings.TrimPrefix(tmpDir, "/") + "/"
-		tmphdr := &tar.Header{
-			Name:     tmpPath,
-			Mode:     0755,
-			Typeflag: tar.TypeDir,
-			ModTime:  defaultModTime,
-			Format:   tar.FormatPAX,
-			PAXRecords: map[string]string{
-				moby.PaxRecordLinuxkitSource:   "linuxkit.volumes",
-				moby.PaxRecordLinuxkitLocation: location,
-			},
-		}
-		if err := apkTar.WriteHeader(tmphdr); err != nil {
+		// tell init how to set up the volume, if it is not an unshared tmpfs owned by root
+		var config []byte
+		vc, err := volumeConfig(vol, m, idMap)
+		if err != nil {
 			return err
 		}
-		mergedPath := strings.TrimPrefix(merged, "/") + "/"
-		mhdr := &tar.Header{
-			Name:     mergedPath,
-			Mode:     0755,
-			Typeflag: tar.TypeDir,
-			ModTime:  defaultModTime,
-			Format:   tar.FormatPAX,
-			PAXRecords: map[string]string{
-				moby.PaxRecordLinuxkitSource:   "linuxkit.volumes",
-				moby.PaxRecordLinuxkitLocation: location,
-			},
+		if vc != nil {
+			if config, err = json.Marshal(vc); err != nil {
+				return err
+			}
 		}
-		if err := apkTar.WriteHeader(mhdr); err != nil {
+
+		if err := queue.add(location, vol.Image, apkTar, func(tw tarWriter, opts BuildOpts) error {
+			if err := addSbomImage(location, vol.ImageRef(), platforms, opts); err != nil {
+				return err
+			}
+			key, err := bc.imageKey(vol.ImageRef(), opts, platforms, location, vol, config)
+			if err != nil {
+				return err
+			}
+			reused, err := bc.section(key, location, tw, func(tw tarWriter) error {
+				// get volume tarball from container
+				switch {
+				case vol.ImageRef() == nil || vol.Format == "" || vol.Format == "filesystem":
+					if err := ImageTar(location, vol.ImageRef(), lowerPath, tw, resolvconfSymlink, opts); err != nil {
+						return fmt.Errorf("failed to build volume filesystem tarball from %s: %v", vol.Name, err)
+					}
+				case vol.Format == "oci":
+					if err := ImageOCITar(location, vol.ImageRef(), lowerPath, tw, opts, platforms); err != nil {
+						return fmt.Errorf("failed to build volume OCI v1 layout tarball from %s: %v", vol.Name, err)
+					}
+				}
+
+				// make upper and merged dirs which will be used for mounting
+				// no need to make lower dir, as it is made automatically by ImageTar()
+				tmpPath := strings.TrimPrefix(tmpDir, "/") + "/"
+				tmphdr := &tar.Header{
+					Name:     tmpPath,
+					Mode:     0755,
+					Typeflag: tar.TypeDir,
+					ModTime:  defaultModTime,
+					Format:   tar.FormatPAX,
+					PAXRecords: map[string]string{
+						moby.PaxRecordLinuxkitSource:   "linuxkit.volumes",
+						moby.PaxRecordLinuxkitLocation: location,
+					},
+				}
+				if err := tw.WriteHeader(tmphdr); err != nil {
+					return err
+				}
+				mergedPath := strings.TrimPrefix(merged, "/") + "/"
+				mhdr := &tar.Header{
+					Name:     mergedPath,
+					Mode:     0755,
+					Typeflag: tar.TypeDir,
+					ModTime:  defaultModTime,
+					Format:   tar.FormatPAX,
+					PAXRecords: map[string]string{
+						moby.PaxRecordLinuxkitSource:   "linuxkit.volumes",
+						moby.PaxRecordLinuxkitLocation: location,
+					},
+				}
+				if err := tw.WriteHeader(mhdr); err != nil {
+					return err
+				}
+				if config == nil {
+					return nil
+				}
+				chdr := &tar.Header{
+					Name:     strings.TrimPrefix(vol.ConfigFile(), "/"),
+					Mode:     0644,
+					Typeflag: tar.TypeReg,
+					Size:     int64(len(config)),
+					ModTime:  defaultModTime,
+					Format:   tar.FormatPAX,
+					PAXRecords: map[string]string{
+						moby.PaxRecordLinuxkitSource:   "linuxkit.volumes",
+						moby.PaxRecordLinuxkitLocation: location,
+					},
+				}
+				if err := tw.WriteHeader(chdr); err != nil {
+					return err
+				}
+				_, err = tw.Write(config)
+				return err
+			})
+			if err != nil || !reused || vol.Format == "oci" {
+				return err
+			}
+			return bc.sboms(vol.ImageRef(), location, lowerPath, opts)
+		}); err != nil {
 			return err
 		}
 	}
@@ -347,13 +520,17 @@ func Build(m moby.Moby, w io.Writer, opts BuildOpts) error {
 		log.Infof("Add onboot containers:")
 	}
 	for i, image := range m.Onboot {
+		location := fmt.Sprintf("onboot[%d]", i)
 		if oldConfig != nil && len(oldConfig.Onboot) > i && oldConfig.Onboot[i].Equal(image) {
-			if err := extractPackageFilesFromTar(in, iw, image.Image, fmt.Sprintf("onboot[%d]", i)); err != nil {
+			if err := queue.add(location, image.Image, iw, fromInputTar(image.Image, location)); err != nil {
 				return err
 			}
 		} else {
 			so := fmt.Sprintf("%03d", i)
-			if err := outputImage(image, "onboot", i, so+"-", m, idMap, dupMap, iw, opts); err != nil {
+			root, first := containerRoot(image)
+			if err := queue.add(location, image.Image, iw, func(tw tarWriter, opts BuildOpts) error {
+				return outputImage(image, "onboot", i, so+"-", m, idMap, root, first, tw, bc, opts)
+			}); err != nil {
 				return err
 			}
 		}
@@ -363,13 +540,17 @@ func Build(m moby.Moby, w io.Writer, opts BuildOpts) error {
 		log.Infof("Add onshutdown containers:")
 	}
 	for i, image := range m.Onshutdown {
+		location := fmt.Sprintf("onshutdown[%d]", i)
 		if oldConfig != nil && len(oldConfig.Onshutdown) > i && oldConfig.Onshutdown[i].Equal(image) {
-			if err := extractPackageFilesFromTar(in, iw, image.Image, fmt.Sprintf("onshutdown[%d]", i)); err != nil {
+			if err := queue.add(location, image.Image, iw, fromInputTar(image.Image, location)); err != nil {
 				return err
 			}
 		} else {
 			so := fmt.Sprintf("%03d", i)
-			if err := outputImage(image, "onshutdown", i, so+"-", m, idMap, dupMap, iw, opts); err != nil {
+			root, first := containerRoot(image)
+			if err := queue.add(location, image.Image, iw, func(tw tarWriter, opts BuildOpts) error {
+				return outputImage(image, "onshutdown", i, so+"-", m, idMap, root, first, tw, bc, opts)
+			}); err != nil {
 				return err
 			}
 		}
@@ -379,21 +560,37 @@ func Build(m moby.Moby, w io.Writer, opts BuildOpts) error {
 		log.Infof("Add service containers:")
 	}
 	for i, image := range m.Services {
+		location := fmt.Sprintf("services[%d]", i)
 		if oldConfig != nil && len(oldConfig.Services) > i && oldConfig.Services[i].Equal(image) {
-			if err := extractPackageFilesFromTar(in, iw, image.Image, fmt.Sprintf("services[%d]", i)); err != nil {
+			if err := queue.add(location, image.Image, iw, fromInputTar(image.Image, location)); err != nil {
 				return err
 			}
 		} else {
-			if err := outputImage(image, "services", i, "", m, idMap, dupMap, iw, opts); err != nil {
+			root, first := containerRoot(image)
+			if err := queue.add(location, image.Image, iw, func(tw tarWriter, opts BuildOpts) error {
+				return outputImage(image, "services", i, "", m, idMap, root, first, tw, bc, opts)
+			}); err != nil {
 				return err
 			}
 		}
 	}
+	if err := queue.wait(); err != nil {
+		return err
+	}
 
 	// add files
-	if err := filesystem(m, iw, idMap); err != nil {
+	key, err := bc.filesKey(m, idMap)
+	if err != nil {
+		return err
+	}
+	// the files have no sbom of their own, so record them as they are written, whether or not from the cache
+	fw := newSbomFiles(iw, opts.SbomGenerator)
+	if _, err := bc.section(key, "files", fw, func(tw tarWriter) error {
+		return filesystem(m, tw, idMap, opts)
+	}); err != nil {
 		return fmt.Errorf("failed to add filesystem parts: %v", err)
 	}
+	fw.finish()
 
 	// add anything additional for this output type
 	if addition != nil {
@@ -420,7 +617,7 @@ func Build(m moby.Moby, w io.Writer, opts BuildOpts) error {
 
 // kernelFilter is a tar.Writer that transforms a kernel image into the output we want on underlying tar writer
 type kernelFilter struct {
-	tw               *tar.Writer
+	tw               tarWriter
 	buffer           *bytes.Buffer
 	hdr              *tar.Header
 	cmdline          string
@@ -435,7 +632,7 @@ type kernelFilter struct {
 	ref              *reference.Spec
 }
 
-func newKernelFilter(ref *reference.Spec, tw *tar.Writer, cmdline string, kernel string, tar, ucode *string, decompressKernel bool) *kernelFilter {
+func newKernelFilter(ref *reference.Spec, tw tarWriter, cmdline string, kernel string, tar, ucode *string, decompressKernel bool) *kernelFilter {
 	tarName, kernelName, ucodeName := "kernel.tar", "kernel", ""
 	if tar != nil {
 		tarName = *tar
@@ -605,7 +802,7 @@ func (k *kernelFilter) WriteHeader(hdr *tar.Header) error {
 	return nil
 }
 
-func tarAppend(ref *reference.Spec, iw *tar.Writer, tr *tar.Reader) error {
+func tarAppend(ref *reference.Spec, iw tarWriter, tr *tar.Reader) error {
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
@@ -725,7 +922,15 @@ func metadata(m moby.Moby, md string) ([]byte, error) {
 	}
 }
 
-func filesystem(m moby.Moby, tw *tar.Writer, idMap map[string]uint32) error {
+// expandSource expands a leading ~/ in the source of a file to the home directory
+func expandSource(source string) string {
+	if len(source) > 2 && source[:2] == "~/" {
+		return util.HomeDir() + source[1:]
+	}
+	return source
+}
+
+func filesystem(m moby.Moby, tw tarWriter, idMap map[string]uint32, opts BuildOpts) error {
 	// TODO also include the files added in other parts of the build
 	var addedFiles = map[string]bool{}
 
@@ -772,35 +977,47 @@ func filesystem(m moby.Moby, tw *tar.Writer, idMap map[string]uint32) error {
 			return err
 		}
 
-		var contents []byte
+		var (
+			contents []byte
+			entries  []sourceEntry
+			tree     bool
+		)
 		if f.Contents != nil {
 			contents = []byte(*f.Contents)
 		}
 		if !f.Directory && f.Symlink == "" && f.Contents == nil {
-			if f.Source == "" && f.Metadata == "" {
+			if f.Source == "" && f.Metadata == "" && f.Secret == "" {
 				return fmt.Errorf("contents of file (%s) not specified", f.Path)
 			}
 			if f.Source != "" && f.Metadata != "" {
 				return fmt.Errorf("specified Source and Metadata for file: %s", f.Path)
 			}
-			if f.Source != "" {
-				source := f.Source
-				if len(source) > 2 && source[:2] == "~/" {
-					source = util.HomeDir() + source[1:]
+			if f.Secret != "" && (f.Source != "" || f.Metadata != "") {
+				return fmt.Errorf("specified Secret with Source or Metadata for file: %s", f.Path)
+			}
+			if f.Secret != "" {
+				// the plaintext is only ever written to the image
+				contents, err = decryptSecret(f.Path, f, opts.SecretIdentities)
+				if err != nil {
+					return err
 				}
-				if f.Optional {
-					_, err := os.Stat(source)
-					if err != nil {
-						// skip if not found or readable
-						log.Debugf("skipping file [%s] as not readable and marked optional", source)
-						continue
-					}
+			} else if f.Source != "" {
+				source := expandSource(f.Source)
+				if f.Optional && !sourceExists(source) {
+					// skip if not found or readable
+					log.Debugf("skipping file [%s] as not readable and marked optional", source)
+					continue
 				}
-				var err error
-				contents, err = os.ReadFile(source)
+				entries, tree, err = sourceTree(source)
 				if err != nil {
 					return err
 				}
+				if !tree {
+					contents, err = os.ReadFile(source)
+					if err != nil {
+						return err
+					}
+				}
 			} else {
 				contents, err = metadata(m, f.Metadata)
 				if err != nil {
@@ -814,6 +1031,19 @@ func filesystem(m moby.Moby, tw *tar.Writer, idMap map[string]uint32) error {
 			if f.Source != "" {
 				return fmt.Errorf("specified Contents and Source for file: %s", f.Path)
 			}
+			if f.Secret != "" {
+				return fmt.Errorf("specified Contents and Secret for file: %s", f.Path)
+			}
+		}
+		if f.Template {
+			if f.Directory || f.Symlink != "" || f.Metadata != "" || f.Secret != "" {
+				return fmt.Errorf("template can only be used with contents or source for file: %s", f.Path)
+			}
+			if !tree {
+				if contents, err = renderTemplate(f.Path, contents, m, idMap, opts); err != nil {
+					return err
+				}
+			}
 		}
 		// we need all the leading directories
 		parts := strings.Split(path.Dir(f.Path), "/")
@@ -848,6 +1078,12 @@ func filesystem(m moby.Moby, tw *tar.Writer, idMap map[string]uint32) error {
 				addedFiles[root] = true
 			}
 		}
+		if tree {
+			if err := writeSourceTree(tw, m, f, entries, mode, dirMode, int(uid), int(gid), fmt.Sprintf("files[%d]", filecount), addedFiles, idMap, opts); err != nil {
+				return err
+			}
+			continue
+		}
 		addedFiles[f.Path] = true
 		hdr := &tar.Header{
 			Name:    f.Path,
@@ -861,6 +1097,9 @@ func filesystem(m moby.Moby, tw *tar.Writer, idMap map[string]uint32) error {
 				moby.PaxRecordLinuxkitLocation: fmt.Sprintf("files[%d]", filecount),
 			},
 		}
+		if f.Secret != "" {
+			hdr.PAXRecords[moby.PaxRecordLinuxkitRedacted] = "true"
+		}
 		if f.Directory {
 			if f.Contents != nil {
 				return errors.New("directory with contents not allowed")
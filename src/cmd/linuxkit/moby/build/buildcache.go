@@ -0,0 +1,370 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/initrd"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// buildCacheVersion is part of every key, so that changes to the output invalidate old entries
+	buildCacheVersion = 1
+
+	buildCacheSections = "sections"
+	buildCacheInitrd   = "initrd"
+	buildCacheImages   = "images"
+)
+
+// buildCache stores the output of parts of the build by key. A nil *buildCache is valid, and
+// just runs everything.
+type buildCache struct {
+	dir string
+}
+
+func newBuildCache(dir string) (*buildCache, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	for _, d := range []string{buildCacheSections, buildCacheInitrd, buildCacheImages} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create build cache: %v", err)
+		}
+	}
+	return &buildCache{dir: dir}, nil
+}
+
+// buildCacheKey returns the hash of the JSON encoding of values
+func buildCacheKey(values ...interface{}) (string, error) {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	for _, v := range append([]interface{}{buildCacheVersion}, values...) {
+		if err := enc.Encode(v); err != nil {
+			return "", fmt.Errorf("failed to calculate build cache key: %v", err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// imageDigest returns the digest of the image or, for platforms, the index that ref points to. It is
+// empty if the digest cannot be known, such as for images read from docker.
+func imageDigest(ref *reference.Spec, opts BuildOpts, platforms []imagespec.Platform) (string, error) {
+	if ref == nil {
+		return "empty", nil
+	}
+	if d := ref.Digest(); d != "" {
+		return d.String(), nil
+	}
+	var desc *v1.Descriptor
+	if platforms != nil {
+		src, err := indexSource(ref, opts.Pull, opts.CacheDir, platforms)
+		if err != nil {
+			return "", fmt.Errorf("could not pull image %s: %v", ref, err)
+		}
+		desc = src.Descriptor()
+	} else {
+		src, err := imageSource(ref, opts.Pull, opts.CacheDir, opts.DockerCache, imagespec.Platform{OS: "linux", Architecture: opts.Arch})
+		if err != nil {
+			return "", fmt.Errorf("could not pull image %s: %v", ref, err)
+		}
+		desc = src.Descriptor()
+	}
+	if desc == nil {
+		return "", nil
+	}
+	return desc.Digest.String(), nil
+}
+
+// imageKey returns the key for a section built from the image ref, or "" if it cannot be cached
+func (c *buildCache) imageKey(ref *reference.Spec, opts BuildOpts, platforms []imagespec.Platform, values ...interface{}) (string, error) {
+	if c == nil {
+		return "", nil
+	}
+	digest, err := imageDigest(ref, opts, platforms)
+	if err != nil || digest == "" {
+		return "", err
+	}
+	return buildCacheKey(append([]interface{}{digest, opts.Arch, opts.BuilderType}, values...)...)
+}
+
+// fileSource is the part of a file source which is used to detect changes, like make does
+type fileSource struct {
+	Path    string
+	Size    int64
+	ModTime int64
+	Missing bool `json:",omitempty"`
+}
+
+// filesKey returns the key for the files section of m
+func (c *buildCache) filesKey(m moby.Moby, idMap map[string]uint32) (string, error) {
+	if c == nil {
+		return "", nil
+	}
+	var sources []fileSource
+	var metadataFiles [][]byte
+	for _, f := range m.Files {
+		// a template can use anything in the config, including the digests of images, so is always rendered
+		if f.Template {
+			return "", nil
+		}
+		// the plaintext of a secret is never written to the cache
+		if f.Secret != "" {
+			return "", nil
+		}
+		switch {
+		case f.Source != "":
+			source := expandSource(f.Source)
+			entries, tree, err := sourceTree(source)
+			if err != nil {
+				sources = append(sources, fileSource{Path: source, Missing: true})
+				continue
+			}
+			if tree {
+				for _, e := range entries {
+					sources = append(sources, fileSource{Path: e.source, Size: e.info.Size(), ModTime: e.info.ModTime().UnixNano()})
+				}
+				continue
+			}
+			fi, err := os.Stat(source)
+			if err != nil {
+				sources = append(sources, fileSource{Path: source, Missing: true})
+				continue
+			}
+			sources = append(sources, fileSource{Path: source, Size: fi.Size(), ModTime: fi.ModTime().UnixNano()})
+		case f.Metadata != "":
+			md, err := metadata(m, f.Metadata)
+			if err != nil {
+				return "", err
+			}
+			metadataFiles = append(metadataFiles, md)
+		}
+	}
+	return buildCacheKey("files", m.Files, idMap, sources, metadataFiles)
+}
+
+// section writes the tar entries of one section of the build to tw. If the cache has an entry for key
+// they are copied from there, and reused is true, otherwise they are generated by fn and stored in the
+// cache. An empty key means the section cannot be cached.
+func (c *buildCache) section(key, location string, tw tarWriter, fn func(tw tarWriter) error) (reused bool, err error) {
+	if c == nil || key == "" {
+		return false, fn(tw)
+	}
+	filename := filepath.Join(c.dir, buildCacheSections, key+".tar")
+	if f, err := os.Open(filename); err == nil {
+		defer func() { _ = f.Close() }()
+		log.Infof("  Reuse %s from build cache", location)
+		tr := tar.NewReader(f)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return true, nil
+			}
+			if err != nil {
+				return true, fmt.Errorf("failed to read %s from build cache: %v", location, err)
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return true, err
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return true, err
+			}
+		}
+	}
+
+	return false, c.store(filename, func(w io.Writer) error {
+		cw := tar.NewWriter(w)
+		if err := fn(&teeTarWriter{tw: tw, cache: cw}); err != nil {
+			return err
+		}
+		return cw.Close()
+	})
+}
+
+// sboms adds the SBoMs of an image that was reused from the cache, as they are not part of its entry
+func (c *buildCache) sboms(ref *reference.Spec, location, prefix string, opts BuildOpts) error {
+	if opts.SbomGenerator == nil || ref == nil {
+		return nil
+	}
+	src, err := imageSource(ref, opts.Pull, opts.CacheDir, opts.DockerCache, imagespec.Platform{OS: "linux", Architecture: opts.Arch})
+	if err != nil {
+		return fmt.Errorf("could not pull image %s: %v", ref, err)
+	}
+	return addSBoMs(src, location, prefix, opts)
+}
+
+// file writes a file generated by fn to filename, copying it from the cache if it has an entry for key
+func (c *buildCache) file(key, filename string, fn func(w io.Writer) error) error {
+	cached := filepath.Join(c.dir, buildCacheImages, key)
+	if in, err := os.Open(cached); err == nil {
+		defer func() { _ = in.Close() }()
+		log.Infof("  Reuse %s from build cache", filepath.Base(filename))
+		out, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = out.Close() }()
+		if _, err := io.Copy(out, in); err != nil {
+			return err
+		}
+		return out.Close()
+	}
+
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = out.Close() }()
+	if err := c.store(cached, func(w io.Writer) error {
+		return fn(io.MultiWriter(out, w))
+	}); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// store writes a new cache entry at filename, so that it only appears once fn has succeeded
+func (c *buildCache) store(filename string, fn func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create build cache entry: %v", err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	if err := fn(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// teeTarWriter writes a tar stream to both the build output and a cache entry
+type teeTarWriter struct {
+	tw    tarWriter
+	cache *tar.Writer
+}
+
+func (t *teeTarWriter) WriteHeader(hdr *tar.Header) error {
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	return t.cache.WriteHeader(hdr)
+}
+
+func (t *teeTarWriter) Write(b []byte) (int, error) {
+	n, err := t.tw.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return t.cache.Write(b[:n])
+}
+
+func (t *teeTarWriter) Flush() error {
+	if err := t.tw.Flush(); err != nil {
+		return err
+	}
+	return t.cache.Flush()
+}
+
+// Close does not close the build output, which is shared with the other sections
+func (t *teeTarWriter) Close() error {
+	return t.cache.Close()
+}
+
+// tarToInitrdCached converts a tar stream to an initrd like tarToInitrd, reusing the compressed initrd from
+// the cache if the root filesystem is unchanged. The initrd is written exactly as tarToInitrd writes it, so
+// the output is the same with or without the cache. An initrd containing a secret is never stored.
+func tarToInitrdCached(r io.Reader, c *buildCache) ([]byte, []byte, string, []byte, error) {
+	tr := tar.NewReader(r)
+	boot := new(bytes.Buffer)
+	bw := tar.NewWriter(boot)
+	rootfs := new(bytes.Buffer)
+	rw := tar.NewWriter(rootfs)
+	redacted := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, "", nil, err
+		}
+		w := rw
+		if strings.HasPrefix(hdr.Name, "boot/") {
+			w = bw
+		} else if hdr.PAXRecords[moby.PaxRecordLinuxkitRedacted] != "" {
+			redacted = true
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			return nil, nil, "", nil, err
+		}
+		if _, err := io.Copy(w, tr); err != nil {
+			return nil, nil, "", nil, err
+		}
+	}
+	if err := bw.Close(); err != nil {
+		return nil, nil, "", nil, err
+	}
+	if err := rw.Close(); err != nil {
+		return nil, nil, "", nil, err
+	}
+
+	// only the kernel, cmdline and ucode are in boot, and they are split out rather than written
+	kernel, cmdline, ucode, err := initrd.CopySplitTar(initrd.NewWriter(io.Discard), tar.NewReader(boot))
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	b, err := c.initrd(rootfs.Bytes(), !redacted)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	return kernel, b, cmdline, ucode, nil
+}
+
+// initrd returns the compressed initrd for a tar of the root filesystem, which is only stored in the cache if store is set
+func (c *buildCache) initrd(rootfs []byte, store bool) ([]byte, error) {
+	sum := sha256.Sum256(rootfs)
+	key, err := buildCacheKey(buildCacheInitrd, hex.EncodeToString(sum[:]))
+	if err != nil {
+		return nil, err
+	}
+	filename := filepath.Join(c.dir, buildCacheInitrd, key+".cpio.gz")
+	if b, err := os.ReadFile(filename); err == nil && store {
+		log.Infof("  Reuse initrd from build cache")
+		return b, nil
+	}
+	buf := new(bytes.Buffer)
+	iw := initrd.NewWriter(buf)
+	if _, _, _, err := initrd.CopySplitTar(iw, tar.NewReader(bytes.NewReader(rootfs))); err != nil {
+		return nil, err
+	}
+	if err := iw.Close(); err != nil {
+		return nil, err
+	}
+	if !store {
+		return buf.Bytes(), nil
+	}
+	if err := c.store(filename, func(w io.Writer) error {
+		_, err := w.Write(buf.Bytes())
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
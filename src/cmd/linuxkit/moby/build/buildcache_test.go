@@ -0,0 +1,135 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	cpio "github.com/surma/gocpio"
+)
+
+func TestBuildCacheFiles(t *testing.T) {
+	MobyDir = t.TempDir()
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source")
+	if err := os.WriteFile(source, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	contents := "contents"
+	m := moby.Moby{Files: []moby.File{
+		{Path: "etc/contents", Contents: &contents},
+		{Path: "etc/source", Source: source},
+		{Path: "etc/linuxkit.yml", Metadata: "yaml"},
+	}}
+	build := func(cacheDir string) []byte {
+		var buf bytes.Buffer
+		if err := Build(m, &buf, BuildOpts{BuildCacheDir: cacheDir}); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	entries := func() int {
+		matches, err := filepath.Glob(filepath.Join(dir, "cache", buildCacheSections, "*.tar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(matches)
+	}
+
+	uncached := build("")
+	if first := build(filepath.Join(dir, "cache")); !bytes.Equal(first, uncached) {
+		t.Fatal("output differs when writing to the build cache")
+	}
+	if reused := build(filepath.Join(dir, "cache")); !bytes.Equal(reused, uncached) {
+		t.Fatal("output differs when reading from the build cache")
+	}
+	if entries() != 1 {
+		t.Fatalf("expected 1 cache entry, found %d", entries())
+	}
+
+	// a changed source invalidates the entry
+	if err := os.WriteFile(source, []byte("second"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if changed := build(filepath.Join(dir, "cache")); !bytes.Equal(changed, build("")) || bytes.Equal(changed, uncached) {
+		t.Fatal("changed source not rebuilt")
+	}
+	if entries() != 2 {
+		t.Fatalf("expected 2 cache entries, found %d", entries())
+	}
+}
+
+// readInitrd returns the names and contents of the files in an initrd
+func readInitrd(t *testing.T, b []byte) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	gr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr := cpio.NewReader(bufio.NewReader(gr))
+	for {
+		hdr, err := cr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.IsTrailer() {
+			return files
+		}
+		contents, err := io.ReadAll(cr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(contents)
+	}
+}
+
+func TestInitrdCache(t *testing.T) {
+	dir := t.TempDir()
+	input := func(service string) []byte {
+		return testTar(t, []testEntry{
+			{name: "boot/kernel", contents: "kernel", mode: 0644, source: "linuxkit/kernel", location: "kernel"},
+			{name: "boot/cmdline", contents: "console=ttyS0", mode: 0644, source: "linuxkit/kernel", location: "kernel"},
+			{name: "sbin/init", contents: "init", mode: 0755, source: "linuxkit/init", location: "init[0]"},
+			{name: "containers/services/sshd/config.json", contents: service, mode: 0644, source: "linuxkit/sshd", location: "services[0]"},
+		})
+	}
+	entries := func() int {
+		matches, err := filepath.Glob(filepath.Join(dir, buildCacheInitrd, "*.cpio.gz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(matches)
+	}
+
+	for _, service := range []string{"first", "first", "second"} {
+		_, uncached, _, _, err := tarToInitrd(bytes.NewReader(input(service)), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		kernel, initrd, cmdline, _, err := tarToInitrd(bytes.NewReader(input(service)), dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(kernel) != "kernel" || cmdline != "console=ttyS0" {
+			t.Fatalf("kernel %q and cmdline %q not split out", kernel, cmdline)
+		}
+		// the initrd is the same whether or not it comes from the cache
+		if !bytes.Equal(initrd, uncached) {
+			t.Fatalf("initrd differs when using the build cache")
+		}
+		files := readInitrd(t, initrd)
+		if len(files) != 2 || files["sbin/init"] != "init" || files["containers/services/sshd/config.json"] != service {
+			t.Fatalf("unexpected initrd contents %v", files)
+		}
+	}
+	// the unchanged root filesystem reused its entry
+	if entries() != 2 {
+		t.Errorf("expected 2 cached initrds, found %d", entries())
+	}
+}
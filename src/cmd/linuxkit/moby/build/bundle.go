@@ -0,0 +1,143 @@
+package build
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+)
+
+// WriteBundle writes every image that building m for arches, and writing formats with builder, uses to w
+// as a single OCI layout tar, which can be loaded into the cache of a host without access to a registry
+// to build there. These are the images in m, the images from images.yaml that the native builder reads
+// files from, and for formats that are written by the mkimage LinuxKit image, the images of that. The
+// images that the docker builder runs with docker, from images.yaml or format plugins, are marked to be
+// loaded into docker too, as docker does not use the cache. Images that are not in the cache are pulled first.
+func WriteBundle(w io.Writer, m moby.Moby, formats []string, builder string, arches []string, opts BuildOpts) error {
+	images, dockerImages, mkimage, err := bundleFormatImages(formats, builder)
+	if err != nil {
+		return err
+	}
+	c, err := cache.NewProvider(opts.CacheDir)
+	if err != nil {
+		return err
+	}
+	bw, err := c.NewBundleWriter(w)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	pull := func(ref *reference.Spec, platforms []imagespec.Platform) (bool, error) {
+		name := util.ReferenceExpand(ref.String())
+		if seen[name] {
+			return false, nil
+		}
+		seen[name] = true
+		log.Infof("  %s", name)
+		if err := c.ImagePull(ref, platforms, opts.Pull); err != nil {
+			return false, fmt.Errorf("could not pull image %s: %v", name, err)
+		}
+		return true, nil
+	}
+	add := func(ref *reference.Spec, platforms []imagespec.Platform) error {
+		if ok, err := pull(ref, platforms); !ok {
+			return err
+		}
+		return bw.Add(ref, platforms)
+	}
+
+	if err := forEachImage(m, arches, add); err != nil {
+		return err
+	}
+	var platforms []imagespec.Platform
+	for _, arch := range arches {
+		platforms = append(platforms, imagespec.Platform{OS: "linux", Architecture: arch})
+	}
+	for _, image := range images {
+		ref, err := reference.Parse(util.ReferenceExpand(image))
+		if err != nil {
+			return fmt.Errorf("could not resolve reference for image %s: %v", image, err)
+		}
+		if err := add(&ref, platforms); err != nil {
+			return err
+		}
+	}
+	for _, image := range dockerImages {
+		ref, err := reference.Parse(util.ReferenceExpand(image))
+		if err != nil {
+			return fmt.Errorf("could not resolve reference for image %s: %v", image, err)
+		}
+		ok, err := pull(&ref, platforms)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := bw.AddDocker(&ref, platforms); err != nil {
+				return err
+			}
+		}
+	}
+	if mkimage {
+		mk, err := moby.NewConfig([]byte(linuxkitYaml["mkimage"]), nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := forEachImage(mk, arches, add); err != nil {
+			return err
+		}
+	}
+	return bw.Close()
+}
+
+// bundleFormatImages returns the images that writing formats with builder reads from the cache, the images
+// that the docker builder runs with docker, and whether any of the formats is written by the mkimage LinuxKit
+// image, which is built from other images.
+func bundleFormatImages(formats []string, builder string) ([]string, []string, bool, error) {
+	if outputImages == nil {
+		var err error
+		outputImages, err = parseOutputImages(imagesBytes)
+		if err != nil {
+			return nil, nil, false, err
+		}
+	}
+	var (
+		images       []string
+		dockerImages []string
+		mkimage      bool
+	)
+	for _, f := range formats {
+		if Streamable(f) {
+			continue
+		}
+		if _, err := outputFun(f, "", builder); err != nil {
+			return nil, nil, false, err
+		}
+		names := formatImages(f, builder)
+		if builder == BuilderNative {
+			for _, n := range names {
+				images = append(images, outputImages[n])
+			}
+			continue
+		}
+		plugins, err := loadFormatPlugins()
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if plugin, ok := plugins[f]; ok {
+			dockerImages = append(dockerImages, plugin.Image)
+			continue
+		}
+		for _, n := range names {
+			dockerImages = append(dockerImages, outputImages[n])
+		}
+		if builtinFormats[f].prereq == "mkimage" {
+			mkimage = true
+		}
+	}
+	return images, dockerImages, mkimage, nil
+}
@@ -0,0 +1,36 @@
+package build
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBundleFormatImages(t *testing.T) {
+	images, dockerImages, mkimage, err := bundleFormatImages([]string{"tar", "kernel+initrd", "raw-efi", "iso-bios"}, BuilderNative)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || !strings.Contains(images[0], "linuxkit/systemd-boot:") || !strings.Contains(images[1], "mkimage-iso-bios") || len(dockerImages) != 0 || mkimage {
+		t.Errorf("unexpected images %v, %v, %v", images, dockerImages, mkimage)
+	}
+
+	images, dockerImages, mkimage, err = bundleFormatImages([]string{"tar", "kernel+initrd", "aws"}, BuilderDocker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 0 || len(dockerImages) != 0 || !mkimage {
+		t.Errorf("expected only the mkimage LinuxKit image, got %v, %v, %v", images, dockerImages, mkimage)
+	}
+
+	// the docker builder runs the mkimage-* images with docker, so they are loaded into docker
+	images, dockerImages, _, err = bundleFormatImages([]string{"raw-bios"}, BuilderDocker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 0 || len(dockerImages) != 1 || !strings.Contains(dockerImages[0], "mkimage-raw-bios") {
+		t.Errorf("unexpected images %v, %v", images, dockerImages)
+	}
+	if _, _, _, err := bundleFormatImages([]string{"vmdk"}, BuilderNative); err == nil {
+		t.Error("expected error for a format the native builder does not support")
+	}
+}
@@ -0,0 +1,169 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/spdx/tools-golang/spdx"
+	spdxcommon "github.com/spdx/tools-golang/spdx/v2/common"
+)
+
+// cdxBOM is a CycloneDX 1.5 json document, with only the fields we write
+type cdxBOM struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	SerialNumber string          `json:"serialNumber,omitempty"`
+	Version      int             `json:"version"`
+	Metadata     cdxMetadata     `json:"metadata"`
+	Components   []*cdxComponent `json:"components,omitempty"`
+	Dependencies []cdxDependency `json:"dependencies,omitempty"`
+}
+
+type cdxMetadata struct {
+	Timestamp string        `json:"timestamp"`
+	Tools     cdxTools      `json:"tools"`
+	Component *cdxComponent `json:"component"`
+}
+
+type cdxTools struct {
+	Components []*cdxComponent `json:"components"`
+}
+
+type cdxComponent struct {
+	BOMRef     string          `json:"bom-ref,omitempty"`
+	Type       string          `json:"type"`
+	Name       string          `json:"name"`
+	Version    string          `json:"version,omitempty"`
+	Hashes     []cdxHash       `json:"hashes,omitempty"`
+	Licenses   []cdxLicense    `json:"licenses,omitempty"`
+	PURL       string          `json:"purl,omitempty"`
+	Properties []cdxProperty   `json:"properties,omitempty"`
+	Components []*cdxComponent `json:"components,omitempty"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxLicense struct {
+	Expression string `json:"expression"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn,omitempty"`
+}
+
+// cdxHashAlgorithms maps SPDX checksum algorithms to CycloneDX hash algorithms
+var cdxHashAlgorithms = map[spdxcommon.ChecksumAlgorithm]string{
+	spdxcommon.MD5:    "MD5",
+	spdxcommon.SHA1:   "SHA-1",
+	spdxcommon.SHA256: "SHA-256",
+	spdxcommon.SHA512: "SHA-512",
+}
+
+// cycloneDX returns the sbom as a CycloneDX document. The image is the metadata component, and
+// the image of each section of the build is a container component, with the packages from the sboms
+// attached to that image as its components, and the files from the files section are file components.
+func (s *SbomGenerator) cycloneDX() ([]byte, error) {
+	bom := cdxBOM{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.5",
+		Version:     1,
+		Metadata: cdxMetadata{
+			Timestamp: s.buildTime.UTC().Format("2006-01-02T15:04:05Z"),
+			Tools:     cdxTools{Components: []*cdxComponent{{Type: "application", Name: "linuxkit"}}},
+			Component: &cdxComponent{BOMRef: sbomRootID, Type: "operating-system", Name: "linuxkit"},
+		},
+	}
+	root := cdxDependency{Ref: sbomRootID}
+	for _, img := range s.images {
+		id := string(spdxID(img.location))
+		c := &cdxComponent{
+			BOMRef:     id,
+			Type:       "container",
+			Name:       img.ref,
+			Properties: []cdxProperty{{Name: "linuxkit:location", Value: img.location}},
+		}
+		if img.digest != "" {
+			c.Version = img.digest
+			c.Hashes = []cdxHash{{Alg: "SHA-256", Content: strings.TrimPrefix(img.digest, "sha256:")}}
+			c.PURL = ociPurl(img.ref, img.digest)
+		}
+		dep := cdxDependency{Ref: id}
+		for n, sbom := range img.sboms {
+			// as for SPDX, the bom-refs of packages are prefixed with the sbom they are in
+			prefix := id
+			if len(img.sboms) > 1 {
+				prefix = string(spdxID(img.location, fmt.Sprint(n)))
+			}
+			for _, p := range sbom.Packages {
+				pc := cdxPackage(prefix, p)
+				c.Components = append(c.Components, pc)
+				dep.DependsOn = append(dep.DependsOn, pc.BOMRef)
+			}
+		}
+		bom.Components = append(bom.Components, c)
+		bom.Dependencies = append(bom.Dependencies, dep)
+		root.DependsOn = append(root.DependsOn, id)
+	}
+	for i, f := range s.files {
+		id := string(spdxID("files", fmt.Sprint(i)))
+		c := &cdxComponent{BOMRef: id, Type: "file", Name: f.path}
+		if f.redacted {
+			c.Properties = []cdxProperty{{Name: "linuxkit:redacted", Value: "true"}}
+		} else {
+			c.Hashes = []cdxHash{{Alg: "SHA-1", Content: f.sha1}, {Alg: "SHA-256", Content: f.sha256}}
+		}
+		bom.Components = append(bom.Components, c)
+		root.DependsOn = append(root.DependsOn, id)
+	}
+	bom.Dependencies = append([]cdxDependency{root}, bom.Dependencies...)
+
+	// as for SPDX, derive the serial number from the contents so the same inputs always give the same sbom
+	b, err := json.Marshal(bom)
+	if err != nil {
+		return nil, err
+	}
+	bom.SerialNumber = "urn:uuid:" + uuid.NewSHA1(uuid.NameSpaceURL, b).String()
+	return json.MarshalIndent(bom, "", "  ")
+}
+
+// cdxPackage converts a package from an sbom of an image to a CycloneDX component, whose bom-ref is prefixed
+// with prefix, which is unique to the sbom
+func cdxPackage(prefix string, p *spdx.Package) *cdxComponent {
+	c := &cdxComponent{
+		// SPDX identifiers are only unique within one sbom
+		BOMRef:  prefix + ":" + string(p.PackageSPDXIdentifier),
+		Type:    "library",
+		Name:    p.PackageName,
+		Version: p.PackageVersion,
+	}
+	for _, ref := range p.PackageExternalReferences {
+		if ref.RefType == "purl" {
+			c.PURL = ref.Locator
+			break
+		}
+	}
+	for _, checksum := range p.PackageChecksums {
+		if alg, ok := cdxHashAlgorithms[checksum.Algorithm]; ok {
+			c.Hashes = append(c.Hashes, cdxHash{Alg: alg, Content: checksum.Value})
+		}
+	}
+	license := p.PackageLicenseConcluded
+	if license == "" || license == "NOASSERTION" || license == "NONE" {
+		license = p.PackageLicenseDeclared
+	}
+	if license != "" && license != "NOASSERTION" && license != "NONE" {
+		c.Licenses = []cdxLicense{{Expression: license}}
+	}
+	return c
+}
@@ -0,0 +1,517 @@
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	gzip "github.com/klauspost/pgzip"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	cpio "github.com/surma/gocpio"
+)
+
+// FileInfo is the metadata and content digest of a file in a build output
+type FileInfo struct {
+	Type     byte   `json:"type"`
+	Mode     int64  `json:"mode"`
+	UID      int    `json:"uid"`
+	GID      int    `json:"gid"`
+	Size     int64  `json:"size"`
+	Linkname string `json:"linkname,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+}
+
+// ImageRef is the image a location in the config was built from, with its digest if known
+type ImageRef struct {
+	Reference string `json:"reference"`
+	Digest    string `json:"digest,omitempty"`
+}
+
+// String returns the reference, including the digest if known
+func (i ImageRef) String() string {
+	if i.Digest == "" {
+		return i.Reference
+	}
+	return i.Reference + "@" + i.Digest
+}
+
+// ImageContents is what went into a build output, as needed to compare it with another
+type ImageContents struct {
+	// Images maps the location in the config, e.g. services[2], to the image it was built from
+	Images map[string]ImageRef
+	// Kernel is the digest of the kernel binary, Cmdline the kernel command line
+	Kernel  string
+	Cmdline string
+	Files   map[string]FileInfo
+	// Specs holds the OCI runtime configs of the containers, by path
+	Specs map[string][]byte
+}
+
+func newImageContents() *ImageContents {
+	return &ImageContents{
+		Images: map[string]ImageRef{},
+		Files:  map[string]FileInfo{},
+		Specs:  map[string][]byte{},
+	}
+}
+
+// isSpec reports whether a path is the OCI runtime config of a container
+func isSpec(p string) bool {
+	dir, file := path.Split(p)
+	return file == "config.json" && strings.HasPrefix(dir, "containers/") && strings.Count(dir, "/") == 3
+}
+
+// add records a file, reading its contents from r
+func (c *ImageContents) add(name string, info FileInfo, r io.Reader) error {
+	name = strings.TrimSuffix(strings.TrimPrefix(path.Clean("/"+name), "/"), "/")
+	if name == "" {
+		return nil
+	}
+	if info.Type == tar.TypeReg {
+		var buf bytes.Buffer
+		h := sha256.New()
+		w := io.Writer(h)
+		if isSpec(name) {
+			w = io.MultiWriter(h, &buf)
+		}
+		n, err := io.Copy(w, r)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		info.Size = n
+		info.Digest = fmt.Sprintf("sha256:%x", h.Sum(nil))
+		if isSpec(name) {
+			c.Specs[name] = buf.Bytes()
+		}
+	}
+	switch name {
+	case "boot/kernel":
+		c.Kernel = info.Digest
+		return nil
+	case "boot/cmdline":
+		return nil
+	}
+	c.Files[name] = info
+	return nil
+}
+
+// ReadTarContents reads the contents of a tar build output, as produced by Build
+func ReadTarContents(r io.Reader) (*ImageContents, error) {
+	c := newImageContents()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if source := hdr.PAXRecords[moby.PaxRecordLinuxkitSource]; source != "" && !strings.HasPrefix(source, "linuxkit.") {
+			location := hdr.PAXRecords[moby.PaxRecordLinuxkitLocation]
+			// volumes are recorded as volume[n] in the tar, but are in the volumes section of the config
+			if strings.HasPrefix(location, "volume[") {
+				location = "volumes" + strings.TrimPrefix(location, "volume")
+			}
+			if _, ok := c.Images[location]; !ok && location != "" {
+				c.Images[location] = ImageRef{Reference: source}
+			}
+		}
+		if hdr.Name == "boot/cmdline" {
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			c.Cmdline = string(b)
+			continue
+		}
+		typeflag := hdr.Typeflag
+		if typeflag == tar.TypeRegA {
+			typeflag = tar.TypeReg
+		}
+		info := FileInfo{
+			Type:     typeflag,
+			Mode:     hdr.Mode & 07777,
+			UID:      hdr.Uid,
+			GID:      hdr.Gid,
+			Size:     hdr.Size,
+			Linkname: hdr.Linkname,
+		}
+		if err := c.add(hdr.Name, info, tr); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// cpioNewcMagic starts every header of a newc cpio archive, as used for the initrd
+const cpioNewcMagic = "070701"
+
+// cpioTypes maps cpio file types to tar ones
+var cpioTypes = map[int64]byte{
+	cpio.TYPE_REG:     tar.TypeReg,
+	cpio.TYPE_SYMLINK: tar.TypeSymlink,
+	cpio.TYPE_CHAR:    tar.TypeChar,
+	cpio.TYPE_BLK:     tar.TypeBlock,
+	cpio.TYPE_DIR:     tar.TypeDir,
+	cpio.TYPE_FIFO:    tar.TypeFifo,
+}
+
+// ReadKernelInitrdContents reads the contents of a kernel+initrd build output, given the base name of
+// the output files, i.e. without the -kernel, -initrd.img and -cmdline suffixes. The kernel and cmdline
+// are optional.
+func ReadKernelInitrdContents(base string) (*ImageContents, error) {
+	c := newImageContents()
+	b, err := os.ReadFile(base + "-initrd.img")
+	if err != nil {
+		return nil, err
+	}
+	// any microcode is prepended as uncompressed cpio archives, so skip them to the compressed initrd
+	br := bytes.NewReader(b)
+	if err := skipUncompressedCpio(br); err != nil {
+		return nil, fmt.Errorf("failed to read microcode in %s-initrd.img: %v", base, err)
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("%s-initrd.img is not a compressed initrd: %v", base, err)
+	}
+	defer func() { _ = zr.Close() }()
+	// the initrd may be several concatenated archives, compressed separately or together, which the
+	// kernel unpacks in turn, so read them all
+	r := bufio.NewReader(zr)
+	for {
+		if err := skipZeros(r); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read initrd: %v", err)
+		}
+		if err := readCpioContents(c, cpio.NewReader(r)); err != nil {
+			return nil, err
+		}
+	}
+
+	if kernel, err := os.ReadFile(base + "-kernel"); err == nil {
+		c.Kernel = fmt.Sprintf("sha256:%x", sha256.Sum256(kernel))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if cmdline, err := os.ReadFile(base + "-cmdline"); err == nil {
+		c.Cmdline = string(cmdline)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readCpioContents adds the contents of a cpio archive, up to its trailer, to c
+func readCpioContents(c *ImageContents, cr *cpio.Reader) error {
+	for {
+		hdr, err := cr.Next()
+		if err != nil {
+			return fmt.Errorf("failed to read initrd: %v", err)
+		}
+		if hdr.IsTrailer() {
+			return nil
+		}
+		info := FileInfo{
+			Type: cpioTypes[hdr.Type],
+			Mode: hdr.Mode & 07777,
+			UID:  hdr.Uid,
+			GID:  hdr.Gid,
+			Size: hdr.Size,
+		}
+		var r io.Reader = cr
+		if hdr.Type == cpio.TYPE_SYMLINK {
+			link, err := io.ReadAll(io.LimitReader(cr, hdr.Size))
+			if err != nil {
+				return err
+			}
+			info.Linkname = string(link)
+			info.Size = 0
+		} else {
+			r = io.LimitReader(cr, hdr.Size)
+		}
+		if err := c.add(hdr.Name, info, r); err != nil {
+			return err
+		}
+	}
+}
+
+// skipUncompressedCpio skips any uncompressed newc cpio archives at the start of r, up to the end
+// of the zero padding after their trailers
+func skipUncompressedCpio(r *bytes.Reader) error {
+	for {
+		magic := make([]byte, 6)
+		n, _ := r.ReadAt(magic, r.Size()-int64(r.Len()))
+		if n < len(magic) || string(magic) != cpioNewcMagic {
+			return nil
+		}
+		cr := cpio.NewReader(r)
+		for {
+			hdr, err := cr.Next()
+			if err != nil {
+				return err
+			}
+			if hdr.IsTrailer() {
+				break
+			}
+			if _, err := io.Copy(io.Discard, cr); err != nil {
+				return err
+			}
+		}
+		if err := skipZeros(r); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// skipZeros skips the zero padding after a cpio archive, returning io.EOF if nothing follows it
+func skipZeros(r io.ByteScanner) error {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 0 {
+			return r.UnreadByte()
+		}
+	}
+}
+
+// SetManifest records the digests each image was resolved to, as the build output only records references
+func (c *ImageContents) SetManifest(manifest *Manifest) {
+	for _, image := range manifest.Images {
+		c.Images[image.Location] = ImageRef{Reference: image.Reference, Digest: image.Digest}
+	}
+}
+
+// Change is a value that was added, removed or modified; Old is empty if added, New if removed
+type Change struct {
+	Name string `json:"name"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+// FileChange is a file that was added, removed or modified, with a description of each modification
+type FileChange struct {
+	Path    string   `json:"path"`
+	Added   bool     `json:"added,omitempty"`
+	Removed bool     `json:"removed,omitempty"`
+	Changes []string `json:"changes,omitempty"`
+}
+
+// SpecChange is a field of the OCI runtime config of a container that changed
+type SpecChange struct {
+	Path  string `json:"path"`
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// ImageDiff is the difference between two build outputs
+type ImageDiff struct {
+	Images  []Change     `json:"images,omitempty"`
+	Kernel  *Change      `json:"kernel,omitempty"`
+	Cmdline []Change     `json:"cmdline,omitempty"`
+	Files   []FileChange `json:"files,omitempty"`
+	Specs   []SpecChange `json:"specs,omitempty"`
+}
+
+// Empty reports whether there are no differences
+func (d *ImageDiff) Empty() bool {
+	return len(d.Images) == 0 && d.Kernel == nil && len(d.Cmdline) == 0 && len(d.Files) == 0 && len(d.Specs) == 0
+}
+
+// DiffContents compares two build outputs
+func DiffContents(old, new *ImageContents) *ImageDiff {
+	d := &ImageDiff{}
+
+	// only compare digests if both sides know them
+	withDigests := true
+	for _, c := range []*ImageContents{old, new} {
+		for _, image := range c.Images {
+			if image.Digest == "" {
+				withDigests = false
+			}
+		}
+	}
+	for _, location := range sortedKeys(old.Images, new.Images) {
+		o, inOld := old.Images[location]
+		n, inNew := new.Images[location]
+		if !withDigests {
+			o.Digest, n.Digest = "", ""
+		}
+		switch {
+		case !inOld:
+			d.Images = append(d.Images, Change{Name: location, New: n.String()})
+		case !inNew:
+			d.Images = append(d.Images, Change{Name: location, Old: o.String()})
+		case o != n:
+			d.Images = append(d.Images, Change{Name: location, Old: o.String(), New: n.String()})
+		}
+	}
+
+	if old.Kernel != new.Kernel {
+		d.Kernel = &Change{Name: "kernel", Old: old.Kernel, New: new.Kernel}
+	}
+	d.Cmdline = diffCmdline(old.Cmdline, new.Cmdline)
+
+	for _, p := range sortedKeys(old.Files, new.Files) {
+		o, inOld := old.Files[p]
+		n, inNew := new.Files[p]
+		switch {
+		case !inOld:
+			d.Files = append(d.Files, FileChange{Path: p, Added: true})
+		case !inNew:
+			d.Files = append(d.Files, FileChange{Path: p, Removed: true})
+		case o != n:
+			d.Files = append(d.Files, FileChange{Path: p, Changes: diffFileInfo(o, n)})
+		}
+	}
+
+	for _, p := range sortedKeys(old.Specs, new.Specs) {
+		o, n := old.Specs[p], new.Specs[p]
+		if o == nil || n == nil || bytes.Equal(o, n) {
+			continue
+		}
+		d.Specs = append(d.Specs, diffSpecs(p, o, n)...)
+	}
+	return d
+}
+
+func diffFileInfo(o, n FileInfo) []string {
+	var changes []string
+	if o.Type != n.Type {
+		changes = append(changes, fmt.Sprintf("type %s -> %s", typeName(o.Type), typeName(n.Type)))
+	}
+	if o.Mode != n.Mode {
+		changes = append(changes, fmt.Sprintf("mode %04o -> %04o", o.Mode, n.Mode))
+	}
+	if o.UID != n.UID || o.GID != n.GID {
+		changes = append(changes, fmt.Sprintf("owner %d:%d -> %d:%d", o.UID, o.GID, n.UID, n.GID))
+	}
+	if o.Linkname != n.Linkname {
+		changes = append(changes, fmt.Sprintf("link %s -> %s", o.Linkname, n.Linkname))
+	}
+	if o.Digest != n.Digest {
+		changes = append(changes, fmt.Sprintf("content, size %d -> %d", o.Size, n.Size))
+	}
+	return changes
+}
+
+func typeName(t byte) string {
+	switch t {
+	case tar.TypeReg:
+		return "file"
+	case tar.TypeDir:
+		return "directory"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeChar:
+		return "char device"
+	case tar.TypeBlock:
+		return "block device"
+	case tar.TypeFifo:
+		return "fifo"
+	default:
+		return fmt.Sprintf("type %q", t)
+	}
+}
+
+// diffCmdline compares kernel command lines by parameter name, so that reordering is not reported
+func diffCmdline(old, new string) []Change {
+	parse := func(cmdline string) map[string]string {
+		params := map[string]string{}
+		for _, p := range strings.Fields(cmdline) {
+			name := strings.SplitN(p, "=", 2)[0]
+			// parameters such as console can be repeated
+			if v, ok := params[name]; ok {
+				params[name] = v + " " + p
+			} else {
+				params[name] = p
+			}
+		}
+		return params
+	}
+	o, n := parse(old), parse(new)
+	var changes []Change
+	for _, name := range sortedKeys(o, n) {
+		if o[name] != n[name] {
+			changes = append(changes, Change{Name: name, Old: o[name], New: n[name]})
+		}
+	}
+	return changes
+}
+
+// diffSpecs compares two OCI runtime configs field by field
+func diffSpecs(p string, old, new []byte) []SpecChange {
+	var o, n interface{}
+	if json.Unmarshal(old, &o) != nil || json.Unmarshal(new, &n) != nil {
+		return []SpecChange{{Path: p, Field: "", Old: "invalid json", New: "invalid json"}}
+	}
+	of, nf := map[string]string{}, map[string]string{}
+	flattenJSON("", o, of)
+	flattenJSON("", n, nf)
+	var changes []SpecChange
+	for _, field := range sortedKeys(of, nf) {
+		if of[field] != nf[field] {
+			changes = append(changes, SpecChange{Path: p, Field: field, Old: of[field], New: nf[field]})
+		}
+	}
+	return changes
+}
+
+// flattenJSON records the leaf values of a decoded json document by their path, e.g. process.args[0]
+func flattenJSON(prefix string, v interface{}, out map[string]string) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(t) == 0 {
+			out[prefix] = "{}"
+		}
+		for k, e := range t {
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+			flattenJSON(key, e, out)
+		}
+	case []interface{}:
+		if len(t) == 0 {
+			out[prefix] = "[]"
+		}
+		for i, e := range t {
+			flattenJSON(fmt.Sprintf("%s[%d]", prefix, i), e, out)
+		}
+	default:
+		b, _ := json.Marshal(t)
+		out[prefix] = string(b)
+	}
+}
+
+// sortedKeys returns the keys present in either map, in order
+func sortedKeys[V any](a, b map[string]V) []string {
+	var keys []string
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,183 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	cpio "github.com/surma/gocpio"
+)
+
+type testEntry struct {
+	name     string
+	contents string
+	mode     int64
+	source   string
+	location string
+}
+
+func testTar(t *testing.T, entries []testEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:    e.name,
+			Mode:    e.mode,
+			Size:    int64(len(e.contents)),
+			ModTime: defaultModTime,
+			Format:  tar.FormatPAX,
+		}
+		if e.source != "" {
+			hdr.PAXRecords = map[string]string{
+				moby.PaxRecordLinuxkitSource:   e.source,
+				moby.PaxRecordLinuxkitLocation: e.location,
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDiffContents(t *testing.T) {
+	oldTar := testTar(t, []testEntry{
+		{"boot/kernel", "kernel1", 0644, "docker.io/linuxkit/kernel:1", "kernel"},
+		{"boot/cmdline", "console=tty0 quiet", 0644, "docker.io/linuxkit/kernel:1", "kernel"},
+		{"etc/a", "a", 0644, "linuxkit.files", "files[0]"},
+		{"etc/b", "b", 0644, "linuxkit.files", "files[1]"},
+		{"containers/services/getty/config.json", `{"process":{"args":["getty","-a"]}}`, 0644, "docker.io/linuxkit/getty:1", "services[0]"},
+	})
+	newTar := testTar(t, []testEntry{
+		{"boot/kernel", "kernel1", 0644, "docker.io/linuxkit/kernel:1", "kernel"},
+		{"boot/cmdline", "quiet console=ttyS0", 0644, "docker.io/linuxkit/kernel:1", "kernel"},
+		{"etc/a", "a", 0600, "linuxkit.files", "files[0]"},
+		{"etc/c", "c", 0644, "linuxkit.files", "files[1]"},
+		{"containers/services/getty/config.json", `{"process":{"args":["getty","-b"]}}`, 0644, "docker.io/linuxkit/getty:2", "services[0]"},
+	})
+	o, err := ReadTarContents(bytes.NewReader(oldTar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := ReadTarContents(bytes.NewReader(newTar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := DiffContents(o, n)
+
+	expected := &ImageDiff{
+		Images:  []Change{{Name: "services[0]", Old: "docker.io/linuxkit/getty:1", New: "docker.io/linuxkit/getty:2"}},
+		Cmdline: []Change{{Name: "console", Old: "console=tty0", New: "console=ttyS0"}},
+		Files: []FileChange{
+			{Path: "containers/services/getty/config.json", Changes: []string{"content, size 35 -> 35"}},
+			{Path: "etc/a", Changes: []string{"mode 0644 -> 0600"}},
+			{Path: "etc/b", Removed: true},
+			{Path: "etc/c", Added: true},
+		},
+		Specs: []SpecChange{{Path: "containers/services/getty/config.json", Field: "process.args[1]", Old: `"-a"`, New: `"-b"`}},
+	}
+	if !reflect.DeepEqual(d, expected) {
+		t.Errorf("unexpected diff:\n%#v\nexpected:\n%#v", d, expected)
+	}
+	if !DiffContents(o, o).Empty() {
+		t.Error("expected no differences comparing with self")
+	}
+}
+
+func TestReadKernelInitrdContents(t *testing.T) {
+	tarball := testTar(t, []testEntry{
+		{"boot/kernel", "kernel1", 0644, "", ""},
+		{"boot/cmdline", "console=tty0", 0644, "", ""},
+		{"etc/a", "a", 0644, "", ""},
+	})
+	fromTar, err := ReadTarContents(bytes.NewReader(tarball))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kernel, initrd, cmdline, _, err := tarToInitrd(bytes.NewReader(tarball), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(t.TempDir(), "test")
+	for suffix, contents := range map[string][]byte{"-kernel": kernel, "-initrd.img": initrd, "-cmdline": []byte(cmdline)} {
+		if err := os.WriteFile(base+suffix, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fromInitrd, err := ReadKernelInitrdContents(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := DiffContents(fromTar, fromInitrd); !d.Empty() {
+		t.Errorf("expected no differences between tar and initrd, got %#v", d)
+	}
+}
+
+func TestReadKernelInitrdContentsSegments(t *testing.T) {
+	first := testTar(t, []testEntry{
+		{"boot/kernel", "kernel1", 0644, "", ""},
+		{"boot/cmdline", "console=tty0", 0644, "", ""},
+		{"etc/a", "a", 0644, "", ""},
+	})
+	second := testTar(t, []testEntry{
+		{"etc/b", "b", 0600, "", ""},
+	})
+	all := testTar(t, []testEntry{
+		{"boot/kernel", "kernel1", 0644, "", ""},
+		{"boot/cmdline", "console=tty0", 0644, "", ""},
+		{"etc/a", "a", 0644, "", ""},
+		{"etc/b", "b", 0600, "", ""},
+	})
+	fromTar, err := ReadTarContents(bytes.NewReader(all))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// microcode that happens to contain the gzip magic number is prepended uncompressed
+	var ucode bytes.Buffer
+	cw := cpio.NewWriter(&ucode)
+	microcode := "\037\213\010microcode"
+	if err := cw.WriteHeader(&cpio.Header{Name: "kernel/x86/microcode/GenuineIntel.bin", Mode: 0644, Type: cpio.TYPE_REG, Size: int64(len(microcode))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cw.Write([]byte(microcode)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	kernel, initrd1, cmdline, _, err := tarToInitrd(bytes.NewReader(first), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, initrd2, _, _, err := tarToInitrd(bytes.NewReader(second), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	initrd := append(append(ucode.Bytes(), initrd1...), initrd2...)
+
+	base := filepath.Join(t.TempDir(), "test")
+	for suffix, contents := range map[string][]byte{"-kernel": kernel, "-initrd.img": initrd, "-cmdline": []byte(cmdline)} {
+		if err := os.WriteFile(base+suffix, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fromInitrd, err := ReadKernelInitrdContents(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := DiffContents(fromTar, fromInitrd); !d.Empty() {
+		t.Errorf("expected no differences between tar and initrd segments, got %#v", d)
+	}
+}
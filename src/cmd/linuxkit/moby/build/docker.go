@@ -29,10 +29,16 @@ func dockerRun(input io.Reader, output io.Writer, img string, runEnv []string, i
 	pull := exec.Command(docker, "pull", img)
 	pull.Env = env
 	if err := pull.Run(); err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
+		// without access to the registry, use the image if it was loaded from a bundle
+		inspect := exec.Command(docker, "image", "inspect", img)
+		inspect.Env = env
+		if inspect.Run() == nil {
+			log.Warnf("docker pull %s failed, using the local image: %v", img, err)
+		} else if exitError, ok := err.(*exec.ExitError); ok {
 			return fmt.Errorf("docker pull %s failed: %v output:\n%s", img, err, exitError.Stderr)
+		} else {
+			return err
 		}
-		return err
 	}
 
 	var errbuf strings.Builder
@@ -0,0 +1,216 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+)
+
+// renderTemplate renders the contents of a file with template set as a go text/template, with the config,
+// with its images resolved, as data. The digest function returns the digest of an image, and the id function
+// the uid and gid assigned to a container by name, as used for files.
+func renderTemplate(name string, contents []byte, m moby.Moby, idMap map[string]uint32, opts BuildOpts) ([]byte, error) {
+	moby.UpdateImages(&m)
+	funcs := template.FuncMap{
+		"digest": func(image string) (string, error) {
+			ref, err := reference.Parse(util.ReferenceExpand(image))
+			if err != nil {
+				return "", fmt.Errorf("invalid image %s: %v", image, err)
+			}
+			digest, err := imageDigest(&ref, opts, nil)
+			if err != nil {
+				return "", err
+			}
+			if digest == "" {
+				return "", fmt.Errorf("digest of image %s is not known", image)
+			}
+			return digest, nil
+		},
+		"id": func(name string) (uint32, error) {
+			return moby.IDNumeric(name, idMap)
+		},
+	}
+	tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("invalid template for file %s: %v", name, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, m); err != nil {
+		return nil, fmt.Errorf("unable to render file %s: %v", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// sourceEntry is a file, directory or symlink copied from a source that is a directory or glob
+type sourceEntry struct {
+	// name is the path relative to the path of the file entry
+	name   string
+	source string
+	info   fs.FileInfo
+}
+
+func isGlob(source string) bool {
+	return strings.ContainsAny(source, "*?[")
+}
+
+// sourceExists returns true if a source is readable or, for a glob, matches anything
+func sourceExists(source string) bool {
+	if isGlob(source) {
+		matches, err := filepath.Glob(source)
+		return err == nil && len(matches) != 0
+	}
+	_, err := os.Stat(source)
+	return err == nil
+}
+
+// sourceTree returns the entries to copy for a source that is a directory, which are its contents,
+// or a glob, which are the matches and the contents of any that are directories. It returns false if
+// the source is a single file.
+func sourceTree(source string) ([]sourceEntry, bool, error) {
+	var roots []string
+	if isGlob(source) {
+		matches, err := filepath.Glob(source)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid source %s: %v", source, err)
+		}
+		if len(matches) == 0 {
+			return nil, true, fmt.Errorf("no files match source %s", source)
+		}
+		roots = matches
+	} else {
+		fi, err := os.Stat(source)
+		if err != nil || !fi.IsDir() {
+			return nil, false, nil
+		}
+		roots = []string{source}
+	}
+
+	var entries []sourceEntry
+	for _, root := range roots {
+		// the contents of a directory source, but the matches of a glob, are copied to the path
+		base := filepath.Dir(root)
+		if !isGlob(source) {
+			base = root
+		}
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if p == base {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(base, p)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, sourceEntry{name: filepath.ToSlash(rel), source: p, info: info})
+			return nil
+		})
+		if err != nil {
+			return nil, true, fmt.Errorf("failed to read source %s: %v", source, err)
+		}
+	}
+	return entries, true, nil
+}
+
+// writeSourceTree writes the entries of a file with a source that is a directory or glob under its path. The mode
+// of the file, if set, is used for the files, and the mode derived from it for the directories; otherwise they
+// keep the permissions of the source. All are owned by the uid and gid of the file.
+func writeSourceTree(tw tarWriter, m moby.Moby, f moby.File, entries []sourceEntry, mode, dirMode int64, uid, gid int, location string, addedFiles map[string]bool, idMap map[string]uint32, opts BuildOpts) error { // nolint: lll
+	header := func(name string, fi fs.FileInfo, typeflag byte) *tar.Header {
+		perm := fs.FileMode(0755)
+		if fi != nil {
+			perm = fi.Mode().Perm()
+		}
+		hdr := &tar.Header{
+			Name:     name,
+			Typeflag: typeflag,
+			Mode:     int64(perm),
+			ModTime:  defaultModTime,
+			Uid:      uid,
+			Gid:      gid,
+			Format:   tar.FormatPAX,
+			PAXRecords: map[string]string{
+				moby.PaxRecordLinuxkitSource:   "linuxkit.files",
+				moby.PaxRecordLinuxkitLocation: location,
+			},
+		}
+		switch {
+		case f.Mode == "":
+		case typeflag == tar.TypeDir:
+			hdr.Mode = dirMode
+		case typeflag == tar.TypeReg:
+			hdr.Mode = mode
+		}
+		return hdr
+	}
+
+	if !addedFiles[f.Path] {
+		var hdr *tar.Header
+		if root, err := os.Stat(expandSource(f.Source)); err == nil {
+			hdr = header(f.Path, root, tar.TypeDir)
+		} else {
+			// a glob has no single directory to take the permissions from
+			hdr = header(f.Path, nil, tar.TypeDir)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		addedFiles[f.Path] = true
+	}
+	for _, e := range entries {
+		name := path.Join(f.Path, e.name)
+		addedFiles[name] = true
+		switch {
+		case e.info.IsDir():
+			if err := tw.WriteHeader(header(name, e.info, tar.TypeDir)); err != nil {
+				return err
+			}
+		case e.info.Mode()&fs.ModeSymlink != 0:
+			hdr := header(name, e.info, tar.TypeSymlink)
+			link, err := os.Readlink(e.source)
+			if err != nil {
+				return err
+			}
+			hdr.Linkname = link
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+		case e.info.Mode().IsRegular():
+			contents, err := os.ReadFile(e.source)
+			if err != nil {
+				return err
+			}
+			if f.Template {
+				if contents, err = renderTemplate(name, contents, m, idMap, opts); err != nil {
+					return err
+				}
+			}
+			hdr := header(name, e.info, tar.TypeReg)
+			hdr.Size = int64(len(contents))
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := tw.Write(contents); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported file type for %s in source %s", e.source, f.Source)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+)
+
+// buildFiles builds the files section of m, and returns the tar headers and contents by name
+func buildFiles(t *testing.T, m moby.Moby) (map[string]*tar.Header, map[string]string) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := filesystem(m, tar.NewWriter(&buf), containerIDs(m), BuildOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	headers, contents := map[string]*tar.Header{}, map[string]string{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return headers, contents
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers[hdr.Name], contents[hdr.Name] = hdr, string(b)
+	}
+}
+
+func TestFilesTemplate(t *testing.T) {
+	m, err := moby.NewConfig([]byte(`services:
+  - name: getty
+    image: linuxkit/getty:v1.0
+  - name: sshd
+    image: linuxkit/sshd:v1.0
+files:
+  - path: etc/services
+    template: true
+    contents: '{{"{{"}} range .Services }}{{"{{"}} .Name }}={{"{{"}} id .Name }}{{"{{"}} println }}{{"{{"}} end }}'
+`), nil, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, contents := buildFiles(t, m)
+	if contents["etc/services"] != "getty=100\nsshd=101\n" {
+		t.Errorf("unexpected contents %q", contents["etc/services"])
+	}
+
+	m.Files[0].Contents = &[]string{"{{ .Missing }}"}[0]
+	if err := filesystem(m, tar.NewWriter(io.Discard), nil, BuildOpts{}); err == nil {
+		t.Error("expected error for missing field")
+	}
+}
+
+func TestFilesSourceTree(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{"a.conf": "a", "b.conf": "b", "c.txt": "c", "sub/d.conf": "d"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a.conf", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, contents := buildFiles(t, moby.Moby{Files: []moby.File{
+		{Path: "etc/all", Source: dir, Mode: "0640", UID: 1},
+		{Path: "etc/conf", Source: filepath.Join(dir, "*.conf")},
+	}})
+	expected := map[string]string{
+		"etc/all/a.conf":     "a",
+		"etc/all/b.conf":     "b",
+		"etc/all/c.txt":      "c",
+		"etc/all/sub/d.conf": "d",
+		"etc/conf/a.conf":    "a",
+		"etc/conf/b.conf":    "b",
+	}
+	for name, c := range expected {
+		if contents[name] != c {
+			t.Errorf("expected %s to contain %q, found %q", name, c, contents[name])
+		}
+	}
+	if _, ok := headers["etc/conf/c.txt"]; ok {
+		t.Error("file not matching glob copied")
+	}
+	if hdr := headers["etc/all/a.conf"]; hdr.Mode != 0640 || hdr.Uid != 1 {
+		t.Errorf("unexpected mode %o and uid %d for file", hdr.Mode, hdr.Uid)
+	}
+	if hdr := headers["etc/all/sub"]; hdr.Typeflag != tar.TypeDir || hdr.Mode != 0750 {
+		t.Errorf("unexpected type %c and mode %o for directory", hdr.Typeflag, hdr.Mode)
+	}
+	if hdr := headers["etc/all/link"]; hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "a.conf" {
+		t.Errorf("unexpected symlink %v", hdr)
+	}
+	if hdr := headers["etc/conf/a.conf"]; hdr.Mode != 0644 {
+		t.Errorf("expected mode of source, found %o", hdr.Mode)
+	}
+}
@@ -0,0 +1,203 @@
+package build
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/template"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Input types for format plugins, which determine what is passed to the container on stdin
+const (
+	// FormatInputTar is the full tar output of the build
+	FormatInputTar = "tar"
+	// FormatInputKernelInitrd is a tar of kernel, initrd.img and cmdline; the cmdline is also passed as an argument
+	FormatInputKernelInitrd = "kernel+initrd"
+	// FormatInputFilesystem is a tar of the root filesystem without /boot; the kernel and cmdline are
+	// written alongside the output, as for kernel+squashfs
+	FormatInputFilesystem = "filesystem"
+)
+
+// FormatPlugin is an output format provided by a container image, defined in a yaml file in the
+// formats directory rather than built in. The container is run with its input on stdin and must write
+// the output to stdout, in the same way as the linuxkit/mkimage-* images.
+type FormatPlugin struct {
+	Name  string `yaml:"name"`
+	Image string `yaml:"image"`
+	Input string `yaml:"input"`
+	// Output is a template for the output filename, with .Name the base name of the outputs, and .Arch
+	// the architecture, e.g. "{{.Name}}-pxe.tar"
+	Output string `yaml:"output"`
+	// Args are passed to the container, after the cmdline for kernel+initrd input
+	Args []string `yaml:"args,omitempty"`
+	// source is the file the format is defined in
+	source string
+}
+
+type formatPluginsFile struct {
+	Formats []FormatPlugin `yaml:"formats"`
+}
+
+var (
+	formatPlugins    map[string]FormatPlugin
+	formatPluginsErr error
+)
+
+// FormatsDir returns the directory from which format plugins are read
+func FormatsDir() string {
+	return filepath.Join(MobyDir, "formats")
+}
+
+// loadFormatPlugins reads the format plugins from every .yml or .yaml file in the formats directory.
+// It is only done once, and the result, or error, reused.
+func loadFormatPlugins() (map[string]FormatPlugin, error) {
+	if formatPlugins != nil || formatPluginsErr != nil {
+		return formatPlugins, formatPluginsErr
+	}
+	formatPlugins, formatPluginsErr = readFormatPlugins(FormatsDir())
+	return formatPlugins, formatPluginsErr
+}
+
+func readFormatPlugins(dir string) (map[string]FormatPlugin, error) {
+	plugins := map[string]FormatPlugin{}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return plugins, nil
+		}
+		return nil, fmt.Errorf("cannot read formats directory: %v", err)
+	}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yml" && ext != ".yaml") {
+			continue
+		}
+		filename := filepath.Join(dir, entry.Name())
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		var f formatPluginsFile
+		if err := yaml.UnmarshalStrict(b, &f); err != nil {
+			return nil, fmt.Errorf("invalid format definition %s: %v", filename, err)
+		}
+		for _, p := range f.Formats {
+			p.source = filename
+			if err := p.validate(); err != nil {
+				return nil, fmt.Errorf("invalid format definition %s: %v", filename, err)
+			}
+			if _, ok := outFuns[p.Name]; ok || streamable[p.Name] {
+				return nil, fmt.Errorf("invalid format definition %s: format %s is built in", filename, p.Name)
+			}
+			if other, ok := plugins[p.Name]; ok {
+				return nil, fmt.Errorf("format %s is defined in both %s and %s", p.Name, other.source, filename)
+			}
+			plugins[p.Name] = p
+		}
+	}
+	return plugins, nil
+}
+
+func (p FormatPlugin) validate() error {
+	if p.Name == "" {
+		return errors.New("format has no name")
+	}
+	if p.Image == "" {
+		return fmt.Errorf("format %s has no image", p.Name)
+	}
+	switch p.Input {
+	case FormatInputTar, FormatInputKernelInitrd, FormatInputFilesystem:
+	default:
+		return fmt.Errorf("format %s has unknown input %q, must be one of %s, %s or %s", p.Name, p.Input, FormatInputTar, FormatInputKernelInitrd, FormatInputFilesystem)
+	}
+	if p.Output == "" {
+		return fmt.Errorf("format %s has no output", p.Name)
+	}
+	if _, err := p.filename("base", "amd64"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// filename returns the output filename for the given base name and architecture
+func (p FormatPlugin) filename(base, arch string) (string, error) {
+	tmpl, err := template.New(p.Name).Option("missingkey=error").Parse(p.Output)
+	if err != nil {
+		return "", fmt.Errorf("format %s has invalid output %q: %v", p.Name, p.Output, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, struct{ Name, Arch string }{base, arch}); err != nil {
+		return "", fmt.Errorf("format %s has invalid output %q: %v", p.Name, p.Output, err)
+	}
+	return buf.String(), nil
+}
+
+// output writes the format, running its container
+func (p FormatPlugin) output(base string, image io.Reader, size int, arch, buildCache string) error {
+	filename, err := p.filename(base, arch)
+	if err != nil {
+		return err
+	}
+	march, err := util.MArch(arch)
+	if err != nil {
+		return err
+	}
+	env := []string{fmt.Sprintf("TARGETARCH=%s", march)}
+
+	input, args := image, p.Args
+	switch p.Input {
+	case FormatInputKernelInitrd:
+		kernel, initrd, cmdline, _, err := tarToInitrd(image, buildCache)
+		if err != nil {
+			return fmt.Errorf("error converting to initrd: %v", err)
+		}
+		if input, err = tarInitrdKernel(kernel, initrd, cmdline); err != nil {
+			return err
+		}
+		args = append([]string{cmdline}, p.Args...)
+	case FormatInputFilesystem:
+		if input, _, err = splitKernel(base, image); err != nil {
+			return err
+		}
+	}
+	if err := outputPlugin(p.Image, filename, input, env, args); err != nil {
+		return fmt.Errorf("error writing %s output: %v", p.Name, err)
+	}
+	return nil
+}
+
+func outputPlugin(image, filename string, input io.Reader, env, args []string) error {
+	log.Debugf("output plugin: %s %s", image, filename)
+	log.Infof("  %s", filename)
+	output, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = output.Close()
+	}()
+	return dockerRun(input, output, image, env, args...)
+}
+
+// pluginNames returns the names of the format plugins, or none if they cannot be loaded
+func pluginNames() []string {
+	plugins, err := loadFormatPlugins()
+	if err != nil {
+		log.Warnf("ignoring format plugins: %v", err)
+		return nil
+	}
+	var names []string
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,63 @@
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadFormatPlugins(t *testing.T) {
+	dir := t.TempDir()
+	plugin := `formats:
+  - name: pxe-bundle
+    image: example.com/mkimage-pxe:1.0
+    input: kernel+initrd
+    output: "{{.Name}}-{{.Arch}}-pxe.tar"
+`
+	if err := os.WriteFile(filepath.Join(dir, "pxe.yml"), []byte(plugin), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("not a format"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	plugins, err := readFormatPlugins(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok := plugins["pxe-bundle"]
+	if !ok || len(plugins) != 1 {
+		t.Fatalf("expected only pxe-bundle format, got %v", plugins)
+	}
+	filename, err := p.filename("out/linuxkit", "arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename != "out/linuxkit-arm64-pxe.tar" {
+		t.Errorf("unexpected filename %s", filename)
+	}
+
+	for _, tc := range []struct {
+		plugin string
+		err    string
+	}{
+		{"formats:\n  - name: raw-efi\n    image: a\n    input: tar\n    output: x\n", "is built in"},
+		{"formats:\n  - name: a\n    image: a\n    input: iso\n    output: x\n", "unknown input"},
+		{"formats:\n  - name: a\n    image: a\n    input: tar\n    output: \"{{.Base}}\"\n", "invalid output"},
+		{"formats:\n  - name: a\n    image: a\n    input: tar\n", "no output"},
+		{"formats:\n  - name: a\n    image: a\n    input: tar\n    output: x\n    unknown: y\n", "invalid format definition"},
+	} {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "bad.yaml"), []byte(tc.plugin), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readFormatPlugins(dir); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expected error containing %q for %q, got %v", tc.err, tc.plugin, err)
+		}
+	}
+
+	plugins, err = readFormatPlugins(filepath.Join(dir, "missing"))
+	if err != nil || len(plugins) != 0 {
+		t.Errorf("expected no formats and no error for missing directory, got %v %v", plugins, err)
+	}
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/containerd/containerd/v2/pkg/reference"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	lktspec "github.com/linuxkit/linuxkit/src/cmd/linuxkit/spec"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	log "github.com/sirupsen/logrus"
@@ -341,19 +342,24 @@ func ImageTar(location string, ref *reference.Spec, prefix string, tw tarWriter,
 	}
 
 	// save the sbom to the sbom writer
-	if opts.SbomGenerator != nil {
-		sboms, err := src.SBoMs()
-		if err != nil {
+	return addSBoMs(src, location, prefix, opts)
+}
+
+// addSBoMs adds the SBoMs of the image of the section at location, extracted at prefix, to the SBoM generator, if there is one
+func addSBoMs(src lktspec.ImageSource, location, prefix string, opts BuildOpts) error {
+	if opts.SbomGenerator == nil {
+		return nil
+	}
+	sboms, err := src.SBoMs()
+	if err != nil {
+		return err
+	}
+	for _, sbom := range sboms {
+		// sbomWriter will escape out any problematic characters for us
+		if err := opts.SbomGenerator.Add(location, prefix, sbom); err != nil {
 			return err
 		}
-		for _, sbom := range sboms {
-			// sbomWriter will escape out any problematic characters for us
-			if err := opts.SbomGenerator.Add(prefix, sbom); err != nil {
-				return err
-			}
-		}
 	}
-
 	return nil
 }
 
@@ -430,16 +436,19 @@ func ImageOCITar(location string, ref *reference.Spec, prefix string, tw tarWrit
 	return nil
 }
 
-// ImageBundle produces an OCI bundle at the given path in a tarball, given an image and a config.json
-func ImageBundle(prefix, location string, ref *reference.Spec, config []byte, runtime moby.Runtime, tw tarWriter, readonly bool, dupMap map[string]string, opts BuildOpts) error { // nolint: lll
+// bundleRoot returns where the root filesystem of a bundle at prefix is extracted
+func bundleRoot(prefix string, readonly bool) string {
 	// if read only, just unpack in rootfs/ but otherwise set up for overlay
-	rootExtract := "rootfs"
-	if !readonly {
-		rootExtract = "lower"
+	if readonly {
+		return path.Join(prefix, "rootfs")
 	}
+	return path.Join(prefix, "lower")
+}
 
+// ImageBundle produces an OCI bundle at the given path in a tarball, given an image and a config.json
+func ImageBundle(prefix, location string, ref *reference.Spec, config []byte, runtime moby.Runtime, tw tarWriter, readonly bool, dupMap map[string]string, opts BuildOpts) error { // nolint: lll
 	// See if we have extracted this image previously
-	root := path.Join(prefix, rootExtract)
+	root := bundleRoot(prefix, readonly)
 	var foundElsewhere = dupMap[ref.String()] != ""
 	if !foundElsewhere {
 		if err := ImageTar(location, ref, root+"/", tw, "", opts); err != nil {
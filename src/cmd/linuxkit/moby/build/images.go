@@ -1,11 +1,17 @@
 package build
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/containerd/containerd/v2/pkg/reference"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/docker"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/signature"
 	lktspec "github.com/linuxkit/linuxkit/src/cmd/linuxkit/spec"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
 )
 
 // imageSource given an image ref, get a handle on the image so it can be used as a source for its configuration
@@ -75,3 +81,35 @@ func indexSource(ref *reference.Spec, alwaysPull bool, cacheDir string, platform
 		platforms,
 	), nil
 }
+
+// VerifyImages pulls every image in m into the cache, for all of arches, and checks that it is signed as
+// required by policy. It returns an error that lists all of the images that are not, rather than only the first.
+// The build must then not pull again, so that it uses the images that were verified.
+func VerifyImages(m moby.Moby, opts BuildOpts, arches []string, policy *signature.Policy) error {
+	c, err := cache.NewProvider(opts.CacheDir)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	err = forEachImage(m, arches, func(ref *reference.Spec, platforms []imagespec.Platform) error {
+		if err := c.ImagePull(ref, platforms, opts.Pull); err != nil {
+			return err
+		}
+		desc, err := c.FindDescriptor(ref)
+		if err != nil {
+			return err
+		}
+		log.Debugf("verify signature of %s@%s", ref, desc.Digest)
+		if err := policy.Verify(ref.String(), desc.Digest); err != nil {
+			failed = append(failed, fmt.Sprintf("  %s: %v", ref, err))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d images do not satisfy the signature policy:\n%s", len(failed), strings.Join(failed, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package build
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sectionQueue runs the jobs that pull and extract each image of the build, up to jobs of them at
+// a time. Each job writes to its own temporary tar file, which are copied to the build output in the
+// order the jobs were added, so the output does not depend on which finishes first.
+type sectionQueue struct {
+	jobs    int
+	total   int
+	added   int
+	opts    BuildOpts
+	sem     chan struct{}
+	pending []*queuedSection
+}
+
+type queuedSection struct {
+	location string
+	tw       tarWriter
+	file     *os.File
+	sbom     *SbomGenerator
+	done     chan struct{}
+	err      error
+}
+
+// newSectionQueue creates a queue for total jobs. With jobs of 1 or less, each job runs as it is
+// added, straight to the build output.
+func newSectionQueue(jobs, total int, opts BuildOpts) *sectionQueue {
+	q := &sectionQueue{jobs: jobs, total: total, opts: opts}
+	if jobs > 1 {
+		q.sem = make(chan struct{}, jobs)
+	}
+	return q
+}
+
+// add queues fn to write the section at location, built from image, to tw. Jobs are started in the
+// order they are added, so a job may wait for one added before it.
+func (q *sectionQueue) add(location, image string, tw tarWriter, fn func(tw tarWriter, opts BuildOpts) error) error {
+	q.added++
+	if q.sem == nil {
+		return fn(tw, q.opts)
+	}
+	f, err := os.CreateTemp(filepath.Join(MobyDir, "tmp"), "section-*.tar")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %v", location, err)
+	}
+	s := &queuedSection{location: location, tw: tw, file: f, done: make(chan struct{})}
+	opts := q.opts
+	if opts.SbomGenerator != nil {
+		s.sbom = opts.SbomGenerator.child()
+		opts.SbomGenerator = s.sbom
+	}
+	q.pending = append(q.pending, s)
+
+	n := q.added
+	q.sem <- struct{}{}
+	go func() {
+		defer func() {
+			<-q.sem
+			close(s.done)
+		}()
+		log.Infof("  [%d/%d] Start %s: %s", n, q.total, location, image)
+		start := time.Now()
+		w := tar.NewWriter(f)
+		if err := fn(w, opts); err != nil {
+			log.Errorf("  [%d/%d] Failed %s: %v", n, q.total, location, err)
+			s.err = err
+			return
+		}
+		s.err = w.Close()
+		log.Infof("  [%d/%d] Done %s in %s", n, q.total, location, time.Since(start).Round(time.Millisecond))
+	}()
+	return nil
+}
+
+// wait waits for the jobs added so far, and copies their output to the build in order. It returns
+// the error of the first job that failed.
+func (q *sectionQueue) wait() error {
+	var err error
+	for _, s := range q.pending {
+		<-s.done
+		if err == nil {
+			err = s.err
+		}
+		if err == nil {
+			err = s.copy()
+		}
+		_ = s.file.Close()
+		_ = os.Remove(s.file.Name())
+	}
+	q.pending = nil
+	return err
+}
+
+// copy writes the output of a finished job to the build
+func (s *queuedSection) copy() error {
+	if _, err := s.file.Seek(0, 0); err != nil {
+		return err
+	}
+	tr := tar.NewReader(s.file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", s.location, err)
+		}
+		if err := s.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(s.tw, tr); err != nil {
+			return err
+		}
+	}
+	if s.sbom != nil {
+		return s.sbom.merge()
+	}
+	return nil
+}
+
+// sharedRoot is where the root filesystem of an image used by several containers is extracted by
+// the first of them. The others may be built concurrently, so wait for it to be known.
+type sharedRoot struct {
+	once  sync.Once
+	ready chan struct{}
+	path  string
+}
+
+func newSharedRoot() *sharedRoot {
+	return &sharedRoot{ready: make(chan struct{})}
+}
+
+// set records the path of the root filesystem; only the first call has any effect
+func (r *sharedRoot) set(path string) {
+	r.once.Do(func() {
+		r.path = path
+		close(r.ready)
+	})
+}
+
+// get waits for the path of the root filesystem, which is empty if the container extracting it failed
+func (r *sharedRoot) get() string {
+	<-r.ready
+	return r.path
+}
@@ -0,0 +1,113 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+)
+
+func TestSectionQueueOrder(t *testing.T) {
+	MobyDir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(MobyDir, "tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	q := newSectionQueue(3, 6, BuildOpts{})
+	root := newSharedRoot()
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("file%d", i)
+		if err := q.add(name, "test", tw, func(tw tarWriter, opts BuildOpts) error {
+			// the last job added finishes first
+			time.Sleep(time.Duration(6-i) * 5 * time.Millisecond)
+			contents := name
+			switch i {
+			case 1:
+				root.set("shared")
+			case 4:
+				contents = root.get()
+			}
+			if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))}); err != nil {
+				return err
+			}
+			_, err := tw.Write([]byte(contents))
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&buf)
+	for i := 0; i < 6; i++ {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := hdr.Name
+		if i == 4 {
+			expected = "shared"
+		}
+		if hdr.Name != fmt.Sprintf("file%d", i) || string(contents) != expected {
+			t.Errorf("entry %d is %s containing %q", i, hdr.Name, contents)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Error("unexpected extra entries")
+	}
+}
+
+func TestSectionQueueError(t *testing.T) {
+	MobyDir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(MobyDir, "tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	q := newSectionQueue(2, 3, BuildOpts{})
+	for i := 0; i < 3; i++ {
+		if err := q.add(fmt.Sprintf("job%d", i), "test", tar.NewWriter(io.Discard), func(tw tarWriter, opts BuildOpts) error {
+			if i == 1 {
+				return fmt.Errorf("job %d failed", i)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.wait(); err == nil || err.Error() != "job 1 failed" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestBuildJobs(t *testing.T) {
+	MobyDir = t.TempDir()
+	var m moby.Moby
+	for i := 0; i < 10; i++ {
+		m.Volumes = append(m.Volumes, &moby.Volume{Name: fmt.Sprintf("vol%d", i)})
+	}
+	build := func(jobs int) []byte {
+		var buf bytes.Buffer
+		if err := Build(m, &buf, BuildOpts{Jobs: jobs}); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	if !bytes.Equal(build(1), build(4)) {
+		t.Error("output differs with concurrent jobs")
+	}
+}
@@ -0,0 +1,369 @@
+package build
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	lktspec "github.com/linuxkit/linuxkit/src/cmd/linuxkit/spec"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	// LintError is a problem that will cause the build or the image to fail
+	LintError = "error"
+	// LintWarning is a likely mistake
+	LintWarning = "warning"
+	// LintInfo is informational, usually that a check could not be carried out
+	LintInfo = "info"
+)
+
+// Lint issue categories
+const (
+	LintCategoryConfig   = "config"
+	LintCategoryVolumes  = "volumes"
+	LintCategoryBinds    = "binds"
+	LintCategoryFiles    = "files"
+	LintCategorySecurity = "security"
+	LintCategoryPinning  = "pinning"
+	LintCategoryCache    = "cache"
+)
+
+// runtimeDirs are created or mounted at boot, so anything below them is available to bind,
+// even if no image provides it
+var runtimeDirs = []string{"dev", "proc", "sys", "run", "tmp", "var", "containers"}
+
+// LintIssue is a single problem found in a config by Lint
+type LintIssue struct {
+	Severity string `json:"severity"`
+	Category string `json:"category"`
+	// Section is the section of the config, e.g. services, and Index the index within it
+	Section string `json:"section"`
+	Index   int    `json:"index"`
+	// Name is the name of the entry, or the path for files
+	Name string `json:"name,omitempty"`
+	// Field is the field within the entry, if any, e.g. binds
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+	// File and Line are the position in the yaml source, if known
+	File string `json:"file,omitempty"`
+	Line int    `json:"line,omitempty"`
+}
+
+// Location returns the location of the issue in the config, in the same form as the
+// location recorded in the PAX headers of the build output, e.g. services[2]
+func (l LintIssue) Location() string {
+	loc := l.Section
+	if l.Section != "kernel" {
+		loc = fmt.Sprintf("%s[%d]", l.Section, l.Index)
+	}
+	if l.Field != "" {
+		loc += "." + l.Field
+	}
+	return loc
+}
+
+type linter struct {
+	m      moby.Moby
+	opts   BuildOpts
+	issues []LintIssue
+	// provided is every path known to exist in the root filesystem
+	provided map[string]bool
+	// mountpoints are the directories under which anything may exist at runtime
+	mountpoints map[string]bool
+	// complete is false if we could not list the contents of all init images
+	complete bool
+}
+
+func (l *linter) add(severity, category, section string, index int, name, field, format string, args ...interface{}) {
+	l.issues = append(l.issues, LintIssue{
+		Severity: severity,
+		Category: category,
+		Section:  section,
+		Index:    index,
+		Name:     name,
+		Field:    field,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Lint checks a config for semantic problems that the schema cannot catch. Image configs and contents are
+// read from the cache; images that are not in the cache are pulled only if opts.Pull is set, otherwise
+// the checks that need them are skipped and reported as LintInfo.
+func Lint(m moby.Moby, opts BuildOpts) ([]LintIssue, error) {
+	l := &linter{
+		m:           m,
+		opts:        opts,
+		provided:    map[string]bool{},
+		mountpoints: map[string]bool{},
+		complete:    true,
+	}
+	for _, d := range runtimeDirs {
+		l.mountpoints[d] = true
+	}
+
+	l.checkPinning()
+	if err := l.listInit(); err != nil {
+		return nil, err
+	}
+	l.checkFiles()
+
+	type resolved struct {
+		section string
+		index   int
+		image   *moby.Image
+		oci     specs.Spec
+		runtime moby.Runtime
+	}
+	var all []resolved
+	idMap := containerIDs(m)
+	for _, section := range []struct {
+		name   string
+		images []*moby.Image
+	}{
+		{"onboot", m.Onboot},
+		{"onshutdown", m.Onshutdown},
+		{"services", m.Services},
+	} {
+		for i, image := range section.images {
+			if !l.checkVolumes(section.name, i, image) {
+				continue
+			}
+			src, err := l.source(image.Ref())
+			if err != nil {
+				return nil, err
+			}
+			if src == nil {
+				l.add(LintInfo, LintCategoryCache, section.name, i, image.Name, "", "image %s not in cache, skipping checks of its configuration", image.Image)
+				continue
+			}
+			config, err := src.Config()
+			if err != nil {
+				return nil, fmt.Errorf("failed to retrieve config for %s: %v", image.Image, err)
+			}
+			withVolPaths, err := updateMountsAndBindsFromVolumes(image, m)
+			if err != nil {
+				l.add(LintError, LintCategoryVolumes, section.name, i, image.Name, "", "%v", err)
+				continue
+			}
+			oci, runtime, err := moby.ConfigToOCI(withVolPaths, config, idMap)
+			if err != nil {
+				l.add(LintError, LintCategoryConfig, section.name, i, image.Name, "", "%v", err)
+				continue
+			}
+			all = append(all, resolved{section.name, i, image, oci, runtime})
+			// anything a container creates or mounts on the host is available to others
+			if runtime.Mkdir != nil {
+				for _, dir := range *runtime.Mkdir {
+					if path.IsAbs(dir) {
+						l.mountpoints[cleanPath(dir)] = true
+					}
+				}
+			}
+			if runtime.Mounts != nil {
+				for _, mount := range *runtime.Mounts {
+					if path.IsAbs(mount.Destination) {
+						l.mountpoints[cleanPath(mount.Destination)] = true
+					}
+				}
+			}
+		}
+	}
+
+	for _, r := range all {
+		l.checkSecurity(r.section, r.index, r.image, r.oci)
+		if !l.complete {
+			continue
+		}
+		for _, mount := range r.oci.Mounts {
+			if mount.Type != "bind" {
+				continue
+			}
+			if !l.exists(mount.Source) {
+				l.add(LintWarning, LintCategoryBinds, r.section, r.index, r.image.Name, "binds", "bind source %s is not provided by any init image, file or container", mount.Source)
+			}
+		}
+	}
+
+	return l.issues, nil
+}
+
+// source gets the image source for a reference, or nil if it is not in the cache and we are not pulling
+func (l *linter) source(ref *reference.Spec) (lktspec.ImageSource, error) {
+	platform := imagespec.Platform{OS: "linux", Architecture: l.opts.Arch}
+	if !l.opts.Pull {
+		c, err := cache.NewProvider(l.opts.CacheDir)
+		if err != nil {
+			return nil, err
+		}
+		if found, err := c.ImageInCache(ref, "", l.opts.Arch); err != nil || !found {
+			return nil, nil
+		}
+	}
+	return imageSource(ref, l.opts.Pull, l.opts.CacheDir, false, platform)
+}
+
+func (l *linter) checkPinning() {
+	check := func(section string, index int, name, field string, ref *reference.Spec) {
+		if ref == nil || ref.Digest() != "" {
+			return
+		}
+		// without a digest, the object is just the tag
+		if tag := ref.Object; tag == "" || tag == "latest" {
+			l.add(LintWarning, LintCategoryPinning, section, index, name, field, "image %s is not pinned to a tag or digest", ref.String())
+		}
+	}
+	check("kernel", 0, "", "image", l.m.Kernel.Ref())
+	for i, ref := range l.m.InitRefs() {
+		check("init", i, ref.String(), "", ref)
+	}
+	for i, image := range l.m.Onboot {
+		check("onboot", i, image.Name, "image", image.Ref())
+	}
+	for i, image := range l.m.Onshutdown {
+		check("onshutdown", i, image.Name, "image", image.Ref())
+	}
+	for i, image := range l.m.Services {
+		check("services", i, image.Name, "image", image.Ref())
+	}
+	for i, vol := range l.m.Volumes {
+		check("volumes", i, vol.Name, "image", vol.ImageRef())
+	}
+}
+
+// listInit records the paths provided by the init images
+func (l *linter) listInit() error {
+	for i, ref := range l.m.InitRefs() {
+		src, err := l.source(ref)
+		if err != nil {
+			return err
+		}
+		if src == nil {
+			l.complete = false
+			l.add(LintInfo, LintCategoryCache, "init", i, ref.String(), "", "image %s not in cache, skipping checks of binds and files", ref.String())
+			continue
+		}
+		rc, err := src.TarReader()
+		if err != nil {
+			return fmt.Errorf("could not unpack image %s: %v", ref, err)
+		}
+		tr := tar.NewReader(rc)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				_ = rc.Close()
+				return fmt.Errorf("could not read image %s: %v", ref, err)
+			}
+			l.provided[cleanPath(hdr.Name)] = true
+		}
+		_ = rc.Close()
+	}
+	return nil
+}
+
+// checkFiles looks for files entries that overwrite init image content or each other
+func (l *linter) checkFiles() {
+	seen := map[string]int{}
+	for i, f := range l.m.Files {
+		p := cleanPath(f.Path)
+		if j, ok := seen[p]; ok {
+			l.add(LintWarning, LintCategoryFiles, "files", i, f.Path, "", "file %s is also specified by files[%d]", f.Path, j)
+		}
+		seen[p] = i
+		if l.complete && !f.Directory && l.provided[p] {
+			l.add(LintWarning, LintCategoryFiles, "files", i, f.Path, "", "file %s overwrites content of an init image", f.Path)
+		}
+	}
+	for p := range seen {
+		for dir := p; dir != "." && dir != "/" && dir != ""; dir = path.Dir(dir) {
+			l.provided[dir] = true
+		}
+	}
+}
+
+// checkVolumes checks that all volumes referenced by an image exist, returning false if any do not
+func (l *linter) checkVolumes(section string, index int, image *moby.Image) bool {
+	ok := true
+	checkBinds := func(field string, binds *[]string) {
+		if binds == nil {
+			return
+		}
+		for _, b := range *binds {
+			source := strings.Split(b, ":")[0]
+			if strings.HasPrefix(source, "/") || l.m.VolByName(source) != nil {
+				continue
+			}
+			ok = false
+			l.add(LintError, LintCategoryVolumes, section, index, image.Name, field, "bind %s references volume %s which does not exist", b, source)
+		}
+	}
+	checkMounts := func(field string, mounts *[]specs.Mount) {
+		if mounts == nil {
+			return
+		}
+		for _, mount := range *mounts {
+			if mount.Type != "bind" || strings.HasPrefix(mount.Source, "/") || l.m.VolByName(mount.Source) != nil {
+				continue
+			}
+			ok = false
+			l.add(LintError, LintCategoryVolumes, section, index, image.Name, field, "mount at %s references volume %s which does not exist", mount.Destination, mount.Source)
+		}
+	}
+	checkBinds("binds", image.Binds)
+	checkBinds("binds.add", image.BindsAdd)
+	checkMounts("mounts", image.Mounts)
+	if image.Runtime != nil {
+		checkMounts("runtime.mounts", image.Runtime.Mounts)
+	}
+	return ok
+}
+
+// checkSecurity looks for dangerous combinations of settings in the final OCI spec
+func (l *linter) checkSecurity(section string, index int, image *moby.Image, oci specs.Spec) {
+	if oci.Process == nil || oci.Process.Capabilities == nil || oci.Linux == nil {
+		return
+	}
+	var sysAdmin bool
+	for _, c := range oci.Process.Capabilities.Bounding {
+		if c == "CAP_SYS_ADMIN" {
+			sysAdmin = true
+		}
+	}
+	if !sysAdmin {
+		return
+	}
+	for _, ns := range oci.Linux.Namespaces {
+		if ns.Type == specs.NetworkNamespace {
+			return
+		}
+	}
+	l.add(LintWarning, LintCategorySecurity, section, index, image.Name, "capabilities", "container has CAP_SYS_ADMIN and shares the host network namespace")
+}
+
+// exists reports whether a path exists in the root filesystem, or is below a mountpoint
+func (l *linter) exists(p string) bool {
+	p = cleanPath(p)
+	if l.provided[p] {
+		return true
+	}
+	for dir := p; dir != "." && dir != "/" && dir != ""; dir = path.Dir(dir) {
+		if l.mountpoints[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanPath normalises a path to the form used in tar headers, without leading or trailing /
+func cleanPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
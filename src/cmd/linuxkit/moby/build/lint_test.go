@@ -0,0 +1,107 @@
+package build
+
+import (
+	"testing"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestLint(t *testing.T) {
+	m, err := moby.NewConfig([]byte(`kernel:
+  image: linuxkit/kernel
+init:
+  - linuxkit/init:v1.0
+volumes:
+  - name: data
+onboot:
+  - name: format
+    image: linuxkit/format:v1.0
+    binds:
+      - data:/data
+      - missing:/missing
+services:
+  - name: sshd
+    image: linuxkit/sshd:latest
+    runtime:
+      mounts:
+        - type: bind
+          source: other
+          destination: /other
+files:
+  - path: etc/motd
+    contents: hello
+  - path: /etc/motd
+    contents: goodbye
+`), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing is in the cache, so the checks that need the images are skipped
+	issues, err := Lint(m, BuildOpts{CacheDir: t.TempDir(), Arch: "amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		severity, category, location string
+	}{
+		{LintWarning, LintCategoryPinning, "kernel.image"},
+		{LintWarning, LintCategoryPinning, "services[0].image"},
+		{LintInfo, LintCategoryCache, "init[0]"},
+		{LintWarning, LintCategoryFiles, "files[1]"},
+		{LintError, LintCategoryVolumes, "onboot[0].binds"},
+		{LintError, LintCategoryVolumes, "services[0].runtime.mounts"},
+	}
+	if len(issues) != len(expected) {
+		t.Fatalf("expected %d issues, got %+v", len(expected), issues)
+	}
+	for i, e := range expected {
+		issue := issues[i]
+		if issue.Severity != e.severity || issue.Category != e.category || issue.Location() != e.location {
+			t.Errorf("expected %s %s issue at %s, got %+v", e.severity, e.category, e.location, issue)
+		}
+	}
+}
+
+func TestLinterExists(t *testing.T) {
+	l := &linter{
+		provided:    map[string]bool{"etc/ssh": true},
+		mountpoints: map[string]bool{"var": true, "run/data": true},
+	}
+	for p, exists := range map[string]bool{
+		"/etc/ssh":          true,
+		"etc/ssh/":          true,
+		"/etc/ssl":          false,
+		"/var/lib/docker":   true,
+		"/run/data/certs":   true,
+		"/run/other":        false,
+		"/etc/../var/cache": true,
+	} {
+		if l.exists(p) != exists {
+			t.Errorf("expected %s to exist: %v", p, exists)
+		}
+	}
+}
+
+func TestLinterCheckSecurity(t *testing.T) {
+	image := &moby.Image{Name: "admin"}
+	spec := func(namespaces ...specs.LinuxNamespaceType) specs.Spec {
+		s := specs.Spec{
+			Process: &specs.Process{Capabilities: &specs.LinuxCapabilities{Bounding: []string{"CAP_NET_ADMIN", "CAP_SYS_ADMIN"}}},
+			Linux:   &specs.Linux{},
+		}
+		for _, ns := range namespaces {
+			s.Linux.Namespaces = append(s.Linux.Namespaces, specs.LinuxNamespace{Type: ns})
+		}
+		return s
+	}
+	l := &linter{}
+	l.checkSecurity("services", 1, image, spec(specs.MountNamespace, specs.NetworkNamespace))
+	if len(l.issues) != 0 {
+		t.Errorf("unexpected issues for a container in its own network namespace: %+v", l.issues)
+	}
+	l.checkSecurity("services", 1, image, spec(specs.MountNamespace))
+	if len(l.issues) != 1 || l.issues[0].Category != LintCategorySecurity || l.issues[0].Location() != "services[1].capabilities" {
+		t.Errorf("expected a security issue for CAP_SYS_ADMIN in the host network namespace, got %+v", l.issues)
+	}
+}
@@ -44,7 +44,7 @@ func ensureLinuxkitImage(name, cache string) error {
 
 	yaml := linuxkitYaml[name]
 
-	m, err := moby.NewConfig([]byte(yaml), nil)
+	m, err := moby.NewConfig([]byte(yaml), nil, nil)
 	if err != nil {
 		return err
 	}
@@ -69,7 +69,7 @@ func ensureLinuxkitImage(name, cache string) error {
 		return err
 	}
 	defer func() { _ = image.Close() }()
-	kernel, initrd, cmdline, _, err := tarToInitrd(image)
+	kernel, initrd, cmdline, _, err := tarToInitrd(image, "")
 	if err != nil {
 		return fmt.Errorf("error converting to initrd: %v", err)
 	}
@@ -0,0 +1,299 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	lktspec "github.com/linuxkit/linuxkit/src/cmd/linuxkit/spec"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ManifestVersion is the version of the build manifest format written by this version of linuxkit
+const ManifestVersion = 1
+
+// Manifest records exactly which images and files went into a build, so that the build
+// can be repeated, or checked, with the same inputs
+type Manifest struct {
+	Version int `json:"version"`
+	// Platform is the os/arch the build was for
+	Platform string          `json:"platform"`
+	Images   []ManifestImage `json:"images,omitempty"`
+	Files    []ManifestFile  `json:"files,omitempty"`
+}
+
+// ManifestImage is an image reference in the config and the digest it resolved to
+type ManifestImage struct {
+	// Location is the location in the config, e.g. services[2]
+	Location  string `json:"location"`
+	Name      string `json:"name,omitempty"`
+	Reference string `json:"reference"`
+	Digest    string `json:"digest"`
+	// Platform is the platform of the image used, or the platforms for volumes in oci format,
+	// empty if all platforms are included
+	Platform string `json:"platform,omitempty"`
+}
+
+// ManifestFile is a file whose contents were read from a source outside of the config
+type ManifestFile struct {
+	Location string `json:"location"`
+	Path     string `json:"path"`
+	Source   string `json:"source"`
+	Digest   string `json:"digest"`
+	// Redacted is set for a secret, whose digest is of the encrypted contents
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+// ReadManifest reads a build manifest from a file
+func ReadManifest(filename string) (*Manifest, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", filename, err)
+	}
+	if manifest.Version != ManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d in %s", manifest.Version, filename)
+	}
+	return &manifest, nil
+}
+
+// Write writes the manifest to a file
+func (m *Manifest) Write(filename string) error {
+	b, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(b, '\n'), 0644)
+}
+
+// ResolveManifest resolves every image in the config to the digest it refers to, pulling it to the cache
+// if necessary, and every file source to the digest of its contents. Images are always resolved from the
+// linuxkit cache or registry, as images in docker have no digest to record.
+func ResolveManifest(m moby.Moby, opts BuildOpts) (*Manifest, error) {
+	platform := imagespec.Platform{OS: "linux", Architecture: opts.Arch}
+	manifest := &Manifest{
+		Version:  ManifestVersion,
+		Platform: platform.OS + "/" + platform.Architecture,
+	}
+	add := func(location, name string, ref *reference.Spec) error {
+		if ref == nil {
+			return nil
+		}
+		src, err := imageSource(ref, opts.Pull, opts.CacheDir, false, platform)
+		if err != nil {
+			return fmt.Errorf("could not resolve image %s: %v", ref, err)
+		}
+		digest, err := sourceDigest(src)
+		if err != nil {
+			return fmt.Errorf("could not resolve image %s: %v", ref, err)
+		}
+		manifest.Images = append(manifest.Images, ManifestImage{
+			Location:  location,
+			Name:      name,
+			Reference: ref.String(),
+			Digest:    digest,
+			Platform:  manifest.Platform,
+		})
+		return nil
+	}
+
+	if err := add("kernel", "", m.Kernel.Ref()); err != nil {
+		return nil, err
+	}
+	for i, ref := range m.InitRefs() {
+		if err := add(fmt.Sprintf("init[%d]", i), "", ref); err != nil {
+			return nil, err
+		}
+	}
+	for i, vol := range m.Volumes {
+		ref := vol.ImageRef()
+		if ref == nil {
+			continue
+		}
+		location := fmt.Sprintf("volumes[%d]", i)
+		if vol.Format != "oci" {
+			if err := add(location, vol.Name, ref); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var platforms []imagespec.Platform
+		for _, p := range vol.Platforms {
+			vp, err := v1.ParsePlatform(p)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse platform %s: %v", p, err)
+			}
+			platforms = append(platforms, imagespec.Platform{OS: vp.OS, Architecture: vp.Architecture, Variant: vp.Variant})
+		}
+		src, err := indexSource(ref, opts.Pull, opts.CacheDir, platforms)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve image %s: %v", ref, err)
+		}
+		desc := src.Descriptor()
+		if desc == nil {
+			return nil, fmt.Errorf("could not resolve image %s: no descriptor", ref)
+		}
+		manifest.Images = append(manifest.Images, ManifestImage{
+			Location:  location,
+			Name:      vol.Name,
+			Reference: ref.String(),
+			Digest:    desc.Digest.String(),
+			Platform:  strings.Join(vol.Platforms, ","),
+		})
+	}
+	for _, section := range []struct {
+		name   string
+		images []*moby.Image
+	}{
+		{"onboot", m.Onboot},
+		{"onshutdown", m.Onshutdown},
+		{"services", m.Services},
+	} {
+		for i, image := range section.images {
+			if err := add(fmt.Sprintf("%s[%d]", section.name, i), image.Name, image.Ref()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for i, f := range m.Files {
+		if f.Secret != "" {
+			encrypted, err := secretContents(f.Secret)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read secret for file %s: %v", f.Path, err)
+			}
+			source := f.Secret
+			if isInlineSecret(f.Secret) {
+				source = "inline"
+			}
+			manifest.Files = append(manifest.Files, ManifestFile{
+				Location: fmt.Sprintf("files[%d]", i),
+				Path:     f.Path,
+				Source:   source,
+				Digest:   fmt.Sprintf("sha256:%x", sha256.Sum256(encrypted)),
+				Redacted: true,
+			})
+			continue
+		}
+		if f.Source == "" || f.Directory || f.Symlink != "" || f.Contents != nil {
+			continue
+		}
+		source := expandSource(f.Source)
+		if f.Optional && !sourceExists(source) {
+			continue
+		}
+		// each file copied from a directory or glob is recorded separately
+		entries, tree, err := sourceTree(source)
+		if err != nil {
+			return nil, err
+		}
+		if tree {
+			for _, e := range entries {
+				if !e.info.Mode().IsRegular() {
+					continue
+				}
+				contents, err := os.ReadFile(e.source)
+				if err != nil {
+					return nil, err
+				}
+				manifest.Files = append(manifest.Files, ManifestFile{
+					Location: fmt.Sprintf("files[%d]", i),
+					Path:     path.Join(f.Path, e.name),
+					Source:   e.source,
+					Digest:   fmt.Sprintf("sha256:%x", sha256.Sum256(contents)),
+				})
+			}
+			continue
+		}
+		contents, err := os.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, ManifestFile{
+			Location: fmt.Sprintf("files[%d]", i),
+			Path:     f.Path,
+			Source:   f.Source,
+			Digest:   fmt.Sprintf("sha256:%x", sha256.Sum256(contents)),
+		})
+	}
+
+	return manifest, nil
+}
+
+// sourceDigest returns the digest of the image, or index, an image source was resolved to
+func sourceDigest(src lktspec.ImageSource) (string, error) {
+	desc := src.Descriptor()
+	if desc == nil {
+		return "", errors.New("no descriptor")
+	}
+	return desc.Digest.String(), nil
+}
+
+// Verify checks that the manifest resolved the same images and files, with the same digests,
+// as a locked manifest, returning an error describing every difference if not
+func (m *Manifest) Verify(locked *Manifest) error {
+	var problems []string
+	if m.Platform != locked.Platform {
+		problems = append(problems, fmt.Sprintf("platform is %s, locked to %s", m.Platform, locked.Platform))
+	}
+
+	lockedImages := map[string]ManifestImage{}
+	for _, image := range locked.Images {
+		lockedImages[image.Location] = image
+	}
+	for _, image := range m.Images {
+		l, ok := lockedImages[image.Location]
+		delete(lockedImages, image.Location)
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s: image %s is not in the locked manifest", image.Location, image.Reference))
+		case l.Reference != image.Reference:
+			problems = append(problems, fmt.Sprintf("%s: image is %s, locked to %s", image.Location, image.Reference, l.Reference))
+		case l.Digest != image.Digest:
+			problems = append(problems, fmt.Sprintf("%s: image %s resolved to %s, locked to %s", image.Location, image.Reference, image.Digest, l.Digest))
+		case l.Platform != image.Platform:
+			problems = append(problems, fmt.Sprintf("%s: image %s is for platform %s, locked to %s", image.Location, image.Reference, image.Platform, l.Platform))
+		}
+	}
+	for _, image := range locked.Images {
+		if _, ok := lockedImages[image.Location]; ok {
+			problems = append(problems, fmt.Sprintf("%s: locked image %s is not in the config", image.Location, image.Reference))
+		}
+	}
+
+	// a source that is a directory or glob has an entry for each file at the same location
+	lockedFiles := map[string]ManifestFile{}
+	for _, f := range locked.Files {
+		lockedFiles[f.Location+" "+f.Path] = f
+	}
+	for _, f := range m.Files {
+		l, ok := lockedFiles[f.Location+" "+f.Path]
+		delete(lockedFiles, f.Location+" "+f.Path)
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s: file %s is not in the locked manifest", f.Location, f.Path))
+		case l.Digest != f.Digest:
+			problems = append(problems, fmt.Sprintf("%s: file %s from %s has digest %s, locked to %s", f.Location, f.Path, f.Source, f.Digest, l.Digest))
+		}
+	}
+	for _, f := range locked.Files {
+		if _, ok := lockedFiles[f.Location+" "+f.Path]; ok {
+			problems = append(problems, fmt.Sprintf("%s: locked file %s is not in the config", f.Location, f.Path))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("build does not match locked manifest:\n  %s", strings.Join(problems, "\n  "))
+}
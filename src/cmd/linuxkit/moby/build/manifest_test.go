@@ -0,0 +1,117 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+)
+
+func TestResolveManifestFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "motd"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "ssh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ssh", "key.pub"), []byte("key\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := moby.NewConfig([]byte(fmt.Sprintf(`files:
+  - path: etc/motd
+    source: %[1]s/motd
+  - path: etc/issue
+    contents: welcome
+  - path: etc/ssh
+    source: %[1]s/ssh
+  - path: etc/optional
+    source: %[1]s/missing
+    optional: true
+`, dir)), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ResolveManifest(m, BuildOpts{Arch: "arm64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Manifest{
+		Version:  ManifestVersion,
+		Platform: "linux/arm64",
+		Files: []ManifestFile{
+			// sha256 of "hello\n" and "key\n"
+			{Location: "files[0]", Path: "etc/motd", Source: dir + "/motd", Digest: "sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"},
+			{Location: "files[2]", Path: "etc/ssh/key.pub", Source: filepath.Join(dir, "ssh", "key.pub"), Digest: "sha256:a7998f247bd965694ff227fa325c81169a07471a8b6808d3e002a486c4e65975"},
+		},
+	}
+	if !reflect.DeepEqual(manifest, expected) {
+		t.Errorf("expected %+v, got %+v", expected, manifest)
+	}
+
+	filename := filepath.Join(t.TempDir(), "manifest.json")
+	if err := manifest.Write(filename); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadManifest(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, manifest) {
+		t.Errorf("expected %+v, got %+v", manifest, read)
+	}
+}
+
+func TestManifestVerify(t *testing.T) {
+	locked := func() *Manifest {
+		return &Manifest{
+			Version:  ManifestVersion,
+			Platform: "linux/amd64",
+			Images: []ManifestImage{
+				{Location: "kernel", Reference: "docker.io/linuxkit/kernel:6.6", Digest: "sha256:aaaa", Platform: "linux/amd64"},
+				{Location: "services[0]", Name: "sshd", Reference: "docker.io/linuxkit/sshd:v1.0", Digest: "sha256:bbbb", Platform: "linux/amd64"},
+			},
+			Files: []ManifestFile{
+				{Location: "files[0]", Path: "etc/ssh/a.pub", Source: "ssh/a.pub", Digest: "sha256:cccc"},
+				{Location: "files[0]", Path: "etc/ssh/b.pub", Source: "ssh/b.pub", Digest: "sha256:dddd"},
+			},
+		}
+	}
+	if err := locked().Verify(locked()); err != nil {
+		t.Errorf("unexpected error for an identical manifest: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		change  func(m *Manifest)
+		problem string
+	}{
+		{"image digest", func(m *Manifest) { m.Images[1].Digest = "sha256:eeee" }, "services[0]: image docker.io/linuxkit/sshd:v1.0 resolved to sha256:eeee, locked to sha256:bbbb"},
+		{"image reference", func(m *Manifest) { m.Images[1].Reference = "docker.io/linuxkit/sshd:v1.1" }, "services[0]: image is docker.io/linuxkit/sshd:v1.1, locked to docker.io/linuxkit/sshd:v1.0"},
+		{"missing image", func(m *Manifest) { m.Images = m.Images[:1] }, "services[0]: locked image docker.io/linuxkit/sshd:v1.0 is not in the config"},
+		{"extra image", func(m *Manifest) {
+			m.Images = append(m.Images, ManifestImage{Location: "services[1]", Reference: "docker.io/linuxkit/getty:v1.0", Digest: "sha256:ffff"})
+		}, "services[1]: image docker.io/linuxkit/getty:v1.0 is not in the locked manifest"},
+		{"file digest", func(m *Manifest) { m.Files[1].Digest = "sha256:eeee" }, "files[0]: file etc/ssh/b.pub from ssh/b.pub has digest sha256:eeee, locked to sha256:dddd"},
+		{"missing file", func(m *Manifest) { m.Files = m.Files[:1] }, "files[0]: locked file etc/ssh/b.pub is not in the config"},
+		{"extra file", func(m *Manifest) {
+			m.Files = append(m.Files, ManifestFile{Location: "files[0]", Path: "etc/ssh/c.pub", Source: "ssh/c.pub", Digest: "sha256:ffff"})
+		}, "files[0]: file etc/ssh/c.pub is not in the locked manifest"},
+		{"platform", func(m *Manifest) { m.Platform = "linux/arm64" }, "platform is linux/arm64, locked to linux/amd64"},
+	} {
+		m := locked()
+		tt.change(m)
+		err := m.Verify(locked())
+		if err == nil {
+			t.Errorf("%s: expected error", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), "\n  "+tt.problem) {
+			t.Errorf("%s: expected %q, got %v", tt.name, tt.problem, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+)
+
+// ArchImage is the tar output of the build for one architecture
+type ArchImage struct {
+	Arch string
+	Path string
+}
+
+// ArchName returns the name of an output for one of several architectures, with the architecture
+// added before any extension, e.g. linuxkit.tar becomes linuxkit-arm64.tar
+func ArchName(name, arch string) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-" + arch + ext
+}
+
+// ResolveIndexes pulls the index of every image in m into the cache, with the images for all of arches,
+// so that each reference is only resolved once, and the builds for each architecture use the same index.
+func ResolveIndexes(m moby.Moby, opts BuildOpts, arches []string) error {
+	return forEachImage(m, arches, func(ref *reference.Spec, platforms []imagespec.Platform) error {
+		log.Debugf("resolve index %s for %v", ref, arches)
+		if _, err := indexSource(ref, opts.Pull, opts.CacheDir, platforms); err != nil {
+			return fmt.Errorf("could not resolve image %s: %v", ref, err)
+		}
+		return nil
+	})
+}
+
+// forEachImage calls fn once for each image reference in m, with the platforms it is needed for,
+// which are those of arches, except for volumes in oci format with their own platforms
+func forEachImage(m moby.Moby, arches []string, fn func(ref *reference.Spec, platforms []imagespec.Platform) error) error {
+	var platforms []imagespec.Platform
+	for _, arch := range arches {
+		platforms = append(platforms, imagespec.Platform{OS: "linux", Architecture: arch})
+	}
+	seen := map[string]bool{}
+	image := func(ref *reference.Spec, platforms []imagespec.Platform) error {
+		if ref == nil || seen[ref.String()] {
+			return nil
+		}
+		seen[ref.String()] = true
+		return fn(ref, platforms)
+	}
+
+	if err := image(m.Kernel.Ref(), platforms); err != nil {
+		return err
+	}
+	for _, ref := range m.InitRefs() {
+		if err := image(ref, platforms); err != nil {
+			return err
+		}
+	}
+	for _, vol := range m.Volumes {
+		volPlatforms := platforms
+		if vol.Format == "oci" && len(vol.Platforms) != 0 {
+			volPlatforms = nil
+			for _, p := range vol.Platforms {
+				vp, err := v1.ParsePlatform(p)
+				if err != nil {
+					return fmt.Errorf("failed to parse platform %s: %v", p, err)
+				}
+				volPlatforms = append(volPlatforms, imagespec.Platform{OS: vp.OS, Architecture: vp.Architecture, Variant: vp.Variant})
+			}
+		}
+		if err := image(vol.ImageRef(), volPlatforms); err != nil {
+			return err
+		}
+	}
+	for _, images := range [][]*moby.Image{m.Onboot, m.Onshutdown, m.Services} {
+		for _, i := range images {
+			if err := image(i.Ref(), platforms); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteOCIIndex writes an OCI image layout tar to filename, with an index that has an image for each
+// architecture whose only layer is the tar output of the build for it, so the images for all of the
+// architectures can be pushed as one multi-arch image.
+func WriteOCIIndex(filename string, images []ArchImage) error {
+	index := mutate.IndexMediaType(empty.Index, types.OCIImageIndex)
+	for _, image := range images {
+		layer, err := tarball.LayerFromFile(image.Path, tarball.WithMediaType(types.OCILayer))
+		if err != nil {
+			return fmt.Errorf("cannot read %s: %v", image.Path, err)
+		}
+		img, err := mutate.AppendLayers(mutate.MediaType(empty.Image, types.OCIManifestSchema1), layer)
+		if err != nil {
+			return err
+		}
+		img = mutate.ConfigMediaType(img, types.OCIConfigJSON)
+		config, err := img.ConfigFile()
+		if err != nil {
+			return err
+		}
+		config = config.DeepCopy()
+		config.OS = "linux"
+		config.Architecture = image.Arch
+		if img, err = mutate.ConfigFile(img, config); err != nil {
+			return err
+		}
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{
+			Add: img,
+			Descriptor: v1.Descriptor{
+				Platform: &v1.Platform{OS: "linux", Architecture: image.Arch},
+			},
+		})
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	if err := cache.WriteIndexLayout(f, index); err != nil {
+		return fmt.Errorf("error writing OCI index %s: %v", filename, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,142 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+)
+
+func TestArchName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"linuxkit.tar":         "linuxkit-arm64.tar",
+		"out/linuxkit":         "out/linuxkit-arm64",
+		"manifest.locked.json": "manifest.locked-arm64.json",
+	} {
+		if actual := ArchName(name, "arm64"); actual != expected {
+			t.Errorf("expected %s for %s, got %s", expected, name, actual)
+		}
+	}
+}
+
+func TestWriteOCIIndex(t *testing.T) {
+	dir := t.TempDir()
+	var images []ArchImage
+	tars := map[string][]byte{}
+	for _, arch := range []string{"amd64", "arm64"} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		contents := []byte("built for " + arch)
+		if err := tw.WriteHeader(&tar.Header{Name: "etc/arch", Mode: 0644, Size: int64(len(contents))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(contents); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, arch+".tar")
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		tars[arch] = buf.Bytes()
+		images = append(images, ArchImage{Arch: arch, Path: path})
+	}
+	filename := filepath.Join(dir, "index.tar")
+	if err := WriteOCIIndex(filename, images); err != nil {
+		t.Fatal(err)
+	}
+
+	// extract the layout to read it back
+	layoutDir := filepath.Join(dir, "layout")
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := filepath.Join(layoutDir, hdr.Name)
+		if hdr.Typeflag == tar.TypeDir {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(target, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p, err := layout.FromPath(layoutDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer, err := p.ImageIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outerManifest, err := outer.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := outer.ImageIndex(outerManifest.Manifests[0].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Manifests) != 2 {
+		t.Fatalf("expected 2 images in the index, found %d", len(manifest.Manifests))
+	}
+	for _, desc := range manifest.Manifests {
+		arch := desc.Platform.Architecture
+		img, err := index.Image(desc.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := img.ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Architecture != arch || config.OS != "linux" {
+			t.Errorf("unexpected platform %s/%s for %s", config.OS, config.Architecture, arch)
+		}
+		layers, err := img.Layers()
+		if err != nil || len(layers) != 1 {
+			t.Fatalf("expected 1 layer for %s: %v", arch, err)
+		}
+		rc, err := layers[0].Uncompressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, tars[arch]) {
+			t.Errorf("layer for %s is not its image tar", arch)
+		}
+	}
+}
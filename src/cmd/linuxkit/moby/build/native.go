@@ -0,0 +1,318 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/diskimage"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+)
+
+// Builders, which determine how output formats are written
+const (
+	// BuilderDocker writes output formats by running the linuxkit/mkimage-* containers
+	BuilderDocker = "docker"
+	// BuilderNative writes output formats in Go, without docker; not every format is supported
+	BuilderNative = "native"
+)
+
+type nativeOutFun func(base string, ir io.Reader, size int, arch, cache, buildCache string) error
+
+// nativeOutFuns are the formats the native builder writes differently from the docker builder
+var nativeOutFuns = map[string]nativeOutFun{
+	"raw-efi": func(base string, image io.Reader, size int, arch, cache, buildCache string) error {
+		kernel, initrd, cmdline, ucode, err := tarToInitrd(image, buildCache)
+		if err != nil {
+			return fmt.Errorf("error converting to initrd: %v", err)
+		}
+		if err := outputRawEFINative(base+"-efi.img", kernel, prependUcode(ucode, initrd), cmdline, arch, cache); err != nil {
+			return fmt.Errorf("error writing raw-efi output: %v", err)
+		}
+		return nil
+	},
+	"iso-bios": func(base string, image io.Reader, size int, arch, cache, buildCache string) error {
+		if err := outputISOBIOSNative(base+".iso", image, arch, cache); err != nil {
+			return fmt.Errorf("error writing iso-bios output: %v", err)
+		}
+		return nil
+	},
+	"iso-efi": func(base string, image io.Reader, size int, arch, cache, buildCache string) error {
+		if err := outputISOEFINative(base+"-efi.iso", image, arch, cache); err != nil {
+			return fmt.Errorf("error writing iso-efi output: %v", err)
+		}
+		return nil
+	},
+	"iso-efi-initrd": func(base string, image io.Reader, size int, arch, cache, buildCache string) error {
+		kernel, initrd, cmdline, ucode, err := tarToInitrd(image, buildCache)
+		if err != nil {
+			return fmt.Errorf("error converting to initrd: %v", err)
+		}
+		if err := outputISOEFIInitrdNative(base+"-efi-initrd.iso", kernel, prependUcode(ucode, initrd), cmdline, arch, cache); err != nil {
+			return fmt.Errorf("error writing iso-efi-initrd output: %v", err)
+		}
+		return nil
+	},
+}
+
+// nativeUnsupported explains why the native builder cannot write some formats
+var nativeUnsupported = map[string]string{
+	// the boot sector and ldlinux.sys that syslinux installs are built into the syslinux installer,
+	// rather than shipped as files in the mkimage-raw-bios image
+	"raw-bios": "installing the syslinux boot loader needs the docker builder; use raw-efi instead",
+}
+
+// dockerFree are the formats that are always written without docker, so the native builder can use them
+var dockerFree = map[string]bool{
+	"kernel+initrd":     true,
+	"tar-kernel-initrd": true,
+}
+
+// prependUcode returns the initrd with the microcode cpio archive, if any, in front of it, as
+// outputKernelInitrd writes it, so that the kernel loads the microcode early in boot
+func prependUcode(ucode, initrd []byte) []byte {
+	if len(ucode) == 0 {
+		return initrd
+	}
+	return append(append([]byte{}, ucode...), initrd...)
+}
+
+// efiBootFiles are the systemd-boot and stub files, and the removable media boot path, for each architecture
+var efiBootFiles = map[string]struct {
+	boot, stub, dest string
+}{
+	"amd64":   {"systemd-bootx64.efi", "linuxx64.efi.stub", "BOOTX64.EFI"},
+	"arm64":   {"systemd-bootaa64.efi", "linuxaa64.efi.stub", "BOOTAA64.EFI"},
+	"riscv64": {"systemd-bootriscv64.efi", "linuxriscv64.efi.stub", "BOOTRISCV64.EFI"},
+}
+
+// grubEFIFiles are the GRUB EFI binaries in the linuxkit/grub image, and the root device of the ISO
+// for each architecture, as used by mkimage-iso-efi
+var grubEFIFiles = map[string]struct {
+	boot, rootDev string
+}{
+	"amd64": {"BOOTX64.EFI", "/dev/sr0"},
+	"arm64": {"BOOTAA64.EFI", "/dev/vda"},
+}
+
+// syslinuxDir is where the mkimage-iso-bios image has the syslinux files
+const syslinuxDir = "usr/share/syslinux"
+
+// systemdBootDir is where the linuxkit/systemd-boot image has the boot loader and stubs
+const systemdBootDir = "usr/lib/systemd/boot/efi"
+
+// outputRawEFINative writes the same disk layout as linuxkit/mkimage-raw-efi: a GPT disk with a FAT32
+// EFI system partition holding systemd-boot and a unified kernel image
+func outputRawEFINative(filename string, kernel, initrd []byte, cmdline, arch, cache string) error {
+	log.Debugf("output native raw-efi: %s", filename)
+	log.Infof("  %s", filename)
+	arch, err := util.GoArch(arch)
+	if err != nil {
+		return err
+	}
+	names, ok := efiBootFiles[arch]
+	if !ok {
+		return fmt.Errorf("unsupported architecture %s", arch)
+	}
+	files, err := imageFiles(outputImages["systemd-boot"], arch, cache, path.Join(systemdBootDir, names.boot), path.Join(systemdBootDir, names.stub))
+	if err != nil {
+		return err
+	}
+	uki, err := diskimage.UKI(files[1], kernel, initrd, cmdline+" text", `NAME="LinuxKit"`)
+	if err != nil {
+		return fmt.Errorf("cannot create unified kernel image: %v", err)
+	}
+	return diskimage.WriteEFIDisk(filename, []diskimage.File{
+		{Path: "EFI/BOOT/" + names.dest, Contents: files[0]},
+		{Path: "EFI/Linux/linuxkit.efi", Contents: uki},
+		{Path: "loader/loader.conf", Contents: []byte("timeout 0\n")},
+	}, defaultModTime)
+}
+
+// imageFiles returns the contents of files in an image, pulling it into the cache if needed
+func imageFiles(image, arch, cache string, filenames ...string) ([][]byte, error) {
+	ref, err := reference.Parse(util.ReferenceExpand(image))
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve reference for image %s: %v", image, err)
+	}
+	src, err := imageSource(&ref, false, cache, false, imagespec.Platform{OS: "linux", Architecture: arch})
+	if err != nil {
+		return nil, fmt.Errorf("could not pull image %s: %v", image, err)
+	}
+	rc, err := src.TarReader()
+	if err != nil {
+		return nil, fmt.Errorf("could not unpack image %s: %v", image, err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	found := map[string][]byte{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read image %s: %v", image, err)
+		}
+		name := path.Clean(hdr.Name)
+		for _, f := range filenames {
+			if name == f && hdr.Typeflag == tar.TypeReg {
+				var buf bytes.Buffer
+				if _, err := io.Copy(&buf, tr); err != nil {
+					return nil, err
+				}
+				found[f] = buf.Bytes()
+			}
+		}
+	}
+	var contents [][]byte
+	for _, f := range filenames {
+		b, ok := found[f]
+		if !ok {
+			return nil, fmt.Errorf("image %s has no file /%s", image, f)
+		}
+		contents = append(contents, b)
+	}
+	return contents, nil
+}
+
+// outputISOBIOSNative writes the same ISO as linuxkit/mkimage-iso-bios, with the filesystem booted by
+// isolinux, and made hybrid so it can also be written to a disk, but without the Joliet names for Windows
+func outputISOBIOSNative(filename string, filesystem io.Reader, arch, cache string) error {
+	log.Debugf("output native iso-bios: %s", filename)
+	log.Infof("  %s", filename)
+	arch, err := util.GoArch(arch)
+	if err != nil {
+		return err
+	}
+	iso := diskimage.NewISO("LinuxKit", defaultModTime)
+	cmdline, err := tarToISO(iso, filesystem)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(cmdline, "root=") {
+		cmdline += " root=/dev/sr0"
+	}
+	files, err := imageFiles(outputImages["iso-bios"], arch, cache, path.Join(syslinuxDir, "isolinux.bin"), path.Join(syslinuxDir, "ldlinux.c32"), path.Join(syslinuxDir, "isohdpfx.bin"))
+	if err != nil {
+		return err
+	}
+	cfg := fmt.Sprintf("DEFAULT linux\nLABEL linux\n    KERNEL /boot/kernel\n    APPEND %s\n", cmdline)
+	for name, contents := range map[string][]byte{
+		"isolinux/isolinux.bin": files[0],
+		"isolinux/ldlinux.c32":  files[1],
+		"isolinux/isolinux.cfg": []byte(cfg),
+	} {
+		if err := iso.AddFile(name, contents); err != nil {
+			return err
+		}
+	}
+	if err := iso.SetBIOSBoot("isolinux/isolinux.bin", "isolinux/boot.cat", files[2]); err != nil {
+		return err
+	}
+	return iso.Write(filename)
+}
+
+// outputISOEFINative writes the same ISO as linuxkit/mkimage-iso-efi, with the filesystem booted by GRUB
+func outputISOEFINative(filename string, filesystem io.Reader, arch, cache string) error {
+	log.Debugf("output native iso-efi: %s", filename)
+	log.Infof("  %s", filename)
+	arch, err := util.GoArch(arch)
+	if err != nil {
+		return err
+	}
+	names, ok := grubEFIFiles[arch]
+	if !ok {
+		return fmt.Errorf("unsupported architecture %s", arch)
+	}
+	iso := diskimage.NewISO("CDROM", defaultModTime)
+	cmdline, err := tarToISO(iso, filesystem)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(cmdline, "root=") {
+		cmdline += " root=" + names.rootDev
+	}
+	return writeGRUBISO(filename, iso, fmt.Sprintf("linux /boot/kernel %s text", cmdline), arch, cache)
+}
+
+// outputISOEFIInitrdNative writes the same ISO as linuxkit/mkimage-iso-efi-initrd, with the kernel and
+// initrd booted by GRUB
+func outputISOEFIInitrdNative(filename string, kernel, initrd []byte, cmdline, arch, cache string) error {
+	log.Debugf("output native iso-efi-initrd: %s", filename)
+	log.Infof("  %s", filename)
+	arch, err := util.GoArch(arch)
+	if err != nil {
+		return err
+	}
+	iso := diskimage.NewISO("CDROM", defaultModTime)
+	if err := iso.AddFile("kernel", kernel); err != nil {
+		return err
+	}
+	if err := iso.AddFile("initrd.img", initrd); err != nil {
+		return err
+	}
+	return writeGRUBISO(filename, iso, fmt.Sprintf("linux /kernel %s text\n\tinitrd /initrd.img", cmdline), arch, cache)
+}
+
+// writeGRUBISO adds the GRUB configuration with the menu entry to boot, and an EFI boot image with GRUB,
+// then writes the ISO
+func writeGRUBISO(filename string, iso *diskimage.ISO, entry, arch, cache string) error {
+	names, ok := grubEFIFiles[arch]
+	if !ok {
+		return fmt.Errorf("unsupported architecture %s", arch)
+	}
+	files, err := imageFiles(outputImages["grub"], arch, cache, names.boot)
+	if err != nil {
+		return err
+	}
+	cfg := fmt.Sprintf("set timeout=0\nset gfxpayload=text\nmenuentry 'LinuxKit ISO Image' {\n\t%s\n}\n", entry)
+	if err := iso.AddFile("EFI/BOOT/grub.cfg", []byte(cfg)); err != nil {
+		return err
+	}
+	// as small as possible, allowing 511KiB for the filesystem, and rounded up to 32KiB
+	size := int64((len(files[0])/1024+511)/32*32) * 1024
+	efi, err := diskimage.FATImage(size, []diskimage.File{{Path: "EFI/BOOT/" + names.boot, Contents: files[0]}}, crc32.ChecksumIEEE(files[0]), defaultModTime)
+	if err != nil {
+		return fmt.Errorf("cannot create EFI boot image: %v", err)
+	}
+	iso.SetEFIBoot(efi)
+	return iso.Write(filename)
+}
+
+// tarToISO adds the contents of a tar to an ISO, apart from the kernel command line, which is returned
+func tarToISO(iso *diskimage.ISO, r io.Reader) (string, error) {
+	var cmdline string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		var contents []byte
+		if hdr.Typeflag == tar.TypeReg {
+			if contents, err = io.ReadAll(tr); err != nil {
+				return "", err
+			}
+		}
+		if path.Clean(hdr.Name) == "boot/cmdline" {
+			cmdline = strings.TrimSpace(string(contents))
+			continue
+		}
+		if err := iso.Add(hdr, contents); err != nil {
+			return "", err
+		}
+	}
+	return cmdline, nil
+}
@@ -0,0 +1,43 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+)
+
+func TestPrependUcode(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, contents := range map[string]string{
+		"boot/kernel":     "kernel",
+		"boot/cmdline":    "console=ttyS0",
+		"boot/ucode.cpio": "microcode",
+		"etc/motd":        "hello",
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, initrd, _, ucode, err := tarToInitrd(&buf, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ucode) != "microcode" {
+		t.Fatalf("expected the microcode to be split out, got %q", ucode)
+	}
+	// the microcode comes first, as the kernel only looks for it at the start of the initrd
+	withUcode := prependUcode(ucode, initrd)
+	if !bytes.Equal(withUcode, append([]byte("microcode"), initrd...)) {
+		t.Errorf("expected the microcode in front of the initrd")
+	}
+	if !bytes.Equal(prependUcode(nil, initrd), initrd) {
+		t.Errorf("expected the initrd unchanged without microcode")
+	}
+}
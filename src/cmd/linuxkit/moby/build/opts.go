@@ -10,4 +10,10 @@ type BuildOpts struct {
 	Arch             string
 	SbomGenerator    *SbomGenerator
 	InputTar         string
+	Jobs             int
+	SecretIdentities []*SecretIdentity
+	// BuildCacheDir is the directory of the incremental build cache. If set, the tar entries for each
+	// kernel, init, volume, container and files section of a build are stored there, keyed by the image
+	// digest and everything else that affects them, and reused by later builds. If empty, no cache is used.
+	BuildCacheDir string
 }
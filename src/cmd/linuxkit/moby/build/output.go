@@ -3,6 +3,8 @@ package build
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 
 	// fix: #3742
 	// golint requires comments on non-main(test)
@@ -15,6 +17,7 @@ import (
 	"strings"
 
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/initrd"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
@@ -24,9 +27,11 @@ import (
 var imagesBytes []byte
 var outputImages map[string]string
 
-var outFuns = map[string]func(base string, ir io.Reader, size int, arch string) error{
-	"kernel+initrd": func(base string, image io.Reader, size int, arch string) error {
-		kernel, initrd, cmdline, ucode, err := tarToInitrd(image)
+type outFun func(base string, ir io.Reader, size int, arch, buildCache string) error
+
+var outFuns = map[string]outFun{
+	"kernel+initrd": func(base string, image io.Reader, size int, arch, buildCache string) error {
+		kernel, initrd, cmdline, ucode, err := tarToInitrd(image, buildCache)
 		if err != nil {
 			return fmt.Errorf("error converting to initrd: %v", err)
 		}
@@ -36,8 +41,8 @@ var outFuns = map[string]func(base string, ir io.Reader, size int, arch string)
 		}
 		return nil
 	},
-	"tar-kernel-initrd": func(base string, image io.Reader, size int, arch string) error {
-		kernel, initrd, cmdline, ucode, err := tarToInitrd(image)
+	"tar-kernel-initrd": func(base string, image io.Reader, size int, arch, buildCache string) error {
+		kernel, initrd, cmdline, ucode, err := tarToInitrd(image, buildCache)
 		if err != nil {
 			return fmt.Errorf("error converting to initrd: %v", err)
 		}
@@ -46,22 +51,22 @@ var outFuns = map[string]func(base string, ir io.Reader, size int, arch string)
 		}
 		return nil
 	},
-	"iso-bios": func(base string, image io.Reader, size int, arch string) error {
+	"iso-bios": func(base string, image io.Reader, size int, arch, buildCache string) error {
 		err := outputIso(outputImages["iso-bios"], base+".iso", image, arch)
 		if err != nil {
 			return fmt.Errorf("error writing iso-bios output: %v", err)
 		}
 		return nil
 	},
-	"iso-efi": func(base string, image io.Reader, size int, arch string) error {
+	"iso-efi": func(base string, image io.Reader, size int, arch, buildCache string) error {
 		err := outputIso(outputImages["iso-efi"], base+"-efi.iso", image, arch)
 		if err != nil {
 			return fmt.Errorf("error writing iso-efi output: %v", err)
 		}
 		return nil
 	},
-	"iso-efi-initrd": func(base string, image io.Reader, size int, arch string) error {
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
+	"iso-efi-initrd": func(base string, image io.Reader, size int, arch, buildCache string) error {
+		kernel, initrd, cmdline, _, err := tarToInitrd(image, buildCache)
 		if err != nil {
 			return fmt.Errorf("error converting to initrd: %v", err)
 		}
@@ -72,8 +77,8 @@ var outFuns = map[string]func(base string, ir io.Reader, size int, arch string)
 		}
 		return nil
 	},
-	"raw-bios": func(base string, image io.Reader, size int, arch string) error {
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
+	"raw-bios": func(base string, image io.Reader, size int, arch, buildCache string) error {
+		kernel, initrd, cmdline, _, err := tarToInitrd(image, buildCache)
 		if err != nil {
 			return fmt.Errorf("error converting to initrd: %v", err)
 		}
@@ -84,8 +89,8 @@ var outFuns = map[string]func(base string, ir io.Reader, size int, arch string)
 		}
 		return nil
 	},
-	"raw-efi": func(base string, image io.Reader, size int, arch string) error {
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
+	"raw-efi": func(base string, image io.Reader, size int, arch, buildCache string) error {
+		kernel, initrd, cmdline, _, err := tarToInitrd(image, buildCache)
 		if err != nil {
 			return fmt.Errorf("error converting to initrd: %v", err)
 		}
@@ -95,31 +100,31 @@ var outFuns = map[string]func(base string, ir io.Reader, size int, arch string)
 		}
 		return nil
 	},
-	"kernel+squashfs": func(base string, image io.Reader, size int, arch string) error {
-		err := outputKernelSquashFS(outputImages["squashfs"], base, image, arch)
+	"kernel+squashfs": func(base string, image io.Reader, size int, arch, buildCache string) error {
+		err := outputKernelSquashFS(outputImages["squashfs"], base, image, arch, buildCache)
 		if err != nil {
 			return fmt.Errorf("error writing kernel+squashfs output: %v", err)
 		}
 		return nil
 	},
-	"kernel+erofs": func(base string, image io.Reader, size int, arch string) error {
-		err := outputKernelEroFS(outputImages["erofs"], base, image, arch)
+	"kernel+erofs": func(base string, image io.Reader, size int, arch, buildCache string) error {
+		err := outputKernelEroFS(outputImages["erofs"], base, image, arch, buildCache)
 		if err != nil {
 			return fmt.Errorf("error writing kernel+erofs output: %v", err)
 		}
 		return nil
 	},
-	"kernel+iso": func(base string, image io.Reader, size int, arch string) error {
-		err := outputKernelISO(outputImages["iso"], base, image, arch)
+	"kernel+iso": func(base string, image io.Reader, size int, arch, buildCache string) error {
+		err := outputKernelISO(outputImages["iso"], base, image, arch, buildCache)
 		if err != nil {
 			return fmt.Errorf("error writing kernel+iso output: %v", err)
 		}
 		return nil
 	},
-	"aws": func(base string, image io.Reader, size int, arch string) error {
+	"aws": func(base string, image io.Reader, size int, arch, buildCache string) error {
 		filename := base + ".raw"
 		log.Infof("  %s", filename)
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
+		kernel, initrd, cmdline, _, err := tarToInitrd(image, buildCache)
 		if err != nil {
 			return fmt.Errorf("error converting to initrd: %v", err)
 		}
@@ -129,8 +134,8 @@ var outFuns = map[string]func(base string, ir io.Reader, size int, arch string)
 		}
 		return nil
 	},
-	"gcp": func(base string, image io.Reader, size int, arch string) error {
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
+	"gcp": func(base string, image io.Reader, size int, arch, buildCache string) error {
+		kernel, initrd, cmdline, _, err := tarToInitrd(image, buildCache)
 		if err != nil {
 			return fmt.Errorf("error converting to initrd: %v", err)
 		}
@@ -140,8 +145,8 @@ var outFuns = map[string]func(base string, ir io.Reader, size int, arch string)
 		}
 		return nil
 	},
-	"qcow2-efi": func(base string, image io.Reader, size int, arch string) error {
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
+	"qcow2-efi": func(base string, image io.Reader, size int, arch, buildCache string) error {
+		kernel, initrd, cmdline, _, err := tarToInitrd(image, buildCache)
 		if err != nil {
 			return fmt.Errorf("error converting to initrd: %v", err)
 		}
@@ -151,10 +156,10 @@ var outFuns = map[string]func(base string, ir io.Reader, size int, arch string)
 		}
 		return nil
 	},
-	"qcow2-bios": func(base string, image io.Reader, size int, arch string) error {
+	"qcow2-bios": func(base string, image io.Reader, size int, arch, buildCache string) error {
 		filename := base + ".qcow2"
 		log.Infof("  %s", filename)
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
+		kernel, initrd, cmdline, _, err := tarToInitrd(image, buildCache)
 		if err != nil {
 			return fmt.Errorf("error converting to initrd: %v", err)
 		}
@@ -165,8 +170,8 @@ var outFuns = map[string]func(base string, ir io.Reader, size int, arch string)
 		}
 		return nil
 	},
-	"vhd": func(base string, image io.Reader, size int, arch string) error {
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
+	"vhd": func(base string, image io.Reader, size int, arch, buildCache string) error {
+		kernel, initrd, cmdline, _, err := tarToInitrd(image, buildCache)
 		if err != nil {
 			return fmt.Errorf("error converting to initrd: %v", err)
 		}
@@ -176,8 +181,8 @@ var outFuns = map[string]func(base string, ir io.Reader, size int, arch string)
 		}
 		return nil
 	},
-	"dynamic-vhd": func(base string, image io.Reader, size int, arch string) error {
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
+	"dynamic-vhd": func(base string, image io.Reader, size int, arch, buildCache string) error {
+		kernel, initrd, cmdline, _, err := tarToInitrd(image, buildCache)
 		if err != nil {
 			return fmt.Errorf("error converting to initrd: %v", err)
 		}
@@ -187,8 +192,8 @@ var outFuns = map[string]func(base string, ir io.Reader, size int, arch string)
 		}
 		return nil
 	},
-	"vmdk": func(base string, image io.Reader, size int, arch string) error {
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
+	"vmdk": func(base string, image io.Reader, size int, arch, buildCache string) error {
+		kernel, initrd, cmdline, _, err := tarToInitrd(image, buildCache)
 		if err != nil {
 			return fmt.Errorf("error converting to initrd: %v", err)
 		}
@@ -198,7 +203,7 @@ var outFuns = map[string]func(base string, ir io.Reader, size int, arch string)
 		}
 		return nil
 	},
-	"rpi3": func(base string, image io.Reader, size int, arch string) error {
+	"rpi3": func(base string, image io.Reader, size int, arch, buildCache string) error {
 		if runtime.GOARCH != "arm64" {
 			return fmt.Errorf("raspberry Pi output currently only supported on arm64")
 		}
@@ -210,14 +215,110 @@ var outFuns = map[string]func(base string, ir io.Reader, size int, arch string)
 	},
 }
 
-var prereq = map[string]string{
-	"aws":        "mkimage",
-	"qcow2-bios": "mkimage",
+// Suffixes of the kernel and cmdline, which formats that write them alongside their other outputs write the same
+const (
+	kernelSuffix  = "-kernel"
+	cmdlineSuffix = "-cmdline"
+)
+
+// builtinFormat is what a built in format writes, and what it uses to write it
+type builtinFormat struct {
+	// suffixes are added to the base name for the files the format writes
+	suffixes []string
+	// images are the images from images.yaml that the docker builder runs to write the format
+	images []string
+	// nativeImages are the images from images.yaml that the native builder reads files from, for the
+	// formats in nativeOutFuns
+	nativeImages []string
+	// prereq is the LinuxKit image that the docker builder runs to write the format
+	prereq string
+}
+
+// builtinFormats are the built in formats, other than the streamable ones, which each have a function in outFuns
+var builtinFormats = map[string]builtinFormat{
+	"kernel+initrd":     {suffixes: []string{kernelSuffix, "-initrd.img", cmdlineSuffix}},
+	"tar-kernel-initrd": {suffixes: []string{"-initrd.tar"}},
+	"iso-bios":          {suffixes: []string{".iso"}, images: []string{"iso-bios"}, nativeImages: []string{"iso-bios"}},
+	"iso-efi":           {suffixes: []string{"-efi.iso"}, images: []string{"iso-efi"}, nativeImages: []string{"grub"}},
+	"iso-efi-initrd":    {suffixes: []string{"-efi-initrd.iso"}, images: []string{"iso-efi-initrd"}, nativeImages: []string{"grub"}},
+	"raw-bios":          {suffixes: []string{"-bios.img"}, images: []string{"raw-bios"}},
+	"raw-efi":           {suffixes: []string{"-efi.img"}, images: []string{"raw-efi"}, nativeImages: []string{"systemd-boot"}},
+	"kernel+squashfs":   {suffixes: []string{kernelSuffix, cmdlineSuffix, "-squashfs.img"}, images: []string{"squashfs"}},
+	"kernel+erofs":      {suffixes: []string{kernelSuffix, cmdlineSuffix, "-erofs.img"}, images: []string{"erofs"}},
+	"kernel+iso":        {suffixes: []string{kernelSuffix, cmdlineSuffix, ".iso"}, images: []string{"iso"}},
+	"aws":               {suffixes: []string{".raw"}, prereq: "mkimage"},
+	"gcp":               {suffixes: []string{".img.tar.gz"}, images: []string{"gcp"}},
+	"qcow2-efi":         {suffixes: []string{"-efi.qcow2"}, images: []string{"qcow2-efi"}},
+	"qcow2-bios":        {suffixes: []string{".qcow2"}, prereq: "mkimage"},
+	"vhd":               {suffixes: []string{".vhd"}, images: []string{"vhd"}},
+	"dynamic-vhd":       {suffixes: []string{".vhd"}, images: []string{"dynamic-vhd"}},
+	"vmdk":              {suffixes: []string{".vmdk"}, images: []string{"vmdk"}},
+	"rpi3":              {suffixes: []string{".tar"}, images: []string{"rpi3"}},
+}
+
+// formatImages returns the images from images.yaml that writing the built in format with builder uses
+func formatImages(format, builder string) []string {
+	f := builtinFormats[format]
+	if builder == BuilderNative && f.nativeImages != nil {
+		return f.nativeImages
+	}
+	return f.images
+}
+
+// OutputFile is a file written by an output format
+type OutputFile struct {
+	Path string
+	// Format is the format that writes the file, or the first of the formats that write the kernel or cmdline
+	Format string
+}
+
+// OutputFiles returns the files that writing formats, built in or from format plugins, for arch writes with the
+// base name base. The kernel and cmdline are returned once, however many of the formats write them, but it is an
+// error for formats to write the same file otherwise, as one would overwrite the other.
+func OutputFiles(base, arch string, formats []string) ([]OutputFile, error) {
+	var files []OutputFile
+	writtenBy := map[string]string{}
+	for _, format := range formats {
+		var paths []string
+		if f, ok := builtinFormats[format]; ok {
+			for _, suffix := range f.suffixes {
+				paths = append(paths, base+suffix)
+			}
+		} else {
+			plugins, err := loadFormatPlugins()
+			if err != nil {
+				return nil, err
+			}
+			p, ok := plugins[format]
+			if !ok {
+				return nil, fmt.Errorf("unknown format type %s", format)
+			}
+			filename, err := p.filename(base, arch)
+			if err != nil {
+				return nil, err
+			}
+			if p.Input == FormatInputFilesystem {
+				paths = append(paths, base+kernelSuffix, base+cmdlineSuffix)
+			}
+			paths = append(paths, filename)
+		}
+		for _, path := range paths {
+			if other, ok := writtenBy[path]; ok {
+				if path == base+kernelSuffix || path == base+cmdlineSuffix {
+					continue
+				}
+				return nil, fmt.Errorf("formats %s and %s both write %s", other, format, path)
+			}
+			writtenBy[path] = format
+			files = append(files, OutputFile{Path: path, Format: format})
+		}
+	}
+	return files, nil
 }
 
 func ensurePrereq(out, cache string) error {
 	var err error
-	p := prereq[out]
+	p := builtinFormats[out].prereq
 	if p != "" {
 		err = ensureLinuxkitImage(p, cache)
 	}
@@ -233,8 +334,8 @@ func parseOutputImages(b []byte) (map[string]string, error) {
 	return m, err
 }
 
-// ValidateFormats checks if the format type is known
-func ValidateFormats(formats []string, cache string) error {
+// ValidateFormats checks if the format type is known, and supported by the builder
+func ValidateFormats(formats []string, cache, builder string) error {
 	log.Debugf("validating output: %v", formats)
 	if outputImages == nil {
 		var err error
@@ -245,9 +346,11 @@ func ValidateFormats(formats []string, cache string) error {
 	}
 
 	for _, o := range formats {
-		f := outFuns[o]
-		if f == nil {
-			return fmt.Errorf("unknown format type %s", o)
+		if _, err := outputFun(o, cache, builder); err != nil {
+			return err
+		}
+		if builder == BuilderNative {
+			continue
 		}
 		err := ensurePrereq(o, cache)
 		if err != nil {
@@ -258,14 +361,55 @@ func ValidateFormats(formats []string, cache string) error {
 	return nil
 }
 
-// Formats generates all the specified output formats
-func Formats(base string, image string, formats []string, size int, arch, cache string) error {
+// outputFun returns the function to write an output format with the builder, built in or from a format plugin
+func outputFun(format, cache, builder string) (outFun, error) {
+	switch builder {
+	case BuilderDocker:
+	case BuilderNative:
+		if f := nativeOutFuns[format]; f != nil {
+			return func(base string, image io.Reader, size int, arch, buildCache string) error {
+				return f(base, image, size, arch, cache, buildCache)
+			}, nil
+		}
+		if !dockerFree[format] {
+			if _, err := outputFun(format, cache, BuilderDocker); err != nil {
+				return nil, err
+			}
+			if reason, ok := nativeUnsupported[format]; ok {
+				return nil, fmt.Errorf("format %s is not supported by the native builder, as %s", format, reason)
+			}
+			return nil, fmt.Errorf("format %s is not supported by the native builder", format)
+		}
+	default:
+		return nil, fmt.Errorf("unknown builder %s, must be one of %s or %s", builder, BuilderDocker, BuilderNative)
+	}
+	if f := outFuns[format]; f != nil {
+		return f, nil
+	}
+	plugins, err := loadFormatPlugins()
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := plugins[format]; ok {
+		return p.output, nil
+	}
+	return nil, fmt.Errorf("unknown format type %s", format)
+}
+
+// Formats generates all the specified output formats. If buildCache is set, the initrd and the
+// container built kernel image formats are reused from the build cache there if the root filesystem
+// is unchanged.
+func Formats(base string, image string, formats []string, size int, arch, cache, buildCache, builder string) error {
 	log.Debugf("format: %v %s", formats, base)
 
-	err := ValidateFormats(formats, cache)
+	err := ValidateFormats(formats, cache, builder)
 	if err != nil {
 		return err
 	}
+	// formats must not overwrite each other's outputs
+	if _, err := OutputFiles(base, arch, formats); err != nil {
+		return err
+	}
 	for _, o := range formats {
 		ir, err := os.Open(image)
 		if err != nil {
@@ -274,8 +418,11 @@ func Formats(base string, image string, formats []string, size int, arch, cache
 		defer func() {
 			_ = ir.Close()
 		}()
-		f := outFuns[o]
-		if err := f(base, ir, size, arch); err != nil {
+		f, err := outputFun(o, cache, builder)
+		if err != nil {
+			return err
+		}
+		if err := f(base, ir, size, arch, buildCache); err != nil {
 			return err
 		}
 	}
@@ -283,7 +430,16 @@ func Formats(base string, image string, formats []string, size int, arch, cache
 	return nil
 }
 
-func tarToInitrd(r io.Reader) ([]byte, []byte, string, []byte, error) {
+// tarToInitrd converts a tar stream to a kernel, initrd, cmdline and ucode, reusing the initrd from
+// the build cache in buildCache, if it is set and the root filesystem is unchanged
+func tarToInitrd(r io.Reader, buildCache string) ([]byte, []byte, string, []byte, error) {
+	if buildCache != "" {
+		c, err := newBuildCache(buildCache)
+		if err != nil {
+			return []byte{}, []byte{}, "", []byte{}, err
+		}
+		return tarToInitrdCached(r, c)
+	}
 	w := new(bytes.Buffer)
 	iw := initrd.NewWriter(w)
 	tr := tar.NewReader(r)
@@ -511,13 +667,53 @@ func outputKernelInitrdTarball(base string, kernel []byte, initrd []byte, cmdlin
 }
 
 // outputKernelImage is a unified function for ISO, SquashFS, and EroFS kernel image outputs
-func outputKernelImage(image, base, format, outfile string, filesystem io.Reader, arch string) error {
+func outputKernelImage(image, base, format, outfile string, filesystem io.Reader, arch, buildCache string) error {
 	log.Debugf("output kernel/%s: %s %s", format, image, base)
 	log.Infof("  %s", outfile)
 
+	buf, redacted, err := splitKernel(base, filesystem)
+	if err != nil {
+		return err
+	}
+
+	march, err := util.MArch(arch)
+	if err != nil {
+		return err
+	}
+	// the plaintext of a secret is never written to the cache, so an image containing one is always built
+	if buildCache != "" && !redacted {
+		// the image only depends on the root filesystem, so is reused if that did not change
+		c, err := newBuildCache(buildCache)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(buf.Bytes())
+		key, err := buildCacheKey(format, image, march, hex.EncodeToString(sum[:]))
+		if err != nil {
+			return err
+		}
+		return c.file(key, outfile, func(w io.Writer) error {
+			return dockerRun(buf, w, image, []string{fmt.Sprintf("TARGETARCH=%s", march)})
+		})
+	}
+
+	output, err := os.Create(outfile)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = output.Close() }()
+
+	return dockerRun(buf, output, image, []string{fmt.Sprintf("TARGETARCH=%s", march)})
+}
+
+// splitKernel writes the kernel and cmdline from the build output to base-kernel and base-cmdline,
+// and returns a tar of the root filesystem without /boot, and whether it contains a redacted entry,
+// such as a secret
+func splitKernel(base string, filesystem io.Reader) (*bytes.Buffer, bool, error) {
 	tr := tar.NewReader(filesystem)
 	buf := new(bytes.Buffer)
 	rootfs := tar.NewWriter(buf)
+	redacted := false
 
 	for {
 		var thdr *tar.Header
@@ -526,58 +722,50 @@ func outputKernelImage(image, base, format, outfile string, filesystem io.Reader
 			break
 		}
 		if err != nil {
-			return err
+			return nil, false, err
 		}
 		thdr.Format = tar.FormatPAX
 		switch {
 		case thdr.Name == "boot/kernel":
 			kernel, err := io.ReadAll(tr)
 			if err != nil {
-				return err
+				return nil, false, err
 			}
 			if err := os.WriteFile(base+"-kernel", kernel, os.FileMode(0644)); err != nil {
-				return err
+				return nil, false, err
 			}
 		case thdr.Name == "boot/cmdline":
 			cmdline, err := io.ReadAll(tr)
 			if err != nil {
-				return err
+				return nil, false, err
 			}
 			if err := os.WriteFile(base+"-cmdline", cmdline, os.FileMode(0644)); err != nil {
-				return err
+				return nil, false, err
 			}
 		case strings.HasPrefix(thdr.Name, "boot/"):
 			// skip the rest of boot/
 		default:
+			if thdr.PAXRecords[moby.PaxRecordLinuxkitRedacted] != "" {
+				redacted = true
+			}
 			_ = rootfs.WriteHeader(thdr)
 			if _, err := io.Copy(rootfs, tr); err != nil {
-				return err
+				return nil, false, err
 			}
 		}
 	}
 	_ = rootfs.Close()
-
-	output, err := os.Create(outfile)
-	if err != nil {
-		return err
-	}
-	defer func() { _ = output.Close() }()
-
-	march, err := util.MArch(arch)
-	if err != nil {
-		return err
-	}
-	return dockerRun(buf, output, image, []string{fmt.Sprintf("TARGETARCH=%s", march)})
+	return buf, redacted, nil
 }
 
-func outputKernelSquashFS(image, base string, filesystem io.Reader, arch string) error {
-	return outputKernelImage(image, base, "squashfs", base+"-squashfs.img", filesystem, arch)
+func outputKernelSquashFS(image, base string, filesystem io.Reader, arch, buildCache string) error {
+	return outputKernelImage(image, base, "squashfs", base+"-squashfs.img", filesystem, arch, buildCache)
 }
 
-func outputKernelEroFS(image, base string, filesystem io.Reader, arch string) error {
-	return outputKernelImage(image, base, "erofs", base+"-erofs.img", filesystem, arch)
+func outputKernelEroFS(image, base string, filesystem io.Reader, arch, buildCache string) error {
+	return outputKernelImage(image, base, "erofs", base+"-erofs.img", filesystem, arch, buildCache)
 }
 
-func outputKernelISO(image, base string, filesystem io.Reader, arch string) error {
-	return outputKernelImage(image, base, "iso", base+".iso", filesystem, arch)
+func outputKernelISO(image, base string, filesystem io.Reader, arch, buildCache string) error {
+	return outputKernelImage(image, base, "iso", base+".iso", filesystem, arch, buildCache)
 }
@@ -0,0 +1,86 @@
+package build
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinFormats(t *testing.T) {
+	images, err := parseOutputImages(imagesBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, f := range builtinFormats {
+		if outFuns[name] == nil {
+			t.Errorf("format %s has no output function", name)
+		}
+		if len(f.suffixes) == 0 {
+			t.Errorf("format %s has no outputs", name)
+		}
+		for _, image := range append(f.images, f.nativeImages...) {
+			if images[image] == "" {
+				t.Errorf("format %s uses %s, which is not in images.yaml", name, image)
+			}
+		}
+		if f.nativeImages != nil && nativeOutFuns[name] == nil {
+			t.Errorf("format %s has native images, but is not written by the native builder", name)
+		}
+	}
+	for name := range outFuns {
+		if _, ok := builtinFormats[name]; !ok {
+			t.Errorf("format %s is not declared", name)
+		}
+	}
+}
+
+func TestOutputFiles(t *testing.T) {
+	defer func(plugins map[string]FormatPlugin) { formatPlugins = plugins }(formatPlugins)
+	formatPlugins = map[string]FormatPlugin{
+		"pxe":  {Name: "pxe", Input: FormatInputKernelInitrd, Output: "{{.Name}}-{{.Arch}}-pxe.tar"},
+		"nbd":  {Name: "nbd", Input: FormatInputFilesystem, Output: "{{.Name}}-nbd.img"},
+		"raw2": {Name: "raw2", Input: FormatInputTar, Output: "{{.Name}}-efi.img"},
+	}
+
+	files, err := OutputFiles("out/linuxkit", "arm64", []string{"kernel+initrd", "kernel+squashfs", "pxe", "nbd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []OutputFile{
+		{Path: "out/linuxkit-kernel", Format: "kernel+initrd"},
+		{Path: "out/linuxkit-initrd.img", Format: "kernel+initrd"},
+		{Path: "out/linuxkit-cmdline", Format: "kernel+initrd"},
+		{Path: "out/linuxkit-squashfs.img", Format: "kernel+squashfs"},
+		{Path: "out/linuxkit-arm64-pxe.tar", Format: "pxe"},
+		{Path: "out/linuxkit-nbd.img", Format: "nbd"},
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected %v, got %v", expected, files)
+	}
+
+	for _, formats := range [][]string{
+		{"iso-bios", "kernel+iso"},
+		{"vhd", "dynamic-vhd"},
+		{"raw-efi", "raw2"},
+		{"tar"},
+		{"unknown"},
+	} {
+		if _, err := OutputFiles("out/linuxkit", "amd64", formats); err == nil {
+			t.Errorf("expected error for %v", formats)
+		}
+	}
+}
+
+func TestValidateFormatsNative(t *testing.T) {
+	if err := ValidateFormats([]string{"kernel+initrd", "raw-efi", "iso-bios"}, t.TempDir(), BuilderNative); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// formats the native builder cannot write are rejected before anything is built
+	err := ValidateFormats([]string{"raw-bios"}, t.TempDir(), BuilderNative)
+	if err == nil || !strings.Contains(err.Error(), "syslinux") {
+		t.Errorf("expected raw-bios to be rejected with the reason, got %v", err)
+	}
+	if err := ValidateFormats([]string{"vmdk"}, t.TempDir(), BuilderNative); err == nil {
+		t.Error("expected error for a format the native builder does not support")
+	}
+}
@@ -3,39 +3,107 @@ package build
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
+	"github.com/containerd/containerd/v2/pkg/reference"
 	"github.com/google/uuid"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 	spdxjson "github.com/spdx/tools-golang/json"
 	"github.com/spdx/tools-golang/spdx"
 	spdxcommon "github.com/spdx/tools-golang/spdx/v2/common"
 	spdxversion "github.com/spdx/tools-golang/spdx/v2/v2_3"
 )
 
+const (
+	// SbomFormatSPDX writes the sbom as SPDX 2.3 json
+	SbomFormatSPDX = "spdx"
+	// SbomFormatCycloneDX writes the sbom as CycloneDX 1.5 json
+	SbomFormatCycloneDX = "cyclonedx"
+
+	// sbomRootID is the SPDX identifier of the package for the whole image
+	sbomRootID = "LinuxKit"
+)
+
 // SbomGenerator handler for generating sbom
 type SbomGenerator struct {
 	filename  string
+	format    string
+	hostFile  string
 	closed    bool
-	sboms     []*spdx.Document
+	images    []*sbomImage
+	files     []sbomFile
 	buildTime time.Time
+	parent    *SbomGenerator
+}
+
+// sbomImage is the image used for a section of the build, such as services[0], and the sboms attached to it
+type sbomImage struct {
+	location string
+	ref      string
+	digest   string
+	sboms    []*spdx.Document
+}
+
+// sbomFile is a file from the files section of the build, which has no sbom of its own
+type sbomFile struct {
+	path   string
+	sha1   string
+	sha256 string
+	// redacted is set for a secret, which has no checksums, as they could be used to guess the contents
+	redacted bool
 }
 
-func NewSbomGenerator(filename string, currentBuildTime bool) (*SbomGenerator, error) {
+// NewSbomGenerator creates a generator that writes an sbom in format to filename in the image and,
+// if hostFile is set, to hostFile.
+func NewSbomGenerator(filename, format, hostFile string, currentBuildTime bool) (*SbomGenerator, error) {
 	if filename == "" {
 		return nil, errors.New("filename must be specified")
 	}
+	if format == "" {
+		format = SbomFormatSPDX
+	}
+	if format != SbomFormatSPDX && format != SbomFormatCycloneDX {
+		return nil, fmt.Errorf("unknown sbom format %s, must be %s or %s", format, SbomFormatSPDX, SbomFormatCycloneDX)
+	}
 	buildTime := defaultModTime
 	if currentBuildTime {
 		buildTime = time.Now()
 	}
-	return &SbomGenerator{filename, false, nil, buildTime}, nil
+	return &SbomGenerator{filename: filename, format: format, hostFile: hostFile, buildTime: buildTime}, nil
+}
+
+// image returns the image for the section at location, adding it if needed
+func (s *SbomGenerator) image(location string) *sbomImage {
+	for _, img := range s.images {
+		if img.location == location {
+			return img
+		}
+	}
+	img := &sbomImage{location: location}
+	s.images = append(s.images, img)
+	return img
+}
+
+// AddImage records the image used for the section at location. The digest may be empty if it is not known.
+func (s *SbomGenerator) AddImage(location, ref, digest string) {
+	img := s.image(location)
+	img.ref, img.digest = ref, digest
 }
 
-func (s *SbomGenerator) Add(prefix string, sbom io.ReadCloser) error {
+// Add adds an sbom attached to the image of the section at location, which is extracted at prefix.
+func (s *SbomGenerator) Add(location, prefix string, sbom io.ReadCloser) error {
 	if s.closed {
 		return fmt.Errorf("sbom generator already closed")
 	}
@@ -56,39 +124,41 @@ func (s *SbomGenerator) Add(prefix string, sbom io.ReadCloser) error {
 		// we should need to add the prefix to each of doc.Packages[i].Files[], but those are pointers,
 		// so they point to the actual file structs we handled above
 	}
-	s.sboms = append(s.sboms, doc)
+	img := s.image(location)
+	img.sboms = append(img.sboms, doc)
+	return nil
+}
+
+// child returns a generator for the sboms of one part of a build that is done concurrently with others,
+// which are added to s by merge, so that they are in the same order however the build is scheduled
+func (s *SbomGenerator) child() *SbomGenerator {
+	return &SbomGenerator{filename: s.filename, format: s.format, buildTime: s.buildTime, parent: s}
+}
+
+// merge adds the sboms of a child generator to its parent
+func (s *SbomGenerator) merge() error {
+	if s.parent.closed {
+		return fmt.Errorf("sbom generator already closed")
+	}
+	s.parent.images = append(s.parent.images, s.images...)
+	s.parent.files = append(s.parent.files, s.files...)
 	return nil
 }
 
 // Close finalize generation of the sbom, including merging any together and writing the output file to a tar stream,
 // and cleaning up any temporary files.
 func (s *SbomGenerator) Close(tw *tar.Writer) error {
-	// merge all of the sboms together
-	doc := spdx.Document{
-		SPDXVersion:       spdxversion.Version,
-		DataLicense:       spdxversion.DataLicense,
-		DocumentName:      "sbom",
-		DocumentNamespace: fmt.Sprintf("https://github.com/linuxkit/linuxkit/sbom-%s", uuid.New().String()),
-		CreationInfo: &spdx.CreationInfo{
-			LicenseListVersion: "3.20",
-			Creators: []spdxcommon.Creator{
-				{CreatorType: "Organization", Creator: "LinuxKit"},
-				{CreatorType: "Tool", Creator: "linuxkit"},
-			},
-			Created: s.buildTime.UTC().Format("2006-01-02T15:04:05Z"),
-		},
-		SPDXIdentifier: spdxcommon.ElementID("DOCUMENT"),
-	}
-	for _, sbom := range s.sboms {
-		doc.Packages = append(doc.Packages, sbom.Packages...)
-		doc.Files = append(doc.Files, sbom.Files...)
-		doc.OtherLicenses = append(doc.OtherLicenses, sbom.OtherLicenses...)
-		doc.Relationships = append(doc.Relationships, sbom.Relationships...)
-		doc.Annotations = append(doc.Annotations, sbom.Annotations...)
-		doc.ExternalDocumentReferences = append(doc.ExternalDocumentReferences, sbom.ExternalDocumentReferences...)
+	var (
+		b   []byte
+		err error
+	)
+	switch s.format {
+	case SbomFormatCycloneDX:
+		b, err = s.cycloneDX()
+	default:
+		b, err = s.spdx()
 	}
-	var buf bytes.Buffer
-	if err := spdxjson.Write(&doc, &buf); err != nil {
+	if err != nil {
 		return err
 	}
 	// create
@@ -100,14 +170,264 @@ func (s *SbomGenerator) Close(tw *tar.Writer) error {
 		Uid:      int(0),
 		Gid:      int(0),
 		Format:   tar.FormatPAX,
-		Size:     int64(buf.Len()),
+		Size:     int64(len(b)),
 	}
 	if err := tw.WriteHeader(hdr); err != nil {
 		return err
 	}
-	if _, err := io.Copy(tw, &buf); err != nil && err != io.EOF {
+	if _, err := tw.Write(b); err != nil {
 		return fmt.Errorf("failed to write sbom: %v", err)
 	}
+	if s.hostFile != "" {
+		if err := os.WriteFile(s.hostFile, b, 0o644); err != nil {
+			return fmt.Errorf("failed to write sbom: %v", err)
+		}
+	}
 	s.closed = true
 	return nil
 }
+
+var spdxIDInvalid = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// spdxID returns the SPDX identifier for a part of the build, such as services[0]
+func spdxID(parts ...string) spdxcommon.ElementID {
+	id := sbomRootID
+	for _, p := range parts {
+		id += "-" + strings.Trim(spdxIDInvalid.ReplaceAllString(p, "-"), "-")
+	}
+	return spdxcommon.ElementID(id)
+}
+
+func spdxRelationship(a, b spdxcommon.ElementID, relationship string) *spdx.Relationship {
+	return &spdx.Relationship{
+		RefA:         spdxcommon.MakeDocElementID("", string(a)),
+		RefB:         spdxcommon.MakeDocElementID("", string(b)),
+		Relationship: relationship,
+	}
+}
+
+// spdx returns the sbom as an SPDX document. The document describes a package for the whole image, which
+// contains a package for the image of each section of the build, which in turn contains the packages from
+// the sboms attached to that image, and the files from the files section.
+func (s *SbomGenerator) spdx() ([]byte, error) {
+	doc := spdx.Document{
+		SPDXVersion:  spdxversion.Version,
+		DataLicense:  spdxversion.DataLicense,
+		DocumentName: "sbom",
+		CreationInfo: &spdx.CreationInfo{
+			LicenseListVersion: "3.20",
+			Creators: []spdxcommon.Creator{
+				{CreatorType: "Organization", Creator: "LinuxKit"},
+				{CreatorType: "Tool", Creator: "linuxkit"},
+			},
+			Created: s.buildTime.UTC().Format("2006-01-02T15:04:05Z"),
+		},
+		SPDXIdentifier: spdxcommon.ElementID("DOCUMENT"),
+	}
+	doc.Packages = append(doc.Packages, &spdx.Package{
+		PackageName:             "linuxkit",
+		PackageSPDXIdentifier:   sbomRootID,
+		PackageDownloadLocation: "NOASSERTION",
+		PrimaryPackagePurpose:   "OPERATING-SYSTEM",
+	})
+	doc.Relationships = append(doc.Relationships, spdxRelationship("DOCUMENT", sbomRootID, "DESCRIBES"))
+
+	for _, img := range s.images {
+		id := spdxID(img.location)
+		pkg := &spdx.Package{
+			PackageName:             img.ref,
+			PackageSPDXIdentifier:   id,
+			PackageDownloadLocation: "NOASSERTION",
+			PrimaryPackagePurpose:   "CONTAINER",
+			PackageComment:          "linuxkit " + img.location,
+		}
+		if img.digest != "" {
+			pkg.PackageVersion = img.digest
+			pkg.PackageChecksums = []spdxcommon.Checksum{{Algorithm: spdxcommon.SHA256, Value: strings.TrimPrefix(img.digest, "sha256:")}}
+			pkg.PackageExternalReferences = []*spdx.PackageExternalReference{{Category: "PACKAGE-MANAGER", RefType: "purl", Locator: ociPurl(img.ref, img.digest)}}
+		}
+		doc.Packages = append(doc.Packages, pkg)
+		doc.Relationships = append(doc.Relationships, spdxRelationship(sbomRootID, id, "CONTAINS"))
+
+		for n, sbom := range img.sboms {
+			// SPDX identifiers are only unique within the sbom of one image
+			prefix := string(id)
+			if len(img.sboms) > 1 {
+				prefix = string(spdxID(img.location, fmt.Sprint(n)))
+			}
+			sbom = prefixSpdxIDs(sbom, prefix)
+			for _, p := range sbom.Packages {
+				doc.Relationships = append(doc.Relationships, spdxRelationship(id, p.PackageSPDXIdentifier, "CONTAINS"))
+			}
+			doc.Packages = append(doc.Packages, sbom.Packages...)
+			doc.Files = append(doc.Files, sbom.Files...)
+			doc.Snippets = append(doc.Snippets, sbom.Snippets...)
+			doc.OtherLicenses = append(doc.OtherLicenses, sbom.OtherLicenses...)
+			doc.Relationships = append(doc.Relationships, sbom.Relationships...)
+			doc.Annotations = append(doc.Annotations, sbom.Annotations...)
+			doc.ExternalDocumentReferences = append(doc.ExternalDocumentReferences, sbom.ExternalDocumentReferences...)
+		}
+	}
+
+	for i, f := range s.files {
+		id := spdxID("files", fmt.Sprint(i))
+		file := &spdx.File{
+			FileName:           f.path,
+			FileSPDXIdentifier: id,
+			LicenseConcluded:   "NOASSERTION",
+			FileCopyrightText:  "NOASSERTION",
+		}
+		if f.redacted {
+			file.FileComment = "redacted: the contents are a secret"
+		} else {
+			file.Checksums = []spdxcommon.Checksum{
+				{Algorithm: spdxcommon.SHA1, Value: f.sha1},
+				{Algorithm: spdxcommon.SHA256, Value: f.sha256},
+			}
+		}
+		doc.Files = append(doc.Files, file)
+		doc.Relationships = append(doc.Relationships, spdxRelationship(sbomRootID, id, "CONTAINS"))
+	}
+
+	// the namespace must be unique to this document, so derive it from the contents, rather than
+	// a random uuid, so that the same inputs always give the same sbom
+	var buf bytes.Buffer
+	if err := spdxjson.Write(&doc, &buf); err != nil {
+		return nil, err
+	}
+	doc.DocumentNamespace = fmt.Sprintf("https://github.com/linuxkit/linuxkit/sbom-%s", uuid.NewSHA1(uuid.NameSpaceURL, buf.Bytes()).String())
+	buf.Reset()
+	if err := spdxjson.Write(&doc, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// prefixSpdxIDs returns a copy of the packages, files, snippets, relationships and annotations of the sbom of
+// an image, with their SPDX identifiers prefixed with prefix, so that they are unique in the sbom of the build.
+// The relationships of the sbom document itself are left out, as the image contains its packages instead.
+func prefixSpdxIDs(sbom *spdx.Document, prefix string) *spdx.Document {
+	rename := func(id spdxcommon.ElementID) spdxcommon.ElementID {
+		return spdxcommon.ElementID(prefix + "-" + string(id))
+	}
+	renameRef := func(ref spdxcommon.DocElementID) spdxcommon.DocElementID {
+		// references to other documents, and NONE and NOASSERTION, are left as they are
+		if ref.DocumentRefID == "" && ref.SpecialID == "" {
+			ref.ElementRefID = rename(ref.ElementRefID)
+		}
+		return ref
+	}
+	isDocument := func(ref spdxcommon.DocElementID) bool {
+		return ref.DocumentRefID == "" && ref.SpecialID == "" && ref.ElementRefID == sbom.SPDXIdentifier
+	}
+	renameFile := func(f *spdx.File) *spdx.File {
+		file := *f
+		file.FileSPDXIdentifier = rename(f.FileSPDXIdentifier)
+		return &file
+	}
+	out := &spdx.Document{
+		OtherLicenses:              sbom.OtherLicenses,
+		ExternalDocumentReferences: sbom.ExternalDocumentReferences,
+	}
+	for _, p := range sbom.Packages {
+		pkg := *p
+		pkg.PackageSPDXIdentifier = rename(p.PackageSPDXIdentifier)
+		pkg.Files = nil
+		for _, f := range p.Files {
+			pkg.Files = append(pkg.Files, renameFile(f))
+		}
+		out.Packages = append(out.Packages, &pkg)
+	}
+	for _, f := range sbom.Files {
+		out.Files = append(out.Files, renameFile(f))
+	}
+	for _, s := range sbom.Snippets {
+		s.SnippetSPDXIdentifier = rename(s.SnippetSPDXIdentifier)
+		s.SnippetFromFileSPDXIdentifier = rename(s.SnippetFromFileSPDXIdentifier)
+		out.Snippets = append(out.Snippets, s)
+	}
+	for _, r := range sbom.Relationships {
+		if isDocument(r.RefA) || isDocument(r.RefB) {
+			continue
+		}
+		rel := *r
+		rel.RefA = renameRef(r.RefA)
+		rel.RefB = renameRef(r.RefB)
+		out.Relationships = append(out.Relationships, &rel)
+	}
+	for _, a := range sbom.Annotations {
+		annotation := *a
+		annotation.AnnotationSPDXIdentifier = renameRef(a.AnnotationSPDXIdentifier)
+		out.Annotations = append(out.Annotations, &annotation)
+	}
+	return out
+}
+
+// ociPurl returns the package URL of an image with a digest
+func ociPurl(ref, digest string) string {
+	spec, err := reference.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	purl := fmt.Sprintf("pkg:oci/%s@%s?repository_url=%s", strings.ToLower(filepath.Base(spec.Locator)), strings.Replace(digest, ":", "%3A", 1), spec.Locator)
+	if tag, _, _ := strings.Cut(spec.Object, "@"); tag != "" {
+		purl += "&tag=" + tag
+	}
+	return purl
+}
+
+// addSbomImage records the image of the section at location in the sbom, if one is being generated
+func addSbomImage(location string, ref *reference.Spec, platforms []imagespec.Platform, opts BuildOpts) error {
+	if opts.SbomGenerator == nil || ref == nil {
+		return nil
+	}
+	digest, err := imageDigest(ref, opts, platforms)
+	if err != nil {
+		return err
+	}
+	opts.SbomGenerator.AddImage(location, ref.String(), digest)
+	return nil
+}
+
+// sbomFiles is a tarWriter that records the regular files written to it in the sbom
+type sbomFiles struct {
+	tarWriter
+	s      *SbomGenerator
+	name   string
+	sha1   hash.Hash
+	sha256 hash.Hash
+}
+
+func newSbomFiles(tw tarWriter, s *SbomGenerator) *sbomFiles {
+	return &sbomFiles{tarWriter: tw, s: s}
+}
+
+func (f *sbomFiles) WriteHeader(hdr *tar.Header) error {
+	f.finish()
+	if f.s != nil && hdr.FileInfo().Mode().IsRegular() {
+		if hdr.PAXRecords[moby.PaxRecordLinuxkitRedacted] != "" {
+			f.s.files = append(f.s.files, sbomFile{path: hdr.Name, redacted: true})
+		} else {
+			f.name, f.sha1, f.sha256 = hdr.Name, sha1.New(), sha256.New()
+		}
+	}
+	return f.tarWriter.WriteHeader(hdr)
+}
+
+func (f *sbomFiles) Write(b []byte) (int, error) {
+	n, err := f.tarWriter.Write(b)
+	if f.sha1 != nil {
+		_, _ = f.sha1.Write(b[:n])
+		_, _ = f.sha256.Write(b[:n])
+	}
+	return n, err
+}
+
+// finish records the last file written
+func (f *sbomFiles) finish() {
+	if f.sha1 == nil {
+		return
+	}
+	f.s.files = append(f.s.files, sbomFile{path: f.name, sha1: hex.EncodeToString(f.sha1.Sum(nil)), sha256: hex.EncodeToString(f.sha256.Sum(nil))})
+	f.sha1, f.sha256 = nil, nil
+}
@@ -0,0 +1,254 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	spdxjson "github.com/spdx/tools-golang/json"
+)
+
+const testImageSbom = `{
+	"spdxVersion": "SPDX-2.3",
+	"dataLicense": "CC0-1.0",
+	"SPDXID": "SPDXRef-DOCUMENT",
+	"name": "sshd",
+	"documentNamespace": "https://example.com/sshd",
+	"creationInfo": {"created": "2023-01-01T00:00:00Z", "creators": ["Tool: test"]},
+	"packages": [{
+		"name": "openssh",
+		"SPDXID": "SPDXRef-Package-openssh",
+		"versionInfo": "9.3",
+		"downloadLocation": "NOASSERTION",
+		"licenseConcluded": "BSD-2-Clause",
+		"externalRefs": [{"referenceCategory": "PACKAGE-MANAGER", "referenceType": "purl", "referenceLocator": "pkg:apk/alpine/openssh@9.3"}]
+	}]
+}`
+
+// testSbom builds an image with files, with sboms for a service added by a child generator, and returns the sbom
+func testSbom(t *testing.T, format string) []byte {
+	t.Helper()
+	MobyDir = t.TempDir()
+	hostFile := filepath.Join(t.TempDir(), "sbom.json")
+	s, err := NewSbomGenerator("sbom", format, hostFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.child()
+	c.AddImage("services[0]", "docker.io/linuxkit/sshd:v1.0", "sha256:0123456789abcdef")
+	if err := c.Add("services[0]", "containers/services/sshd/lower/", io.NopCloser(strings.NewReader(testImageSbom))); err != nil {
+		t.Fatal(err)
+	}
+	s.AddImage("init[0]", "docker.io/linuxkit/init:v1.0", "")
+	if err := c.merge(); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := "contents"
+	m := moby.Moby{Files: []moby.File{{Path: "etc/contents", Contents: &contents}}}
+	var buf bytes.Buffer
+	if err := Build(m, &buf, BuildOpts{SbomGenerator: s}); err != nil {
+		t.Fatal(err)
+	}
+	var sbom []byte
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == "sbom" {
+			if sbom, err = io.ReadAll(tr); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	onHost, err := os.ReadFile(hostFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sbom, onHost) {
+		t.Fatal("sbom on the host differs from the one in the image")
+	}
+	return sbom
+}
+
+func TestSbomSPDX(t *testing.T) {
+	doc, err := spdxjson.Read(bytes.NewReader(testSbom(t, SbomFormatSPDX)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range doc.Packages {
+		names = append(names, p.PackageName)
+	}
+	if strings.Join(names, ",") != "linuxkit,docker.io/linuxkit/init:v1.0,docker.io/linuxkit/sshd:v1.0,openssh" {
+		t.Errorf("unexpected packages %v", names)
+	}
+	if purl := doc.Packages[2].PackageExternalReferences[0].Locator; purl != "pkg:oci/sshd@sha256%3A0123456789abcdef?repository_url=docker.io/linuxkit/sshd&tag=v1.0" {
+		t.Errorf("unexpected purl %s", purl)
+	}
+	if len(doc.Files) != 1 || doc.Files[0].FileName != "etc/contents" {
+		t.Fatalf("unexpected files %v", doc.Files)
+	}
+	relationships := map[string]bool{}
+	for _, r := range doc.Relationships {
+		relationships[string(r.RefA.ElementRefID)+" "+r.Relationship+" "+string(r.RefB.ElementRefID)] = true
+	}
+	for _, r := range []string{
+		"DOCUMENT DESCRIBES LinuxKit",
+		"LinuxKit CONTAINS LinuxKit-init-0",
+		"LinuxKit CONTAINS LinuxKit-services-0",
+		"LinuxKit-services-0 CONTAINS LinuxKit-services-0-Package-openssh",
+		"LinuxKit CONTAINS LinuxKit-files-0",
+	} {
+		if !relationships[r] {
+			t.Errorf("missing relationship %s", r)
+		}
+	}
+}
+
+func TestSbomSPDXUniqueIDs(t *testing.T) {
+	const imageSbom = `{
+	"spdxVersion": "SPDX-2.3",
+	"dataLicense": "CC0-1.0",
+	"SPDXID": "SPDXRef-DOCUMENT",
+	"name": "sshd",
+	"documentNamespace": "https://example.com/sshd",
+	"creationInfo": {"created": "2023-01-01T00:00:00Z", "creators": ["Tool: test"]},
+	"documentDescribes": ["SPDXRef-Package-openssh"],
+	"packages": [{"name": "openssh", "SPDXID": "SPDXRef-Package-openssh", "downloadLocation": "NOASSERTION", "hasFiles": ["SPDXRef-File-sshd"]}],
+	"files": [{"fileName": "usr/sbin/sshd", "SPDXID": "SPDXRef-File-sshd", "checksums": [{"algorithm": "SHA1", "checksumValue": "0123456789abcdef0123456789abcdef01234567"}]}]
+}`
+	s, err := NewSbomGenerator("sbom", SbomFormatSPDX, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, location := range []string{"services[0]", "services[1]"} {
+		s.AddImage(location, "docker.io/linuxkit/sshd:v1.0", "")
+		if err := s.Add(location, "containers/services/"+location+"/lower/", io.NopCloser(strings.NewReader(imageSbom))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := s.spdx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := spdxjson.Read(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]bool{"DOCUMENT": true}
+	for _, p := range doc.Packages {
+		if ids[string(p.PackageSPDXIdentifier)] {
+			t.Errorf("duplicate SPDX identifier %s", p.PackageSPDXIdentifier)
+		}
+		ids[string(p.PackageSPDXIdentifier)] = true
+	}
+	for _, f := range doc.Files {
+		if ids[string(f.FileSPDXIdentifier)] {
+			t.Errorf("duplicate SPDX identifier %s", f.FileSPDXIdentifier)
+		}
+		ids[string(f.FileSPDXIdentifier)] = true
+	}
+	relationships := map[string]bool{}
+	for _, r := range doc.Relationships {
+		if !ids[string(r.RefA.ElementRefID)] || !ids[string(r.RefB.ElementRefID)] {
+			t.Errorf("relationship to an unknown element: %s %s %s", r.RefA.ElementRefID, r.Relationship, r.RefB.ElementRefID)
+		}
+		relationships[string(r.RefA.ElementRefID)+" "+r.Relationship+" "+string(r.RefB.ElementRefID)] = true
+	}
+	for _, r := range []string{
+		"DOCUMENT DESCRIBES LinuxKit",
+		"LinuxKit-services-0 CONTAINS LinuxKit-services-0-Package-openssh",
+		"LinuxKit-services-1 CONTAINS LinuxKit-services-1-Package-openssh",
+		"LinuxKit-services-0-Package-openssh CONTAINS LinuxKit-services-0-File-sshd",
+		"LinuxKit-services-1-Package-openssh CONTAINS LinuxKit-services-1-File-sshd",
+	} {
+		if !relationships[r] {
+			t.Errorf("missing relationship %s", r)
+		}
+	}
+	if relationships["DOCUMENT DESCRIBES LinuxKit-services-0-Package-openssh"] || relationships["DOCUMENT DESCRIBES Package-openssh"] {
+		t.Error("the sbom describes a package of an image")
+	}
+}
+
+func TestSbomCycloneDXUniqueRefs(t *testing.T) {
+	const imageSbom = `{
+	"spdxVersion": "SPDX-2.3",
+	"dataLicense": "CC0-1.0",
+	"SPDXID": "SPDXRef-DOCUMENT",
+	"name": "sshd",
+	"documentNamespace": "https://example.com/sshd",
+	"creationInfo": {"created": "2023-01-01T00:00:00Z", "creators": ["Tool: test"]},
+	"packages": [{"name": "openssh", "SPDXID": "SPDXRef-Package-openssh", "downloadLocation": "NOASSERTION"}]
+}`
+	s, err := NewSbomGenerator("sbom", SbomFormatCycloneDX, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one image with an sbom in each of two layers
+	s.AddImage("services[0]", "docker.io/linuxkit/sshd:v1.0", "")
+	for _, layer := range []string{"lower", "upper"} {
+		if err := s.Add("services[0]", "containers/services/sshd/"+layer+"/", io.NopCloser(strings.NewReader(imageSbom))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := s.cycloneDX()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bom cdxBOM
+	if err := json.Unmarshal(b, &bom); err != nil {
+		t.Fatal(err)
+	}
+	refs := map[string]bool{}
+	for _, c := range bom.Components {
+		for _, pc := range append([]*cdxComponent{c}, c.Components...) {
+			if refs[pc.BOMRef] {
+				t.Errorf("duplicate bom-ref %s", pc.BOMRef)
+			}
+			refs[pc.BOMRef] = true
+		}
+	}
+	if len(refs) != 3 {
+		t.Errorf("expected 3 bom-refs, found %v", refs)
+	}
+}
+
+func TestSbomCycloneDX(t *testing.T) {
+	var bom cdxBOM
+	if err := json.Unmarshal(testSbom(t, SbomFormatCycloneDX), &bom); err != nil {
+		t.Fatal(err)
+	}
+	if len(bom.Components) != 3 {
+		t.Fatalf("expected 3 components, found %d", len(bom.Components))
+	}
+	sshd := bom.Components[1]
+	if sshd.Type != "container" || sshd.Properties[0].Value != "services[0]" || len(sshd.Components) != 1 {
+		t.Fatalf("unexpected service component %+v", sshd)
+	}
+	openssh := sshd.Components[0]
+	if openssh.PURL != "pkg:apk/alpine/openssh@9.3" || openssh.Licenses[0].Expression != "BSD-2-Clause" {
+		t.Errorf("unexpected package component %+v", openssh)
+	}
+	if file := bom.Components[2]; file.Type != "file" || file.Name != "etc/contents" || len(file.Hashes) != 2 {
+		t.Errorf("unexpected file component %+v", file)
+	}
+	if len(bom.Dependencies) != 3 || len(bom.Dependencies[0].DependsOn) != 3 || bom.Dependencies[2].DependsOn[0] != openssh.BOMRef {
+		t.Errorf("unexpected dependencies %+v", bom.Dependencies)
+	}
+	if !strings.HasPrefix(bom.SerialNumber, "urn:uuid:") {
+		t.Errorf("unexpected serial number %s", bom.SerialNumber)
+	}
+}
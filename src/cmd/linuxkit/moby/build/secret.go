@@ -0,0 +1,108 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+)
+
+// Secrets are encrypted in the age format, https://age-encryption.org/v1, to X25519 recipients,
+// so they can be created with the age tools or any compatible implementation.
+
+// SecretIdentity is an age X25519 identity used to decrypt the secrets in the files section
+type SecretIdentity struct {
+	id *age.X25519Identity
+}
+
+// ParseSecretIdentities reads age X25519 identities, one per line, as written by age-keygen,
+// ignoring blank lines and comments
+func ParseSecretIdentities(r io.Reader) ([]*SecretIdentity, error) {
+	var ids []*SecretIdentity
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, err := age.ParseX25519Identity(line)
+		if err != nil {
+			// never include the line, as it is a private key
+			return nil, fmt.Errorf("invalid secret key on line %d: %v", n, err)
+		}
+		ids = append(ids, &SecretIdentity{id: id})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("no secret keys found")
+	}
+	return ids, nil
+}
+
+// Unwrap implements age.Identity. Each recipient stanza is tried on its own, so that one that cannot be
+// unwrapped, even if it is malformed, is taken to be for another recipient rather than failing the decryption.
+func (i *SecretIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	for _, s := range stanzas {
+		if fileKey, err := i.id.Unwrap([]*age.Stanza{s}); err == nil {
+			return fileKey, nil
+		}
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+// secretContents returns the encrypted contents of the secret of a file, which is either an
+// armored age file inline, or the path to an age file, armored or not
+func secretContents(secret string) ([]byte, error) {
+	if isInlineSecret(secret) {
+		return []byte(secret), nil
+	}
+	return os.ReadFile(expandSource(secret))
+}
+
+// isInlineSecret returns true if the secret of a file is an armored age file rather than a path
+func isInlineSecret(secret string) bool {
+	return strings.HasPrefix(strings.TrimSpace(secret), armor.Header)
+}
+
+// decryptSecret decrypts the secret of the file at path with the first identity it was encrypted to.
+// Errors never include any of the plaintext.
+func decryptSecret(path string, f moby.File, ids []*SecretIdentity) ([]byte, error) {
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("file %s is a secret, but no secret key was provided", path)
+	}
+	encrypted, err := secretContents(f.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read secret for file %s: %v", path, err)
+	}
+	plaintext, err := ageDecrypt(encrypted, ids)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt secret for file %s: %v", path, err)
+	}
+	return plaintext, nil
+}
+
+// ageDecrypt decrypts an age file, which may be armored
+func ageDecrypt(b []byte, ids []*SecretIdentity) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(b)
+	if trimmed := bytes.TrimSpace(b); bytes.HasPrefix(trimmed, []byte(armor.Header)) {
+		r = armor.NewReader(bytes.NewReader(trimmed))
+	}
+	identities := make([]age.Identity, len(ids))
+	for i, id := range ids {
+		identities[i] = id
+	}
+	plaintext, err := age.Decrypt(r, identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(plaintext)
+}
@@ -0,0 +1,215 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+)
+
+// testSecretKey returns a new age identity, as written by age-keygen, and the identity parsed from it
+func testSecretKey(t *testing.T) (string, *SecretIdentity) {
+	t.Helper()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := id.String()
+	ids, err := ParseSecretIdentities(strings.NewReader("# created: today\n" + key + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, ids[0]
+}
+
+// testEncrypt encrypts plaintext to the recipient of id in the age format
+func testEncrypt(t *testing.T, plaintext []byte, id *SecretIdentity, armored bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var dst io.WriteCloser = nopWriteCloser{&buf}
+	if armored {
+		dst = armor.NewWriter(&buf)
+	}
+	w, err := age.Encrypt(dst, id.id.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestSecretDecrypt(t *testing.T) {
+	_, id := testSecretKey(t)
+	_, other := testSecretKey(t)
+	large := bytes.Repeat([]byte("0123456789abcdef"), 64*1024/8)
+	for _, plaintext := range [][]byte{[]byte("password"), large} {
+		for _, armored := range []bool{false, true} {
+			encrypted := testEncrypt(t, plaintext, id, armored)
+			decrypted, err := ageDecrypt(encrypted, []*SecretIdentity{other, id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Errorf("decrypted contents differ for %d bytes, armored %v", len(plaintext), armored)
+			}
+			if _, err := ageDecrypt(encrypted, []*SecretIdentity{other}); err == nil {
+				t.Error("expected error for the wrong key")
+			}
+		}
+	}
+
+	encrypted := testEncrypt(t, []byte("password"), id, false)
+	encrypted[len(encrypted)-1] ^= 1
+	if _, err := ageDecrypt(encrypted, []*SecretIdentity{id}); err == nil {
+		t.Error("expected error for corrupt payload")
+	}
+}
+
+// TestSecretDecryptAge decrypts files made by the age tools: key.txt by age-keygen, password.age by
+// age -r, password.armored.age by age -a to another recipient and key.txt, and other.age to another recipient
+func TestSecretDecryptAge(t *testing.T) {
+	f, err := os.Open("testdata/secret/key.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ids, err := ParseSecretIdentities(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"password.age", "password.armored.age"} {
+		b, err := os.ReadFile(filepath.Join("testdata/secret", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := ageDecrypt(b, ids)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(plaintext) != "password" {
+			t.Errorf("%s: unexpected contents %q", name, plaintext)
+		}
+	}
+	b, err := os.ReadFile("testdata/secret/other.age")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ageDecrypt(b, ids); err == nil {
+		t.Error("expected error for a file encrypted to another recipient")
+	}
+}
+
+func TestSecretIdentityUnwrap(t *testing.T) {
+	_, id := testSecretKey(t)
+	fileKey := []byte("0123456789abcdef")
+	stanzas, err := id.id.Recipient().Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a malformed stanza is taken to be for another recipient
+	malformed := &age.Stanza{Type: "X25519", Args: []string{"malformed"}}
+	unwrapped, err := id.Unwrap(append([]*age.Stanza{malformed}, stanzas...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, fileKey) {
+		t.Error("unexpected file key")
+	}
+	if _, err := id.Unwrap([]*age.Stanza{malformed}); err != age.ErrIncorrectIdentity {
+		t.Errorf("expected incorrect identity, got %v", err)
+	}
+}
+
+func TestFilesSecret(t *testing.T) {
+	key, id := testSecretKey(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "token.age"), testEncrypt(t, []byte("token"), id, false), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := moby.Moby{Files: []moby.File{
+		{Path: "etc/token", Secret: filepath.Join(dir, "token.age")},
+		{Path: "etc/password", Secret: string(testEncrypt(t, []byte("password"), id, true))},
+	}}
+
+	var buf bytes.Buffer
+	ids, err := ParseSecretIdentities(strings.NewReader(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSbomGenerator("sbom", SbomFormatSPDX, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw := newSbomFiles(tar.NewWriter(&buf), s)
+	if err := filesystem(m, sw, nil, BuildOpts{SecretIdentities: ids}); err != nil {
+		t.Fatal(err)
+	}
+	sw.finish()
+	tarball := buf.Bytes()
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		b, _ := io.ReadAll(tr)
+		if hdr.Name != "etc/"+string(b) {
+			t.Errorf("unexpected contents %q for %s", b, hdr.Name)
+		}
+		if hdr.PAXRecords[moby.PaxRecordLinuxkitRedacted] == "" || hdr.Mode != 0600 {
+			t.Errorf("unexpected header for %s: %+v", hdr.Name, hdr)
+		}
+	}
+	if len(s.files) != 2 {
+		t.Fatalf("expected 2 files in the sbom, found %d", len(s.files))
+	}
+	for _, f := range s.files {
+		if !f.redacted || f.sha256 != "" {
+			t.Errorf("secret %s is not redacted in the sbom", f.path)
+		}
+	}
+
+	manifest, err := ResolveManifest(moby.Moby{Files: m.Files}, BuildOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 2 || !manifest.Files[0].Redacted || manifest.Files[1].Source != "inline" {
+		t.Errorf("unexpected manifest files %+v", manifest.Files)
+	}
+
+	// a root filesystem containing a secret is not stored in the build cache
+	if _, redacted, err := splitKernel(filepath.Join(dir, "image"), bytes.NewReader(tarball)); err != nil || !redacted {
+		t.Errorf("expected the root filesystem to be redacted, got %v, %v", redacted, err)
+	}
+
+	if err := filesystem(m, tar.NewWriter(io.Discard), nil, BuildOpts{}); err == nil {
+		t.Error("expected error without a key")
+	}
+}
@@ -5,45 +5,27 @@ import (
 	"strings"
 
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	"github.com/opencontainers/runtime-spec/specs-go"
 )
 
 func updateMountsAndBindsFromVolumes(image *moby.Image, m moby.Moby) (*moby.Image, error) {
 	// clean image to send back
 	img := *image
 	if img.Mounts != nil {
-		for i, mount := range *img.Mounts {
-			// only care about type bind
-			if mount.Type != "bind" {
-				continue
-			}
-			// starts with / = not a volume
-			if strings.HasPrefix(mount.Source, "/") {
-				continue
-			}
-			vol := m.VolByName(mount.Source)
-			if vol == nil {
-				return nil, fmt.Errorf("volume %s not found in onboot image mount %d", mount.Source, i)
-			}
-			merged := vol.MergedDir()
-			// make sure it is not read-write if the underlying volume is read-only
-			if vol.ReadOnly {
-				var foundReadOnly bool
-				for _, opt := range mount.Options {
-					if opt == "rw" {
-						foundReadOnly = false
-						break
-					}
-					if opt == "ro" {
-						foundReadOnly = true
-						break
-					}
-				}
-				if !foundReadOnly {
-					return nil, fmt.Errorf("volume %s is read-only, but attempting to write into container read-write", mount.Source)
-				}
-			}
-			mount.Source = merged
+		mounts, err := mountsFromVolumes(*img.Mounts, image, m)
+		if err != nil {
+			return nil, err
+		}
+		img.Mounts = &mounts
+	}
+	if img.Runtime != nil && img.Runtime.Mounts != nil {
+		mounts, err := mountsFromVolumes(*img.Runtime.Mounts, image, m)
+		if err != nil {
+			return nil, err
 		}
+		runtime := *img.Runtime
+		runtime.Mounts = &mounts
+		img.Runtime = &runtime
 	}
 	if img.Binds != nil {
 		var newBinds []string
@@ -61,10 +43,8 @@ func updateMountsAndBindsFromVolumes(image *moby.Image, m moby.Moby) (*moby.Imag
 				return nil, fmt.Errorf("volume %s not found in onboot image bin %d", source, i)
 			}
 			merged := vol.MergedDir()
-			if vol.ReadOnly {
-				if len(parts) < 3 || parts[2] != "ro" {
-					return nil, fmt.Errorf("volume %s is read-only, but attempting to write into container read-write", source)
-				}
+			if err := checkVolumeAccess(vol, image, len(parts) >= 3 && readOnlyOptions(strings.Split(parts[2], ","))); err != nil {
+				return nil, err
 			}
 			parts[0] = merged
 			newBinds = append(newBinds, strings.Join(parts, ":"))
@@ -87,10 +67,8 @@ func updateMountsAndBindsFromVolumes(image *moby.Image, m moby.Moby) (*moby.Imag
 				return nil, fmt.Errorf("volume %s not found in onboot image bin %d", parts[0], i)
 			}
 			merged := vol.MergedDir()
-			if vol.ReadOnly {
-				if len(parts) < 3 || parts[2] != "ro" {
-					return nil, fmt.Errorf("volume %s is read-only, but attempting to write into container read-write", source)
-				}
+			if err := checkVolumeAccess(vol, image, len(parts) >= 3 && readOnlyOptions(strings.Split(parts[2], ","))); err != nil {
+				return nil, err
 			}
 			parts[0] = merged
 			newBinds = append(newBinds, strings.Join(parts, ":"))
@@ -100,3 +78,138 @@ func updateMountsAndBindsFromVolumes(image *moby.Image, m moby.Moby) (*moby.Imag
 
 	return &img, nil
 }
+
+// mountsFromVolumes returns a copy of the mounts of image with the source of any bind mount of a volume replaced by the volume path
+func mountsFromVolumes(mounts []specs.Mount, image *moby.Image, m moby.Moby) ([]specs.Mount, error) {
+	var newMounts []specs.Mount
+	for i, mount := range mounts {
+		// only care about type bind; starts with / = not a volume
+		if mount.Type != "bind" || strings.HasPrefix(mount.Source, "/") {
+			newMounts = append(newMounts, mount)
+			continue
+		}
+		vol := m.VolByName(mount.Source)
+		if vol == nil {
+			return nil, fmt.Errorf("volume %s not found in image mount %d", mount.Source, i)
+		}
+		// make sure it is not read-write if the container may not write to the volume
+		if err := checkVolumeAccess(vol, image, readOnlyOptions(mount.Options)); err != nil {
+			return nil, err
+		}
+		mount.Source = vol.MergedDir()
+		newMounts = append(newMounts, mount)
+	}
+	return newMounts, nil
+}
+
+// readOnlyOptions returns true if the first of ro or rw in the mount options opts is ro
+func readOnlyOptions(opts []string) bool {
+	for _, opt := range opts {
+		if opt == "rw" {
+			return false
+		}
+		if opt == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVolumeAccess returns an error if image mounts vol read-write but may not write to it, as the
+// volume is read-only, or is shared and image is not its producer
+func checkVolumeAccess(vol *moby.Volume, image *moby.Image, readOnly bool) error {
+	switch {
+	case readOnly:
+		return nil
+	case vol.ReadOnly:
+		return fmt.Errorf("volume %s is read-only, but attempting to write into container read-write", vol.Name)
+	case vol.Producer != "" && vol.Producer != image.Name:
+		return fmt.Errorf("volume %s is written by %s, so must be mounted read-only in %s", vol.Name, vol.Producer, image.Name)
+	}
+	return nil
+}
+
+// usesVolume returns true if image binds or mounts the volume called name
+func usesVolume(image *moby.Image, name string) bool {
+	var binds []string
+	if image.Binds != nil {
+		binds = append(binds, *image.Binds...)
+	}
+	if image.BindsAdd != nil {
+		binds = append(binds, *image.BindsAdd...)
+	}
+	for _, bind := range binds {
+		if strings.Split(bind, ":")[0] == name {
+			return true
+		}
+	}
+	var mounts []specs.Mount
+	if image.Mounts != nil {
+		mounts = append(mounts, *image.Mounts...)
+	}
+	if image.Runtime != nil && image.Runtime.Mounts != nil {
+		mounts = append(mounts, *image.Runtime.Mounts...)
+	}
+	for _, mount := range mounts {
+		if mount.Type == "bind" && mount.Source == name {
+			return true
+		}
+	}
+	return false
+}
+
+// volumeConsumers returns the names of the containers in onboot and services, other than its producer,
+// that use a shared volume. If they wait for it to be ready, any in onboot must run after the producer.
+func volumeConsumers(vol *moby.Volume, m moby.Moby) ([]string, error) {
+	// containers are started in order, onboot then services
+	images := append(append([]*moby.Image{}, m.Onboot...), m.Services...)
+	producer := -1
+	for i, image := range images {
+		if image.Name == vol.Producer {
+			producer = i
+			break
+		}
+	}
+	if producer == -1 {
+		return nil, fmt.Errorf("volume %s has producer %s, which is not in onboot or services", vol.Name, vol.Producer)
+	}
+	var consumers []string
+	for i, image := range images {
+		if i == producer || !usesVolume(image, vol.Name) {
+			continue
+		}
+		if vol.Wait && i < producer && i < len(m.Onboot) {
+			return nil, fmt.Errorf("onboot container %s waits for volume %s, but runs before its producer %s", image.Name, vol.Name, vol.Producer)
+		}
+		consumers = append(consumers, image.Name)
+	}
+	return consumers, nil
+}
+
+// volumeConfig returns the configuration of vol for init, or nil if there is nothing to configure
+func volumeConfig(vol *moby.Volume, m moby.Moby, idMap map[string]uint32) (*moby.VolumeConfig, error) {
+	uid, err := moby.IDNumeric(vol.UID, idMap)
+	if err != nil {
+		return nil, fmt.Errorf("volume %s: %v", vol.Name, err)
+	}
+	gid, err := moby.IDNumeric(vol.GID, idMap)
+	if err != nil {
+		return nil, fmt.Errorf("volume %s: %v", vol.Name, err)
+	}
+	config := &moby.VolumeConfig{VolumeBacking: vol.VolumeBacking, UID: uid, GID: gid}
+	if vol.Producer != "" {
+		consumers, err := volumeConsumers(vol, m)
+		if err != nil {
+			return nil, err
+		}
+		// init only needs to know about a shared volume if the consumers wait for it
+		if vol.Wait {
+			config.Producer = vol.Producer
+			config.Consumers = consumers
+		}
+	}
+	if !vol.HasBacking() && uid == 0 && gid == 0 && config.Producer == "" {
+		return nil, nil
+	}
+	return config, nil
+}
@@ -0,0 +1,147 @@
+package build
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestSharedVolume(t *testing.T) {
+	config := func(yml string) moby.Moby {
+		t.Helper()
+		m, err := moby.NewConfig([]byte(yml), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	m := config(`volumes:
+  - name: certs
+    producer: certgen
+    wait: true
+    uid: certgen
+onboot:
+  - name: certgen
+    image: linuxkit/certgen:v1.0
+    binds:
+      - certs:/certs
+services:
+  - name: nginx
+    image: nginx:alpine
+    binds:
+      - certs:/etc/nginx/certs:ro
+  - name: getty
+    image: linuxkit/getty:v1.0
+`)
+	idMap := containerIDs(m)
+	vc, err := volumeConfig(m.VolByName("certs"), m, idMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &moby.VolumeConfig{UID: idMap["certgen"], Producer: "certgen", Consumers: []string{"nginx"}}
+	if !reflect.DeepEqual(vc, expected) {
+		t.Errorf("expected %+v, got %+v", expected, vc)
+	}
+	for _, image := range append(m.Onboot, m.Services...) {
+		if _, err := updateMountsAndBindsFromVolumes(image, m); err != nil {
+			t.Errorf("unexpected error for %s: %v", image.Name, err)
+		}
+	}
+
+	// only the producer may write to the volume
+	rw := config(`volumes:
+  - name: certs
+    producer: certgen
+services:
+  - name: certgen
+    image: linuxkit/certgen:v1.0
+    binds:
+      - certs:/certs
+  - name: nginx
+    image: nginx:alpine
+    binds:
+      - certs:/etc/nginx/certs
+`)
+	if _, err := updateMountsAndBindsFromVolumes(rw.Services[1], rw); err == nil {
+		t.Error("expected error for consumer writing to volume")
+	}
+	// ro can be one of several bind options
+	for _, bind := range []string{"certs:/etc/nginx/certs:rshared,ro", "certs:/etc/nginx/certs:ro,rshared"} {
+		binds := []string{bind}
+		consumer := *rw.Services[1]
+		consumer.Binds = &binds
+		if _, err := updateMountsAndBindsFromVolumes(&consumer, rw); err != nil {
+			t.Errorf("unexpected error for read-only bind %s: %v", bind, err)
+		}
+	}
+
+	// an onboot consumer cannot wait for a service
+	early := config(`volumes:
+  - name: certs
+    producer: certgen
+    wait: true
+onboot:
+  - name: nginx
+    image: nginx:alpine
+    binds:
+      - certs:/etc/nginx/certs:ro
+services:
+  - name: certgen
+    image: linuxkit/certgen:v1.0
+    binds:
+      - certs:/certs
+`)
+	if _, err := volumeConfig(early.VolByName("certs"), early, containerIDs(early)); err == nil {
+		t.Error("expected error for onboot consumer waiting for a service")
+	}
+}
+
+func TestMountsFromVolumes(t *testing.T) {
+	m, err := moby.NewConfig([]byte(`volumes:
+  - name: data
+  - name: certs
+    readonly: true
+`), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounts := []specs.Mount{
+		{Type: "bind", Source: "data", Destination: "/data"},
+		{Type: "bind", Source: "/etc/hosts", Destination: "/etc/hosts"},
+		{Type: "bind", Source: "certs", Destination: "/certs", Options: []string{"rbind", "ro"}},
+		{Type: "tmpfs", Source: "tmpfs", Destination: "/tmp"},
+	}
+	image := &moby.Image{Name: "app", Image: "app:v1", ImageConfig: moby.ImageConfig{Mounts: &mounts, Runtime: &moby.Runtime{Mounts: &mounts}}}
+	img, err := updateMountsAndBindsFromVolumes(image, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every volume is replaced by its own path, in both the mounts and the runtime mounts
+	expected := []specs.Mount{
+		{Type: "bind", Source: m.VolByName("data").MergedDir(), Destination: "/data"},
+		{Type: "bind", Source: "/etc/hosts", Destination: "/etc/hosts"},
+		{Type: "bind", Source: m.VolByName("certs").MergedDir(), Destination: "/certs", Options: []string{"rbind", "ro"}},
+		{Type: "tmpfs", Source: "tmpfs", Destination: "/tmp"},
+	}
+	if !reflect.DeepEqual(*img.Mounts, expected) {
+		t.Errorf("expected mounts %+v, got %+v", expected, *img.Mounts)
+	}
+	if !reflect.DeepEqual(*img.Runtime.Mounts, expected) {
+		t.Errorf("expected runtime mounts %+v, got %+v", expected, *img.Runtime.Mounts)
+	}
+	// the original image is not changed
+	if mounts[0].Source != "data" || image.Runtime.Mounts != &mounts {
+		t.Errorf("image mounts were modified: %+v", mounts)
+	}
+
+	for _, mount := range []specs.Mount{
+		{Type: "bind", Source: "missing", Destination: "/missing"},
+		{Type: "bind", Source: "certs", Destination: "/certs"},
+	} {
+		if _, err := mountsFromVolumes([]specs.Mount{mount}, image, m); err == nil {
+			t.Errorf("expected error for mount %+v", mount)
+		}
+	}
+}
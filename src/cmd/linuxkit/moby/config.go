@@ -9,6 +9,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"text/template"
+	"text/template/parse"
 
 	"github.com/containerd/containerd/v2/pkg/reference"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/spec"
@@ -32,6 +34,7 @@ type Moby struct {
 	Services   []*Image     `yaml:"services" json:"services"`
 	Files      []File       `yaml:"files" json:"files"`
 	Volumes    []*Volume    `yaml:"volumes" json:"volumes"`
+	Include    []string     `yaml:"include,omitempty" json:"include,omitempty"`
 
 	initRefs []*reference.Spec
 	vols     map[string]*Volume
@@ -67,11 +70,14 @@ type File struct {
 	Symlink   string      `yaml:"symlink,omitempty" json:"symlink,omitempty"`
 	Contents  *string     `yaml:"contents,omitempty" json:"contents,omitempty"`
 	Source    string      `yaml:"source,omitempty" json:"source,omitempty"`
+	Secret    string      `yaml:"secret,omitempty" json:"secret,omitempty"`
 	Metadata  string      `yaml:"metadata,omitempty" json:"metadata,omitempty"`
+	Template  bool        `yaml:"template,omitempty" json:"template,omitempty"`
 	Optional  bool        `yaml:"optional" json:"optional"`
 	Mode      string      `yaml:"mode,omitempty" json:"mode,omitempty"`
 	UID       interface{} `yaml:"uid,omitempty" json:"uid,omitempty"`
 	GID       interface{} `yaml:"gid,omitempty" json:"gid,omitempty"`
+	Overlay   string      `yaml:"overlay,omitempty" json:"overlay,omitempty"`
 }
 
 // Volume is the type of a volume specification
@@ -81,7 +87,26 @@ type Volume struct {
 	ReadOnly  bool     `yaml:"readonly,omitempty" json:"readonly,omitempty"`
 	Format    string   `yaml:"format,omitempty" json:"format,omitempty"`
 	Platforms []string `yaml:"platforms,omitempty" json:"platforms,omitempty"`
-	ref       *reference.Spec
+	Overlay   string   `yaml:"overlay,omitempty" json:"overlay,omitempty"`
+
+	VolumeBacking `yaml:",inline"`
+
+	Producer string      `yaml:"producer,omitempty" json:"producer,omitempty"`
+	Wait     bool        `yaml:"wait,omitempty" json:"wait,omitempty"`
+	UID      interface{} `yaml:"uid,omitempty" json:"uid,omitempty"`
+	GID      interface{} `yaml:"gid,omitempty" json:"gid,omitempty"`
+
+	ref *reference.Spec
+}
+
+// VolumeBacking is where the read-write upper layer of a volume is stored. By default this is a tmpfs,
+// optionally limited to Size, so any changes are lost at reboot. With a Device, which is mounted, or a
+// host Path, which is bind mounted, the upper layer persists across boots.
+type VolumeBacking struct {
+	Device string `yaml:"device,omitempty" json:"device,omitempty"`
+	FSType string `yaml:"fstype,omitempty" json:"fstype,omitempty"`
+	Path   string `yaml:"path,omitempty" json:"path,omitempty"`
+	Size   string `yaml:"size,omitempty" json:"size,omitempty"`
 }
 
 func (v Volume) ImageRef() *reference.Spec {
@@ -104,10 +129,33 @@ func (v Volume) MergedDir() string {
 	return volumeMergedDir(v.Name)
 }
 
+// VolumeConfig is the configuration of a volume for init, written to VolumeConfigFile in its directory.
+// The UID and GID own the root of the volume. If the volume is shared, the Producer writes to it, and the
+// Consumers wait for it to be ready before they are started.
+type VolumeConfig struct {
+	VolumeBacking
+	UID       uint32   `json:"uid,omitempty"`
+	GID       uint32   `json:"gid,omitempty"`
+	Producer  string   `json:"producer,omitempty"`
+	Consumers []string `json:"consumers,omitempty"`
+}
+
+// ConfigFile returns the path of the configuration of the volume for init, which is only
+// written if there is anything to configure
+func (v Volume) ConfigFile() string {
+	return path.Join(volumeBaseDir(v.Name), VolumeConfigFile)
+}
+
+// HasBacking returns true if the volume has a backing other than the default tmpfs
+func (v Volume) HasBacking() bool {
+	return v.VolumeBacking != VolumeBacking{}
+}
+
 // Image is the type of an image config
 type Image struct {
 	Name        string `yaml:"name" json:"name"`
 	Image       string `yaml:"image" json:"image"`
+	Overlay     string `yaml:"overlay,omitempty" json:"overlay,omitempty"`
 	ImageConfig `yaml:",inline"`
 }
 
@@ -190,12 +238,70 @@ type Device struct {
 
 // Runtime is the type of config processed at runtime, not used to build the OCI spec
 type Runtime struct {
-	Cgroups    *[]string      `yaml:"cgroups,omitempty" json:"cgroups,omitempty"`
-	Mounts     *[]specs.Mount `yaml:"mounts,omitempty" json:"mounts,omitempty"`
-	Mkdir      *[]string      `yaml:"mkdir,omitempty" json:"mkdir,omitempty"`
-	Interfaces *[]Interface   `yaml:"interfaces,omitempty,omitempty" json:"interfaces,omitempty"`
-	BindNS     Namespaces     `yaml:"bindNS,omitempty" json:"bindNS,omitempty"`
-	Namespace  *string        `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	Cgroups     *[]string      `yaml:"cgroups,omitempty" json:"cgroups,omitempty"`
+	Mounts      *[]specs.Mount `yaml:"mounts,omitempty" json:"mounts,omitempty"`
+	Mkdir       *[]string      `yaml:"mkdir,omitempty" json:"mkdir,omitempty"`
+	Interfaces  *[]Interface   `yaml:"interfaces,omitempty,omitempty" json:"interfaces,omitempty"`
+	BindNS      Namespaces     `yaml:"bindNS,omitempty" json:"bindNS,omitempty"`
+	Namespace   *string        `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	DependsOn   *[]string      `yaml:"dependsOn,omitempty" json:"dependsOn,omitempty"`
+	Readiness   *Readiness     `yaml:"readiness,omitempty" json:"readiness,omitempty"`
+	Restart     *RestartPolicy `yaml:"restart,omitempty" json:"restart,omitempty"`
+	Healthcheck *Healthcheck   `yaml:"healthcheck,omitempty" json:"healthcheck,omitempty"`
+	Timeout     *string        `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	OnFailure   *string        `yaml:"onFailure,omitempty" json:"onFailure,omitempty"`
+	Retries     *int           `yaml:"retries,omitempty" json:"retries,omitempty"`
+}
+
+// Readiness is how init finds out that a service is ready, before it starts the services that depend on it:
+// when a unix Socket accepts connections, a File exists, or an Exec command run in the container succeeds.
+// A service without one is ready once it has started.
+type Readiness struct {
+	Socket  string   `yaml:"socket,omitempty" json:"socket,omitempty"`
+	File    string   `yaml:"file,omitempty" json:"file,omitempty"`
+	Exec    []string `yaml:"exec,omitempty" json:"exec,omitempty"`
+	Timeout string   `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+// What init does when an onboot or onshutdown container fails, after its retries: continue with the
+// next container, which is the default, or not run the remaining containers and halt, reboot or power off
+const (
+	OnFailureContinue = "continue"
+	OnFailureHalt     = "halt"
+	OnFailureReboot   = "reboot"
+	OnFailurePoweroff = "poweroff"
+)
+
+// Restart policies for services
+const (
+	RestartNo        = "no"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// RestartPolicy is when init restarts a service that has exited: never, which is the default, if it failed,
+// or always. Each restart is delayed by Backoff, doubled for each consecutive restart, and with on-failure
+// no more than MaxRetries consecutive restarts are made, if it is set.
+type RestartPolicy struct {
+	Policy     string `yaml:"policy" json:"policy"`
+	MaxRetries int    `yaml:"maxRetries,omitempty" json:"maxRetries,omitempty"`
+	Backoff    string `yaml:"backoff,omitempty" json:"backoff,omitempty"`
+}
+
+// Healthcheck is how init checks that a running service is healthy: an Exec command run in the container
+// succeeds, a TCP connection to a port on localhost succeeds, or an HTTP GET of a URL on localhost does not
+// return an error status, the last two in the network namespace of the service. It is checked every
+// Interval, failing if it takes longer than Timeout, and after Retries consecutive failures, not counting
+// those in the StartPeriod after the service starts, the service is unhealthy, and is restarted if Restart is set.
+type Healthcheck struct {
+	Exec        []string `yaml:"exec,omitempty" json:"exec,omitempty"`
+	TCP         int      `yaml:"tcp,omitempty" json:"tcp,omitempty"`
+	HTTP        string   `yaml:"http,omitempty" json:"http,omitempty"`
+	Interval    string   `yaml:"interval,omitempty" json:"interval,omitempty"`
+	Timeout     string   `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	StartPeriod string   `yaml:"startPeriod,omitempty" json:"startPeriod,omitempty"`
+	Retries     int      `yaml:"retries,omitempty" json:"retries,omitempty"`
+	Restart     bool     `yaml:"restart,omitempty" json:"restart,omitempty"`
 }
 
 // Namespaces is the type for configuring paths to bind namespaces
@@ -260,11 +366,48 @@ func uniqueVolumes(m *Moby) error {
 		if _, ok := m.vols[v.Name]; ok {
 			return fmt.Errorf("duplicate volume name: %s", v.Name)
 		}
+		if err := validateVolume(v); err != nil {
+			return fmt.Errorf("invalid volume %s: %v", v.Name, err)
+		}
 		m.vols[v.Name] = v
 	}
 	return nil
 }
 
+var volumeSizeRE = regexp.MustCompile(`^[0-9]+[kmgKMG%]?$`)
+
+func validateVolume(v *Volume) error {
+	b := v.VolumeBacking
+	if b.Device != "" && b.Path != "" {
+		return fmt.Errorf("cannot have both a device and a path")
+	}
+	if b.Size != "" && (b.Device != "" || b.Path != "") {
+		return fmt.Errorf("size can only be set for a tmpfs backed volume, without a device or path")
+	}
+	if (b.Device != "" || b.Path != "") && v.ReadOnly {
+		return fmt.Errorf("a read-only volume cannot have a device or path to store changes")
+	}
+	if b.FSType != "" && b.Device == "" {
+		return fmt.Errorf("fstype can only be set with a device")
+	}
+	if b.Device != "" && !strings.HasPrefix(b.Device, "LABEL=") && !strings.HasPrefix(b.Device, "UUID=") && !strings.HasPrefix(b.Device, "/dev/") {
+		return fmt.Errorf("device %s must be LABEL=<label>, UUID=<uuid> or a path under /dev", b.Device)
+	}
+	if b.Path != "" && !path.IsAbs(b.Path) {
+		return fmt.Errorf("path %s must be absolute", b.Path)
+	}
+	if b.Size != "" && !volumeSizeRE.MatchString(b.Size) {
+		return fmt.Errorf("size %s must be a number with an optional k, m, g or %% suffix", b.Size)
+	}
+	if v.Producer != "" && v.ReadOnly {
+		return fmt.Errorf("a read-only volume cannot have a producer")
+	}
+	if v.Wait && v.Producer == "" {
+		return fmt.Errorf("wait needs a producer to wait for")
+	}
+	return nil
+}
+
 func volumeBaseDir(name string) string {
 	return path.Join(allVolumesBaseDir, name)
 }
@@ -297,6 +440,10 @@ func extractReferences(m *Moby) error {
 		m.initRefs = append(m.initRefs, &r)
 	}
 	for _, image := range m.Onboot {
+		// overlays that patch or delete an earlier image need not specify one
+		if image.Image == "" && image.Overlay != "" {
+			continue
+		}
 		r, err := reference.Parse(util.ReferenceExpand(image.Image))
 		if err != nil {
 			return fmt.Errorf("extract on boot image reference: %v", err)
@@ -304,6 +451,10 @@ func extractReferences(m *Moby) error {
 		image.ref = &r
 	}
 	for _, image := range m.Onshutdown {
+		// overlays that patch or delete an earlier image need not specify one
+		if image.Image == "" && image.Overlay != "" {
+			continue
+		}
 		r, err := reference.Parse(util.ReferenceExpand(image.Image))
 		if err != nil {
 			return fmt.Errorf("extract on shutdown image reference: %v", err)
@@ -311,6 +462,10 @@ func extractReferences(m *Moby) error {
 		image.ref = &r
 	}
 	for _, image := range m.Services {
+		// overlays that patch or delete an earlier image need not specify one
+		if image.Image == "" && image.Overlay != "" {
+			continue
+		}
 		r, err := reference.Parse(util.ReferenceExpand(image.Image))
 		if err != nil {
 			return fmt.Errorf("extract service image reference: %v", err)
@@ -354,10 +509,21 @@ func UpdateImages(m *Moby) {
 	}
 }
 
-// NewConfig parses a config file
-func NewConfig(config []byte, packageFinder spec.PackageResolver) (Moby, error) {
+// NewConfig parses a config file. If vars is not nil, the config is first rendered as a
+// template with vars as the variables, see renderVariables. vars is nil for configs that
+// were already rendered, such as the one recorded in a previous build.
+func NewConfig(config []byte, packageFinder spec.PackageResolver, vars map[string]string) (Moby, error) {
 	m := Moby{}
 
+	// substitute any variables before anything else, as they can appear anywhere in the file
+	if vars != nil {
+		var err error
+		config, err = renderVariables(config, vars)
+		if err != nil {
+			return m, err
+		}
+	}
+
 	// Parse raw yaml
 	var rawYaml interface{}
 	dec := yaml.NewDecoder(bytes.NewReader(config))
@@ -404,6 +570,10 @@ func NewConfig(config []byte, packageFinder spec.PackageResolver) (Moby, error)
 		return m, err
 	}
 
+	if err := validateServiceRuntime(m); err != nil {
+		return m, err
+	}
+
 	if err := extractReferences(&m); err != nil {
 		return m, err
 	}
@@ -411,7 +581,8 @@ func NewConfig(config []byte, packageFinder spec.PackageResolver) (Moby, error)
 	return m, nil
 }
 
-// AppendConfig appends two configs.
+// AppendConfig appends two configs. Entries in m1 which have an overlay directive
+// replace, patch or delete the entry of the same name in m0, rather than being appended.
 func AppendConfig(m0, m1 Moby) (Moby, error) {
 	moby := m0
 	if m1.Kernel.Image != "" {
@@ -433,15 +604,26 @@ func AppendConfig(m0, m1 Moby) (Moby, error) {
 		moby.Kernel.ref = m1.Kernel.ref
 	}
 	moby.Init = append(moby.Init, m1.Init...)
-	moby.Onboot = append(moby.Onboot, m1.Onboot...)
-	moby.Onshutdown = append(moby.Onshutdown, m1.Onshutdown...)
-	moby.Services = append(moby.Services, m1.Services...)
-	moby.Files = append(moby.Files, m1.Files...)
 	moby.initRefs = append(moby.initRefs, m1.initRefs...)
-	moby.Volumes = append(moby.Volumes, m1.Volumes...)
-	moby.vols = map[string]*Volume{}
-	for k, v := range m1.vols {
-		moby.vols[k] = v
+
+	var err error
+	if moby.Onboot, err = overlayImages("onboot", m0.Onboot, m1.Onboot); err != nil {
+		return moby, err
+	}
+	if moby.Onshutdown, err = overlayImages("onshutdown", m0.Onshutdown, m1.Onshutdown); err != nil {
+		return moby, err
+	}
+	if moby.Services, err = overlayImages("services", m0.Services, m1.Services); err != nil {
+		return moby, err
+	}
+	if moby.Files, err = overlayFiles(m0.Files, m1.Files); err != nil {
+		return moby, err
+	}
+	if moby.Volumes, err = overlayVolumes(m0.Volumes, m1.Volumes); err != nil {
+		return moby, err
+	}
+	if err := uniqueVolumes(&moby); err != nil {
+		return moby, err
 	}
 
 	return moby, uniqueServices(moby)
@@ -509,6 +691,9 @@ func NewImage(config []byte) (Image, error) {
 	if mi.Image != "" {
 		return mi, fmt.Errorf("image cannot be set in metadata label")
 	}
+	if mi.Overlay != "" {
+		return mi, fmt.Errorf("overlay cannot be set in metadata label")
+	}
 
 	return mi, nil
 }
@@ -727,6 +912,7 @@ func assignRuntime(v1, v2 *Runtime) Runtime {
 	runtimeMkdir := assignStrings(v1.Mkdir, v2.Mkdir)
 	runtimeInterfaces := assignRuntimeInterfaceArray(v1.Interfaces, v2.Interfaces)
 	runtimeNamespace := assignString(v1.Namespace, v2.Namespace)
+	runtimeDependsOn := assignStrings(v1.DependsOn, v2.DependsOn)
 	runtime := Runtime{
 		Cgroups:    &runtimeCgroups,
 		Mounts:     &runtimeMounts,
@@ -741,11 +927,42 @@ func assignRuntime(v1, v2 *Runtime) Runtime {
 			User:   assignStringPtr(v1.BindNS.User, v2.BindNS.User),
 			Uts:    assignStringPtr(v1.BindNS.Uts, v2.BindNS.Uts),
 		},
-		Namespace: &runtimeNamespace,
+		Namespace:   &runtimeNamespace,
+		DependsOn:   &runtimeDependsOn,
+		Readiness:   assignReadiness(v1.Readiness, v2.Readiness),
+		Restart:     assignRestartPolicy(v1.Restart, v2.Restart),
+		Healthcheck: assignHealthcheck(v1.Healthcheck, v2.Healthcheck),
+		Timeout:     assignStringPtr(v1.Timeout, v2.Timeout),
+		OnFailure:   assignStringPtr(v1.OnFailure, v2.OnFailure),
+		Retries:     assignIntPtr(v1.Retries, v2.Retries),
 	}
 	return runtime
 }
 
+// assignReadiness does ordered overrides from Readiness
+func assignReadiness(v1, v2 *Readiness) *Readiness {
+	if v2 != nil {
+		return v2
+	}
+	return v1
+}
+
+// assignRestartPolicy does ordered overrides from RestartPolicy
+func assignRestartPolicy(v1, v2 *RestartPolicy) *RestartPolicy {
+	if v2 != nil {
+		return v2
+	}
+	return v1
+}
+
+// assignHealthcheck does ordered overrides from Healthcheck
+func assignHealthcheck(v1, v2 *Healthcheck) *Healthcheck {
+	if v2 != nil {
+		return v2
+	}
+	return v1
+}
+
 // assignStringEmpty does ordered overrides if strings are empty, for
 // values where there is always an explicit override eg "none"
 func assignStringEmpty(v1, v2 string) string {
@@ -1233,3 +1450,83 @@ func handleTemplate(node *yaml.Node, packageFinder spec.PackageResolver) {
 		node.Value = val
 	}
 }
+
+// renderVariables renders the raw config as a go text/template, with vars available as {{ .Name }}.
+// A variable that is referenced but not provided is an error, unless it is piped into default,
+// e.g. {{ .Hostname | default "linuxkit" }}, in which case the default is used.
+// This is done on the raw bytes rather than on the parsed yaml, so that variables can be used
+// for any value, and not just strings.
+func renderVariables(b []byte, vars map[string]string) ([]byte, error) {
+	funcs := template.FuncMap{
+		"default": func(def string, v interface{}) string {
+			if s, ok := v.(string); ok && s != "" {
+				return s
+			}
+			return def
+		},
+	}
+	tmpl, err := template.New("config").Funcs(funcs).Option("missingkey=error").Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("invalid template in config: %v", err)
+	}
+
+	data := map[string]interface{}{}
+	// variables with a default must exist in the data, or missingkey=error will fail
+	// before the default is reached
+	for _, name := range defaultedVariables(tmpl.Tree.Root) {
+		data[name] = nil
+	}
+	for k, v := range vars {
+		data[k] = v
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("unable to render config: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// defaultedVariables walks a template tree and returns the names of all of the variables
+// that are piped into the default function.
+func defaultedVariables(node parse.Node) []string {
+	var names []string
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Nodes {
+			names = append(names, defaultedVariables(c)...)
+		}
+	case *parse.ActionNode:
+		names = append(names, defaultedVariables(n.Pipe)...)
+	case *parse.IfNode:
+		names = append(names, defaultedVariables(n.Pipe)...)
+		names = append(names, defaultedVariables(n.List)...)
+		names = append(names, defaultedVariables(n.ElseList)...)
+	case *parse.RangeNode:
+		names = append(names, defaultedVariables(n.Pipe)...)
+		names = append(names, defaultedVariables(n.List)...)
+		names = append(names, defaultedVariables(n.ElseList)...)
+	case *parse.WithNode:
+		names = append(names, defaultedVariables(n.Pipe)...)
+		names = append(names, defaultedVariables(n.List)...)
+		names = append(names, defaultedVariables(n.ElseList)...)
+	case *parse.PipeNode:
+		if n == nil || len(n.Cmds) < 2 {
+			return nil
+		}
+		last := n.Cmds[len(n.Cmds)-1]
+		if len(last.Args) == 0 {
+			return nil
+		}
+		if ident, ok := last.Args[0].(*parse.IdentifierNode); !ok || ident.Ident != "default" {
+			return nil
+		}
+		if field, ok := n.Cmds[0].Args[0].(*parse.FieldNode); ok && len(field.Ident) == 1 {
+			names = append(names, field.Ident[0])
+		}
+	}
+	return names
+}
@@ -107,3 +107,248 @@ func TestIdMap(t *testing.T) {
 		t.Error("Expected numerical gid to work")
 	}
 }
+
+func TestVariables(t *testing.T) {
+	config := []byte(`kernel:
+  image: linuxkit/kernel:6.6.71
+  cmdline: "console={{ .Console | default "ttyS0" }}"
+services:
+  - name: "{{ .Name }}"
+    image: linuxkit/getty:v1.0
+`)
+
+	m, err := NewConfig(config, nil, map[string]string{"Name": "getty"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Kernel.Cmdline != "console=ttyS0" {
+		t.Errorf("expected default to be applied, got %q", m.Kernel.Cmdline)
+	}
+	if len(m.Services) != 1 || m.Services[0].Name != "getty" {
+		t.Errorf("expected variable to be substituted, got %v", m.Services)
+	}
+
+	m, err = NewConfig(config, nil, map[string]string{"Name": "getty", "Console": "tty0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Kernel.Cmdline != "console=tty0" {
+		t.Errorf("expected variable to override default, got %q", m.Kernel.Cmdline)
+	}
+
+	if _, err := NewConfig(config, nil, map[string]string{}); err == nil {
+		t.Error("expected error for undefined variable")
+	}
+
+	// without any variables given, defaults still apply
+	m, err = NewConfig([]byte(`kernel:
+  image: linuxkit/kernel:6.6.71
+  cmdline: "console={{ .Console | default "ttyS0" }}"
+`), nil, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Kernel.Cmdline != "console=ttyS0" {
+		t.Errorf("expected default to be applied without variables, got %q", m.Kernel.Cmdline)
+	}
+
+	// a nil map is for configs that were already rendered, which are not rendered again
+	m, err = NewConfig([]byte(`files:
+  - path: etc/hello
+    contents: "hello {{ .Name }}"
+`), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Files[0].Contents == nil || *m.Files[0].Contents != "hello {{ .Name }}" {
+		t.Errorf("expected contents to be left as they are, got %v", m.Files[0].Contents)
+	}
+}
+
+func TestAppendConfigOverlay(t *testing.T) {
+	base, err := NewConfig([]byte(`onboot:
+  - name: dhcpcd
+    image: linuxkit/dhcpcd:v1
+  - name: sysctl
+    image: linuxkit/sysctl:v1
+services:
+  - name: getty
+    image: linuxkit/getty:v1
+    env:
+      - INSECURE=false
+      - FOO=bar
+`), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlay, err := NewConfig([]byte(`onboot:
+  - name: dhcpcd
+    overlay: delete
+services:
+  - name: getty
+    overlay: patch
+    env:
+      - INSECURE=true
+`), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := AppendConfig(base, overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Onboot) != 1 || m.Onboot[0].Name != "sysctl" {
+		t.Errorf("expected dhcpcd to be deleted, got %v", m.Onboot)
+	}
+	if len(m.Services) != 1 || m.Services[0].Image != "linuxkit/getty:v1" {
+		t.Fatalf("expected getty to be patched, got %v", m.Services)
+	}
+	if env := *m.Services[0].Env; !reflect.DeepEqual(env, []string{"INSECURE=true", "FOO=bar"}) {
+		t.Errorf("expected env to be patched, got %v", env)
+	}
+	// the base config must not be modified
+	if env := *base.Services[0].Env; !reflect.DeepEqual(env, []string{"INSECURE=false", "FOO=bar"}) {
+		t.Errorf("expected base env to be unchanged, got %v", env)
+	}
+
+	missing, err := NewConfig([]byte(`services:
+  - name: sshd
+    overlay: delete
+`), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AppendConfig(base, missing); err == nil {
+		t.Error("expected error when overlaying a missing service")
+	}
+}
+
+func TestVolumeBacking(t *testing.T) {
+	m, err := NewConfig([]byte(`volumes:
+  - name: data
+    device: LABEL=data
+  - name: cache
+    size: 64m
+`), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol := m.VolByName("data"); vol.Device != "LABEL=data" || !vol.HasBacking() {
+		t.Errorf("expected device backing, got %v", vol.VolumeBacking)
+	}
+	if vol := m.VolByName("cache"); vol.Size != "64m" {
+		t.Errorf("expected size, got %v", vol.VolumeBacking)
+	}
+
+	for _, invalid := range []string{
+		"device: LABEL=data\n    path: /var/data",
+		"device: LABEL=data\n    size: 64m",
+		"device: LABEL=data\n    readonly: true",
+		"device: sda1",
+		"fstype: ext4",
+		"path: data",
+		"size: lots",
+	} {
+		if _, err := NewConfig([]byte("volumes:\n  - name: data\n    "+invalid+"\n"), nil, nil); err == nil {
+			t.Errorf("expected error for volume with %q", invalid)
+		}
+	}
+}
+
+func TestServiceOrder(t *testing.T) {
+	m, err := NewConfig([]byte(`services:
+  - name: agent
+    image: agent
+    runtime:
+      dependsOn: [dhcpcd, sshd]
+  - name: sshd
+    image: sshd
+    runtime:
+      restart:
+        policy: on-failure
+        maxRetries: 3
+        backoff: 2s
+      healthcheck:
+        http: http://localhost:8080/healthz
+        interval: 10s
+        retries: 2
+        restart: true
+  - name: dhcpcd
+    image: dhcpcd
+    runtime:
+      readiness:
+        file: /run/dhcpcd.ready
+        timeout: 30s
+`), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, err := ServiceOrder(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"dhcpcd", "sshd", "agent"}; !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected order %v, got %v", expected, order)
+	}
+
+	for _, invalid := range []string{
+		"  - name: a\n    image: a\n    runtime:\n      dependsOn: [b]\n  - name: b\n    image: b\n    runtime:\n      dependsOn: [a]\n",
+		"  - name: a\n    image: a\n    runtime:\n      dependsOn: [a]\n",
+		"  - name: a\n    image: a\n    runtime:\n      dependsOn: [b]\n",
+	} {
+		m, err := NewConfig([]byte("services:\n"+invalid), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ServiceOrder(m); err == nil {
+			t.Errorf("expected error for services:\n%s", invalid)
+		}
+	}
+
+	for _, invalid := range []string{
+		"services:\n  - name: a\n    image: a\n    runtime:\n      readiness:\n        file: /run/a\n        socket: /run/a.sock\n",
+		"services:\n  - name: a\n    image: a\n    runtime:\n      readiness:\n        file: run/a\n",
+		"services:\n  - name: a\n    image: a\n    runtime:\n      readiness:\n        exec: [\"true\"]\n        timeout: soon\n",
+		"onboot:\n  - name: a\n    image: a\n    runtime:\n      dependsOn: [b]\n",
+		"services:\n  - name: a\n    image: a\n    runtime:\n      restart:\n        policy: sometimes\n",
+		"services:\n  - name: a\n    image: a\n    runtime:\n      restart:\n        policy: always\n        maxRetries: 3\n",
+		"services:\n  - name: a\n    image: a\n    runtime:\n      restart:\n        policy: on-failure\n        backoff: -1s\n",
+		"services:\n  - name: a\n    image: a\n    runtime:\n      healthcheck:\n        tcp: 22\n        exec: [\"true\"]\n",
+		"services:\n  - name: a\n    image: a\n    runtime:\n      healthcheck:\n        http: http://example.com/\n",
+		"services:\n  - name: a\n    image: a\n    runtime:\n      healthcheck:\n        tcp: 22\n        interval: often\n",
+	} {
+		if _, err := NewConfig([]byte(invalid), nil, nil); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestOnbootFailure(t *testing.T) {
+	m, err := NewConfig([]byte(`onboot:
+  - name: format
+    image: format
+    runtime:
+      timeout: 2m
+      onFailure: halt
+      retries: 2
+`), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := m.Onboot[0].Runtime
+	if *r.Timeout != "2m" || *r.OnFailure != OnFailureHalt || *r.Retries != 2 {
+		t.Errorf("unexpected runtime %v %v %v", *r.Timeout, *r.OnFailure, *r.Retries)
+	}
+
+	for _, invalid := range []string{
+		"services:\n  - name: a\n    image: a\n    runtime:\n      timeout: 1m\n",
+		"onboot:\n  - name: a\n    image: a\n    runtime:\n      onFailure: explode\n",
+		"onboot:\n  - name: a\n    image: a\n    runtime:\n      timeout: 0s\n",
+		"onshutdown:\n  - name: a\n    image: a\n    runtime:\n      retries: -1\n",
+	} {
+		if _, err := NewConfig([]byte(invalid), nil, nil); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
@@ -6,5 +6,9 @@ const (
 	// PaxRecordLinuxkitLocation report the location of the file in the linuxkit.yaml
 	// that led to this file being in this location
 	PaxRecordLinuxkitLocation = "LINUXKIT.location"
+	// PaxRecordLinuxkitRedacted marks a file with contents from a secret, which are not recorded in the sbom or cached
+	PaxRecordLinuxkitRedacted = "LINUXKIT.redacted"
 	allVolumesBaseDir         = "/containers/volumes"
+	// VolumeConfigFile is the name of the file in the directory of a volume with its VolumeConfig
+	VolumeConfigFile = "volume.json"
 )
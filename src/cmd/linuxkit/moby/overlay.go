@@ -0,0 +1,210 @@
+package moby
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	// OverlayReplace replaces an earlier entry with the same name entirely
+	OverlayReplace = "replace"
+	// OverlayPatch patches an earlier entry with the same name, see patchImage
+	OverlayPatch = "patch"
+	// OverlayDelete removes an earlier entry with the same name
+	OverlayDelete = "delete"
+)
+
+// overlayImages applies the images in overlay to those in base. Images without an overlay
+// directive are appended, the others replace, patch or delete the image of the same name in base.
+// section is used for error messages only.
+func overlayImages(section string, base, overlay []*Image) ([]*Image, error) {
+	// never modify base, as it may be shared
+	images := append([]*Image{}, base...)
+	for _, o := range overlay {
+		if o.Overlay == "" {
+			images = append(images, o)
+			continue
+		}
+		index := -1
+		for i, image := range images {
+			if image.Name == o.Name {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("cannot %s %s %s: not found in earlier config", o.Overlay, section, o.Name)
+		}
+		switch o.Overlay {
+		case OverlayReplace:
+			if o.Image == "" {
+				return nil, fmt.Errorf("cannot replace %s %s: image is required", section, o.Name)
+			}
+			replacement := *o
+			replacement.Overlay = ""
+			images[index] = &replacement
+		case OverlayPatch:
+			images[index] = patchImage(images[index], o)
+		case OverlayDelete:
+			images = append(images[:index], images[index+1:]...)
+		default:
+			return nil, fmt.Errorf("unknown overlay %q for %s %s", o.Overlay, section, o.Name)
+		}
+	}
+	return images, nil
+}
+
+// patchImage returns a copy of base with the fields set in patch applied to it.
+// Lists of strings are appended to, except that env variables replace any earlier
+// value for the same variable, maps are merged, and anything else is replaced.
+func patchImage(base, patch *Image) *Image {
+	image := *base
+	if patch.Image != "" {
+		image.Image = patch.Image
+		image.ref = patch.ref
+	}
+	iv := reflect.ValueOf(&image.ImageConfig).Elem()
+	pv := reflect.ValueOf(&patch.ImageConfig).Elem()
+	for i := 0; i < pv.NumField(); i++ {
+		field := pv.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		pf, f := pv.Field(i), iv.Field(i)
+		if pf.IsZero() {
+			continue
+		}
+		switch p := pf.Interface().(type) {
+		case *[]string:
+			current, _ := f.Interface().(*[]string)
+			var merged []string
+			if field.Name == "Env" {
+				merged = mergeEnv(current, p)
+			} else {
+				merged = mergeUnique(current, p)
+			}
+			f.Set(reflect.ValueOf(&merged))
+		case *map[string]string:
+			merged := map[string]string{}
+			if current, _ := f.Interface().(*map[string]string); current != nil {
+				for k, v := range *current {
+					merged[k] = v
+				}
+			}
+			for k, v := range *p {
+				merged[k] = v
+			}
+			f.Set(reflect.ValueOf(&merged))
+		default:
+			f.Set(pf)
+		}
+	}
+	return &image
+}
+
+// mergeUnique appends the strings in v2 to those in v1, skipping any already present
+func mergeUnique(v1, v2 *[]string) []string {
+	var ret []string
+	seen := map[string]bool{}
+	for _, l := range []*[]string{v1, v2} {
+		if l == nil {
+			continue
+		}
+		for _, s := range *l {
+			if seen[s] {
+				continue
+			}
+			seen[s] = true
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// mergeEnv merges two lists of NAME=value environment variables, with those in v2
+// overriding any of the same name in v1
+func mergeEnv(v1, v2 *[]string) []string {
+	var ret []string
+	index := map[string]int{}
+	for _, l := range []*[]string{v1, v2} {
+		if l == nil {
+			continue
+		}
+		for _, s := range *l {
+			name := strings.SplitN(s, "=", 2)[0]
+			if i, ok := index[name]; ok {
+				ret[i] = s
+				continue
+			}
+			index[name] = len(ret)
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// overlayFiles applies the files in overlay to those in base, matching on path.
+// Only replace and delete are supported for files.
+func overlayFiles(base, overlay []File) ([]File, error) {
+	files := append([]File{}, base...)
+	for _, o := range overlay {
+		if o.Overlay == "" {
+			files = append(files, o)
+			continue
+		}
+		index := -1
+		for i, f := range files {
+			if strings.TrimPrefix(f.Path, "/") == strings.TrimPrefix(o.Path, "/") {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("cannot %s file %s: not found in earlier config", o.Overlay, o.Path)
+		}
+		switch o.Overlay {
+		case OverlayReplace:
+			o.Overlay = ""
+			files[index] = o
+		case OverlayDelete:
+			files = append(files[:index], files[index+1:]...)
+		default:
+			return nil, fmt.Errorf("unsupported overlay %q for file %s", o.Overlay, o.Path)
+		}
+	}
+	return files, nil
+}
+
+// overlayVolumes applies the volumes in overlay to those in base, matching on name.
+// Only replace and delete are supported for volumes.
+func overlayVolumes(base, overlay []*Volume) ([]*Volume, error) {
+	volumes := append([]*Volume{}, base...)
+	for _, o := range overlay {
+		if o.Overlay == "" {
+			volumes = append(volumes, o)
+			continue
+		}
+		index := -1
+		for i, v := range volumes {
+			if v.Name == o.Name {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("cannot %s volume %s: not found in earlier config", o.Overlay, o.Name)
+		}
+		switch o.Overlay {
+		case OverlayReplace:
+			replacement := *o
+			replacement.Overlay = ""
+			volumes[index] = &replacement
+		case OverlayDelete:
+			volumes = append(volumes[:index], volumes[index+1:]...)
+		default:
+			return nil, fmt.Errorf("unsupported overlay %q for volume %s", o.Overlay, o.Name)
+		}
+	}
+	return volumes, nil
+}
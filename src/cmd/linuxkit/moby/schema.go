@@ -26,11 +26,14 @@ var schema = `
           "symlink": {"type": "string"},
           "contents": {"type": "string"},
           "source": {"type": "string"},
+          "secret": {"type": "string"},
           "metadata": {"type": "string"},
+          "template": {"type": "boolean"},
           "optional": {"type": "boolean"},
           "mode": {"type": "string"},
           "uid": {"anyOf": [{"type": "string"}, {"type": "integer"}]},
-          "gid": {"anyOf": [{"type": "string"}, {"type": "integer"}]}
+          "gid": {"anyOf": [{"type": "string"}, {"type": "integer"}]},
+          "overlay": {"enum": ["replace", "delete"]}
         }
     },
     "files": {
@@ -45,7 +48,16 @@ var schema = `
           "image": {"type": "string"},
           "readonly": {"type": "boolean"},
           "format": {"enum": ["oci","filesystem"]},
-          "platforms": {"$ref": "#/definitions/strings"}
+          "platforms": {"$ref": "#/definitions/strings"},
+          "overlay": {"enum": ["replace", "delete"]},
+          "device": {"type": "string"},
+          "fstype": {"type": "string"},
+          "path": {"type": "string"},
+          "size": {"type": "string"},
+          "producer": {"type": "string"},
+          "wait": {"type": "boolean"},
+          "uid": {"anyOf": [{"type": "string"}, {"type": "integer"}]},
+          "gid": {"anyOf": [{"type": "string"}, {"type": "integer"}]}
         }
     },
     "volumes": {
@@ -278,6 +290,40 @@ var schema = `
         "uts": {"type": "string"}
       }
     },
+    "readiness": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "socket": {"type": "string"},
+        "file": {"type": "string"},
+        "exec": {"$ref": "#/definitions/strings"},
+        "timeout": {"type": "string"}
+      }
+    },
+    "restart": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["policy"],
+      "properties": {
+        "policy": {"enum": ["no", "on-failure", "always"]},
+        "maxRetries": {"type": "integer", "minimum": 0},
+        "backoff": {"type": "string"}
+      }
+    },
+    "healthcheck": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "exec": {"$ref": "#/definitions/strings"},
+        "tcp": {"type": "integer", "minimum": 1, "maximum": 65535},
+        "http": {"type": "string"},
+        "interval": {"type": "string"},
+        "timeout": {"type": "string"},
+        "startPeriod": {"type": "string"},
+        "retries": {"type": "integer", "minimum": 0},
+        "restart": {"type": "boolean"}
+      }
+    },
     "runtime": {
       "type": "object",
       "additionalProperties": false,
@@ -287,16 +333,28 @@ var schema = `
         "mkdir": {"$ref": "#/definitions/strings"},
         "interfaces": {"$ref": "#/definitions/interfaces"},
         "bindNS": {"$ref": "#/definitions/namespaces"},
-        "namespace": {"type": "string"}
+        "namespace": {"type": "string"},
+        "dependsOn": {"$ref": "#/definitions/strings"},
+        "readiness": {"$ref": "#/definitions/readiness"},
+        "restart": {"$ref": "#/definitions/restart"},
+        "healthcheck": {"$ref": "#/definitions/healthcheck"},
+        "timeout": {"type": "string"},
+        "onFailure": {"enum": ["continue", "halt", "reboot", "poweroff"]},
+        "retries": {"type": "integer", "minimum": 0}
       }
     },
     "image": {
       "type": "object",
       "additionalProperties": false,
-      "required": ["name", "image"],
+      "required": ["name"],
+      "anyOf": [
+        {"required": ["image"]},
+        {"required": ["overlay"]}
+      ],
       "properties": {
         "name": {"type": "string"},
         "image": {"type": "string"},
+        "overlay": {"enum": ["replace", "patch", "delete"]},
         "capabilities": { "$ref": "#/definitions/strings" },
         "capabilities.add": { "$ref": "#/definitions/strings" },
         "ambient": { "$ref": "#/definitions/strings" },
@@ -349,7 +407,8 @@ var schema = `
     "services": { "$ref": "#/definitions/images" },
     "trust": { "$ref": "#/definitions/trust" },
     "files": { "$ref": "#/definitions/files" },
-    "volumes": { "$ref": "#/definitions/volumes" }
+    "volumes": { "$ref": "#/definitions/volumes" },
+    "include": { "$ref": "#/definitions/strings" }
   }
 }
 `
@@ -0,0 +1,201 @@
+package moby
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// validateServiceRuntime checks the dependencies, readiness, restart policies and health checks of the
+// containers in m, which only init starting and supervising services uses, as onboot and onshutdown
+// containers run one after another, and the timeouts, failure actions and retries, which only apply to those
+func validateServiceRuntime(m Moby) error {
+	for _, section := range []struct {
+		name   string
+		images []*Image
+	}{{"onboot", m.Onboot}, {"onshutdown", m.Onshutdown}} {
+		for _, image := range section.images {
+			if image.Runtime == nil {
+				continue
+			}
+			r := image.Runtime
+			if r.DependsOn != nil || r.Readiness != nil || r.Restart != nil || r.Healthcheck != nil {
+				return fmt.Errorf("%s container %s: dependsOn, readiness, restart and healthcheck are only supported for services", section.name, image.Name)
+			}
+			if err := validateOnFailure(r); err != nil {
+				return fmt.Errorf("%s container %s: %v", section.name, image.Name, err)
+			}
+		}
+	}
+	for _, image := range m.Services {
+		if image.Runtime == nil {
+			continue
+		}
+		if r := image.Runtime; r.Timeout != nil || r.OnFailure != nil || r.Retries != nil {
+			return fmt.Errorf("service %s: timeout, onFailure and retries are only supported for onboot and onshutdown containers", image.Name)
+		}
+		if r := image.Runtime.Readiness; r != nil {
+			if err := validateReadiness(r); err != nil {
+				return fmt.Errorf("service %s: invalid readiness: %v", image.Name, err)
+			}
+		}
+		if r := image.Runtime.Restart; r != nil {
+			if err := validateRestartPolicy(r); err != nil {
+				return fmt.Errorf("service %s: invalid restart policy: %v", image.Name, err)
+			}
+		}
+		if h := image.Runtime.Healthcheck; h != nil {
+			if err := validateHealthcheck(h); err != nil {
+				return fmt.Errorf("service %s: invalid healthcheck: %v", image.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateOnFailure checks the timeout, failure action and retries of an onboot or onshutdown container
+func validateOnFailure(r *Runtime) error {
+	if r.OnFailure != nil {
+		switch *r.OnFailure {
+		case OnFailureContinue, OnFailureHalt, OnFailureReboot, OnFailurePoweroff:
+		default:
+			return fmt.Errorf("unknown onFailure %s", *r.OnFailure)
+		}
+	}
+	if r.Retries != nil && *r.Retries < 0 {
+		return fmt.Errorf("retries %d is negative", *r.Retries)
+	}
+	if r.Timeout != nil {
+		return validateDurations(map[string]string{"timeout": *r.Timeout})
+	}
+	return nil
+}
+
+func validateReadiness(r *Readiness) error {
+	n := 0
+	for _, set := range []bool{r.Socket != "", r.File != "", len(r.Exec) != 0} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("must have exactly one of socket, file or exec")
+	}
+	for _, p := range []string{r.Socket, r.File} {
+		if p != "" && !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("path %s is not absolute", p)
+		}
+	}
+	return validateDurations(map[string]string{"timeout": r.Timeout})
+}
+
+func validateRestartPolicy(r *RestartPolicy) error {
+	if r.MaxRetries != 0 && r.Policy != RestartOnFailure {
+		return fmt.Errorf("maxRetries is only supported with %s", RestartOnFailure)
+	}
+	return validateDurations(map[string]string{"backoff": r.Backoff})
+}
+
+func validateHealthcheck(h *Healthcheck) error {
+	n := 0
+	for _, set := range []bool{len(h.Exec) != 0, h.TCP != 0, h.HTTP != ""} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("must have exactly one of exec, tcp or http")
+	}
+	if h.HTTP != "" {
+		u, err := url.Parse(h.HTTP)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("%s is not an http or https URL", h.HTTP)
+		}
+		switch u.Hostname() {
+		case "localhost", "127.0.0.1", "::1":
+		default:
+			return fmt.Errorf("%s is not on localhost", h.HTTP)
+		}
+	}
+	return validateDurations(map[string]string{"interval": h.Interval, "timeout": h.Timeout, "startPeriod": h.StartPeriod})
+}
+
+// validateDurations checks that each of the durations by name, if set, is positive
+func validateDurations(durations map[string]string) error {
+	for name, s := range durations {
+		if s == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(s); err != nil || d <= 0 {
+			return fmt.Errorf("%s %s is not a positive duration", name, s)
+		}
+	}
+	return nil
+}
+
+// ServiceOrder returns the names of the services in m in an order in which each comes after the
+// services it depends on, and otherwise in the order of the configuration. It is an error for a
+// service to depend on one that is not in services, or for dependencies to form a cycle, as init
+// could not start them.
+func ServiceOrder(m Moby) ([]string, error) {
+	deps := map[string][]string{}
+	for _, image := range m.Services {
+		deps[image.Name] = nil
+	}
+	for _, image := range m.Services {
+		if image.Runtime == nil || image.Runtime.DependsOn == nil {
+			continue
+		}
+		for _, dep := range *image.Runtime.DependsOn {
+			if _, ok := deps[dep]; !ok {
+				return nil, fmt.Errorf("service %s depends on %s, which is not in services", image.Name, dep)
+			}
+			deps[image.Name] = append(deps[image.Name], dep)
+		}
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	var (
+		order []string
+		path  []string
+		visit func(name string) error
+	)
+	state := map[string]int{}
+	visit = func(name string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			// the cycle is the part of the path since name was first visited
+			for i, p := range path {
+				if p == name {
+					return fmt.Errorf("services depend on each other in a cycle: %s", strings.Join(append(path[i:], name), " -> "))
+				}
+			}
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range deps[name] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+	for _, image := range m.Services {
+		if err := visit(image.Name); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/pkglib"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/signature"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/spec"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/spf13/cobra"
@@ -21,6 +22,7 @@ const (
 	envVarBuilderConfig = "LINUXKIT_BUILDER_CONFIG"
 	envVarMirror        = "LINUXKIT_MIRROR"
 	envVarPkgOrg        = "LINUXKIT_PKG_ORG"
+	envVarSignKey       = "LINUXKIT_SIGN_KEY"
 	defaultBuilderImage = "moby/buildkit:v0.26.3"
 )
 
@@ -60,6 +62,7 @@ func pkgBuildCmd() *cobra.Command {
 		progress       string
 		ssh            []string
 		dryRun         bool
+		signKey        = flagOverEnvVarOverDefaultString{envVar: envVarSignKey}
 	)
 	cmd := &cobra.Command{
 		Use:   "build",
@@ -110,6 +113,20 @@ func pkgBuildCmd() *cobra.Command {
 					opts = append(opts, pkglib.WithBuildManifest())
 				}
 			}
+			if signKey.String() != "" {
+				if !push {
+					return errors.New("flag -sign-key requires -push")
+				}
+				b, err := os.ReadFile(signKey.String())
+				if err != nil {
+					return fmt.Errorf("error reading sign key: %w", err)
+				}
+				key, err := signature.ParsePrivateKey(b)
+				if err != nil {
+					return fmt.Errorf("invalid sign key %s: %w", signKey.String(), err)
+				}
+				opts = append(opts, pkglib.WithSignKey(key))
+			}
 			if docker {
 				opts = append(opts, pkglib.WithBuildTargetDockerCache())
 			}
@@ -321,6 +338,7 @@ func pkgBuildCmd() *cobra.Command {
 	cmd.Flags().StringVar(&release, "release", "", "Release the given version")
 	cmd.Flags().BoolVar(&nobuild, "nobuild", false, "Skip building the image before pushing, conflicts with -force")
 	cmd.Flags().BoolVar(&manifest, "manifest", true, "Create and push multi-arch manifest")
+	cmd.Flags().Var(&signKey, "sign-key", fmt.Sprintf("Private key file to sign the pushed images and index with, storing the signatures alongside them in the registry; requires --push, overrides env var %s", envVarSignKey))
 	cmd.Flags().StringVar(&sbomScanner, "sbom-scanner", "", "SBOM scanner to use, must match the buildkit spec; set to blank to use the buildkit default; set to 'false' for no scanning")
 	cmd.Flags().StringVar(&dockerfile, "dockerfile", "", "Dockerfile to use for building the image, must be in this directory or below, overrides what is in build.yml")
 	cmd.Flags().StringArrayVar(&buildArgFiles, "build-arg-file", nil, "Files containing build arguments, one key=value per line, contents augment and override buildArgs in build.yml. Can be specified multiple times. File is relative to working directory when running `linuxkit pkg build`")
@@ -3,6 +3,7 @@ package pkglib
 import (
 	"archive/tar"
 	"context"
+	"crypto"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -32,6 +33,7 @@ type buildOpts struct {
 	dryRun           bool
 	preCacheImages   bool
 	release          string
+	signKey          crypto.Signer
 	manifest         bool
 	targetDocker     bool
 	cacheDir         string
@@ -101,6 +103,14 @@ func WithRelease(r string) BuildOpt {
 	}
 }
 
+// WithSignKey signs the index and each of the images in it with the given key when pushing them
+func WithSignKey(key crypto.Signer) BuildOpt {
+	return func(bo *buildOpts) error {
+		bo.signKey = key
+		return nil
+	}
+}
+
 // WithBuildTargetDockerCache put the build target in the docker cache instead of the default linuxkit cache
 func WithBuildTargetDockerCache() BuildOpt {
 	return func(bo *buildOpts) error {
@@ -298,6 +308,9 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 	if bo.release != "" && !bo.push {
 		return fmt.Errorf("cannot release %q if not pushing", bo.release)
 	}
+	if bo.signKey != nil && !bo.push {
+		return errors.New("cannot sign if not pushing")
+	}
 
 	d := bo.runner
 	switch {
@@ -561,11 +574,30 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 	if p.dirty {
 		return fmt.Errorf("build complete, refusing to push dirty package")
 	}
-	// push the manifest for the default tag if needed
+	// push the manifest for the default tag if needed, signing it first
 	if !skipDefaultPush {
+		var signatures []string
+		if bo.signKey != nil {
+			if desc == nil {
+				return fmt.Errorf("unable to find %s in local cache to sign", p.FullTag())
+			}
+			if signatures, err = signImages(c, p.FullTag(), *desc, bo.signKey); err != nil {
+				return err
+			}
+		}
 		if err := c.Push(p.FullTag(), "", bo.manifest, true); err != nil {
 			return err
 		}
+		for _, s := range signatures {
+			if err := c.Push(s, "", false, true); err != nil {
+				return err
+			}
+		}
+		if bo.signKey != nil {
+			if err := signPushedIndex(c, p.FullTag(), desc.Digest, bo.signKey); err != nil {
+				return err
+			}
+		}
 	} else {
 		_, _ = fmt.Fprintf(writer, "Skipping push of default tag %q\n", p.FullTag())
 	}
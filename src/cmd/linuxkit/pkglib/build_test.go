@@ -4,6 +4,8 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"encoding/json"
 	"errors"
@@ -337,6 +339,8 @@ func (c *cacheMocker) imageWriteStream(r io.Reader) ([]v1.Descriptor, error) {
 
 		filename := header.Name
 		switch {
+		case header.Typeflag == tar.TypeDir:
+			continue
 		case filename == "index.json":
 			// any errors should stop and get reported
 			if _, err := io.Copy(&index, tr); err != nil {
@@ -651,6 +655,50 @@ func TestPushReleaseImageInRegistry(t *testing.T) {
 	}
 }
 
+func TestSignImages(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &cacheMocker{enableIndexWrite: true, enableImageLoad: true}
+	ref, err := reference.Parse("docker.io/foo/bar:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var descs []v1.Descriptor
+	for i, platform := range []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}, {OS: "unknown", Architecture: "unknown"}} {
+		descs = append(descs, v1.Descriptor{
+			MediaType: types.OCIManifestSchema1,
+			Size:      100,
+			Digest:    v1.Hash{Algorithm: "sha256", Hex: strings.Repeat(fmt.Sprint(i), 64)},
+			Platform:  &platform,
+		})
+	}
+	if err := c.IndexWrite(&ref, descs...); err != nil {
+		t.Fatal(err)
+	}
+	desc, err := c.FindDescriptor(&ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := signImages(c, "foo/bar:abc", *desc, key)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	expected := []string{desc.Digest.Hex, descs[0].Digest.Hex, descs[1].Digest.Hex}
+	if len(names) != len(expected) {
+		t.Fatalf("expected %d signatures, got %v", len(expected), names)
+	}
+	for i, name := range names {
+		if name != "docker.io/foo/bar:sha256-"+expected[i]+".sig" {
+			t.Errorf("unexpected signature name %s", name)
+		}
+		if _, ok := c.images[name]; !ok {
+			t.Errorf("expected signature %s to be written to cache", name)
+		}
+	}
+}
+
 // testCheckBuildRun check the output of a build run
 func testCheckBuildRun(build buildLog, platforms map[string]bool) error {
 	platform := build.platform
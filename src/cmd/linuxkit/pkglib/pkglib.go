@@ -84,7 +84,6 @@ type Pkg struct {
 	sources       []pkgSource
 	gitRepo       string
 	network       bool
-	trust         bool
 	cache         bool
 	config        *moby.ImageConfig
 	buildArgs     *[]string
@@ -341,11 +340,6 @@ func (p Pkg) FullTag() string {
 	return util.ReferenceExpand(p.Tag())
 }
 
-// TrustEnabled returns true if trust is enabled
-func (p Pkg) TrustEnabled() bool {
-	return p.trust
-}
-
 // Arches which arches this can be built for
 func (p Pkg) Arches() []string {
 	return p.arches
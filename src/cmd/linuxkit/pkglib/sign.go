@@ -0,0 +1,105 @@
+package pkglib
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	"github.com/google/go-containerregistry/pkg/authn"
+	namepkg "github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/registry"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/signature"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/spec"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+)
+
+// signImages signs the index or image desc of name, and if it is an index each of the images for a platform
+// in it, with key. The signatures are written to the cache, each as an image named by its signature tag, e.g.
+// docker.io/linuxkit/init:sha256-<hex>.sig, and those names are returned so they can be pushed with the images.
+func signImages(c spec.CacheProvider, name string, desc v1.Descriptor, key crypto.Signer) ([]string, error) {
+	ref, err := reference.Parse(util.ReferenceExpand(name))
+	if err != nil {
+		return nil, err
+	}
+
+	descs := []v1.Descriptor{desc}
+	if desc.MediaType.IsIndex() {
+		rc, err := c.GetContent(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read index of %s: %v", name, err)
+		}
+		im, err := v1.ParseIndexManifest(rc)
+		_ = rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid index of %s: %v", name, err)
+		}
+		for _, m := range im.Manifests {
+			// skip attestations and the like, which are not images that anything runs
+			if m.Platform == nil || m.Platform.OS == "unknown" {
+				continue
+			}
+			descs = append(descs, m)
+		}
+	}
+
+	var names []string
+	for _, d := range descs {
+		sigName, err := writeSignature(c, ref.Locator, d, key)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, sigName)
+	}
+	return names, nil
+}
+
+// signPushedIndex signs what name is in the registry after it was pushed, if that is not the local index,
+// which happens when the push merged the local index with one already in the registry for other platforms.
+func signPushedIndex(c spec.CacheProvider, name string, local v1.Hash, key crypto.Signer) error {
+	ref, err := reference.Parse(util.ReferenceExpand(name))
+	if err != nil {
+		return err
+	}
+	remoteRef, err := namepkg.ParseReference(ref.String())
+	if err != nil {
+		return err
+	}
+	desc, err := registry.GetRemote().Head(remoteRef, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return fmt.Errorf("unable to find pushed %s to sign: %v", name, err)
+	}
+	if desc.Digest == local {
+		return nil
+	}
+	sigName, err := writeSignature(c, ref.Locator, *desc, key)
+	if err != nil {
+		return err
+	}
+	return c.Push(sigName, "", false, true)
+}
+
+// writeSignature writes the signature of desc in repository, e.g. docker.io/linuxkit/init, by key to the
+// cache, returning its name
+func writeSignature(c spec.CacheProvider, repository string, desc v1.Descriptor, key crypto.Signer) (string, error) {
+	repo, err := namepkg.NewRepository(repository)
+	if err != nil {
+		return "", err
+	}
+	img, err := signature.SignatureImage(repository, desc, key)
+	if err != nil {
+		return "", err
+	}
+	sigName := repository + ":" + signature.SignatureTag(repo, desc.Digest).TagStr()
+	var buf bytes.Buffer
+	if err := cache.WriteImageLayout(&buf, sigName, img); err != nil {
+		return "", fmt.Errorf("unable to write signature %s: %v", sigName, err)
+	}
+	if _, err := c.ImageLoad(&buf); err != nil {
+		return "", fmt.Errorf("unable to write signature %s to cache: %v", sigName, err)
+	}
+	return sigName, nil
+}
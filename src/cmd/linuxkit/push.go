@@ -8,14 +8,15 @@ func pushCmd() *cobra.Command {
 
 	cmd := &cobra.Command{
 		Use:   "push",
-		Short: "push a VM image to a cloud provider",
-		Long:  `Push a VM image to a cloud provider.`,
+		Short: "push a VM image to a cloud provider or registry",
+		Long:  `Push a VM image to a cloud provider or an OCI registry.`,
 	}
 
 	// Please keep cases in alphabetical order
 	cmd.AddCommand(pushAWSCmd())
 	cmd.AddCommand(pushAzureCmd())
 	cmd.AddCommand(pushGCPCmd())
+	cmd.AddCommand(pushOCICmd())
 	cmd.AddCommand(pushOpenstackCmd())
 	cmd.AddCommand(pushEquinixMetalCmd())
 	cmd.AddCommand(pushScalewayCmd())
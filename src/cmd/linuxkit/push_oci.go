@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	cachepkg "github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	mobybuild "github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby/build"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func pushOCICmd() *cobra.Command {
+	var (
+		arch    string
+		formats string
+		source  string
+	)
+	cmd := &cobra.Command{
+		Use:   "oci",
+		Short: "push image to an OCI registry",
+		Long: `Push image to an OCI registry.
+		First argument specifies the reference to push to, the second the prefix of the outputs of linuxkit build.
+		The files of each format are pushed as an OCI artifact, with an index that has one for each architecture.
+		With several architectures, the outputs of each are found with the architecture added to the prefix,
+		as written by linuxkit build --arch, e.g. linuxkit-amd64-kernel.
+		The image can then be run with linuxkit run <backend> oci://<reference>.
+		`,
+		Args:    cobra.ExactArgs(2),
+		Example: "linuxkit push oci [options] reference prefix",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := util.ReferenceExpand(args[0])
+			prefix := args[1]
+			ref, err := reference.Parse(name)
+			if err != nil {
+				return fmt.Errorf("invalid image reference %s: %v", name, err)
+			}
+
+			arches := strings.Split(arch, ",")
+			formatList := strings.Split(formats, ",")
+			annotations := map[string]string{cachepkg.AnnotationFormats: formats}
+			if source != "" {
+				b, err := os.ReadFile(source)
+				if err != nil {
+					return fmt.Errorf("cannot read %s: %v", source, err)
+				}
+				annotations[cachepkg.AnnotationSourceDigest] = fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+			}
+
+			p, err := cachepkg.NewProvider(cacheDir)
+			if err != nil {
+				return fmt.Errorf("unable to read a local cache: %v", err)
+			}
+			var descs []v1.Descriptor
+			for _, a := range arches {
+				base := prefix
+				if len(arches) > 1 {
+					base = prefix + "-" + a
+				}
+				files, err := ociArtifactFiles(base, a, formatList)
+				if err != nil {
+					return err
+				}
+				archAnnotations := map[string]string{cachepkg.AnnotationArch: a}
+				for k, v := range annotations {
+					archAnnotations[k] = v
+				}
+				desc, err := p.ArtifactWrite(cachepkg.ArtifactTypeImage, files, v1.Platform{OS: "linux", Architecture: a}, archAnnotations)
+				if err != nil {
+					return fmt.Errorf("unable to write the image for %s: %v", a, err)
+				}
+				log.Debugf("image for %s is %s", a, desc.Digest)
+				descs = append(descs, desc)
+			}
+			if err := p.IndexWrite(&ref, descs...); err != nil {
+				return fmt.Errorf("unable to write index for %s: %v", name, err)
+			}
+			if err := p.Push(name, "", false, true); err != nil {
+				return fmt.Errorf("unable to push %s: %v", name, err)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&arch, "arch", runtime.GOARCH, "Architectures the image was built for, as a comma separated list")
+	cmd.Flags().StringVar(&formats, "format", "kernel+initrd", "Formats to push, as a comma separated list")
+	cmd.Flags().StringVar(&source, "source", "", "Path to the yaml the image was built from, to record its digest. *Optional*")
+
+	return cmd
+}
+
+// ociArtifactFiles returns the files that linuxkit build wrote for formats with the prefix base
+func ociArtifactFiles(base, arch string, formats []string) ([]cachepkg.ArtifactFile, error) {
+	outputs, err := mobybuild.OutputFiles(base, arch, formats)
+	if err != nil {
+		return nil, err
+	}
+	var files []cachepkg.ArtifactFile
+	for _, output := range outputs {
+		if _, err := os.Stat(output.Path); err != nil {
+			return nil, fmt.Errorf("cannot find the %s output: %v", output.Format, err)
+		}
+		name := filepath.Base(output.Path)
+		if suffix, ok := strings.CutPrefix(output.Path, base); ok {
+			name = "linuxkit" + suffix
+		}
+		file := cachepkg.ArtifactFile{Name: name, Path: output.Path}
+		switch name {
+		case "linuxkit-kernel":
+			file.MediaType = cachepkg.MediaTypeKernel
+		case "linuxkit-initrd.img":
+			file.MediaType = cachepkg.MediaTypeInitrd
+		case "linuxkit-cmdline":
+			file.MediaType = cachepkg.MediaTypeCmdline
+		default:
+			file.MediaType = cachepkg.MediaTypeDisk
+			file.Annotations = map[string]string{cachepkg.AnnotationFormat: output.Format}
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
@@ -205,6 +205,20 @@ func (r *Remote) Image(ref name.Reference, options ...remote.Option) (v1.Image,
 	return remote.Image(ref, opts...)
 }
 
+func (r *Remote) Referrers(d name.Digest, options ...remote.Option) (v1.ImageIndex, error) {
+	var err error
+	d, err = r.rewriteDigest(d)
+	if err != nil {
+		return nil, fmt.Errorf("rewriting digest %q: %w", d.Name(), err)
+	}
+	opts, err := r.rewriteTLSTransport(options)
+	if err != nil {
+		return nil, fmt.Errorf("rewriting TLS transport for %q: %w", d.Name(), err)
+	}
+
+	return remote.Referrers(d, opts...)
+}
+
 func (r *Remote) Delete(ref name.Reference, options ...remote.Option) error {
 	var err error
 	ref, err = r.rewriteReference(ref)
@@ -282,7 +296,7 @@ func (r *Remote) rewriteDigest(dig name.Digest) (name.Digest, error) {
 		return dig, fmt.Errorf("rewriting repository %q: %w", dig, err)
 	}
 
-	return name.NewDigest(newRepo, opts...)
+	return name.NewDigest(newRepo+"@"+dig.DigestStr(), opts...)
 }
 
 func (r *Remote) rewriteRepositoryBase(repo name.Repository) (string, []name.Option, error) {
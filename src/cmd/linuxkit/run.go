@@ -1,12 +1,23 @@
 package main
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"path/filepath"
 	"runtime"
+	"strings"
 
+	"github.com/containerd/containerd/v2/pkg/reference"
+	cachepkg "github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+// ociImagePrefix marks a path to run as a reference to a LinuxKit image pushed with 'linuxkit push oci'
+const ociImagePrefix = "oci://"
+
 var (
 	cpus  int
 	mem   int
@@ -25,6 +36,8 @@ func runCmd() *cobra.Command {
 		
 		'prefix' specifies the path to the image.
 		If the image is not specified, the default is './image'.
+		The local backends also take oci://<reference> to run an image pushed with
+		'linuxkit push oci', which is pulled through the linuxkit cache.
 		`,
 		Example: `run [options] [backend] [prefix]`,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -71,3 +84,49 @@ func runCmd() *cobra.Command {
 
 	return cmd
 }
+
+// resolveRunImage returns path, unless it is an oci:// reference to a LinuxKit image, in which case
+// the image for arch is pulled into the cache and extracted, and the path to run it is returned,
+// which is the prefix of the kernel, initrd and cmdline if it has them, or else its disk image.
+func resolveRunImage(path, arch string) (string, error) {
+	if !strings.HasPrefix(path, ociImagePrefix) {
+		return path, nil
+	}
+	name := util.ReferenceExpand(strings.TrimPrefix(path, ociImagePrefix))
+	ref, err := reference.Parse(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %s: %v", name, err)
+	}
+	p, err := cachepkg.NewProvider(cacheDir)
+	if err != nil {
+		return "", fmt.Errorf("unable to read a local cache: %v", err)
+	}
+	platform := imagespec.Platform{OS: "linux", Architecture: arch}
+	if err := p.ImagePull(&ref, []imagespec.Platform{platform}, false); err != nil {
+		return "", fmt.Errorf("unable to pull %s: %v", name, err)
+	}
+	sum := sha256.Sum256([]byte(ref.String() + " " + arch))
+	dir := filepath.Join(util.HomeDir(), ".linuxkit", "images", fmt.Sprintf("%x", sum[:16]))
+	files, err := p.ArtifactExtract(&ref, platform, dir)
+	if err != nil {
+		return "", err
+	}
+	var disk string
+	for _, f := range files {
+		switch f.MediaType {
+		case cachepkg.MediaTypeKernel:
+			prefix := strings.TrimSuffix(f.Path, "-kernel")
+			log.Infof("Running %s from %s", name, prefix)
+			return prefix, nil
+		case cachepkg.MediaTypeDisk:
+			if disk == "" {
+				disk = f.Path
+			}
+		}
+	}
+	if disk == "" {
+		return "", fmt.Errorf("%s has neither a kernel nor a disk image for %s", name, arch)
+	}
+	log.Infof("Running %s from %s", name, disk)
+	return disk, nil
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 
@@ -59,7 +60,10 @@ func runHyperkitCmd() *cobra.Command {
 		Args:    cobra.ExactArgs(1),
 		Example: "linuxkit run hyperkit [options] prefix",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			path := args[0]
+			path, err := resolveRunImage(args[0], runtime.GOARCH)
+			if err != nil {
+				return err
+			}
 
 			if data != "" && dataPath != "" {
 				return errors.New("cannot specify both -data and -data-file")
@@ -67,7 +71,7 @@ func runHyperkitCmd() *cobra.Command {
 
 			prefix := path
 
-			_, err := os.Stat(path + "-kernel")
+			_, err = os.Stat(path + "-kernel")
 			statKernel := err == nil
 
 			var isoPaths []string
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 
@@ -29,7 +30,10 @@ func runHyperVCmd() *cobra.Command {
 		Args:    cobra.ExactArgs(1),
 		Example: "linuxkit run hyperv [options] path",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			isoPath := args[0]
+			isoPath, err := resolveRunImage(args[0], runtime.GOARCH)
+			if err != nil {
+				return err
+			}
 			// Sanity checks. Errors out on failure
 			hypervChecks()
 
@@ -121,6 +121,21 @@ func generateMAC() net.HardwareAddr {
 	return mac
 }
 
+// qemuGoArch returns the GOARCH equivalent of a qemu architecture
+func qemuGoArch(arch string) (string, error) {
+	switch arch {
+	case "s390x":
+		return "s390x", nil
+	case "aarch64":
+		return "arm64", nil
+	case "x86_64":
+		return "amd64", nil
+	case "riscv64":
+		return "riscv64", nil
+	}
+	return "", fmt.Errorf("%s is an unsupported architecture", arch)
+}
+
 func runQEMUCmd() *cobra.Command {
 	var (
 		enableGUI      bool
@@ -157,7 +172,14 @@ func runQEMUCmd() *cobra.Command {
 		Args:    cobra.ExactArgs(1),
 		Example: "linuxkit run qemu [options] path",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			path := args[0]
+			goArch, err := qemuGoArch(arch)
+			if err != nil {
+				return err
+			}
+			path, err := resolveRunImage(args[0], goArch)
+			if err != nil {
+				return err
+			}
 
 			if data != "" && dataPath != "" {
 				return errors.New("cannot specify both -data and -data-file")
@@ -172,7 +194,7 @@ func runQEMUCmd() *cobra.Command {
 
 			prefix := path
 
-			_, err := os.Stat(path)
+			_, err = os.Stat(path)
 			stat := err == nil
 
 			// if the path does not exist, must be trying to do a kernel+initrd or kernel+squashfs boot
@@ -468,19 +490,9 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 		}
 	}
 
-	// goArch is the GOARCH equivalent of config.Arch
-	var goArch string
-	switch config.Arch {
-	case "s390x":
-		goArch = "s390x"
-	case "aarch64":
-		goArch = "arm64"
-	case "x86_64":
-		goArch = "amd64"
-	case "riscv64":
-		goArch = "riscv64"
-	default:
-		log.Fatalf("%s is an unsupported architecture.", config.Arch)
+	goArch, err := qemuGoArch(config.Arch)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	if goArch != runtime.GOARCH {
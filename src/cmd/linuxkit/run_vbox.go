@@ -79,7 +79,10 @@ func runVBoxCmd() *cobra.Command {
 		Args:    cobra.ExactArgs(1),
 		Example: "linuxkit run vbox [options] path",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			path := args[0]
+			path, err := resolveRunImage(args[0], runtime.GOARCH)
+			if err != nil {
+				return err
+			}
 			if runtime.GOOS == "windows" {
 				return fmt.Errorf("TODO: Windows is not yet supported")
 			}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"runtime"
+
 	"github.com/spf13/cobra"
 )
 
@@ -55,7 +57,11 @@ func runVirtualizationFrameworkCmd() *cobra.Command {
 				kernelBoot:     kernelBoot,
 				virtiofsShares: virtiofsShares,
 			}
-			return runVirtualizationFramework(cfg, args[0])
+			path, err := resolveRunImage(args[0], runtime.GOARCH)
+			if err != nil {
+				return err
+			}
+			return runVirtualizationFramework(cfg, path)
 		},
 	}
 
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -78,7 +79,11 @@ func runVMWareCmd() *cobra.Command {
 		Args:    cobra.ExactArgs(1),
 		Example: "linuxkit run vmware [options] prefix",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			prefix := args[0]
+			prefix, err := resolveRunImage(args[0], runtime.GOARCH)
+			if err != nil {
+				return err
+			}
+			prefix = strings.TrimSuffix(prefix, ".vmdk")
 			if state == "" {
 				state = prefix + "-state"
 			}
@@ -173,7 +178,7 @@ func runVMWareCmd() *cobra.Command {
 
 			// Create the .vmx file
 			vmxPath := filepath.Join(state, "linuxkit.vmx")
-			err := os.WriteFile(vmxPath, []byte(vmx), 0644)
+			err = os.WriteFile(vmxPath, []byte(vmx), 0644)
 			if err != nil {
 				return fmt.Errorf("error writing .vmx file: %v", err)
 			}
@@ -0,0 +1,226 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/registry"
+	log "github.com/sirupsen/logrus"
+)
+
+// The format of cosign signatures, which are an image whose layers are the signed payloads, with the
+// signature of each in an annotation of the layer
+const (
+	// MediaTypeSimpleSigning is the media type of a signed payload
+	MediaTypeSimpleSigning = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// ArtifactTypeSignature is the artifact type of a signature stored as a referrer of the image
+	ArtifactTypeSignature = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	// AnnotationSignature is the annotation of a payload layer with its base64 encoded signature
+	AnnotationSignature = "dev.cosignproject.cosign/signature"
+	// SignatureTagSuffix is the suffix of the tag of signatures, which is the digest with the
+	// colon replaced, e.g. sha256-<hex>.sig
+	SignatureTagSuffix = ".sig"
+
+	payloadType = "cosign container image signature"
+	// maxPayloadSize limits what is read of a payload, which is a small json document
+	maxPayloadSize = 1 << 20
+)
+
+// payload is the simple signing payload that a cosign signature is of
+type payload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+// signature is a payload and its signature
+type signature struct {
+	payload   []byte
+	signature []byte
+	// source is where the signature was found, for reporting
+	source string
+}
+
+// ParsePublicKey parses a PEM encoded public key, as written by cosign generate-key-pair
+func ParsePublicKey(b []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("not a PEM encoded public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey, *rsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+// SignatureTag returns the tag of the signatures of digest in repository
+func SignatureTag(repository name.Repository, digest v1.Hash) name.Tag {
+	return repository.Tag(strings.Replace(digest.String(), ":", "-", 1) + SignatureTagSuffix)
+}
+
+// fetchSignatures returns the signatures of digest in repository, both from its referrers and from its
+// signature tag. A registry without either is the same as an unsigned image.
+func fetchSignatures(repository string, digest v1.Hash) ([]signature, error) {
+	repo, err := name.NewRepository(repository)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository %s: %v", repository, err)
+	}
+	options := []remote.Option{remote.WithAuthFromKeychain(authn.DefaultKeychain)}
+	var sigs []signature
+
+	dig := repo.Digest(digest.String())
+	referrers, err := registry.GetRemote().Referrers(dig, append(options, remote.WithFilter("artifactType", ArtifactTypeSignature))...)
+	if err != nil {
+		log.Debugf("no referrers of %s: %v", dig, err)
+	} else {
+		im, err := referrers.IndexManifest()
+		if err != nil {
+			return nil, fmt.Errorf("invalid referrers of %s: %v", dig, err)
+		}
+		for _, m := range im.Manifests {
+			if m.ArtifactType != ArtifactTypeSignature {
+				continue
+			}
+			img, err := registry.GetRemote().Image(repo.Digest(m.Digest.String()), options...)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read signature %s of %s: %v", m.Digest, dig, err)
+			}
+			s, err := imageSignatures(img, "referrer "+m.Digest.String())
+			if err != nil {
+				return nil, err
+			}
+			sigs = append(sigs, s...)
+		}
+	}
+
+	tag := SignatureTag(repo, digest)
+	img, err := registry.GetRemote().Image(tag, options...)
+	if err != nil {
+		log.Debugf("no signature tag %s: %v", tag, err)
+	} else {
+		s, err := imageSignatures(img, "tag "+tag.TagStr())
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, s...)
+	}
+	return sigs, nil
+}
+
+// imageSignatures returns the signatures in a cosign signature image
+func imageSignatures(img v1.Image, source string) ([]signature, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read signature %s: %v", source, err)
+	}
+	var sigs []signature
+	for _, desc := range manifest.Layers {
+		encoded, ok := desc.Annotations[AnnotationSignature]
+		if !ok || desc.MediaType != MediaTypeSimpleSigning {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature in %s: %v", source, err)
+		}
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read payload in %s: %v", source, err)
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read payload in %s: %v", source, err)
+		}
+		b, err := io.ReadAll(io.LimitReader(rc, maxPayloadSize))
+		_ = rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read payload in %s: %v", source, err)
+		}
+		sigs = append(sigs, signature{payload: b, signature: sig, source: source})
+	}
+	return sigs, nil
+}
+
+// verifySignatures returns nil if one of sigs is a valid signature of digest by one of keys,
+// or else an error that says why none is
+func verifySignatures(sigs []signature, keys []crypto.PublicKey, digest v1.Hash) error {
+	if len(sigs) == 0 {
+		return errors.New("unsigned")
+	}
+	var reasons []string
+	for _, s := range sigs {
+		err := verifySignature(s, keys, digest)
+		if err == nil {
+			log.Debugf("%s verified by signature in %s", digest, s.source)
+			return nil
+		}
+		reasons = append(reasons, fmt.Sprintf("%s: %v", s.source, err))
+	}
+	return fmt.Errorf("no valid signature by a required key (%s)", strings.Join(reasons, "; "))
+}
+
+func verifySignature(s signature, keys []crypto.PublicKey, digest v1.Hash) error {
+	var verified bool
+	for _, key := range keys {
+		if verifyKey(key, s.payload, s.signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return errors.New("not signed by any of the keys")
+	}
+	var p payload
+	if err := json.Unmarshal(s.payload, &p); err != nil {
+		return fmt.Errorf("invalid payload: %v", err)
+	}
+	if p.Critical.Type != payloadType {
+		return fmt.Errorf("payload has type %q", p.Critical.Type)
+	}
+	if p.Critical.Image.DockerManifestDigest != digest.String() {
+		return fmt.Errorf("payload is for %s", p.Critical.Image.DockerManifestDigest)
+	}
+	return nil
+}
+
+// verifyKey returns true if sig is a signature of payload by key, as cosign signs: ECDSA and RSA
+// PKCS #1 v1.5 signatures of the SHA-256 of the payload, and Ed25519 signatures of the payload itself
+func verifyKey(key crypto.PublicKey, payload, sig []byte) bool {
+	sum := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, sum[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, sig)
+	}
+	return false
+}
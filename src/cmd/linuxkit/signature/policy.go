@@ -0,0 +1,158 @@
+package signature
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule is the signature requirement for the images of a registry, or of repositories in it.
+// Match is a registry, e.g. docker.io, or a repository or prefix of repositories in it, e.g.
+// docker.io/linuxkit, and an image must be signed by one of Keys, unless AllowUnsigned is set.
+type Rule struct {
+	Match         string   `yaml:"match,omitempty"`
+	Keys          []string `yaml:"keys,omitempty"`
+	AllowUnsigned bool     `yaml:"allowUnsigned,omitempty"`
+
+	keys []crypto.PublicKey
+}
+
+// Policy is the signature requirements for the images used by a build. The rule of an image is the one in
+// Repositories with the longest match, or Default if none match, so with no default every image
+// has to be matched by a rule.
+type Policy struct {
+	Default      Rule   `yaml:"default"`
+	Repositories []Rule `yaml:"repositories"`
+
+	mu       sync.Mutex
+	verified map[string]error
+}
+
+// LoadPolicy reads a policy from a yaml file, and the keys in it, which are relative to the
+// directory of the file
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid signature policy %s: %v", path, err)
+	}
+	dir := filepath.Dir(path)
+	if err := p.Default.loadKeys(dir); err != nil {
+		return nil, err
+	}
+	if p.Default.Match != "" {
+		return nil, fmt.Errorf("invalid signature policy %s: the default rule cannot have a match", path)
+	}
+	seen := map[string]bool{}
+	for i := range p.Repositories {
+		r := &p.Repositories[i]
+		r.Match = strings.TrimSuffix(r.Match, "/")
+		if r.Match == "" || seen[r.Match] {
+			return nil, fmt.Errorf("invalid signature policy %s: missing or repeated match %q", path, r.Match)
+		}
+		seen[r.Match] = true
+		if err := r.loadKeys(dir); err != nil {
+			return nil, err
+		}
+	}
+	return &p, nil
+}
+
+func (r *Rule) loadKeys(dir string) error {
+	for _, k := range r.Keys {
+		if !filepath.IsAbs(k) {
+			k = filepath.Join(dir, k)
+		}
+		b, err := os.ReadFile(k)
+		if err != nil {
+			return fmt.Errorf("cannot read key: %v", err)
+		}
+		key, err := ParsePublicKey(b)
+		if err != nil {
+			return fmt.Errorf("invalid key %s: %v", k, err)
+		}
+		r.keys = append(r.keys, key)
+	}
+	return nil
+}
+
+// rule returns the rule for a repository, e.g. docker.io/linuxkit/init
+func (p *Policy) rule(repository string) *Rule {
+	rule := &p.Default
+	for i := range p.Repositories {
+		r := &p.Repositories[i]
+		if (repository == r.Match || strings.HasPrefix(repository, r.Match+"/")) && len(r.Match) > len(rule.Match) {
+			rule = r
+		}
+	}
+	return rule
+}
+
+// Verify checks that the image or index ref, with digest, is signed as required by the policy.
+// The signatures are the cosign signatures of the digest, found either as referrers of it or with the
+// sha256-<digest>.sig tag, and the result is remembered, so each image is only verified once.
+func (p *Policy) Verify(ref string, digest v1.Hash) error {
+	spec, err := reference.Parse(util.ReferenceExpand(ref))
+	if err != nil {
+		return fmt.Errorf("invalid image reference %s: %v", ref, err)
+	}
+	repository := spec.Locator
+	key := repository + "@" + digest.String()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err, ok := p.verified[key]; ok {
+		return err
+	}
+	err = p.verify(repository, digest)
+	if p.verified == nil {
+		p.verified = map[string]error{}
+	}
+	p.verified[key] = err
+	return err
+}
+
+func (p *Policy) verify(repository string, digest v1.Hash) error {
+	rule := p.rule(repository)
+	if len(rule.keys) == 0 {
+		if rule.AllowUnsigned {
+			return nil
+		}
+		if rule.Match == "" {
+			return fmt.Errorf("no rule in the policy matches %s", repository)
+		}
+		return fmt.Errorf("the rule for %s has no keys, and does not allow unsigned images", rule.Match)
+	}
+
+	sigs, err := fetchSignatures(repository, digest)
+	if err != nil {
+		return err
+	}
+	return rule.check(repository, digest, sigs)
+}
+
+// check checks the signatures of digest in repository against the rule. AllowUnsigned only allows an
+// image without any signatures: one that has a signature which is not valid, as it is by an unknown key
+// or of another digest, is never allowed.
+func (r *Rule) check(repository string, digest v1.Hash, sigs []signature) error {
+	if len(sigs) == 0 && r.AllowUnsigned {
+		log.Warnf("Allowing unsigned image %s@%s", repository, digest)
+		return nil
+	}
+	return verifySignatures(sigs, r.keys, digest)
+}
@@ -0,0 +1,117 @@
+package signature
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// ParsePrivateKey parses a PEM encoded private key to sign with, which must not be encrypted.
+// ECDSA, Ed25519 and RSA keys are supported, in PKCS #8 form, or for ECDSA and RSA also in SEC 1 and PKCS #1.
+func ParsePrivateKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("not a PEM encoded private key")
+	}
+	var (
+		key interface{}
+		err error
+	)
+	switch {
+	case block.Type == "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case block.Type == "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case block.Type == "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case strings.HasPrefix(block.Type, "ENCRYPTED"):
+		return nil, fmt.Errorf("encrypted keys are not supported, the key must be an unencrypted PKCS #8 key")
+	default:
+		return nil, fmt.Errorf("unsupported PEM type %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// sign signs payload as cosign does, see verifyKey
+func sign(key crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		return key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	sum := sha256.Sum256(payload)
+	return key.Sign(rand.Reader, sum[:], crypto.SHA256)
+}
+
+// SignatureImage returns a cosign signature of subject, an image or index in repository, signed by key.
+// It refers to subject, so is found as a referrer of it when pushed, as well as by its SignatureTag.
+func SignatureImage(repository string, subject v1.Descriptor, key crypto.Signer) (v1.Image, error) {
+	var p payload
+	p.Critical.Identity.DockerReference = repository
+	p.Critical.Image.DockerManifestDigest = subject.Digest.String()
+	p.Critical.Type = payloadType
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := sign(key, b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign %s: %v", subject.Digest, err)
+	}
+	digest, size, err := v1.SHA256(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	img, err := mutate.Append(mutate.MediaType(empty.Image, types.OCIManifestSchema1), mutate.Addendum{
+		Layer:       &payloadLayer{payload: b, digest: digest, size: size},
+		Annotations: map[string]string{AnnotationSignature: base64.StdEncoding.EncodeToString(sig)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	img = mutate.ConfigMediaType(img, ArtifactTypeSignature)
+	return mutate.Subject(img, v1.Descriptor{MediaType: subject.MediaType, Size: subject.Size, Digest: subject.Digest}).(v1.Image), nil
+}
+
+// payloadLayer is the layer of a signature image with a payload, which is stored uncompressed
+type payloadLayer struct {
+	payload []byte
+	digest  v1.Hash
+	size    int64
+}
+
+func (l *payloadLayer) Digest() (v1.Hash, error) { return l.digest, nil }
+
+func (l *payloadLayer) DiffID() (v1.Hash, error) { return l.digest, nil }
+
+func (l *payloadLayer) Compressed() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(l.payload)), nil
+}
+
+func (l *payloadLayer) Uncompressed() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(l.payload)), nil
+}
+
+func (l *payloadLayer) Size() (int64, error) { return l.size, nil }
+
+func (l *payloadLayer) MediaType() (types.MediaType, error) { return MediaTypeSimpleSigning, nil }